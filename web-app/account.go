@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Email verification and password reset
+
+const (
+	purposeVerifyEmail   = "verify_email"
+	purposePasswordReset = "password_reset"
+	verifyEmailTTL       = 48 * time.Hour
+	passwordResetTTL     = time.Hour
+	trialDays            = 7 // Length of the seeded trial plan
+)
+
+// Normalize an email so aliases of one mailbox compare equal
+// (case, +tags, and dots for Gmail addresses)
+func canonicalEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+
+	local, domain := email[:at], email[at+1:]
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+	if domain == "gmail.com" || domain == "googlemail.com" {
+		local = strings.ReplaceAll(local, ".", "")
+		domain = "gmail.com"
+	}
+	return local + "@" + domain
+}
+
+// Fill EmailCanonical for accounts created before it existed
+func backfillCanonicalEmails() {
+	var users []User
+	db.Where("email_canonical IS NULL OR email_canonical = ''").Find(&users)
+	for _, u := range users {
+		db.Model(&u).Update("email_canonical", canonicalEmail(u.Email))
+	}
+}
+
+// Send the verification link for the user's current email
+func sendVerificationEmail(user *User) error {
+	token, err := generateActionToken(user.ID, purposeVerifyEmail, tokenBinding(user.Email), verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+
+	link := getBaseURL() + "/verify-email?token=" + url.QueryEscape(token)
+	return mailer.Send(MailMessage{
+		To:      user.Email,
+		Subject: "Verify your IPO Pilot email",
+		TextBody: fmt.Sprintf("Hi %s,\n\nConfirm your email address to activate your %s free trial:\n\n%s\n\n"+
+			"This link expires in %d hours. If you did not create an IPO Pilot account, ignore this email.\n",
+			user.Name, trialLength(), link, int(verifyEmailTTL.Hours())),
+	})
+}
+
+// Trial length for messages, e.g. "7 days"
+func trialLength() string {
+	if plan, err := getPlanByCode(planCodeTrial); err == nil {
+		return plan.DurationLabel("english")
+	}
+	return fmt.Sprintf("%d days", trialDays)
+}
+
+// Send a password reset link. The token is bound to the current password hash, so it is single-use.
+func sendPasswordResetEmail(user *User) error {
+	token, err := generateActionToken(user.ID, purposePasswordReset, tokenBinding(user.Password), passwordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	link := getBaseURL() + "/reset-password?token=" + url.QueryEscape(token)
+	return mailer.Send(MailMessage{
+		To:      user.Email,
+		Subject: "Reset your IPO Pilot password",
+		TextBody: fmt.Sprintf("Hi %s,\n\nSomeone requested a password reset for your IPO Pilot account. "+
+			"Use this link to choose a new password:\n\n%s\n\n"+
+			"This link expires in %d minutes. If you did not request it, you can ignore this email.\n",
+			user.Name, link, int(passwordResetTTL.Minutes())),
+	})
+}
+
+// Create the free trial once a user's email is verified. Returns nil (no error) when
+// the user is not eligible: unverified, already subscribed, or the same mailbox
+// already had a trial.
+func grantTrialIfEligible(user *User) (*Subscription, error) {
+	if !user.EmailVerified {
+		return nil, nil
+	}
+	if _, err := getCurrentSubscription(user.ID); err == nil {
+		return nil, nil
+	}
+
+	var previousTrials int64
+	db.Unscoped().Model(&Subscription{}).
+		Joins("JOIN users ON users.id = subscriptions.user_id").
+		Where("users.email_canonical = ? AND subscriptions.is_trial = ?", canonicalEmail(user.Email), true).
+		Count(&previousTrials)
+	if previousTrials > 0 {
+		return nil, nil
+	}
+
+	// Trials are switched off by deactivating the trial plan
+	plan, err := getPlanByCode(planCodeTrial)
+	if err != nil || !plan.IsActive || plan.IsArchived {
+		return nil, nil
+	}
+
+	now := time.Now()
+	trialEndDate := plan.PeriodEnd(now)
+	subscription := Subscription{
+		UserID:        user.ID,
+		Status:        SubscriptionTrial,
+		IsTrial:       true,
+		TrialEndDate:  &trialEndDate,
+		StartDate:     now,
+		EndDate:       trialEndDate,
+		Price:         0,
+		PaymentMethod: "free_trial",
+	}
+	plan.ApplyTo(&subscription)
+
+	if err := db.Create(&subscription).Error; err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+// Email verification link target
+func verifyEmailHandler(c *gin.Context) {
+	claims, err := validateActionToken(c.Query("token"), purposeVerifyEmail)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/login?verify_error=1")
+		return
+	}
+
+	var user User
+	if err := db.First(&user, claims.UserID).Error; err != nil || claims.Binding != tokenBinding(user.Email) {
+		c.Redirect(http.StatusFound, "/login?verify_error=1")
+		return
+	}
+
+	if !user.EmailVerified {
+		now := time.Now()
+		user.EmailVerified = true
+		user.EmailVerifiedAt = &now
+		if err := db.Model(&user).Updates(map[string]interface{}{
+			"email_verified":    true,
+			"email_verified_at": now,
+		}).Error; err != nil {
+			c.Redirect(http.StatusFound, "/login?verify_error=1")
+			return
+		}
+
+		if _, err := grantTrialIfEligible(&user); err != nil {
+			log.Printf("Failed to create trial for user %d: %v\n", user.ID, err)
+		}
+	}
+
+	c.Redirect(http.StatusFound, "/login?verified=1")
+}
+
+// Resend the verification email for the signed-in user
+func resendVerificationHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if user.EmailVerified {
+		c.JSON(http.StatusOK, gin.H{"message": "Email already verified"})
+		return
+	}
+
+	if err := sendVerificationEmail(&user); err != nil {
+		log.Printf("Failed to send verification email to user %d: %v\n", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
+// Forgot password page
+func forgotPasswordPageHandler(c *gin.Context) {
+	c.HTML(http.StatusOK, "forgot_password.html", gin.H{})
+}
+
+// Forgot password handler - always answers the same way so emails can't be enumerated
+func forgotPasswordHandler(c *gin.Context) {
+	var input struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	var user User
+	if err := db.Where("email = ?", input.Email).First(&user).Error; err == nil && user.IsActive {
+		if err := sendPasswordResetEmail(&user); err != nil {
+			log.Printf("Failed to send password reset email to user %d: %v\n", user.ID, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "If an account exists for that email, a password reset link has been sent.",
+	})
+}
+
+// Reset password page
+func resetPasswordPageHandler(c *gin.Context) {
+	c.HTML(http.StatusOK, "reset_password.html", gin.H{
+		"token": c.Query("token"),
+	})
+}
+
+// Reset password handler
+func resetPasswordHandler(c *gin.Context) {
+	var input struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required,min=6"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	claims, err := validateActionToken(input.Token, purposePasswordReset)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reset link is invalid or has expired"})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, claims.UserID).Error; err != nil || claims.Binding != tokenBinding(user.Password) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reset link is invalid or has already been used"})
+		return
+	}
+
+	hashedPassword, err := hashPassword(input.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process password"})
+		return
+	}
+
+	// Bumping the token version signs out every existing session
+	if err := db.Model(&user).Updates(map[string]interface{}{
+		"password":      hashedPassword,
+		"token_version": gorm.Expr("token_version + 1"),
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password updated. You can now sign in."})
+}
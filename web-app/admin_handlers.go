@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
@@ -23,9 +24,12 @@ func adminDashboardHandler(c *gin.Context) {
 	db.Model(&User{}).Count(&stats.TotalUsers)
 	db.Model(&User{}).Where("is_active = ?", true).Count(&stats.ActiveUsers)
 	db.Model(&Subscription{}).Count(&stats.TotalSubscriptions)
-	db.Model(&Subscription{}).Where("status = ?", "active").Count(&stats.ActiveSubscriptions)
+	db.Model(&Subscription{}).Where("status IN ?", []string{SubscriptionTrial, SubscriptionActive, SubscriptionGrace}).Count(&stats.ActiveSubscriptions)
 	db.Model(&IPOApplication{}).Count(&stats.TotalApplications)
-	db.Model(&Subscription{}).Select("COALESCE(SUM(price), 0)").Row().Scan(&stats.TotalRevenue)
+	if hasPermission(c, permRevenueRead) {
+		db.Model(&PaymentTransaction{}).Where("status = ?", PaymentCompleted).
+			Select("COALESCE(SUM(amount), 0)").Row().Scan(&stats.TotalRevenue)
+	}
 	db.Model(&IPOSource{}).Where("is_active = ?", true).Count(&stats.IPOSources)
 
 	c.HTML(http.StatusOK, "admin_dashboard.html", gin.H{
@@ -63,17 +67,27 @@ func activateSubscriptionHandler(c *gin.Context) {
 		return
 	}
 
-	subscription.Status = "active"
-	subscription.StartDate = time.Now()
-	
-	// Set end date based on plan
-	months := 3
-	if subscription.PlanType == "enterprise" {
-		months = 12
+	// One effective subscription per user
+	if current, err := getCurrentSubscription(subscription.UserID); err == nil && current.ID != subscription.ID {
+		c.JSON(http.StatusConflict, gin.H{"error": "User already has an effective subscription"})
+		return
+	}
+
+	plan, err := getSubscriptionPlan(&subscription)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Subscription plan not found in the catalog"})
+		return
 	}
-	subscription.EndDate = time.Now().AddDate(0, months, 0)
 
-	if err := db.Save(&subscription).Error; err != nil {
+	// Period and limits come from the plan
+	subscription.StartDate = time.Now()
+	subscription.EndDate = plan.PeriodEnd(subscription.StartDate)
+	plan.ApplyTo(&subscription)
+
+	if err = applySubscriptionTransition(&subscription, SubscriptionActive); errors.Is(err, errInvalidSubscriptionTransition) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate subscription"})
 		return
 	}
@@ -84,23 +98,37 @@ func activateSubscriptionHandler(c *gin.Context) {
 	})
 }
 
-// Deactivate subscription handler
+// Deactivate subscription handler - cancels and refunds by policy, or exactly
+// refund_amount (0 for no refund) when given
 func deactivateSubscriptionHandler(c *gin.Context) {
 	subscriptionID, _ := strconv.ParseUint(c.Param("id"), 10, 32)
 
-	var subscription Subscription
-	if err := db.First(&subscription, subscriptionID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+	var input struct {
+		Reason       string   `json:"reason"`
+		RefundAmount *float64 `json:"refund_amount"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+	}
+	if input.RefundAmount != nil && *input.RefundAmount < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "refund_amount cannot be negative"})
 		return
 	}
 
-	subscription.Status = "cancelled"
-	if err := db.Save(&subscription).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deactivate subscription"})
+	subscription, refunds, err := cancelSubscription(uint(subscriptionID), c.GetUint("userID"), input.Reason, input.RefundAmount)
+	if err != nil {
+		respondCancellationError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Subscription deactivated"})
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Subscription deactivated",
+		"subscription": subscription,
+		"refunds":      refunds,
+	})
 }
 
 // IPO sources handler
@@ -181,11 +209,20 @@ func analyticsHandler(c *gin.Context) {
 		Order("date").
 		Scan(&analyticsData.DailyApplications)
 
-	// Subscription breakdown - PREMIUM ONLY
+	// Active subscriptions per plan
 	analyticsData.SubscriptionBreakdown = make(map[string]int64)
-	var premiumCount int64
-	db.Model(&Subscription{}).Where("plan_type = ? AND status = ?", "premium", "active").Count(&premiumCount)
-	analyticsData.SubscriptionBreakdown["premium"] = premiumCount
+	var breakdown []struct {
+		PlanType string
+		Count    int64
+	}
+	db.Model(&Subscription{}).
+		Select("plan_type, COUNT(*) as count").
+		Where("status = ?", SubscriptionActive).
+		Group("plan_type").
+		Scan(&breakdown)
+	for _, row := range breakdown {
+		analyticsData.SubscriptionBreakdown[row.PlanType] = row.Count
+	}
 
 	c.HTML(http.StatusOK, "admin_analytics.html", gin.H{
 		"analytics": analyticsData,
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IPO allotment results. Once the issue manager publishes results, an admin
+// posts the allotted BOIDs for the issue; every successful application for it
+// gets its result and the user is notified.
+
+// Allotment statuses
+const (
+	AllotmentAllotted    = "allotted"
+	AllotmentNotAllotted = "not_allotted"
+)
+
+// Admin: record results for an issue. Applications whose profile BOID isn't
+// listed were not allotted.
+func publishAllotmentResultsHandler(c *gin.Context) {
+	var input struct {
+		CompanyShareID string         `json:"company_share_id" binding:"required"`
+		Allotted       map[string]int `json:"allotted"` // BOID -> kittas
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "company_share_id is required"})
+		return
+	}
+	allotted := map[string]int{}
+	for boid, kittas := range input.Allotted {
+		allotted[strings.TrimSpace(boid)] = kittas
+	}
+
+	var applications []IPOApplication
+	db.Preload("Profile").
+		Where("company_share_id = ? AND status = ? AND (allotment_status IS NULL OR allotment_status = '')", input.CompanyShareID, "success").
+		Find(&applications)
+
+	now := time.Now()
+	counts := map[string]int{}
+	for i := range applications {
+		app := &applications[i]
+		app.AllotmentStatus = AllotmentNotAllotted
+		app.AllottedKittas = 0
+		if kittas := allotted[app.Profile.BOID]; kittas > 0 {
+			app.AllotmentStatus = AllotmentAllotted
+			app.AllottedKittas = kittas
+		}
+		app.ResultAt = &now
+
+		if err := db.Model(&IPOApplication{}).Where("id = ?", app.ID).Updates(map[string]interface{}{
+			"allotment_status": app.AllotmentStatus,
+			"allotted_kittas":  app.AllottedKittas,
+			"result_at":        now,
+		}).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record results"})
+			return
+		}
+		counts[app.AllotmentStatus]++
+		notifyAllotmentResult(app)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"applications": len(applications),
+		"allotted":     counts[AllotmentAllotted],
+		"not_allotted": counts[AllotmentNotAllotted],
+	})
+}
+
+// Email the user an application's allotment result
+func notifyAllotmentResult(app *IPOApplication) {
+	notifyUser(app.UserID, NotifyAllotmentResult, fmt.Sprintf("%s:%d", NotifyAllotmentResult, app.ID), gin.H{
+		"Company":  applicationCompany(app),
+		"Profile":  profileLabel(app.ProfileID),
+		"Allotted": app.AllotmentStatus == AllotmentAllotted,
+		"Kittas":   app.AllottedKittas,
+	})
+}
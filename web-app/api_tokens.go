@@ -0,0 +1,201 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Personal API tokens for scripting against /api
+
+const (
+	apiTokenPrefix      = "ipp_"
+	apiTokenTouchPeriod = time.Minute // Throttle last-used writes
+	maxAPITokensPerUser = 20
+)
+
+// API token scopes
+const (
+	scopeReadIPOs     = "read:ipos"
+	scopeWriteMonitor = "write:monitor"
+	scopeWriteApply   = "write:apply"
+
+	scopeReadNotifications  = "read:notifications"
+	scopeWriteNotifications = "write:notifications"
+)
+
+var apiTokenScopes = map[string]string{
+	scopeReadIPOs:     "Read live and upcoming IPOs",
+	scopeWriteMonitor: "Start, stop and view monitoring sessions",
+	scopeWriteApply:   "Submit IPO applications",
+
+	scopeReadNotifications:  "Read notification center entries",
+	scopeWriteNotifications: "Mark notifications read",
+}
+
+var errAPITokenExpired = errors.New("api token expired")
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Generate a new random token; only its hash is stored
+func generateAPIToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := crand.Read(raw); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + hex.EncodeToString(raw), nil
+}
+
+// Look up an active token and record its use
+func authenticateAPIToken(token, ip string) (*APIToken, error) {
+	var apiToken APIToken
+	if err := db.Where("token_hash = ? AND revoked_at IS NULL", hashAPIToken(token)).First(&apiToken).Error; err != nil {
+		return nil, err
+	}
+
+	if apiToken.ExpiresAt != nil && time.Now().After(*apiToken.ExpiresAt) {
+		return nil, errAPITokenExpired
+	}
+
+	if apiToken.LastUsedAt == nil || time.Since(*apiToken.LastUsedAt) > apiTokenTouchPeriod {
+		now := time.Now()
+		db.Model(&apiToken).Updates(map[string]interface{}{
+			"last_used_at": now,
+			"last_used_ip": ip,
+		})
+	}
+
+	return &apiToken, nil
+}
+
+// Does this token carry the scope?
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range strings.Split(t.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Scope middleware - browser sessions pass, API tokens need the scope
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if value, ok := c.Get("apiToken"); ok {
+			token := value.(*APIToken)
+			if !token.HasScope(scope) {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error": "Token is missing required scope",
+					"scope": scope,
+				})
+				c.Abort()
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// List the signed-in user's tokens
+func listAPITokensHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var tokens []APIToken
+	db.Where("user_id = ? AND revoked_at IS NULL", userID).Order("created_at DESC").Find(&tokens)
+
+	c.JSON(http.StatusOK, gin.H{
+		"tokens": tokens,
+		"scopes": apiTokenScopes,
+	})
+}
+
+// Create a token. The plaintext is returned once and never again.
+func createAPITokenHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var input struct {
+		Name          string   `json:"name" binding:"required"`
+		Scopes        []string `json:"scopes" binding:"required,min=1"`
+		ExpiresInDays int      `json:"expires_in_days"` // 0 = never
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	for _, scope := range input.Scopes {
+		if _, ok := apiTokenScopes[scope]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope: " + scope})
+			return
+		}
+	}
+
+	if input.ExpiresInDays < 0 || input.ExpiresInDays > 365 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in_days must be between 0 and 365"})
+		return
+	}
+
+	var count int64
+	db.Model(&APIToken{}).Where("user_id = ? AND revoked_at IS NULL", userID).Count(&count)
+	if count >= maxAPITokensPerUser {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API token limit reached. Revoke an unused token first."})
+		return
+	}
+
+	plaintext, err := generateAPIToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	token := APIToken{
+		UserID:    userID,
+		Name:      input.Name,
+		TokenHash: hashAPIToken(plaintext),
+		Prefix:    plaintext[:len(apiTokenPrefix)+6],
+		Scopes:    strings.Join(input.Scopes, ","),
+	}
+	if input.ExpiresInDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, input.ExpiresInDays)
+		token.ExpiresAt = &expiresAt
+	}
+
+	if err := db.Create(&token).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Token created. Copy it now, it will not be shown again.",
+		"token":   plaintext,
+		"details": token,
+	})
+}
+
+// Revoke a token
+func revokeAPITokenHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+	tokenID, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+
+	result := db.Model(&APIToken{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", tokenID, userID).
+		Update("revoked_at", time.Now())
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked"})
+}
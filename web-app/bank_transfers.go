@@ -0,0 +1,431 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Manual bank transfers. The user pays into our account, then submits a claim
+// with the bank reference and a receipt. The claim opens a pending ledger entry;
+// an admin approves it (completing the payment and activating the subscription)
+// or rejects it.
+
+// Claim statuses
+const (
+	BankTransferPending  = "pending"
+	BankTransferApproved = "approved"
+	BankTransferRejected = "rejected"
+)
+
+const maxReceiptSize = 5 << 20 // 5 MB
+
+// Receipt types we accept, by sniffed content type
+var receiptExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"application/pdf": ".pdf",
+}
+
+var (
+	errReceiptTooLarge = errors.New("receipt must be 5 MB or smaller")
+	errReceiptType     = errors.New("receipt must be a JPEG, PNG or PDF")
+)
+
+// Directory for uploaded files (UPLOAD_DIR, default ./uploads)
+func uploadDir() string {
+	return getEnvDefault("UPLOAD_DIR", "uploads")
+}
+
+// Account users should transfer to, from the environment
+func bankTransferAccount() gin.H {
+	return gin.H{
+		"bank_name":      os.Getenv("BANK_NAME"),
+		"branch":         os.Getenv("BANK_BRANCH"),
+		"account_name":   os.Getenv("BANK_ACCOUNT_NAME"),
+		"account_number": os.Getenv("BANK_ACCOUNT_NUMBER"),
+	}
+}
+
+// Save an uploaded receipt under uploadDir()/receipts with a random name.
+// Returns the path relative to uploadDir() and the sniffed content type.
+func saveReceipt(file io.Reader, size int64) (string, string, error) {
+	if size > maxReceiptSize {
+		return "", "", errReceiptTooLarge
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, maxReceiptSize+1))
+	if err != nil {
+		return "", "", err
+	}
+	if len(data) > maxReceiptSize {
+		return "", "", errReceiptTooLarge
+	}
+
+	// Trust the bytes, not the client's filename or Content-Type
+	contentType := http.DetectContentType(data)
+	ext, ok := receiptExtensions[contentType]
+	if !ok {
+		return "", "", errReceiptType
+	}
+
+	raw := make([]byte, 16)
+	if _, err := crand.Read(raw); err != nil {
+		return "", "", err
+	}
+	relative := filepath.Join("receipts", hex.EncodeToString(raw)+ext)
+
+	full := filepath.Join(uploadDir(), relative)
+	if err := os.MkdirAll(filepath.Dir(full), 0o750); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(full, data, 0o640); err != nil {
+		return "", "", err
+	}
+	return relative, contentType, nil
+}
+
+// The signed-in user's bank transfer claims, plus the account to pay into
+func bankTransfersHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var claims []BankTransferClaim
+	db.Preload("Comments").Where("user_id = ?", userID).Order("created_at DESC").Find(&claims)
+
+	c.JSON(http.StatusOK, gin.H{
+		"account": bankTransferAccount(),
+		"count":   len(claims),
+		"claims":  claims,
+	})
+}
+
+// Submit a bank transfer claim (multipart form with a "receipt" file)
+func submitBankTransferHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxReceiptSize+64<<10) // Receipt plus form fields
+
+	var input struct {
+		PlanID        uint    `form:"plan_id" binding:"required"`
+		BankReference string  `form:"reference_number" binding:"required"`
+		Amount        float64 `form:"amount" binding:"required"`
+		TransferDate  string  `form:"transfer_date" binding:"required"` // YYYY-MM-DD
+		CouponCode    string  `form:"coupon_code"`
+	}
+	if err := c.ShouldBind(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "plan_id, reference_number, amount and transfer_date are required"})
+		return
+	}
+
+	reference := strings.TrimSpace(input.BankReference)
+	if reference == "" || len(reference) > 64 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid reference number"})
+		return
+	}
+
+	transferDate, err := time.ParseInLocation("2006-01-02", input.TransferDate, nepalTime)
+	if err != nil || transferDate.After(time.Now()) || transferDate.Before(time.Now().AddDate(0, 0, -90)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "transfer_date must be a date within the last 90 days (YYYY-MM-DD)"})
+		return
+	}
+
+	plan, err := getPurchasablePlan(input.PlanID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Plan is not available"})
+		return
+	}
+	quote, err := quotePayment(userID, plan, nil, input.CouponCode)
+	if msg, ok := paymentInputError(err); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to price plan"})
+		return
+	}
+	if math.Abs(input.Amount-quote.Amount) > 0.005 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Transferred amount must match the price of " + formatNPR(quote.Amount)})
+		return
+	}
+
+	// The same bank reference can't back two live claims
+	var existing int64
+	db.Model(&BankTransferClaim{}).
+		Where("bank_reference = ? AND status IN ?", reference, []string{BankTransferPending, BankTransferApproved}).
+		Count(&existing)
+	if existing > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "This reference number has already been submitted"})
+		return
+	}
+
+	header, err := c.FormFile("receipt")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A receipt image or PDF is required"})
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read receipt"})
+		return
+	}
+	defer file.Close()
+
+	receiptPath, receiptType, err := saveReceipt(file, header.Size)
+	if errors.Is(err, errReceiptTooLarge) || errors.Is(err, errReceiptType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Printf("Saving receipt failed: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save receipt"})
+		return
+	}
+
+	txn, err := createPaymentTransaction(userID, plan, "bank_transfer", nil, input.CouponCode)
+	if err != nil {
+		os.Remove(filepath.Join(uploadDir(), receiptPath))
+		if msg, ok := paymentInputError(err); ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record payment"})
+		return
+	}
+
+	claim := BankTransferClaim{
+		UserID:               userID,
+		PlanID:               plan.ID,
+		PaymentTransactionID: txn.ID,
+		BankReference:        reference,
+		Amount:               input.Amount,
+		TransferDate:         transferDate,
+		ReceiptPath:          receiptPath,
+		ReceiptName:          filepath.Base(header.Filename),
+		ReceiptType:          receiptType,
+		Status:               BankTransferPending,
+	}
+	if err := db.Create(&claim).Error; err != nil {
+		failPaymentTransaction(txn.Reference, "bank transfer claim could not be saved", "")
+		os.Remove(filepath.Join(uploadDir(), receiptPath))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit claim"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":   "Bank transfer submitted. We'll activate your plan once it's verified.",
+		"claim":     claim,
+		"reference": txn.Reference,
+	})
+}
+
+// Serve a claim's receipt inline
+func sendReceipt(c *gin.Context, claim *BankTransferClaim) {
+	c.Header("Content-Type", claim.ReceiptType)
+	c.Header("Content-Disposition", "inline; filename=\"receipt"+filepath.Ext(claim.ReceiptPath)+"\"")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.File(filepath.Join(uploadDir(), claim.ReceiptPath))
+}
+
+// The user's own receipt
+func bankTransferReceiptHandler(c *gin.Context) {
+	var claim BankTransferClaim
+	if err := db.Where("id = ? AND user_id = ?", c.Param("id"), c.GetUint("userID")).First(&claim).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Claim not found"})
+		return
+	}
+	sendReceipt(c, &claim)
+}
+
+// Admin: approval queue, pending first. ?status= filters.
+func adminBankTransfersHandler(c *gin.Context) {
+	query := db.Preload("Comments").Order("CASE WHEN status = 'pending' THEN 0 ELSE 1 END, created_at").Limit(500)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var claims []BankTransferClaim
+	query.Find(&claims)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":  len(claims),
+		"claims": claims,
+	})
+}
+
+// Admin: view a receipt
+func adminBankTransferReceiptHandler(c *gin.Context) {
+	var claim BankTransferClaim
+	if err := db.First(&claim, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Claim not found"})
+		return
+	}
+	sendReceipt(c, &claim)
+}
+
+// Add a reviewer comment to a claim
+func addBankTransferComment(claimID, authorID uint, body string) error {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return nil
+	}
+	return db.Create(&BankTransferComment{ClaimID: claimID, AuthorID: authorID, Body: body}).Error
+}
+
+// Claim the right to decide on a pending claim; false if someone else already did
+func markBankTransferReviewed(claim *BankTransferClaim, status string, reviewerID uint) (bool, error) {
+	now := time.Now()
+	result := db.Model(&BankTransferClaim{}).
+		Where("id = ? AND status = ?", claim.ID, BankTransferPending).
+		Updates(map[string]interface{}{
+			"status":      status,
+			"reviewed_by": reviewerID,
+			"reviewed_at": now,
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	claim.Status = status
+	claim.ReviewedBy = &reviewerID
+	claim.ReviewedAt = &now
+	return result.RowsAffected == 1, nil
+}
+
+// Load a claim for review and its ledger entry
+func loadBankTransferForReview(c *gin.Context) (*BankTransferClaim, *PaymentTransaction, bool) {
+	var claim BankTransferClaim
+	if err := db.First(&claim, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Claim not found"})
+		return nil, nil, false
+	}
+	if claim.Status != BankTransferPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Claim has already been " + claim.Status})
+		return nil, nil, false
+	}
+
+	var txn PaymentTransaction
+	if err := db.First(&txn, claim.PaymentTransactionID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Payment record not found"})
+		return nil, nil, false
+	}
+	return &claim, &txn, true
+}
+
+// Admin: approve a claim after checking the bank statement. Completes the
+// ledger entry, which activates or extends the subscription.
+func approveBankTransferHandler(c *gin.Context) {
+	var input struct {
+		Comment string `json:"comment"`
+	}
+	c.ShouldBindJSON(&input)
+
+	claim, txn, ok := loadBankTransferForReview(c)
+	if !ok {
+		return
+	}
+	if txn.Status != PaymentPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Payment is no longer pending"})
+		return
+	}
+
+	reviewerID := c.GetUint("userID")
+	if won, err := markBankTransferReviewed(claim, BankTransferApproved, reviewerID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to approve claim"})
+		return
+	} else if !won {
+		c.JSON(http.StatusConflict, gin.H{"error": "Claim has already been reviewed"})
+		return
+	}
+
+	payload, _ := json.Marshal(gin.H{
+		"claim_id":       claim.ID,
+		"bank_reference": claim.BankReference,
+		"transfer_date":  claim.TransferDate.Format("2006-01-02"),
+		"approved_by":    reviewerID,
+	})
+	txn, _, err := completePaymentTransaction(txn.Reference, claim.BankReference, claim.Amount, string(payload))
+	if err != nil {
+		// Put the claim back in the queue so it can be looked at again
+		db.Model(&BankTransferClaim{}).Where("id = ?", claim.ID).
+			Updates(map[string]interface{}{"status": BankTransferPending, "reviewed_by": nil, "reviewed_at": nil})
+		log.Printf("Approving bank transfer %d failed: %v\n", claim.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete payment"})
+		return
+	}
+
+	addBankTransferComment(claim.ID, reviewerID, input.Comment)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Bank transfer approved",
+		"claim":   claim,
+		"payment": txn,
+	})
+}
+
+// Admin: reject a claim. The reason is shown to the user.
+func rejectBankTransferHandler(c *gin.Context) {
+	var input struct {
+		Reason string `json:"reason" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || strings.TrimSpace(input.Reason) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A reason is required"})
+		return
+	}
+
+	claim, txn, ok := loadBankTransferForReview(c)
+	if !ok {
+		return
+	}
+
+	reviewerID := c.GetUint("userID")
+	if won, err := markBankTransferReviewed(claim, BankTransferRejected, reviewerID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reject claim"})
+		return
+	} else if !won {
+		c.JSON(http.StatusConflict, gin.H{"error": "Claim has already been reviewed"})
+		return
+	}
+
+	failPaymentTransaction(txn.Reference, "bank transfer rejected: "+strings.TrimSpace(input.Reason), "")
+	addBankTransferComment(claim.ID, reviewerID, input.Reason)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Bank transfer rejected",
+		"claim":   claim,
+	})
+}
+
+// Admin: comment on a claim without deciding, e.g. to ask for a clearer receipt
+func commentBankTransferHandler(c *gin.Context) {
+	var input struct {
+		Body string `json:"body" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || strings.TrimSpace(input.Body) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Comment body is required"})
+		return
+	}
+
+	claimID, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+	var claim BankTransferClaim
+	if err := db.First(&claim, claimID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Claim not found"})
+		return
+	}
+
+	if err := addBankTransferComment(claim.ID, c.GetUint("userID"), input.Body); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add comment"})
+		return
+	}
+
+	var comments []BankTransferComment
+	db.Where("claim_id = ?", claim.ID).Order("created_at").Find(&comments)
+	c.JSON(http.StatusCreated, gin.H{"comments": comments})
+}
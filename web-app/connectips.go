@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// ConnectIPS (NCHL). The browser POSTs a form carrying an RSA-SHA256 TOKEN signed
+// with the merchant's creditor key, ConnectIPS redirects back to the success or
+// failure URL registered for the merchant with ?TXNID=, and the payment is only
+// completed after the validatetxn API confirms it server-side.
+
+// ConnectIPS endpoints per CONNECTIPS_ENV
+const (
+	connectIPSTestFormURL     = "https://uat.connectips.com/connectipswebgw/loginpage"
+	connectIPSTestValidateURL = "https://uat.connectips.com/connectipswebws/api/creditor/validatetxn"
+	connectIPSLiveFormURL     = "https://connectips.com/connectipswebgw/loginpage"
+	connectIPSLiveValidateURL = "https://connectips.com/connectipswebws/api/creditor/validatetxn"
+	connectIPSFakePath        = "/_fake/connectips" // Local stub, see connectips_fake.go
+)
+
+// validatetxn statuses
+const (
+	connectIPSStatusSuccess = "SUCCESS"
+	connectIPSStatusFailed  = "FAILED"
+	connectIPSStatusError   = "ERROR"
+)
+
+// TXNDATE is the transaction's day in Nepal time
+var nepalTime = time.FixedZone("NPT", 5*3600+45*60)
+
+var (
+	errConnectIPSNoKey    = errors.New("connectips: CONNECTIPS_KEY_FILE is not set")
+	errConnectIPSBadKey   = errors.New("connectips: no RSA private key in key file")
+	errConnectIPSMismatch = errors.New("connectips: validation does not match the transaction")
+)
+
+// Form and validation URLs for CONNECTIPS_ENV: "live", "fake", or anything else for UAT
+func connectIPSEndpoints(env string) (formURL, validateURL string) {
+	switch env {
+	case "live":
+		return connectIPSLiveFormURL, connectIPSLiveValidateURL
+	case "fake":
+		base := getBaseURL() + connectIPSFakePath
+		return base + "/connectipswebgw/loginpage", base + "/connectipswebws/api/creditor/validatetxn"
+	}
+	return connectIPSTestFormURL, connectIPSTestValidateURL
+}
+
+// The creditor key is loaded once; in fake mode without a key file a throwaway
+// test keypair is generated so the stub can verify tokens.
+var connectIPSKey struct {
+	once sync.Once
+	key  *rsa.PrivateKey
+	err  error
+}
+
+func connectIPSSigningKey() (*rsa.PrivateKey, error) {
+	connectIPSKey.once.Do(func() {
+		path := os.Getenv("CONNECTIPS_KEY_FILE")
+		if path == "" {
+			if os.Getenv("CONNECTIPS_ENV") == "fake" {
+				connectIPSKey.key, connectIPSKey.err = rsa.GenerateKey(rand.Reader, 2048)
+				return
+			}
+			connectIPSKey.err = errConnectIPSNoKey
+			return
+		}
+		connectIPSKey.key, connectIPSKey.err = loadConnectIPSKey(path, os.Getenv("CONNECTIPS_KEY_PASSWORD"))
+	})
+	return connectIPSKey.key, connectIPSKey.err
+}
+
+// Read an RSA private key from a PEM file (PKCS#1 or PKCS#8) or the CREDITOR.pfx
+// bundle NCHL issues
+func loadConnectIPSKey(path, password string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		return parseConnectIPSKeyBlock(block)
+	}
+
+	key, _, err := pkcs12.Decode(data, password)
+	if err == nil {
+		if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+			return rsaKey, nil
+		}
+		return nil, errConnectIPSBadKey
+	}
+
+	// Decode only accepts a single certificate; walk the bags for bundles with a chain
+	blocks, pemErr := pkcs12.ToPEM(data, password)
+	if pemErr != nil {
+		return nil, fmt.Errorf("connectips: reading key file: %w", err)
+	}
+	for _, block := range blocks {
+		if block.Type == "PRIVATE KEY" || block.Type == "RSA PRIVATE KEY" {
+			return parseConnectIPSKeyBlock(block)
+		}
+	}
+	return nil, errConnectIPSBadKey
+}
+
+func parseConnectIPSKeyBlock(block *pem.Block) (*rsa.PrivateKey, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errConnectIPSBadKey
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errConnectIPSBadKey
+	}
+	return rsaKey, nil
+}
+
+// Base64 RSA-SHA256 (PKCS#1 v1.5) signature, as ConnectIPS expects in TOKEN
+func connectIPSSign(key *rsa.PrivateKey, message string) (string, error) {
+	digest := sha256.Sum256([]byte(message))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// Check a TOKEN against the public half of the key
+func connectIPSVerify(key *rsa.PublicKey, message, token string) bool {
+	signature, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return false
+	}
+	digest := sha256.Sum256([]byte(message))
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+}
+
+// Signed string for the payment form; field order is fixed by ConnectIPS
+func connectIPSFormMessage(fields map[string]string) string {
+	return fmt.Sprintf("MERCHANTID=%s,APPID=%s,APPNAME=%s,TXNID=%s,TXNDATE=%s,TXNCRNCY=%s,TXNAMT=%s,REFERENCEID=%s,REMARKS=%s,PARTICULARS=%s,TOKEN=TOKEN",
+		fields["MERCHANTID"], fields["APPID"], fields["APPNAME"], fields["TXNID"], fields["TXNDATE"],
+		fields["TXNCRNCY"], fields["TXNAMT"], fields["REFERENCEID"], fields["REMARKS"], fields["PARTICULARS"])
+}
+
+// Signed string for validatetxn
+func connectIPSValidateMessage(merchantID, appID, referenceID string, amount int64) string {
+	return fmt.Sprintf("MERCHANTID=%s,APPID=%s,REFERENCEID=%s,TXNAMT=%d", merchantID, appID, referenceID, amount)
+}
+
+// Signed form fields for a pending transaction. Amounts are in paisa.
+func connectIPSPaymentForm(config NepalPaymentConfig, txn *PaymentTransaction) (string, map[string]string, error) {
+	key, err := connectIPSSigningKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	fields := map[string]string{
+		"MERCHANTID":  config.ConnectIPSMerchantID,
+		"APPID":       config.ConnectIPSAppID,
+		"APPNAME":     config.ConnectIPSAppName,
+		"TXNID":       txn.Reference,
+		"TXNDATE":     txn.CreatedAt.In(nepalTime).Format("02-01-2006"),
+		"TXNCRNCY":    "NPR",
+		"TXNAMT":      strconv.FormatInt(toPaisa(txn.Amount), 10),
+		"REFERENCEID": txn.Reference,
+		"REMARKS":     "IPO Pilot subscription",
+		"PARTICULARS": txn.Reference,
+	}
+	fields["TOKEN"], err = connectIPSSign(key, connectIPSFormMessage(fields))
+	if err != nil {
+		return "", nil, err
+	}
+	return config.ConnectIPSFormURL, fields, nil
+}
+
+// ConnectIPSValidation is the validatetxn response
+type ConnectIPSValidation struct {
+	MerchantID  interface{} `json:"merchantId"`
+	AppID       string      `json:"appId"`
+	ReferenceID string      `json:"referenceId"`
+	TxnAmt      interface{} `json:"txnAmt"` // Paisa, number or string
+	Status      string      `json:"status"`
+	StatusDesc  string      `json:"statusDesc"`
+}
+
+// Ask ConnectIPS whether a transaction went through
+func validateConnectIPSTransaction(config NepalPaymentConfig, txn *PaymentTransaction) (*ConnectIPSValidation, []byte, error) {
+	key, err := connectIPSSigningKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	amount := toPaisa(txn.Amount)
+	token, err := connectIPSSign(key, connectIPSValidateMessage(config.ConnectIPSMerchantID, config.ConnectIPSAppID, txn.Reference, amount))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	merchantID, _ := strconv.ParseInt(config.ConnectIPSMerchantID, 10, 64)
+	body, _ := json.Marshal(gin.H{
+		"merchantId":  merchantID,
+		"appId":       config.ConnectIPSAppID,
+		"referenceId": txn.Reference,
+		"txnAmt":      amount,
+		"token":       token,
+	})
+
+	req, err := http.NewRequest(http.MethodPost, config.ConnectIPSValidateURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.SetBasicAuth(config.ConnectIPSAppID, config.ConnectIPSPassword)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := paymentHTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, raw, fmt.Errorf("connectips validatetxn: HTTP %d: %s", resp.StatusCode, raw)
+	}
+
+	var validation ConnectIPSValidation
+	if err := json.Unmarshal(raw, &validation); err != nil {
+		return nil, raw, fmt.Errorf("connectips validatetxn: %w", err)
+	}
+	if validation.ReferenceID != txn.Reference {
+		return nil, raw, errConnectIPSMismatch
+	}
+	return &validation, raw, nil
+}
+
+// Confirm a transaction with validatetxn and complete or fail it in the ledger
+func verifyConnectIPSPayment(config NepalPaymentConfig, txn *PaymentTransaction) (string, error) {
+	validation, raw, err := validateConnectIPSTransaction(config, txn)
+	if err != nil {
+		return "", err
+	}
+
+	switch validation.Status {
+	case connectIPSStatusSuccess:
+		paisa, err := strconv.ParseFloat(fmt.Sprint(validation.TxnAmt), 64)
+		if err != nil {
+			return "", errConnectIPSMismatch
+		}
+		if _, _, err = completePaymentTransaction(txn.Reference, txn.Reference, paisa/100, string(raw)); err != nil {
+			return "", err
+		}
+		return PaymentCompleted, nil
+	case connectIPSStatusFailed:
+		failPaymentTransaction(txn.Reference, "connectips: "+validation.StatusDesc, string(raw))
+		return PaymentFailed, nil
+	}
+	return PaymentPending, nil
+}
+
+// connectIPSGateway is ConnectIPS behind the PaymentGateway interface
+type connectIPSGateway struct{}
+
+func (connectIPSGateway) Name() string { return "connectips" }
+
+func (connectIPSGateway) Enabled() bool { return getNepalPaymentConfig().ConnectIPSEnabled }
+
+// ConnectIPS takes a signed form POST; the checkout page auto-submits it
+func (connectIPSGateway) Initiate(txn *PaymentTransaction, plan *Plan, user *User) (*PaymentInitiation, error) {
+	formURL, fields, err := connectIPSPaymentForm(getNepalPaymentConfig(), txn)
+	if err != nil {
+		return nil, err
+	}
+	return &PaymentInitiation{Method: paymentMethodForm, URL: formURL, Fields: fields}, nil
+}
+
+// The success and failure URLs both only carry TXNID
+func (connectIPSGateway) HandleCallback(c *gin.Context) (*PaymentTransaction, error) {
+	txn, err := getPaymentTransaction(c.Query("TXNID"))
+	if err != nil || txn.Gateway != "connectips" {
+		return nil, errPaymentNotFound
+	}
+	return txn, nil
+}
+
+func (connectIPSGateway) Verify(txn *PaymentTransaction) (string, error) {
+	return verifyConnectIPSPayment(getNepalPaymentConfig(), txn)
+}
+
+// Refunds go through NCHL's dispute process, not an API
+func (connectIPSGateway) Refund(txn *PaymentTransaction, amount float64, reason string) error {
+	return errRefundUnsupported
+}
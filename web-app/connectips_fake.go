@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Local stub of ConnectIPS for development and integration testing.
+// Enabled with CONNECTIPS_ENV=fake, which also points the ConnectIPS config at
+// it. Without CONNECTIPS_KEY_FILE a test keypair is generated at startup, and
+// the stub verifies every TOKEN against it - never enable it in production.
+
+type fakeConnectIPSTxn struct {
+	Amount string // Paisa
+	Status string
+}
+
+type fakeConnectIPS struct {
+	mu   sync.Mutex
+	txns map[string]*fakeConnectIPSTxn
+}
+
+// Mount the stub under connectIPSFakePath
+func mountFakeConnectIPS(r *gin.Engine) {
+	fake := &fakeConnectIPS{txns: make(map[string]*fakeConnectIPSTxn)}
+
+	group := r.Group(connectIPSFakePath)
+	group.POST("/connectipswebgw/loginpage", fake.loginPageHandler)
+	group.POST("/pay", fake.payHandler)
+	group.POST("/connectipswebws/api/creditor/validatetxn", fake.validateHandler)
+}
+
+// Token check with the public half of the merchant key
+func (f *fakeConnectIPS) verify(message, token string) bool {
+	key, err := connectIPSSigningKey()
+	if err != nil {
+		return false
+	}
+	return connectIPSVerify(&key.PublicKey, message, token)
+}
+
+// Payment form target: verify the TOKEN, then ask the "customer"
+func (f *fakeConnectIPS) loginPageHandler(c *gin.Context) {
+	config := getNepalPaymentConfig()
+	c.Request.ParseForm()
+
+	fields := make(map[string]string)
+	for key := range c.Request.PostForm {
+		fields[key] = c.Request.PostForm.Get(key)
+	}
+	if !f.verify(connectIPSFormMessage(fields), fields["TOKEN"]) {
+		c.String(http.StatusBadRequest, "fake connectips: invalid token")
+		return
+	}
+	if fields["MERCHANTID"] != config.ConnectIPSMerchantID || fields["APPID"] != config.ConnectIPSAppID {
+		c.String(http.StatusBadRequest, "fake connectips: unknown merchant")
+		return
+	}
+	if _, err := strconv.ParseInt(fields["TXNAMT"], 10, 64); err != nil {
+		c.String(http.StatusBadRequest, "fake connectips: TXNAMT must be in paisa")
+		return
+	}
+
+	txnID := fields["TXNID"]
+	f.mu.Lock()
+	f.txns[fields["REFERENCEID"]] = &fakeConnectIPSTxn{Amount: fields["TXNAMT"], Status: "pending"}
+	f.mu.Unlock()
+
+	page := `<!DOCTYPE html><html><body style="font-family:sans-serif;text-align:center;margin-top:80px">
+<h2>Fake ConnectIPS</h2><p>Pay %s paisa for %s?</p>
+<form method="POST" action="%s/pay">
+<input type="hidden" name="TXNID" value="%s">
+<button name="decision" value="pay">Pay</button> <button name="decision" value="cancel">Cancel</button>
+</form></body></html>`
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(fmt.Sprintf(page,
+		html.EscapeString(fields["TXNAMT"]), html.EscapeString(txnID),
+		connectIPSFakePath, html.EscapeString(txnID))))
+}
+
+// Customer decision: redirect to the merchant's success or failure URL with TXNID
+func (f *fakeConnectIPS) payHandler(c *gin.Context) {
+	txnID := c.PostForm("TXNID")
+
+	f.mu.Lock()
+	stored, ok := f.txns[txnID]
+	var status string
+	if ok {
+		if stored.Status == "pending" {
+			if c.PostForm("decision") == "pay" {
+				stored.Status = connectIPSStatusSuccess
+			} else {
+				stored.Status = connectIPSStatusFailed
+			}
+		}
+		status = stored.Status
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		c.String(http.StatusNotFound, "fake connectips: unknown transaction")
+		return
+	}
+
+	target := "/payment/connectips/failure"
+	if status == connectIPSStatusSuccess {
+		target = "/payment/connectips/success"
+	}
+	c.Redirect(http.StatusFound, getBaseURL()+target+"?TXNID="+url.QueryEscape(txnID))
+}
+
+// validatetxn: basic auth with the app credentials plus a signed token
+func (f *fakeConnectIPS) validateHandler(c *gin.Context) {
+	config := getNepalPaymentConfig()
+
+	appID, password, ok := c.Request.BasicAuth()
+	if !ok || appID != config.ConnectIPSAppID || password != config.ConnectIPSPassword {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	var input struct {
+		MerchantID  int64  `json:"merchantId"`
+		AppID       string `json:"appId"`
+		ReferenceID string `json:"referenceId"`
+		TxnAmt      int64  `json:"txnAmt"`
+		Token       string `json:"token"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+
+	response := gin.H{
+		"merchantId":  input.MerchantID,
+		"appId":       input.AppID,
+		"referenceId": input.ReferenceID,
+		"txnAmt":      strconv.FormatInt(input.TxnAmt, 10),
+		"token":       input.Token,
+		"status":      connectIPSStatusError,
+		"statusDesc":  "ERROR",
+	}
+
+	message := connectIPSValidateMessage(strconv.FormatInt(input.MerchantID, 10), input.AppID, input.ReferenceID, input.TxnAmt)
+	if !f.verify(message, input.Token) {
+		response["statusDesc"] = "Invalid token"
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	f.mu.Lock()
+	txn, found := f.txns[input.ReferenceID]
+	var stored fakeConnectIPSTxn
+	if found {
+		stored = *txn
+	}
+	f.mu.Unlock()
+
+	switch {
+	case !found:
+		response["statusDesc"] = "Transaction not found"
+	case stored.Amount != strconv.FormatInt(input.TxnAmt, 10):
+		response["status"] = connectIPSStatusFailed
+		response["statusDesc"] = "Amount mismatch"
+	case stored.Status == connectIPSStatusSuccess:
+		response["status"] = connectIPSStatusSuccess
+		response["statusDesc"] = "TRANSACTION SUCCESSFUL"
+	case stored.Status == connectIPSStatusFailed:
+		response["status"] = connectIPSStatusFailed
+		response["statusDesc"] = "TRANSACTION FAILED"
+	default:
+		response["statusDesc"] = "Transaction is not complete"
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ConnectIPS signing and payment flow against the local stub
+// (connectips_fake.go), with keys generated by the tests
+
+func generateTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating RSA key: %v", err)
+	}
+	return key
+}
+
+func writeTestPEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "creditor.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("writing key file: %v", err)
+	}
+	return path
+}
+
+func resetConnectIPSKey() {
+	connectIPSKey.once = sync.Once{}
+	connectIPSKey.key, connectIPSKey.err = nil, nil
+}
+
+// Make key the creditor key, loaded through CONNECTIPS_KEY_FILE like in production.
+// The stub verifies tokens with its public half.
+func useConnectIPSTestKey(t *testing.T, key *rsa.PrivateKey) {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("encoding key: %v", err)
+	}
+	t.Setenv("CONNECTIPS_KEY_FILE", writeTestPEM(t, "PRIVATE KEY", der))
+	resetConnectIPSKey()
+	t.Cleanup(resetConnectIPSKey)
+}
+
+type connectIPSTest struct {
+	key    *rsa.PrivateKey
+	server string
+	user   *User
+	plan   *Plan
+}
+
+func setupConnectIPSTest(t *testing.T) *connectIPSTest {
+	t.Helper()
+
+	setupTestDB(t)
+	t.Setenv("CONNECTIPS_ENV", "fake")
+	t.Setenv("CONNECTIPS_PASSWORD", "app-password")
+	key := generateTestRSAKey(t)
+	useConnectIPSTestKey(t, key)
+	registerPaymentGateways()
+
+	r := gin.New()
+	mountFakeConnectIPS(r)
+	r.GET("/payment/connectips/success", paymentCallbackHandler("connectips"))
+	r.GET("/payment/connectips/failure", paymentCallbackHandler("connectips"))
+	server := startTestServer(t, r)
+
+	return &connectIPSTest{
+		key:    key,
+		server: server.URL,
+		user:   createTestUser(t, "connectips@example.com"),
+		plan:   getTestPlan(t, "premium"),
+	}
+}
+
+// A pending payment and its signed form
+func (ct *connectIPSTest) start(t *testing.T) (*PaymentTransaction, string, map[string]string) {
+	t.Helper()
+
+	txn, err := createPaymentTransaction(ct.user.ID, ct.plan, "connectips", nil, "")
+	if err != nil {
+		t.Fatalf("creating payment: %v", err)
+	}
+	formURL, fields, err := connectIPSPaymentForm(getNepalPaymentConfig(), txn)
+	if err != nil {
+		t.Fatalf("building payment form: %v", err)
+	}
+	return txn, formURL, fields
+}
+
+// Submit the payment form the way the checkout page does
+func postConnectIPSForm(t *testing.T, formURL string, fields map[string]string) (int, string) {
+	t.Helper()
+
+	form := url.Values{}
+	for k, v := range fields {
+		form.Set(k, v)
+	}
+	resp, err := http.PostForm(formURL, form)
+	if err != nil {
+		t.Fatalf("posting payment form: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+// Call validatetxn directly with a token signed by key over amount, sending txnAmt
+func (ct *connectIPSTest) validate(t *testing.T, key *rsa.PrivateKey, reference string, signedAmount, txnAmt int64) map[string]interface{} {
+	t.Helper()
+
+	config := getNepalPaymentConfig()
+	token, err := connectIPSSign(key, connectIPSValidateMessage(config.ConnectIPSMerchantID, config.ConnectIPSAppID, reference, signedAmount))
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+	merchantID, _ := strconv.ParseInt(config.ConnectIPSMerchantID, 10, 64)
+	body, _ := json.Marshal(gin.H{
+		"merchantId":  merchantID,
+		"appId":       config.ConnectIPSAppID,
+		"referenceId": reference,
+		"txnAmt":      txnAmt,
+		"token":       token,
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, config.ConnectIPSValidateURL, bytes.NewReader(body))
+	req.SetBasicAuth(config.ConnectIPSAppID, config.ConnectIPSPassword)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("validatetxn: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("decoding validatetxn: %v", err)
+	}
+	return result
+}
+
+func TestConnectIPSSignedPaymentCompletes(t *testing.T) {
+	ct := setupConnectIPSTest(t)
+	txn, formURL, fields := ct.start(t)
+
+	if !connectIPSVerify(&ct.key.PublicKey, connectIPSFormMessage(fields), fields["TOKEN"]) {
+		t.Fatal("form TOKEN does not verify with the test key")
+	}
+	if fields["TXNAMT"] != strconv.FormatInt(toPaisa(txn.Amount), 10) {
+		t.Fatalf("TXNAMT = %s, want %d paisa", fields["TXNAMT"], toPaisa(txn.Amount))
+	}
+	if status, body := postConnectIPSForm(t, formURL, fields); status != http.StatusOK {
+		t.Fatalf("stub rejected the signed form: %d %s", status, body)
+	}
+
+	resp, err := noRedirectClient.PostForm(ct.server+connectIPSFakePath+"/pay", url.Values{"TXNID": {txn.Reference}, "decision": {"pay"}})
+	if err != nil {
+		t.Fatalf("paying: %v", err)
+	}
+	resp.Body.Close()
+	resp, err = noRedirectClient.Get(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("calling success URL: %v", err)
+	}
+	resp.Body.Close()
+	if location := resp.Header.Get("Location"); !strings.HasPrefix(location, "/dashboard?payment=success") {
+		t.Fatalf("success handler redirected to %q", location)
+	}
+
+	if txn = reloadPayment(t, txn.Reference); txn.Status != PaymentCompleted || txn.SubscriptionID == nil {
+		t.Fatalf("payment is %s with subscription %v, want completed", txn.Status, txn.SubscriptionID)
+	}
+}
+
+func TestConnectIPSStubRejectsTamperedForm(t *testing.T) {
+	ct := setupConnectIPSTest(t)
+	_, formURL, fields := ct.start(t)
+
+	otherKey := generateTestRSAKey(t)
+	otherToken, err := connectIPSSign(otherKey, connectIPSFormMessage(fields))
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(fields map[string]string)
+	}{
+		{"amount", func(f map[string]string) { f["TXNAMT"] = "100" }},
+		{"reference", func(f map[string]string) { f["REFERENCEID"] = "IPP-OTHER" }},
+		{"token from another key", func(f map[string]string) { f["TOKEN"] = otherToken }},
+		{"corrupted token", func(f map[string]string) { f["TOKEN"] = "A" + f["TOKEN"][1:] }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := make(map[string]string)
+			for k, v := range fields {
+				tampered[k] = v
+			}
+			tt.tamper(tampered)
+
+			status, body := postConnectIPSForm(t, formURL, tampered)
+			if status != http.StatusBadRequest || !strings.Contains(body, "invalid token") {
+				t.Fatalf("stub answered %d %q, want 400 invalid token", status, body)
+			}
+		})
+	}
+}
+
+func TestConnectIPSValidationRejectsTampering(t *testing.T) {
+	ct := setupConnectIPSTest(t)
+	txn, formURL, fields := ct.start(t)
+	postConnectIPSForm(t, formURL, fields)
+	resp, err := noRedirectClient.PostForm(ct.server+connectIPSFakePath+"/pay", url.Values{"TXNID": {txn.Reference}, "decision": {"pay"}})
+	if err != nil {
+		t.Fatalf("paying: %v", err)
+	}
+	resp.Body.Close()
+
+	amount := toPaisa(txn.Amount)
+	if result := ct.validate(t, ct.key, txn.Reference, amount, amount); result["status"] != connectIPSStatusSuccess {
+		t.Fatalf("genuine validation = %v, want SUCCESS", result)
+	}
+	if result := ct.validate(t, generateTestRSAKey(t), txn.Reference, amount, amount); result["status"] != connectIPSStatusError {
+		t.Fatalf("validation signed by another key = %v, want ERROR", result)
+	}
+	if result := ct.validate(t, ct.key, txn.Reference, amount, amount-100); result["status"] != connectIPSStatusError {
+		t.Fatalf("validation with an amount the token doesn't cover = %v, want ERROR", result)
+	}
+
+	// The ledger expects a different amount than was paid: the stub reports a mismatch
+	db.Model(&PaymentTransaction{}).Where("id = ?", txn.ID).Update("amount", txn.Amount-1)
+	status, err := verifyConnectIPSPayment(getNepalPaymentConfig(), reloadPayment(t, txn.Reference))
+	if err != nil || status != PaymentFailed {
+		t.Fatalf("verify with a tampered amount = %q, %v; want failed", status, err)
+	}
+	if txn = reloadPayment(t, txn.Reference); txn.Status != PaymentFailed {
+		t.Fatalf("payment is %s, want failed", txn.Status)
+	}
+}
+
+func TestLoadConnectIPSKey(t *testing.T) {
+	key := generateTestRSAKey(t)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("encoding key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating EC key: %v", err)
+	}
+	ecDER, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatalf("encoding EC key: %v", err)
+	}
+	garbage := filepath.Join(t.TempDir(), "garbage.pfx")
+	os.WriteFile(garbage, []byte("not a key"), 0600)
+
+	tests := []struct {
+		name     string
+		path     string
+		password string
+		want     *rsa.PrivateKey // nil: any RSA key
+		wantErr  error           // nil: any error when fail is set
+		fail     bool
+	}{
+		{name: "PKCS#1 PEM", path: writeTestPEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)), want: key},
+		{name: "PKCS#8 PEM", path: writeTestPEM(t, "PRIVATE KEY", pkcs8), want: key},
+		{name: "PFX", path: "testdata/connectips_test.pfx", password: "test"},
+		{name: "PFX with a certificate chain", path: "testdata/connectips_chain_test.pfx", password: "test"},
+		{name: "PFX with the wrong password", path: "testdata/connectips_test.pfx", password: "wrong", fail: true},
+		{name: "EC key", path: writeTestPEM(t, "PRIVATE KEY", ecDER), fail: true, wantErr: errConnectIPSBadKey},
+		{name: "not a key", path: garbage, fail: true},
+		{name: "missing file", path: filepath.Join(t.TempDir(), "missing.pem"), fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadConnectIPSKey(tt.path, tt.password)
+			if tt.fail {
+				if err == nil {
+					t.Fatal("loaded a key, want an error")
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loading key: %v", err)
+			}
+			if tt.want != nil && !got.Equal(tt.want) {
+				t.Fatal("loaded a different key")
+			}
+
+			// Whatever the format, the key must produce tokens its public half accepts
+			token, err := connectIPSSign(got, "MERCHANTID=1000,TXNAMT=199900")
+			if err != nil || !connectIPSVerify(&got.PublicKey, "MERCHANTID=1000,TXNAMT=199900", token) {
+				t.Fatalf("key does not round-trip a signature: %v", err)
+			}
+		})
+	}
+}
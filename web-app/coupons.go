@@ -0,0 +1,378 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Coupons. A code is checked and priced when a payment starts, the discounted
+// amount is stored on the PaymentTransaction, and the redemption is recorded
+// when that payment completes. The client never sends a price.
+
+// Discount types
+const (
+	CouponPercent = "percent"
+	CouponFixed   = "fixed"
+)
+
+const (
+	minPayableAmount = 10.0             // NPR; the gateways won't take less
+	couponHoldWindow = 30 * time.Minute // How long an unfinished online payment holds a redemption
+)
+
+// couponError is a reason a code can't be used, safe to show the user
+type couponError string
+
+func (e couponError) Error() string { return string(e) }
+
+var (
+	errCouponInvalid   = couponError("Coupon code is not valid")
+	errCouponExpired   = couponError("This coupon has expired")
+	errCouponExhausted = couponError("This coupon has been fully redeemed")
+	errCouponUserLimit = couponError("You have already used this coupon")
+	errCouponPlan      = couponError("This coupon doesn't apply to the selected plan")
+)
+
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Plan codes the coupon is limited to; empty means every plan
+func (cp *Coupon) PlanCodeList() []string {
+	codes := []string{}
+	for _, code := range strings.Split(cp.PlanCodes, ",") {
+		if code = strings.TrimSpace(code); code != "" {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
+
+func (cp *Coupon) AppliesTo(plan *Plan) bool {
+	codes := cp.PlanCodeList()
+	if len(codes) == 0 {
+		return true
+	}
+	for _, code := range codes {
+		if code == plan.Code {
+			return true
+		}
+	}
+	return false
+}
+
+// Discount on a price, in whole rupees, never taking the price below what the
+// gateways accept
+func (cp *Coupon) Discount(price float64) float64 {
+	discount := cp.DiscountValue
+	if cp.DiscountType == CouponPercent {
+		discount = price * cp.DiscountValue / 100
+	}
+	discount = math.Round(discount)
+	if discount > price-minPayableAmount {
+		discount = math.Max(price-minPayableAmount, 0)
+	}
+	return discount
+}
+
+// Redemptions of a coupon that count against its limits: completed payments,
+// pending bank transfers (awaiting review), and online payments started recently
+func couponUsage(tx *gorm.DB, couponID uint, userID uint) (total, byUser int64) {
+	query := func() *gorm.DB {
+		return tx.Model(&PaymentTransaction{}).
+			Where("coupon_id = ?", couponID).
+			Where("status = ? OR (status = ? AND (gateway = ? OR created_at > ?))",
+				PaymentCompleted, PaymentPending, "bank_transfer", time.Now().Add(-couponHoldWindow))
+	}
+	query().Count(&total)
+	query().Where("user_id = ?", userID).Count(&byUser)
+	return total, byUser
+}
+
+// Check a code for a user and plan, returning the coupon and the discount it gives
+func validateCoupon(code string, plan *Plan, userID uint) (*Coupon, float64, error) {
+	var coupon Coupon
+	if err := db.Where("code = ? AND is_active = ?", normalizeCouponCode(code), true).First(&coupon).Error; err != nil {
+		return nil, 0, errCouponInvalid
+	}
+
+	now := time.Now()
+	if coupon.StartsAt != nil && now.Before(*coupon.StartsAt) {
+		return nil, 0, errCouponInvalid
+	}
+	if coupon.ExpiresAt != nil && now.After(*coupon.ExpiresAt) {
+		return nil, 0, errCouponExpired
+	}
+	if !coupon.AppliesTo(plan) {
+		return nil, 0, errCouponPlan
+	}
+
+	total, byUser := couponUsage(db, coupon.ID, userID)
+	if coupon.MaxRedemptions > 0 && total >= int64(coupon.MaxRedemptions) {
+		return nil, 0, errCouponExhausted
+	}
+	if coupon.PerUserLimit > 0 && byUser >= int64(coupon.PerUserLimit) {
+		return nil, 0, errCouponUserLimit
+	}
+
+	return &coupon, coupon.Discount(plan.Price), nil
+}
+
+// Record the redemption for a payment being completed (inside its transaction)
+func recordCouponRedemption(tx *gorm.DB, txn *PaymentTransaction) error {
+	if txn.CouponID == nil {
+		return nil
+	}
+	return tx.Create(&CouponRedemption{
+		CouponID:             *txn.CouponID,
+		UserID:               txn.UserID,
+		PaymentTransactionID: txn.ID,
+		PlanID:               txn.PlanID,
+		DiscountAmount:       txn.DiscountAmount,
+		AmountPaid:           txn.Amount,
+	}).Error
+}
+
+// Preview the price of a plan with a coupon (including any upgrade credit)
+func checkCouponHandler(c *gin.Context) {
+	var input struct {
+		PlanID uint   `json:"plan_id" binding:"required"`
+		Code   string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "plan_id and code are required"})
+		return
+	}
+
+	plan, err := getPurchasablePlan(input.PlanID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Plan is not available"})
+		return
+	}
+
+	quote, err := quotePayment(c.GetUint("userID"), plan, nil, input.Code)
+	if msg, ok := paymentInputError(err); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to price plan"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":             quote.Coupon.Code,
+		"description":      quote.Coupon.Description,
+		"list_price":       quote.ListPrice,
+		"discount":         quote.Discount,
+		"proration_credit": quote.Credit,
+		"amount":           quote.Amount,
+	})
+}
+
+// CouponInput is the admin create/update payload
+type CouponInput struct {
+	Code           string     `json:"code"`
+	Description    string     `json:"description"`
+	DiscountType   string     `json:"discount_type"`
+	DiscountValue  float64    `json:"discount_value"`
+	PlanCodes      []string   `json:"plan_codes"`
+	StartsAt       *time.Time `json:"starts_at"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	MaxRedemptions int        `json:"max_redemptions"`
+	PerUserLimit   int        `json:"per_user_limit"`
+	IsActive       bool       `json:"is_active"`
+}
+
+func (in *CouponInput) validate() error {
+	switch in.DiscountType {
+	case CouponPercent:
+		if in.DiscountValue <= 0 || in.DiscountValue > 100 {
+			return errors.New("percent discount must be between 0 and 100")
+		}
+	case CouponFixed:
+		if in.DiscountValue <= 0 {
+			return errors.New("fixed discount must be positive")
+		}
+	default:
+		return errors.New("discount_type must be percent or fixed")
+	}
+	if in.MaxRedemptions < 0 || in.PerUserLimit < 0 {
+		return errors.New("limits cannot be negative")
+	}
+	if in.StartsAt != nil && in.ExpiresAt != nil && !in.ExpiresAt.After(*in.StartsAt) {
+		return errors.New("expires_at must be after starts_at")
+	}
+	for _, code := range in.PlanCodes {
+		if _, err := getPlanByCode(strings.TrimSpace(code)); err != nil {
+			return errors.New("unknown plan code: " + code)
+		}
+	}
+	return nil
+}
+
+func (in *CouponInput) applyTo(coupon *Coupon) {
+	codes := []string{}
+	for _, code := range in.PlanCodes {
+		if code = strings.TrimSpace(code); code != "" {
+			codes = append(codes, code)
+		}
+	}
+
+	coupon.Description = in.Description
+	coupon.DiscountType = in.DiscountType
+	coupon.DiscountValue = in.DiscountValue
+	coupon.PlanCodes = strings.Join(codes, ",")
+	coupon.StartsAt = in.StartsAt
+	coupon.ExpiresAt = in.ExpiresAt
+	coupon.MaxRedemptions = in.MaxRedemptions
+	coupon.PerUserLimit = in.PerUserLimit
+	coupon.IsActive = in.IsActive
+}
+
+// Admin: list coupons
+func adminCouponsHandler(c *gin.Context) {
+	var coupons []Coupon
+	db.Order("created_at DESC").Find(&coupons)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":   len(coupons),
+		"coupons": coupons,
+	})
+}
+
+// Admin: create a coupon
+func createCouponHandler(c *gin.Context) {
+	var input CouponInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	input.Code = normalizeCouponCode(input.Code)
+	if input.Code == "" || len(input.Code) > 50 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code is required (up to 50 characters)"})
+		return
+	}
+	if err := input.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var count int64
+	db.Unscoped().Model(&Coupon{}).Where("code = ?", input.Code).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A coupon with this code already exists"})
+		return
+	}
+
+	coupon := Coupon{Code: input.Code}
+	input.applyTo(&coupon)
+
+	if err := db.Create(&coupon).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create coupon"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Coupon created",
+		"coupon":  coupon,
+	})
+}
+
+// Admin: update a coupon. The code can't change; payments already started keep their price.
+func updateCouponHandler(c *gin.Context) {
+	couponID, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+
+	var coupon Coupon
+	if err := db.First(&coupon, couponID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Coupon not found"})
+		return
+	}
+
+	var input CouponInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if err := input.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	input.applyTo(&coupon)
+	if err := db.Save(&coupon).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update coupon"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Coupon updated",
+		"coupon":  coupon,
+	})
+}
+
+// Admin: delete a coupon. Redemptions and payments keep referring to it.
+func deleteCouponHandler(c *gin.Context) {
+	result := db.Delete(&Coupon{}, c.Param("id"))
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Coupon not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Coupon deleted"})
+}
+
+// CouponReportRow is one coupon's redemption totals
+type CouponReportRow struct {
+	CouponID      uint    `json:"coupon_id"`
+	Code          string  `json:"code"`
+	Redemptions   int64   `json:"redemptions"`
+	UniqueUsers   int64   `json:"unique_users"`
+	TotalDiscount float64 `json:"total_discount"`
+	TotalRevenue  float64 `json:"total_revenue"`
+}
+
+// Admin: redemptions per coupon, optionally between ?from= and ?to= (YYYY-MM-DD)
+func couponReportHandler(c *gin.Context) {
+	query := db.Table("coupon_redemptions").
+		Select("coupon_redemptions.coupon_id, coupons.code, COUNT(*) AS redemptions, " +
+			"COUNT(DISTINCT coupon_redemptions.user_id) AS unique_users, " +
+			"SUM(coupon_redemptions.discount_amount) AS total_discount, SUM(coupon_redemptions.amount_paid) AS total_revenue").
+		Joins("JOIN coupons ON coupons.id = coupon_redemptions.coupon_id").
+		Where("coupon_redemptions.deleted_at IS NULL").
+		Group("coupon_redemptions.coupon_id, coupons.code").
+		Order("redemptions DESC")
+
+	if from, err := time.ParseInLocation("2006-01-02", c.Query("from"), nepalTime); err == nil {
+		query = query.Where("coupon_redemptions.created_at >= ?", from)
+	}
+	if to, err := time.ParseInLocation("2006-01-02", c.Query("to"), nepalTime); err == nil {
+		query = query.Where("coupon_redemptions.created_at < ?", to.AddDate(0, 0, 1))
+	}
+
+	rows := []CouponReportRow{}
+	query.Scan(&rows)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":   len(rows),
+		"coupons": rows,
+	})
+}
+
+// Admin: individual redemptions of one coupon
+func couponRedemptionsHandler(c *gin.Context) {
+	var redemptions []CouponRedemption
+	db.Where("coupon_id = ?", c.Param("id")).Order("created_at DESC").Limit(500).Find(&redemptions)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":       len(redemptions),
+		"redemptions": redemptions,
+	})
+}
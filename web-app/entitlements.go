@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Entitlements answer "can this user do X" from their current subscription.
+// Every paid feature goes through here so limits are enforced and reported
+// the same way everywhere.
+
+// Entitlement actions
+const (
+	entitlementAddProfile      = "add_profile"
+	entitlementApply           = "apply"
+	entitlementStartMonitoring = "start_monitoring"
+)
+
+// Limit names reported to clients
+const (
+	limitSubscription       = "subscription"
+	limitMaxProfiles        = "max_profiles"
+	limitMaxApplications    = "max_applications"
+	limitMaxMonitors        = "max_monitoring_sessions"
+	limitMinMonitorInterval = "min_monitor_interval"
+)
+
+const unlimited = -1 // Limit value meaning no cap
+
+// EntitlementError says which limit blocked an action
+type EntitlementError struct {
+	Limit   string
+	Max     int
+	Used    int64
+	Message string
+}
+
+func (e *EntitlementError) Error() string {
+	return fmt.Sprintf("entitlement %s: %s", e.Limit, e.Message)
+}
+
+// Entitlements is a user's plan plus current usage
+type Entitlements struct {
+	Subscription           *Subscription
+	Profiles               int64
+	ApplicationsThisPeriod int64 // Since the current paid period started
+	ActiveMonitors         int64
+}
+
+// Start of the billing period covering now, which resets the application
+// allowance: the completed payment whose period contains now, so an early
+// renewal starts counting afresh when the new period begins. Days past the last
+// paid period (referral credit) count as a period of their own. Trials, grants
+// and payments without a recorded period fall back to the subscription start.
+func currentPeriodStart(sub *Subscription, now time.Time) time.Time {
+	start := sub.StartDate
+
+	var txn PaymentTransaction
+	if db.Where("subscription_id = ? AND status = ? AND period_start <= ? AND period_end > ?", sub.ID, PaymentCompleted, now, now).
+		Order("period_start DESC").First(&txn).Error == nil {
+		if txn.PeriodStart.After(start) {
+			start = *txn.PeriodStart
+		}
+		return start
+	}
+
+	if db.Where("subscription_id = ? AND status = ? AND period_end <= ?", sub.ID, PaymentCompleted, now).
+		Order("period_end DESC").First(&txn).Error == nil && txn.PeriodEnd.After(start) {
+		start = *txn.PeriodEnd
+	}
+	return start
+}
+
+// Load the user's plan and usage. Returns an EntitlementError without a subscription.
+func loadEntitlements(userID uint) (*Entitlements, error) {
+	subscription, err := getCurrentSubscription(userID)
+	if err != nil {
+		return nil, &EntitlementError{
+			Limit:   limitSubscription,
+			Message: "No active subscription. Subscribe to use this feature.",
+		}
+	}
+
+	e := &Entitlements{Subscription: subscription}
+	db.Model(&Profile{}).Where("user_id = ?", userID).Count(&e.Profiles)
+	db.Model(&IPOApplication{}).
+		Where("user_id = ? AND applied_at >= ?", userID, currentPeriodStart(subscription, time.Now())).
+		Count(&e.ApplicationsThisPeriod)
+	db.Model(&MonitoringSession{}).Where("user_id = ? AND is_active = ?", userID, true).Count(&e.ActiveMonitors)
+	return e, nil
+}
+
+func withinLimit(used int64, max int) bool {
+	return max == unlimited || used < int64(max)
+}
+
+// Can the user add another MeroShare profile?
+func (e *Entitlements) CanAddProfile() error {
+	max := e.Subscription.MaxProfiles
+	if !withinLimit(e.Profiles, max) {
+		return &EntitlementError{
+			Limit:   limitMaxProfiles,
+			Max:     max,
+			Used:    e.Profiles,
+			Message: fmt.Sprintf("Profile limit reached (%d of %d). Upgrade your plan.", e.Profiles, max),
+		}
+	}
+	return nil
+}
+
+// Can the user submit another application this period?
+func (e *Entitlements) CanApply() error {
+	max := e.Subscription.MaxApplications
+	if !withinLimit(e.ApplicationsThisPeriod, max) {
+		return &EntitlementError{
+			Limit:   limitMaxApplications,
+			Max:     max,
+			Used:    e.ApplicationsThisPeriod,
+			Message: fmt.Sprintf("Application limit reached (%d of %d this period). Upgrade your plan.", e.ApplicationsThisPeriod, max),
+		}
+	}
+	return nil
+}
+
+// Can the user start another monitoring session with this interval (seconds)?
+// One session per profile, so the profile limit also caps concurrent sessions.
+func (e *Entitlements) CanStartMonitoring(interval int) error {
+	max := e.Subscription.MaxProfiles
+	if !withinLimit(e.ActiveMonitors, max) {
+		return &EntitlementError{
+			Limit:   limitMaxMonitors,
+			Max:     max,
+			Used:    e.ActiveMonitors,
+			Message: fmt.Sprintf("Monitoring session limit reached (%d of %d). Stop a session or upgrade your plan.", e.ActiveMonitors, max),
+		}
+	}
+	return e.CanUseMonitorInterval(interval)
+}
+
+// Is the monitor interval (seconds) allowed on this plan?
+func (e *Entitlements) CanUseMonitorInterval(interval int) error {
+	min := e.Subscription.MinMonitorInterval
+	if interval < min {
+		return &EntitlementError{
+			Limit:   limitMinMonitorInterval,
+			Max:     min,
+			Message: fmt.Sprintf("Your plan allows a monitor interval of %d seconds or more.", min),
+		}
+	}
+	return nil
+}
+
+// Check an action for a user. Monitoring is checked at the plan's minimum interval;
+// handlers that know the requested interval use CanStartMonitoring directly.
+func checkEntitlement(userID uint, action string) error {
+	e, err := loadEntitlements(userID)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case entitlementAddProfile:
+		return e.CanAddProfile()
+	case entitlementApply:
+		return e.CanApply()
+	case entitlementStartMonitoring:
+		return e.CanStartMonitoring(e.Subscription.MinMonitorInterval)
+	}
+	return fmt.Errorf("unknown entitlement action %q", action)
+}
+
+// Write the error response for a failed entitlement check
+func respondEntitlementError(c *gin.Context, err error) {
+	var entErr *EntitlementError
+	if !errors.As(err, &entErr) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check plan limits"})
+		return
+	}
+
+	body := gin.H{
+		"error": entErr.Message,
+		"limit": entErr.Limit,
+	}
+	if entErr.Limit != limitSubscription {
+		body["max"] = entErr.Max
+	}
+	if entErr.Limit != limitSubscription && entErr.Limit != limitMinMonitorInterval {
+		body["used"] = entErr.Used
+	}
+	c.JSON(http.StatusForbidden, body)
+}
+
+// Entitlement middleware for count-based actions
+func requireEntitlement(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := checkEntitlement(c.GetUint("userID"), action); err != nil {
+			respondEntitlementError(c, err)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// Current plan limits and usage for the signed-in user
+func entitlementsHandler(c *gin.Context) {
+	e, err := loadEntitlements(c.GetUint("userID"))
+	if err != nil {
+		respondEntitlementError(c, err)
+		return
+	}
+
+	sub := e.Subscription
+	c.JSON(http.StatusOK, gin.H{
+		"plan":       sub.PlanType,
+		"status":     sub.Status,
+		"period_end": sub.EndDate,
+		"limits": gin.H{
+			limitMaxProfiles:        sub.MaxProfiles,
+			limitMaxApplications:    sub.MaxApplications,
+			limitMaxMonitors:        sub.MaxProfiles,
+			limitMinMonitorInterval: sub.MinMonitorInterval,
+		},
+		"usage": gin.H{
+			limitMaxProfiles:     e.Profiles,
+			limitMaxApplications: e.ApplicationsThisPeriod,
+			limitMaxMonitors:     e.ActiveMonitors,
+		},
+		"can": gin.H{
+			entitlementAddProfile:      e.CanAddProfile() == nil,
+			entitlementApply:           e.CanApply() == nil,
+			entitlementStartMonitoring: e.CanStartMonitoring(sub.MinMonitorInterval) == nil,
+		},
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Complete a payment as if the gateway confirmed it
+func payForPlan(t *testing.T, user *User, plan *Plan, renew *Subscription) *PaymentTransaction {
+	t.Helper()
+
+	txn, err := createPaymentTransaction(user.ID, plan, "khalti", renew, "")
+	if err != nil {
+		t.Fatalf("creating payment: %v", err)
+	}
+	txn, _, err = completePaymentTransaction(txn.Reference, "test-"+txn.Reference, txn.Amount, "")
+	if err != nil {
+		t.Fatalf("completing payment: %v", err)
+	}
+	return txn
+}
+
+func recordApplication(t *testing.T, user *User, at time.Time) {
+	t.Helper()
+
+	application := IPOApplication{
+		UserID:         user.ID,
+		ProfileID:      1,
+		IPOSourceID:    1,
+		CompanyName:    "Test Hydropower",
+		CompanyShareID: "1",
+		KittasApplied:  10,
+		BankID:         1,
+		Status:         "success",
+		AppliedAt:      at,
+	}
+	if err := db.Create(&application).Error; err != nil {
+		t.Fatalf("recording application: %v", err)
+	}
+}
+
+func TestEarlyRenewalResetsApplicationAllowance(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "renew@example.com")
+	plan := getTestPlan(t, "premium")
+
+	first := payForPlan(t, user, plan, nil)
+	sub, err := getCurrentSubscription(user.ID)
+	if err != nil {
+		t.Fatalf("loading subscription: %v", err)
+	}
+	recordApplication(t, user, time.Now())
+
+	// Renew well before the first period ends: the new period starts where it ends
+	second := payForPlan(t, user, plan, sub)
+	if !second.PeriodStart.Equal(*first.PeriodEnd) {
+		t.Fatalf("renewal period starts %v, want %v", second.PeriodStart, first.PeriodEnd)
+	}
+
+	e, err := loadEntitlements(user.ID)
+	if err != nil {
+		t.Fatalf("loading entitlements: %v", err)
+	}
+	if e.ApplicationsThisPeriod != 1 {
+		t.Fatalf("applications in the first period = %d, want 1", e.ApplicationsThisPeriod)
+	}
+
+	inSecond := first.PeriodEnd.Add(time.Hour)
+	if got := currentPeriodStart(e.Subscription, inSecond); !got.Equal(*second.PeriodStart) {
+		t.Fatalf("period start during the renewal = %v, want %v", got, second.PeriodStart)
+	}
+	if got := currentPeriodStart(e.Subscription, time.Now()); !got.Equal(*first.PeriodStart) {
+		t.Fatalf("period start now = %v, want %v", got, first.PeriodStart)
+	}
+
+	// Past every paid period, e.g. on referral credit days, counting starts afresh
+	afterAll := second.PeriodEnd.Add(time.Hour)
+	if got := currentPeriodStart(e.Subscription, afterAll); !got.Equal(*second.PeriodEnd) {
+		t.Fatalf("period start after the last paid period = %v, want %v", got, second.PeriodEnd)
+	}
+}
+
+func TestRenewalRecordsItsPrice(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "price@example.com")
+	plan := getTestPlan(t, "premium")
+
+	payForPlan(t, user, plan, nil)
+	sub, _ := getCurrentSubscription(user.ID)
+
+	// The plan's price went up before the renewal
+	db.Model(plan).Update("price", plan.Price+500)
+	plan = getTestPlan(t, "premium")
+	renewal := payForPlan(t, user, plan, sub)
+
+	sub, _ = getCurrentSubscription(user.ID)
+	if sub.Price != renewal.Amount {
+		t.Fatalf("subscription price after renewal = %.2f, want %.2f", sub.Price, renewal.Amount)
+	}
+}
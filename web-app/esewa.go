@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// eSewa ePay v2. The browser POSTs a signed form to eSewa, eSewa redirects back
+// to success_url with a signed base64 "data" payload, and the payment is only
+// completed after the status API confirms it server-side.
+
+// eSewa endpoints per ESEWA_ENV
+const (
+	esewaTestFormURL   = "https://rc-epay.esewa.com.np/api/epay/main/v2/form"
+	esewaTestStatusURL = "https://rc.esewa.com.np/api/epay/transaction/status/"
+	esewaLiveFormURL   = "https://epay.esewa.com.np/api/epay/main/v2/form"
+	esewaLiveStatusURL = "https://epay.esewa.com.np/api/epay/transaction/status/"
+	esewaFakePath      = "/_fake/esewa" // Local fake server, see esewa_fake.go
+)
+
+// eSewa transaction statuses
+const (
+	esewaStatusComplete = "COMPLETE"
+	esewaStatusPending  = "PENDING"
+	esewaStatusNotFound = "NOT_FOUND"
+	esewaStatusCanceled = "CANCELED"
+)
+
+const esewaRequestSignedFields = "total_amount,transaction_uuid,product_code"
+
+var (
+	errEsewaBadPayload   = errors.New("esewa: malformed callback payload")
+	errEsewaBadSignature = errors.New("esewa: signature mismatch")
+)
+
+// Form and status URLs for ESEWA_ENV: "live", "fake", or anything else for eSewa's UAT
+func esewaEndpoints(env string) (formURL, statusURL string) {
+	switch env {
+	case "live":
+		return esewaLiveFormURL, esewaLiveStatusURL
+	case "fake":
+		base := getBaseURL() + esewaFakePath
+		return base + "/api/epay/main/v2/form", base + "/api/epay/transaction/status/"
+	}
+	return esewaTestFormURL, esewaTestStatusURL
+}
+
+// Base64 HMAC-SHA256 over "name=value,..." for the names in signedFieldNames
+func esewaSignature(secret string, fields map[string]string, signedFieldNames string) string {
+	names := strings.Split(signedFieldNames, ",")
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+"="+fields[name])
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(parts, ",")))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Check a signature in constant time
+func verifyEsewaSignature(secret string, fields map[string]string) bool {
+	expected := esewaSignature(secret, fields, fields["signed_field_names"])
+	return hmac.Equal([]byte(expected), []byte(fields["signature"]))
+}
+
+// Amount as sent to gateways: "1999", "1999.5"
+func formatGatewayAmount(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', -1, 64)
+}
+
+// Parse an eSewa amount, which may come back as 1999, 1999.0 or "1,999.0"
+func parseEsewaAmount(value string) (float64, error) {
+	return strconv.ParseFloat(strings.ReplaceAll(value, ",", ""), 64)
+}
+
+// Signed form fields for a pending transaction
+func esewaPaymentForm(config NepalPaymentConfig, txn *PaymentTransaction) (string, map[string]string) {
+	amount := formatGatewayAmount(txn.Amount)
+	fields := map[string]string{
+		"amount":                  amount,
+		"tax_amount":              "0",
+		"product_service_charge":  "0",
+		"product_delivery_charge": "0",
+		"total_amount":            amount,
+		"transaction_uuid":        txn.Reference,
+		"product_code":            config.EsewaProductCode,
+		"success_url":             getBaseURL() + "/payment/esewa/success",
+		"failure_url":             getBaseURL() + "/payment/esewa/failure?reference=" + url.QueryEscape(txn.Reference),
+		"signed_field_names":      esewaRequestSignedFields,
+	}
+	fields["signature"] = esewaSignature(config.EsewaSecret, fields, esewaRequestSignedFields)
+	return config.EsewaFormURL, fields
+}
+
+// Decode and verify the base64 "data" parameter eSewa sends to success_url
+func decodeEsewaCallback(config NepalPaymentConfig, data string) (map[string]string, error) {
+	if config.EsewaSecret == "" {
+		return nil, errEsewaBadSignature // Anyone could sign with an empty key
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		if raw, err = base64.URLEncoding.DecodeString(data); err != nil {
+			return nil, errEsewaBadPayload
+		}
+	}
+
+	// Keep numbers as written (e.g. 1999.0): the signature covers their text
+	decoder := json.NewDecoder(strings.NewReader(string(raw)))
+	decoder.UseNumber()
+	var payload map[string]interface{}
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, errEsewaBadPayload
+	}
+
+	fields := make(map[string]string, len(payload))
+	for key, value := range payload {
+		fields[key] = fmt.Sprint(value)
+	}
+
+	signed := "," + fields["signed_field_names"] + ","
+	for _, required := range []string{"transaction_uuid", "total_amount", "status", "product_code"} {
+		if !strings.Contains(signed, ","+required+",") {
+			return nil, errEsewaBadPayload
+		}
+	}
+	if !verifyEsewaSignature(config.EsewaSecret, fields) {
+		return nil, errEsewaBadSignature
+	}
+	if fields["product_code"] != config.EsewaProductCode {
+		return nil, errEsewaBadPayload
+	}
+	return fields, nil
+}
+
+// EsewaStatus is the status API response
+type EsewaStatus struct {
+	ProductCode     string      `json:"product_code"`
+	TransactionUUID string      `json:"transaction_uuid"`
+	TotalAmount     interface{} `json:"total_amount"` // Number or formatted string
+	Status          string      `json:"status"`
+	RefID           string      `json:"ref_id"`
+}
+
+// Ask eSewa for the state of a transaction
+func checkEsewaStatus(config NepalPaymentConfig, txn *PaymentTransaction) (*EsewaStatus, []byte, error) {
+	query := url.Values{}
+	query.Set("product_code", config.EsewaProductCode)
+	query.Set("total_amount", formatGatewayAmount(txn.Amount))
+	query.Set("transaction_uuid", txn.Reference)
+
+	resp, err := paymentHTTPClient.Get(config.EsewaStatusURL + "?" + query.Encode())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, raw, fmt.Errorf("esewa status check: HTTP %d", resp.StatusCode)
+	}
+
+	var status EsewaStatus
+	if err := json.Unmarshal(raw, &status); err != nil {
+		return nil, raw, fmt.Errorf("esewa status check: %w", err)
+	}
+	if status.TransactionUUID != txn.Reference {
+		return nil, raw, errors.New("esewa status check: transaction mismatch")
+	}
+	return &status, raw, nil
+}
+
+// Confirm a transaction with the status API and complete or fail it in the ledger
+func verifyEsewaPayment(config NepalPaymentConfig, txn *PaymentTransaction) (string, error) {
+	status, raw, err := checkEsewaStatus(config, txn)
+	if err != nil {
+		return "", err
+	}
+
+	switch status.Status {
+	case esewaStatusComplete:
+		amount, err := parseEsewaAmount(fmt.Sprint(status.TotalAmount))
+		if err != nil {
+			return "", errEsewaBadPayload
+		}
+		if _, _, err = completePaymentTransaction(txn.Reference, status.RefID, amount, string(raw)); err != nil {
+			return "", err
+		}
+		return PaymentCompleted, nil
+	case esewaStatusCanceled, esewaStatusNotFound:
+		failPaymentTransaction(txn.Reference, "esewa: "+status.Status, string(raw))
+		return PaymentFailed, nil
+	}
+	return PaymentPending, nil
+}
+
+// esewaGateway is eSewa ePay v2 behind the PaymentGateway interface
+type esewaGateway struct{}
+
+func (esewaGateway) Name() string { return "esewa" }
+
+func (esewaGateway) Enabled() bool { return getNepalPaymentConfig().EsewaEnabled }
+
+// eSewa v2 takes a form POST; the checkout page auto-submits it
+func (esewaGateway) Initiate(txn *PaymentTransaction, plan *Plan, user *User) (*PaymentInitiation, error) {
+	formURL, fields := esewaPaymentForm(getNepalPaymentConfig(), txn)
+	return &PaymentInitiation{Method: paymentMethodForm, URL: formURL, Fields: fields}, nil
+}
+
+// success_url carries a signed base64 "data" payload; failure_url only our
+// ?reference=, which is enough since Verify asks the status API either way
+func (esewaGateway) HandleCallback(c *gin.Context) (*PaymentTransaction, error) {
+	reference := c.Query("reference")
+	if data := c.Query("data"); data != "" {
+		fields, err := decodeEsewaCallback(getNepalPaymentConfig(), data)
+		if err != nil {
+			return nil, err
+		}
+		reference = fields["transaction_uuid"]
+	}
+
+	txn, err := getPaymentTransaction(reference)
+	if err != nil || txn.Gateway != "esewa" {
+		return nil, errPaymentNotFound
+	}
+	return txn, nil
+}
+
+// eSewa notifies with the same signed base64 "data" payload it sends to
+// success_url, as a form field or JSON
+func (esewaGateway) ParseNotification(body []byte) (*PaymentNotification, error) {
+	var payload struct {
+		Data string `json:"data"`
+	}
+	if json.Unmarshal(body, &payload) != nil || payload.Data == "" {
+		form, _ := url.ParseQuery(string(body))
+		payload.Data = form.Get("data")
+	}
+
+	fields, err := decodeEsewaCallback(getNepalPaymentConfig(), payload.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &PaymentNotification{
+		EventID:   fields["transaction_uuid"] + ":" + fields["status"],
+		Type:      fields["status"],
+		Reference: fields["transaction_uuid"],
+		Signature: fields["signature"],
+	}, nil
+}
+
+func (esewaGateway) Verify(txn *PaymentTransaction) (string, error) {
+	return verifyEsewaPayment(getNepalPaymentConfig(), txn)
+}
+
+// ePay v2 has no merchant refund API
+func (esewaGateway) Refund(txn *PaymentTransaction, amount float64, reason string) error {
+	return errRefundUnsupported
+}
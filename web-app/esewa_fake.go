@@ -0,0 +1,172 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Local fake of eSewa ePay v2 for development and integration testing.
+// Enabled with ESEWA_ENV=fake, which also points the eSewa config at it.
+// It checks request signatures, shows a pay/cancel page, signs callbacks with
+// the same secret and answers status checks - never enable it in production.
+
+type fakeEsewaTxn struct {
+	TotalAmount string
+	SuccessURL  string
+	FailureURL  string
+	Status      string
+	RefID       string
+}
+
+type fakeEsewa struct {
+	mu   sync.Mutex
+	txns map[string]*fakeEsewaTxn
+}
+
+// Mount the fake under esewaFakePath
+func mountFakeEsewa(r *gin.Engine) {
+	fake := &fakeEsewa{txns: make(map[string]*fakeEsewaTxn)}
+
+	group := r.Group(esewaFakePath)
+	group.POST("/api/epay/main/v2/form", fake.formHandler)
+	group.POST("/pay", fake.payHandler)
+	group.GET("/api/epay/transaction/status/", fake.statusHandler)
+}
+
+// Payment form target: verify the merchant signature, then ask the "customer"
+func (f *fakeEsewa) formHandler(c *gin.Context) {
+	config := getNepalPaymentConfig()
+	c.Request.ParseForm()
+
+	fields := make(map[string]string)
+	for key := range c.Request.PostForm {
+		fields[key] = c.Request.PostForm.Get(key)
+	}
+	if fields["signed_field_names"] == "" || !verifyEsewaSignature(config.EsewaSecret, fields) {
+		c.String(http.StatusBadRequest, "fake esewa: invalid signature")
+		return
+	}
+	if fields["product_code"] != config.EsewaProductCode {
+		c.String(http.StatusBadRequest, "fake esewa: unknown product_code")
+		return
+	}
+
+	uuid := fields["transaction_uuid"]
+	f.mu.Lock()
+	f.txns[uuid] = &fakeEsewaTxn{
+		TotalAmount: fields["total_amount"],
+		SuccessURL:  fields["success_url"],
+		FailureURL:  fields["failure_url"],
+		Status:      esewaStatusPending,
+	}
+	f.mu.Unlock()
+
+	page := `<!DOCTYPE html><html><body style="font-family:sans-serif;text-align:center;margin-top:80px">
+<h2>Fake eSewa</h2><p>Pay NPR %s for %s?</p>
+<form method="POST" action="%s/pay">
+<input type="hidden" name="transaction_uuid" value="%s">
+<button name="decision" value="pay">Pay</button> <button name="decision" value="cancel">Cancel</button>
+</form></body></html>`
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(fmt.Sprintf(page,
+		html.EscapeString(fields["total_amount"]), html.EscapeString(uuid),
+		esewaFakePath, html.EscapeString(uuid))))
+}
+
+// Customer decision: redirect to success_url with a signed payload, or to failure_url
+func (f *fakeEsewa) payHandler(c *gin.Context) {
+	config := getNepalPaymentConfig()
+	uuid := c.PostForm("transaction_uuid")
+
+	f.mu.Lock()
+	stored, ok := f.txns[uuid]
+	var txn fakeEsewaTxn
+	if ok {
+		if stored.Status == esewaStatusPending {
+			if c.PostForm("decision") == "pay" {
+				raw := make([]byte, 4)
+				crand.Read(raw)
+				stored.Status = esewaStatusComplete
+				stored.RefID = "FAKE" + strings.ToUpper(hex.EncodeToString(raw))
+			} else {
+				stored.Status = esewaStatusCanceled
+			}
+		}
+		txn = *stored
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		c.String(http.StatusNotFound, "fake esewa: unknown transaction")
+		return
+	}
+	if txn.Status != esewaStatusComplete {
+		c.Redirect(http.StatusFound, txn.FailureURL)
+		return
+	}
+
+	fields := map[string]string{
+		"transaction_code":   txn.RefID,
+		"status":             esewaStatusComplete,
+		"total_amount":       txn.TotalAmount,
+		"transaction_uuid":   uuid,
+		"product_code":       config.EsewaProductCode,
+		"signed_field_names": "transaction_code,status,total_amount,transaction_uuid,product_code,signed_field_names",
+	}
+	fields["signature"] = esewaSignature(config.EsewaSecret, fields, fields["signed_field_names"])
+
+	// Like eSewa, send total_amount as a JSON number
+	payload := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		payload[key] = value
+	}
+	payload["total_amount"] = json.Number(txn.TotalAmount)
+	data, _ := json.Marshal(payload)
+
+	c.Redirect(http.StatusFound, txn.SuccessURL+"?data="+url.QueryEscape(base64.StdEncoding.EncodeToString(data)))
+}
+
+// Status API
+func (f *fakeEsewa) statusHandler(c *gin.Context) {
+	uuid := c.Query("transaction_uuid")
+
+	f.mu.Lock()
+	txn, ok := f.txns[uuid]
+	var status fakeEsewaTxn
+	if ok {
+		status = *txn
+	}
+	f.mu.Unlock()
+
+	amount := c.Query("total_amount")
+	if _, err := strconv.ParseFloat(amount, 64); err != nil {
+		amount = "0"
+	}
+
+	response := gin.H{
+		"product_code":     c.Query("product_code"),
+		"transaction_uuid": uuid,
+		"total_amount":     json.Number(amount),
+		"status":           esewaStatusNotFound,
+		"ref_id":           nil,
+	}
+	if ok && status.TotalAmount == amount &&
+		c.Query("product_code") == getNepalPaymentConfig().EsewaProductCode {
+		response["status"] = status.Status
+		if status.RefID != "" {
+			response["ref_id"] = status.RefID
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// eSewa payment flow against the local fake (esewa_fake.go)
+
+type esewaTest struct {
+	user *User
+	plan *Plan
+}
+
+func setupEsewaTest(t *testing.T) *esewaTest {
+	t.Helper()
+
+	setupTestDB(t)
+	t.Setenv("ESEWA_ENV", "fake")
+	t.Setenv("ESEWA_MERCHANT_CODE", "")
+	t.Setenv("ESEWA_SECRET", "")
+	registerPaymentGateways()
+
+	r := gin.New()
+	mountFakeEsewa(r)
+	r.GET("/payment/esewa/success", paymentCallbackHandler("esewa"))
+	r.GET("/payment/esewa/failure", paymentCallbackHandler("esewa"))
+	startTestServer(t, r)
+
+	return &esewaTest{
+		user: createTestUser(t, "esewa@example.com"),
+		plan: getTestPlan(t, "premium"),
+	}
+}
+
+// Create a pending payment and post its signed form to the fake
+func (e *esewaTest) start(t *testing.T) *PaymentTransaction {
+	t.Helper()
+
+	txn, err := createPaymentTransaction(e.user.ID, e.plan, "esewa", nil, "")
+	if err != nil {
+		t.Fatalf("creating payment: %v", err)
+	}
+	formURL, fields := esewaPaymentForm(getNepalPaymentConfig(), txn)
+
+	form := url.Values{}
+	for key, value := range fields {
+		form.Set(key, value)
+	}
+	resp, err := http.PostForm(formURL, form)
+	if err != nil {
+		t.Fatalf("posting payment form: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("fake eSewa rejected the payment form: %d", resp.StatusCode)
+	}
+	return txn
+}
+
+// Customer decision on the fake's page; returns the URL it sends the browser back to
+func (e *esewaTest) decide(t *testing.T, txn *PaymentTransaction, decision string) string {
+	t.Helper()
+
+	resp, err := noRedirectClient.PostForm(getBaseURL()+esewaFakePath+"/pay", url.Values{
+		"transaction_uuid": {txn.Reference},
+		"decision":         {decision},
+	})
+	if err != nil {
+		t.Fatalf("paying: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("pay page answered %d, want a redirect", resp.StatusCode)
+	}
+	return resp.Header.Get("Location")
+}
+
+// Follow a return URL into our callback handler; returns where it redirects
+func (e *esewaTest) returnTo(t *testing.T, returnURL string) string {
+	t.Helper()
+
+	resp, err := noRedirectClient.Get(returnURL)
+	if err != nil {
+		t.Fatalf("calling return URL: %v", err)
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Location")
+}
+
+// Signed success payload for a payment, as eSewa would send it
+func signedEsewaFields(config NepalPaymentConfig, reference, amount string) map[string]string {
+	fields := map[string]string{
+		"transaction_code":   "0007ABC",
+		"status":             esewaStatusComplete,
+		"total_amount":       amount,
+		"transaction_uuid":   reference,
+		"product_code":       config.EsewaProductCode,
+		"signed_field_names": "transaction_code,status,total_amount,transaction_uuid,product_code,signed_field_names",
+	}
+	fields["signature"] = esewaSignature(config.EsewaSecret, fields, fields["signed_field_names"])
+	return fields
+}
+
+func TestEsewaSignature(t *testing.T) {
+	fields := map[string]string{"total_amount": "100", "transaction_uuid": "11-201-13", "product_code": "EPAYTEST", "ignored": "x"}
+
+	// eSewa signs "name=value" pairs joined by commas, in signed_field_names order
+	mac := hmac.New(sha256.New, []byte(esewaUATSecret))
+	mac.Write([]byte("total_amount=100,transaction_uuid=11-201-13,product_code=EPAYTEST"))
+	want := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	if got := esewaSignature(esewaUATSecret, fields, esewaRequestSignedFields); got != want {
+		t.Fatalf("signature = %s, want %s", got, want)
+	}
+	if esewaSignature("another-secret", fields, esewaRequestSignedFields) == want {
+		t.Fatal("signature doesn't depend on the secret")
+	}
+}
+
+func TestDecodeEsewaCallback(t *testing.T) {
+	t.Setenv("ESEWA_ENV", "")
+	t.Setenv("ESEWA_MERCHANT_CODE", "")
+	t.Setenv("ESEWA_SECRET", "")
+	config := getNepalPaymentConfig()
+
+	valid := signedEsewaFields(config, "IPO-1", "1999.0")
+
+	// URL-safe base64 of a payload whose standard encoding has '+' or '/'
+	var urlSafe string
+	for i := 0; urlSafe == ""; i++ {
+		fields := signedEsewaFields(config, "IPO-"+strings.Repeat("?", i), "1999.0")
+		if std := encodeEsewaData(t, fields); strings.ContainsAny(std, "+/") {
+			urlSafe = strings.NewReplacer("+", "-", "/", "_").Replace(std)
+		}
+	}
+
+	tampered := signedEsewaFields(config, "IPO-1", "1999.0")
+	tampered["total_amount"] = "1.0"
+
+	unsignedStatus := signedEsewaFields(config, "IPO-1", "1999.0")
+	unsignedStatus["signed_field_names"] = "transaction_code,total_amount,transaction_uuid,product_code,signed_field_names"
+	unsignedStatus["signature"] = esewaSignature(config.EsewaSecret, unsignedStatus, unsignedStatus["signed_field_names"])
+
+	otherMerchant := signedEsewaFields(config, "IPO-1", "1999.0")
+	otherMerchant["product_code"] = "OTHER"
+	otherMerchant["signature"] = esewaSignature(config.EsewaSecret, otherMerchant, otherMerchant["signed_field_names"])
+
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"valid", encodeEsewaData(t, valid), nil},
+		{"url-safe base64", urlSafe, nil},
+		{"not base64", "%%%", errEsewaBadPayload},
+		{"not json", base64.StdEncoding.EncodeToString([]byte("status=COMPLETE")), errEsewaBadPayload},
+		{"tampered amount", encodeEsewaData(t, tampered), errEsewaBadSignature},
+		{"status not signed", encodeEsewaData(t, unsignedStatus), errEsewaBadPayload},
+		{"other product code", encodeEsewaData(t, otherMerchant), errEsewaBadPayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := decodeEsewaCallback(config, tt.data)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error = %v, want %v", err, tt.err)
+			}
+			if err == nil && (fields["status"] != esewaStatusComplete || !strings.HasPrefix(fields["transaction_uuid"], "IPO-")) {
+				t.Fatalf("decoded fields = %v", fields)
+			}
+		})
+	}
+}
+
+func TestEsewaPayAndComplete(t *testing.T) {
+	e := setupEsewaTest(t)
+	txn := e.start(t)
+
+	returnURL := e.decide(t, txn, "pay")
+	if !strings.Contains(returnURL, "/payment/esewa/success?data=") {
+		t.Fatalf("fake sent the browser to %q, want success_url with data", returnURL)
+	}
+	if location := e.returnTo(t, returnURL); !strings.HasPrefix(location, "/dashboard?payment=success") {
+		t.Fatalf("return handler redirected to %q, want the success page", location)
+	}
+
+	txn = reloadPayment(t, txn.Reference)
+	if txn.Status != PaymentCompleted || txn.GatewayRef == "" || txn.SubscriptionID == nil {
+		t.Fatalf("payment is %s (ref %q), want completed with eSewa's ref and a subscription", txn.Status, txn.GatewayRef)
+	}
+}
+
+func TestEsewaCancelFailsPayment(t *testing.T) {
+	e := setupEsewaTest(t)
+	txn := e.start(t)
+
+	returnURL := e.decide(t, txn, "cancel")
+	if location := e.returnTo(t, returnURL); !strings.HasPrefix(location, "/pricing?payment=failed") {
+		t.Fatalf("return handler redirected to %q, want the failure page", location)
+	}
+	if txn = reloadPayment(t, txn.Reference); txn.Status != PaymentFailed || txn.FailureReason != "esewa: "+esewaStatusCanceled {
+		t.Fatalf("payment is %s (%q), want failed as cancelled", txn.Status, txn.FailureReason)
+	}
+}
+
+func TestEsewaVerifyChecksStatusAndAmount(t *testing.T) {
+	e := setupEsewaTest(t)
+
+	// Form posted but not paid yet: eSewa still reports it pending
+	unpaid := e.start(t)
+	if status, err := verifyEsewaPayment(getNepalPaymentConfig(), unpaid); err != nil || status != PaymentPending {
+		t.Fatalf("verify before paying = %q, %v; want pending", status, err)
+	}
+
+	// The status API is asked for the ledger's amount and doesn't find a payment of another
+	txn := e.start(t)
+	e.decide(t, txn, "pay")
+	db.Model(&PaymentTransaction{}).Where("id = ?", txn.ID).Update("amount", txn.Amount+100)
+	if status, err := verifyEsewaPayment(getNepalPaymentConfig(), reloadPayment(t, txn.Reference)); err != nil || status != PaymentFailed {
+		t.Fatalf("verify for the wrong amount = %q, %v; want failed", status, err)
+	}
+	if txn = reloadPayment(t, txn.Reference); txn.Status != PaymentFailed || txn.FailureReason != "esewa: "+esewaStatusNotFound {
+		t.Fatalf("payment for the wrong amount is %s (%q), want failed as not found", txn.Status, txn.FailureReason)
+	}
+}
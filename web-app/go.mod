@@ -4,8 +4,10 @@ go 1.21
 
 require (
 	github.com/gin-gonic/gin v1.9.1
+	github.com/go-text/typesetting v0.2.1
 	github.com/golang-jwt/jwt/v5 v5.2.0
 	golang.org/x/crypto v0.17.0
+	golang.org/x/image v0.3.0
 	gorm.io/driver/sqlite v1.5.4
 	gorm.io/gorm v1.25.5
 )
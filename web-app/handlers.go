@@ -1,12 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 // Home page
@@ -47,33 +51,66 @@ func loginHandler(c *gin.Context) {
 		return
 	}
 
+	// Per-account bucket on top of the per-IP one, so spreading guesses across IPs doesn't help
+	if !allowRequest(c, "login:account:"+strings.ToLower(input.Email), loginAccountLimit) {
+		return
+	}
+
 	var user User
 	if err := db.Where("email = ?", input.Email).First(&user).Error; err != nil {
+		recordLoginAttempt(c, input.Email, nil, false, "unknown_user")
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
+	if isAccountLocked(&user) {
+		recordLoginAttempt(c, input.Email, &user, false, "locked")
+		respondAccountLocked(c, &user)
+		return
+	}
+
 	if !user.IsActive {
+		recordLoginAttempt(c, input.Email, &user, false, "inactive")
 		c.JSON(http.StatusForbidden, gin.H{"error": "Account is not active"})
 		return
 	}
 
 	if !checkPasswordHash(input.Password, user.Password) {
+		registerLoginFailure(c, &user, "bad_password")
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
+	// Second step required: hand out a short-lived challenge instead of a session
+	if user.TwoFactorEnabled {
+		challenge, err := generateActionToken(user.ID, twoFactorChallenge, "", twoFactorLoginTTL)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"two_factor_required": true,
+			"challenge_token":     challenge,
+		})
+		return
+	}
+
+	registerLoginSuccess(c, &user)
+	respondWithSession(c, &user, time.Time{})
+}
+
+// Issue a session token and the login payload (user + trial info)
+func respondWithSession(c *gin.Context, user *User, twoFactorAt time.Time) {
 	// Generate JWT token
-	token, err := generateJWT(user.ID, user.IsAdmin)
+	token, err := generateJWT(user, twoFactorAt)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
 	// Get subscription/trial info
-	var subscription Subscription
 	trialInfo := gin.H{}
-	if err := db.Where("user_id = ? AND status = ?", user.ID, "active").First(&subscription).Error; err == nil {
+	if subscription, err := getCurrentSubscription(user.ID); err == nil {
 		if subscription.IsTrial {
 			trialDaysRemaining := int(time.Until(*subscription.TrialEndDate).Hours() / 24)
 			if trialDaysRemaining < 0 {
@@ -93,6 +130,7 @@ func loginHandler(c *gin.Context) {
 			}
 			trialInfo = gin.H{
 				"status":          "paid",
+				"state":           subscription.Status,
 				"is_trial":        false,
 				"plan_type":       subscription.PlanType,
 				"days_remaining":  daysRemaining,
@@ -105,11 +143,15 @@ func loginHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"token": token,
 		"user": gin.H{
-			"id":      user.ID,
-			"email":   user.Email,
-			"name":    user.Name,
-			"isAdmin": user.IsAdmin,
-			"trial":   trialInfo,
+			"id":            user.ID,
+			"email":         user.Email,
+			"name":          user.Name,
+			"isAdmin":       user.IsAdmin,
+			"roles":         getUserRoles(user.ID),
+			"trial":         trialInfo,
+			"emailVerified": user.EmailVerified,
+			// Admins must enroll before /admin will let them in
+			"twoFactorSetupRequired": user.IsAdmin && !user.TwoFactorEnabled,
 		},
 	})
 }
@@ -125,6 +167,7 @@ func registerHandler(c *gin.Context) {
 		Email    string `json:"email" binding:"required,email"`
 		Password string `json:"password" binding:"required,min=6"`
 		Name     string `json:"name" binding:"required"`
+		Referral string `json:"referral_code"` // Optional, from a ?ref= link
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -146,12 +189,22 @@ func registerHandler(c *gin.Context) {
 		return
 	}
 
+	referralCode, err := newReferralCode()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+
 	// Create user
 	user := User{
-		Email:    input.Email,
-		Password: hashedPassword,
-		Name:     input.Name,
-		IsActive: true,
+		Email:          input.Email,
+		EmailCanonical: canonicalEmail(input.Email),
+		Password:       hashedPassword,
+		Name:           input.Name,
+		IsActive:       true,
+		ReferralCode:   referralCode,
+		SignupIP:       c.ClientIP(),
+		Language:       getUserLanguage(c.Request),
 	}
 
 	if err := db.Create(&user).Error; err != nil {
@@ -159,93 +212,103 @@ func registerHandler(c *gin.Context) {
 		return
 	}
 
-	// Auto-create 7-day free trial subscription
-	trialEndDate := time.Now().AddDate(0, 0, 7) // 7 days from now
-	subscription := Subscription{
-		UserID:          user.ID,
-		PlanType:        "trial",
-		Status:          "active",
-		IsTrial:         true,
-		TrialEndDate:    &trialEndDate,
-		StartDate:       time.Now(),
-		EndDate:         trialEndDate,
-		Price:           0,
-		PaymentMethod:   "free_trial",
-		MaxProfiles:     3,          // Generous limit for trial
-		MaxApplications: 999,        // Unlimited IPO applications for trial
-	}
+	recordReferral(&user, input.Referral)
 
-	if err := db.Create(&subscription).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create trial subscription"})
-		return
+	// The 7-day free trial starts once the email is verified (see verifyEmailHandler)
+	if err := sendVerificationEmail(&user); err != nil {
+		log.Printf("Failed to send verification email to user %d: %v\n", user.ID, err)
 	}
 
 	c.JSON(http.StatusCreated, gin.H{
-		"message": "Registration successful! You have 7 days free trial access.",
+		"message": "Registration successful! Check your email to verify your account and start your 7-day free trial.",
 		"user": gin.H{
-			"id":    user.ID,
-			"email": user.Email,
-			"name":  user.Name,
-			"trial": gin.H{
-				"status":      "active",
-				"days_remaining": 7,
-				"expires_at":   trialEndDate.Format("2006-01-02"),
-			},
+			"id":            user.ID,
+			"email":         user.Email,
+			"name":          user.Name,
+			"emailVerified": false,
 		},
 	})
 }
 
-// Pricing page - Dynamic Pricing with Future Roadmap
+// Pricing page - plans come from the catalog (plans.go)
 func pricingHandler(c *gin.Context) {
-	// 2026: PREMIUM-ONLY TIER - ₹1,999 for 3 months (50% discount from original ₹3,999)
-	premiumPrice := 1999
-	announcementBanner := "🎉 2026 LAUNCH YEAR SPECIAL! One Premium Plan - ₹1,999 for 3 months!"
-	
+	lang := getUserLanguage(c.Request)
+
+	plans := []gin.H{}
+	announcement := ""
+	catalog := listPricingPlans()
+	for _, plan := range catalog {
+		badge := ""
+		if plan.IsPopular {
+			badge = "Most Popular"
+			if lang == "nepali" {
+				badge = "लोकप्रिय"
+			}
+			if announcement == "" {
+				format := "🎉 %s - ₹%s for %s!"
+				if lang == "nepali" {
+					format = "🎉 %s - ₹%s (%s)!"
+				}
+				announcement = fmt.Sprintf(format, plan.LocalizedName(lang), formatNPR(plan.Price), plan.DurationLabel(lang))
+			}
+		}
+
+		plans = append(plans, gin.H{
+			"id":          plan.ID,
+			"code":        plan.Code,
+			"name":        plan.LocalizedName(lang),
+			"price":       formatNPR(plan.Price),
+			"priceUSD":    fmt.Sprintf("$%d", int(plan.Price)/75),
+			"duration":    plan.DurationLabel(lang),
+			"popular":     plan.IsPopular,
+			"badge":       badge,
+			"description": plan.LocalizedDescription(lang),
+			"features":    plan.FeatureList(lang),
+		})
+	}
+
 	c.HTML(http.StatusOK, "pricing.html", gin.H{
-		"year": 2026,
-		"currency": "NPR",
-		"announcement": announcementBanner,
+		"year":           time.Now().Year(),
+		"currency":       "NPR",
+		"announcement":   announcement,
+		"catalog":        pricingCatalogSummary(catalog, lang),
 		"paymentMethods": []string{"eSewa", "Khalti", "Bank Transfer"},
-		"plans": []gin.H{
-			{
-				"name":     "Premium",
-				"nameNepali": "प्रिमियम",
-				"price":    premiumPrice,
-				"priceUSD": fmt.Sprintf("$%d", premiumPrice/75),
-				"duration": "3 months",
-				"durationNepali": "3 महीना",
-				"popular":  true,
-				"badge":    "Only Plan",
-				"badgeNepali": "एकमात्र योजना",
-				"description": "Everything you need for IPO automation",
-				"descriptionNepali": "IPO स्वचालन के लिए आपको सभी कुछ",
-				"features": []string{
-					"✓ Unlimited MeroShare Accounts",
-					"✓ Unlimited IPO Applications",
-					"✓ Real-time IPO Notifications",
-					"✓ 24/7 Priority Email & Chat Support",
-					"✓ 2-minute Smart Monitoring",
-					"✓ Multi-Source IPO Tracking (All Exchanges)",
-					"✓ SMS Alerts for New IPOs",
-					"✓ Secure Credential Encryption",
-					"✓ Mobile-Friendly Dashboard",
-				},
-				"featuresNepali": []string{
-					"✓ असीमित MeroShare खाताहरू",
-					"✓ असीमित IPO आवेदनहरू",
-					"✓ रिअल-टाइम IPO सूचनाहरू",
-					"✓ 24/7 प्राथमिकता समर्थन",
-					"✓ 2-मिनेट स्मार्ट निगरानी",
-					"✓ बहु-स्रोत IPO ट्र्यैकिङ",
-					"✓ SMS अलर्ट",
-					"✓ सुरक्षित एन्क्रिप्शन",
-					"✓ मोबाइल-अनुकूल डैशबोर्ड",
-				},
-			},
-		},
+		"plans":          plans,
 	})
 }
 
+// Pricing page blurb describing the plan catalog (nil without plans)
+func pricingCatalogSummary(catalog []Plan, lang string) gin.H {
+	if len(catalog) == 0 {
+		return nil
+	}
+	if len(catalog) == 1 {
+		if lang == "nepali" {
+			return gin.H{"title": "किन एउटा मात्र योजना?", "summary": "पहिलो दिनदेखि नै सबै सुविधा", "note": "सबैका लागि पूर्ण सुविधा।"}
+		}
+		return gin.H{"title": "Why One Plan?", "summary": "Everything You Need from Day One", "note": "No compromises. Full features for everyone."}
+	}
+
+	cheapest := catalog[0]
+	for _, plan := range catalog[1:] {
+		if plan.Price < cheapest.Price {
+			cheapest = plan
+		}
+	}
+	if lang == "nepali" {
+		return gin.H{
+			"title":   fmt.Sprintf("%d योजनाहरू", len(catalog)),
+			"summary": fmt.Sprintf("₹%s / %s देखि", formatNPR(cheapest.Price), cheapest.DurationLabel(lang)),
+			"note":    "जुनसुकै बेला योजना परिवर्तन गर्न सकिन्छ।",
+		}
+	}
+	return gin.H{
+		"title":   fmt.Sprintf("%d Plans to Choose From", len(catalog)),
+		"summary": fmt.Sprintf("From ₹%s / %s", formatNPR(cheapest.Price), cheapest.DurationLabel(lang)),
+		"note":    "Switch plans any time.",
+	}
+}
+
 // Dashboard handler
 func dashboardHandler(c *gin.Context) {
 	userID := c.GetUint("userID")
@@ -269,9 +332,11 @@ func dashboardHandler(c *gin.Context) {
 	stats.PendingApps = int(pendingApps)
 	
 	// Get subscription info
-	var subscription Subscription
-	if err := db.Where("user_id = ? AND status = ?", userID, "active").Order("end_date DESC").First(&subscription).Error; err == nil {
+	if subscription, err := getCurrentSubscription(userID); err == nil {
 		stats.SubscriptionStatus = "Active"
+		if subscription.Status == SubscriptionGrace {
+			stats.SubscriptionStatus = "Grace Period"
+		}
 		stats.SubscriptionExpiry = subscription.EndDate
 		stats.RemainingDays = int(time.Until(subscription.EndDate).Hours() / 24)
 		
@@ -326,20 +391,7 @@ func createProfileHandler(c *gin.Context) {
 		return
 	}
 
-	// Check subscription limits
-	var profileCount int64
-	db.Model(&Profile{}).Where("user_id = ?", userID).Count(&profileCount)
-	
-	var subscription Subscription
-	if err := db.Where("user_id = ? AND status = ?", userID, "active").First(&subscription).Error; err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"error": "No active subscription found"})
-		return
-	}
-
-	if int(profileCount) >= subscription.MaxProfiles {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Profile limit reached. Upgrade your plan."})
-		return
-	}
+	// Plan limits are checked by requireEntitlement on the route
 
 	// Encrypt sensitive data
 	key := generateEncryptionKey(input.Name)
@@ -415,6 +467,77 @@ func deleteProfileHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Profile deleted successfully"})
 }
 
+// Re-enter the password before sensitive actions; refreshes the session's confirmation time
+func confirmPasswordHandler(c *gin.Context) {
+	var input struct {
+		Password string `json:"password" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, c.GetUint("userID")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if !checkPasswordHash(input.Password, user.Password) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Incorrect password"})
+		return
+	}
+
+	// Keep the session's 2FA confirmation, if any
+	var twoFactorAt time.Time
+	if at := c.GetInt64("twoFactorAt"); at != 0 {
+		twoFactorAt = time.Unix(at, 0)
+	}
+	token, err := generateConfirmedJWT(&user, twoFactorAt, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	c.SetCookie("auth_token", token, 86400, "/", "", false, false)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "Password confirmed",
+		"token":     token,
+		"valid_for": int(twoFactorConfirmTTL.Seconds()),
+	})
+}
+
+// View decrypted profile secrets (route is behind requireRecentConfirmation)
+func profileSecretsHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+	profileID, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+
+	var profile Profile
+	if err := db.Where("id = ? AND user_id = ?", profileID, userID).First(&profile).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Profile not found"})
+		return
+	}
+
+	key := generateEncryptionKey(profile.Name)
+	secrets := gin.H{"profile_id": profile.ID}
+	for field, enc := range map[string]string{
+		"password":        profile.PasswordEnc,
+		"crn":             profile.CRNEnc,
+		"transaction_pin": profile.TransactionPINEnc,
+	} {
+		plain, err := decryptAES(key, enc)
+		if err != nil {
+			log.Printf("Decrypting %s of profile %d failed: %v\n", field, profile.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt profile credentials"})
+			return
+		}
+		secrets[field] = plain
+	}
+
+	c.JSON(http.StatusOK, secrets)
+}
+
 // IPOs handler
 func iposHandler(c *gin.Context) {
 	ipos, err := getOpenIPOsFromAllSources()
@@ -431,6 +554,8 @@ func iposHandler(c *gin.Context) {
 	})
 }
 
+var errAlreadyApplied = errors.New("This profile has already applied to this IPO")
+
 // Apply to IPO handler
 func applyIPOHandler(c *gin.Context) {
 	userID := c.GetUint("userID")
@@ -453,40 +578,64 @@ func applyIPOHandler(c *gin.Context) {
 		return
 	}
 
-	// Check application limit
-	var appCount int64
-	db.Model(&IPOApplication{}).Where("user_id = ?", userID).Count(&appCount)
-	
-	var subscription Subscription
-	db.Where("user_id = ? AND status = ?", userID, "active").First(&subscription)
-	if int(appCount) >= subscription.MaxApplications {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Application limit reached"})
+	application, err := submitIPOApplication(userID, &profile, ipoID, "", input.Kittas)
+	var entErr *EntitlementError
+	switch {
+	case errors.As(err, &entErr):
+		respondEntitlementError(c, err)
+		return
+	case errors.Is(err, errAlreadyApplied):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create application"})
 		return
 	}
 
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Application submitted successfully",
+		"application": application,
+	})
+}
+
+// Apply to an IPO with one of the user's profiles, within the plan's
+// application limit. The application is processed in the background. Shared by
+// applyIPOHandler and the Telegram bot's apply button.
+func submitIPOApplication(userID uint, profile *Profile, ipoID, companyName string, kittas int) (*IPOApplication, error) {
+	// Check application limit for the current period
+	if err := checkEntitlement(userID, entitlementApply); err != nil {
+		return nil, err
+	}
+
+	// A failed application can be retried, anything else is a duplicate
+	var existing int64
+	db.Model(&IPOApplication{}).
+		Where("profile_id = ? AND company_share_id = ? AND status <> ?", profile.ID, ipoID, "failed").
+		Count(&existing)
+	if existing > 0 {
+		return nil, errAlreadyApplied
+	}
+
 	// Apply to IPO (simulated - integrate with actual MeroShare API)
 	application := IPOApplication{
 		UserID:         userID,
-		ProfileID:      input.ProfileID,
+		ProfileID:      profile.ID,
+		CompanyName:    companyName,
 		CompanyShareID: ipoID,
-		KittasApplied:  input.Kittas,
+		KittasApplied:  kittas,
 		BankID:         profile.DefaultBankID,
 		Status:         "pending",
 		AppliedAt:      time.Now(),
 	}
 
 	if err := db.Create(&application).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create application"})
-		return
+		return nil, err
 	}
 
 	// TODO: Actual IPO application logic here
-	go processIPOApplication(&application, &profile)
+	go processIPOApplication(&application, profile)
 
-	c.JSON(http.StatusOK, gin.H{
-		"message":     "Application submitted successfully",
-		"application": application,
-	})
+	return &application, nil
 }
 
 // Applications handler
@@ -517,36 +666,54 @@ func settingsHandler(c *gin.Context) {
 func updateSettingsHandler(c *gin.Context) {
 	userID := c.GetUint("userID")
 
-	var input map[string]interface{}
+	// Only plain account fields and notification preferences; 2FA, admin and password have their own flows
+	var input struct {
+		Name          *string                       `json:"name"`
+		Notifications *NotificationPreferencesInput `json:"notifications"`
+	}
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 		return
 	}
 
-	if err := db.Model(&User{}).Where("id = ?", userID).Updates(input).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update settings"})
-		return
+	// Validate everything before saving anything
+	var name string
+	if input.Name != nil {
+		name = strings.TrimSpace(*input.Name)
+		if name == "" || len(name) > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Name must be 1 to 100 characters"})
+			return
+		}
+	}
+	var prefs *NotificationPreference
+	if input.Notifications != nil {
+		prefs = loadNotificationPreferences(userID)
+		if err := prefs.apply(input.Notifications); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Settings updated successfully"})
-}
-
-// Payment webhook handler
-func paymentWebhookHandler(c *gin.Context) {
-	// TODO: Implement payment gateway webhook
-	// This would be called by Stripe, PayPal, Khalti, eSewa, etc.
-	
-	var payload map[string]interface{}
-	if err := c.ShouldBindJSON(&payload); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload"})
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if input.Name != nil {
+			if err := tx.Model(&User{}).Where("id = ?", userID).Update("name", name).Error; err != nil {
+				return err
+			}
+		}
+		if prefs != nil {
+			return tx.Save(prefs).Error
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update settings"})
 		return
 	}
+	if prefs != nil {
+		rescheduleDigest(prefs, time.Now())
+	}
 
-	// Verify payment signature
-	// Create/update subscription
-	// Send confirmation email
-
-	c.JSON(http.StatusOK, gin.H{"received": true})
+	c.JSON(http.StatusOK, gin.H{"message": "Settings updated successfully"})
 }
 
 // API docs handler
@@ -572,6 +739,7 @@ func processIPOApplication(app *IPOApplication, profile *Profile) {
 	}
 	
 	db.Save(app)
+	notifyApplicationProcessed(app)
 }
 
 // Placeholder for actual MeroShare API call
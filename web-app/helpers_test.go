@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// Point db at a fresh, migrated database with the default plans, mail at a temp dir and a test TOTP key
+func setupTestDB(t *testing.T) {
+	t.Helper()
+
+	var err error
+	db, err = gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+	if err := migrateDatabase(); err != nil {
+		t.Fatalf("migrating test database: %v", err)
+	}
+	seedPlans()
+	mailer = &FileMailer{Dir: t.TempDir()}
+	totpMasterKey = []byte("test-totp-encryption-key")
+}
+
+// Serve r and point getBaseURL at it, so gateway stubs and return URLs resolve
+func startTestServer(t *testing.T, r *gin.Engine) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	t.Setenv("APP_BASE_URL", server.URL)
+	return server
+}
+
+// HTTP client that stops at redirects, to inspect where the browser is sent
+var noRedirectClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func createTestUser(t *testing.T, email string) *User {
+	t.Helper()
+
+	user := User{Email: email, Password: "x", Name: "Test User", IsActive: true}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+	return &user
+}
+
+func getTestPlan(t *testing.T, code string) *Plan {
+	t.Helper()
+
+	var plan Plan
+	if err := db.Where("code = ?", code).First(&plan).Error; err != nil {
+		t.Fatalf("loading plan %s: %v", code, err)
+	}
+	return &plan
+}
+
+// Reload a payment from the database
+func reloadPayment(t *testing.T, reference string) *PaymentTransaction {
+	t.Helper()
+
+	txn, err := getPaymentTransaction(reference)
+	if err != nil {
+		t.Fatalf("loading payment %s: %v", reference, err)
+	}
+	return txn
+}
+
+// In-memory gateway whose answers a test sets
+type stubGateway struct {
+	PaymentGateway // Methods a test doesn't set panic if called
+	name           string
+	status         string // What Verify reports
+	refundErr      error
+	verified       int
+	refunded       int
+}
+
+func (g *stubGateway) Name() string  { return g.name }
+func (g *stubGateway) Enabled() bool { return true }
+
+func (g *stubGateway) Verify(txn *PaymentTransaction) (string, error) {
+	g.verified++
+	if g.status == PaymentCompleted {
+		if _, _, err := completePaymentTransaction(txn.Reference, "stub-"+txn.Reference, txn.Amount, ""); err != nil {
+			return "", err
+		}
+	}
+	return g.status, nil
+}
+
+func (g *stubGateway) Refund(*PaymentTransaction, float64, string) error {
+	g.refunded++
+	return g.refundErr
+}
+
+// Register a stub gateway for the test
+func registerStubGateway(t *testing.T, name string) *stubGateway {
+	t.Helper()
+
+	gateway := &stubGateway{name: name}
+	registerPaymentGateway(gateway)
+	t.Cleanup(func() {
+		delete(paymentGateways, name)
+		paymentGatewayOrder = paymentGatewayOrder[:len(paymentGatewayOrder)-1]
+	})
+	return gateway
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// VAT invoices. Every completed payment gets one invoice with a gapless
+// sequential number per Nepali fiscal year. Plan prices include VAT, so the invoice splits
+// the amount paid into taxable value and VAT.
+
+var errInvoiceNotPayable = errors.New("payment is not completed")
+
+var panPattern = regexp.MustCompile(`^[0-9]{9}$`)
+
+// Seller details and numbering, from the environment
+func invoiceSeller() (name, pan, address string) {
+	return getEnvDefault("INVOICE_SELLER_NAME", "IPO Pilot"),
+		os.Getenv("INVOICE_SELLER_PAN"),
+		getEnvDefault("INVOICE_SELLER_ADDRESS", "Kathmandu, Nepal")
+}
+
+func invoicePrefix() string {
+	return getEnvDefault("INVOICE_PREFIX", "INV")
+}
+
+// VAT rate in percent (VAT_RATE, default 13)
+func vatRate() float64 {
+	if rate, err := strconv.ParseFloat(os.Getenv("VAT_RATE"), 64); err == nil && rate >= 0 {
+		return rate
+	}
+	return 13
+}
+
+func roundPaisa(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// Split a VAT-inclusive total into taxable value and VAT
+func splitVAT(total, rate float64) (taxable, vat float64) {
+	taxable = roundPaisa(total * 100 / (100 + rate))
+	return taxable, roundPaisa(total - taxable)
+}
+
+// Amount with thousands separators and two decimals, e.g. 1,769.03
+func formatInvoiceAmount(amount float64) string {
+	text := strconv.FormatFloat(roundPaisa(amount), 'f', 2, 64)
+	whole, fraction := text[:len(text)-3], text[len(text)-3:]
+
+	var b strings.Builder
+	for i, d := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(d)
+	}
+	return b.String() + fraction
+}
+
+// Gregorian date of 1 Shrawan, when each Nepali fiscal year starts, by Bikram
+// Sambat year. The government publishes the calendar a year or so ahead; add
+// each year as it's announced.
+var shrawanFirst = map[int]string{
+	2075: "2018-07-17",
+	2076: "2019-07-17",
+	2077: "2020-07-16",
+	2078: "2021-07-16",
+	2079: "2022-07-17",
+	2080: "2023-07-17",
+	2081: "2024-07-16",
+	2082: "2025-07-17",
+	2083: "2026-07-17",
+}
+
+// Start of the fiscal year beginning in BS year bsYear
+func fiscalYearStart(bsYear int) time.Time {
+	if date, ok := shrawanFirst[bsYear]; ok {
+		start, _ := time.ParseInLocation("2006-01-02", date, nepalTime)
+		return start
+	}
+	// 1 Shrawan is 16 or 17 July; close enough until the table is extended
+	log.Printf("Fiscal year %d is missing from shrawanFirst, assuming it starts on 17 July\n", bsYear)
+	return time.Date(bsYear-57, time.July, 17, 0, 0, 0, 0, nepalTime)
+}
+
+// Nepali fiscal year containing t, by the BS year it starts in (2083 for 2083/84)
+func fiscalYear(t time.Time) int {
+	t = t.In(nepalTime)
+	year := t.Year() + 57
+	if t.Before(fiscalYearStart(year)) {
+		year--
+	}
+	return year
+}
+
+// Next number for the fiscal year, e.g. INV-2083-84-000001; must run inside the
+// transaction that creates the invoice
+func nextInvoiceNumber(tx *gorm.DB, year int) (string, error) {
+	seq := InvoiceSequence{Year: year}
+	if err := tx.FirstOrCreate(&seq, InvoiceSequence{Year: year}).Error; err != nil {
+		return "", err
+	}
+	result := tx.Model(&InvoiceSequence{}).
+		Where("year = ? AND last_number = ?", year, seq.LastNumber).
+		Update("last_number", seq.LastNumber+1)
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		return "", errors.New("invoice sequence changed concurrently")
+	}
+	return fmt.Sprintf("%s-%d-%02d-%06d", invoicePrefix(), year, (year+1)%100, seq.LastNumber+1), nil
+}
+
+// Issue the invoice for a completed payment. Idempotent: returns the existing
+// invoice if there is one.
+func issueInvoice(paymentID uint) (*Invoice, error) {
+	var invoice Invoice
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if tx.Where("payment_transaction_id = ?", paymentID).First(&invoice).Error == nil {
+			return nil
+		}
+
+		var txn PaymentTransaction
+		if err := tx.First(&txn, paymentID).Error; err != nil {
+			return err
+		}
+		if txn.Status != PaymentCompleted || txn.SubscriptionID == nil {
+			return errInvoiceNotPayable
+		}
+
+		var user User
+		var plan Plan
+		var sub Subscription
+		if err := tx.First(&user, txn.UserID).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().First(&plan, txn.PlanID).Error; err != nil {
+			return err
+		}
+		if err := tx.First(&sub, *txn.SubscriptionID).Error; err != nil {
+			return err
+		}
+
+		issuedAt := time.Now()
+		if txn.CompletedAt != nil {
+			issuedAt = *txn.CompletedAt
+		}
+		number, err := nextInvoiceNumber(tx, fiscalYear(issuedAt))
+		if err != nil {
+			return err
+		}
+
+		// Older payments didn't record their period
+		periodStart, periodEnd := sub.StartDate, sub.EndDate
+		if txn.PeriodStart != nil && txn.PeriodEnd != nil {
+			periodStart, periodEnd = *txn.PeriodStart, *txn.PeriodEnd
+		}
+
+		buyerName := user.BillingName
+		if buyerName == "" {
+			buyerName = user.Name
+		}
+
+		rate := vatRate()
+		taxable, vat := splitVAT(txn.Amount, rate)
+		sellerName, sellerPAN, sellerAddress := invoiceSeller()
+
+		invoice = Invoice{
+			Number:               number,
+			UserID:               txn.UserID,
+			SubscriptionID:       sub.ID,
+			PaymentTransactionID: txn.ID,
+			IssuedAt:             issuedAt,
+			SellerName:           sellerName,
+			SellerPAN:            sellerPAN,
+			SellerAddress:        sellerAddress,
+			BuyerName:            buyerName,
+			BuyerEmail:           user.Email,
+			BuyerPAN:             user.BillingPAN,
+			BuyerAddress:         user.BillingAddress,
+			PlanName:             plan.Name,
+			PlanNameNepali:       plan.NameNepali,
+			PeriodStart:          periodStart,
+			PeriodEnd:            periodEnd,
+			PaymentMethod:        txn.Gateway,
+			PaymentReference:     txn.Reference,
+			TaxableAmount:        taxable,
+			VATRate:              rate,
+			VATAmount:            vat,
+			TotalAmount:          txn.Amount,
+			Currency:             txn.Currency,
+		}
+		return tx.Create(&invoice).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// Invoice completed payments that don't have one yet. Runs at startup and with
+// the lifecycle job, never on a request.
+func backfillInvoices() {
+	var ids []uint
+	db.Model(&PaymentTransaction{}).
+		Where("status = ? AND subscription_id IS NOT NULL", PaymentCompleted).
+		Where("id NOT IN (?)", db.Model(&Invoice{}).Select("payment_transaction_id")).
+		Order("completed_at").Pluck("id", &ids)
+	for _, id := range ids {
+		if _, err := issueInvoice(id); err != nil {
+			log.Printf("Backfilling invoice for payment %d failed: %v\n", id, err)
+		}
+	}
+}
+
+// Invoice labels per language
+var invoiceLabels = map[string]map[string]string{
+	"english": {
+		"title":        "Tax Invoice",
+		"number":       "Invoice No.",
+		"date":         "Invoice Date",
+		"seller":       "Seller",
+		"bill_to":      "Bill To",
+		"pan":          "PAN",
+		"email":        "Email",
+		"address":      "Address",
+		"description":  "Description",
+		"period":       "Period",
+		"amount":       "Amount",
+		"subscription": "IPO Pilot subscription",
+		"taxable":      "Taxable Amount",
+		"vat":          "VAT",
+		"total":        "Total",
+		"payment":      "Payment Method",
+		"reference":    "Payment Reference",
+		"note":         "Prices include VAT. This is a computer-generated invoice.",
+		"print":        "Print",
+		"pdf":          "Download PDF",
+		"period_range": "%s to %s",
+	},
+	"nepali": {
+		"title":        "कर बीजक",
+		"number":       "बीजक नं.",
+		"date":         "बीजक मिति",
+		"seller":       "विक्रेता",
+		"bill_to":      "खरिदकर्ता",
+		"pan":          "प्यान नं.",
+		"email":        "इमेल",
+		"address":      "ठेगाना",
+		"description":  "विवरण",
+		"period":       "अवधि",
+		"amount":       "रकम",
+		"subscription": "IPO Pilot सदस्यता",
+		"taxable":      "करयोग्य रकम",
+		"vat":          "मूल्य अभिवृद्धि कर",
+		"total":        "जम्मा",
+		"payment":      "भुक्तानी माध्यम",
+		"reference":    "भुक्तानी सन्दर्भ",
+		"note":         "मूल्यमा मूल्य अभिवृद्धि कर समावेश छ। यो कम्प्युटरबाट तयार गरिएको बीजक हो।",
+		"print":        "प्रिन्ट",
+		"pdf":          "PDF डाउनलोड",
+		"period_range": "%s देखि %s सम्म",
+	},
+}
+
+// Language for an invoice page: ?lang= wins over the usual cookie/header
+func invoiceLanguage(c *gin.Context) string {
+	if lang := c.Query("lang"); lang == "nepali" || lang == "english" {
+		return lang
+	}
+	return getUserLanguage(c.Request)
+}
+
+// Load an invoice by number, scoped to the signed-in user unless admin is set
+func findInvoice(c *gin.Context, admin bool) (*Invoice, bool) {
+	query := db.Where("number = ?", c.Param("number"))
+	if !admin {
+		query = query.Where("user_id = ?", c.GetUint("userID"))
+	}
+
+	var invoice Invoice
+	if err := query.First(&invoice).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+		return nil, false
+	}
+	return &invoice, true
+}
+
+// Render an invoice as HTML
+func renderInvoice(c *gin.Context, invoice *Invoice, pdfURL string) {
+	lang := invoiceLanguage(c)
+	planName := invoice.PlanName
+	if lang == "nepali" && invoice.PlanNameNepali != "" {
+		planName = invoice.PlanNameNepali
+	}
+
+	c.HTML(http.StatusOK, "invoice.html", gin.H{
+		"lang":     lang,
+		"t":        invoiceLabels[lang],
+		"invoice":  invoice,
+		"planName": planName,
+		"issued":   invoice.IssuedAt.In(nepalTime).Format("2006-01-02"),
+		"period":   invoice.PeriodStart.In(nepalTime).Format("2006-01-02") + " – " + invoice.PeriodEnd.In(nepalTime).Format("2006-01-02"),
+		"taxable":  formatInvoiceAmount(invoice.TaxableAmount),
+		"vat":      formatInvoiceAmount(invoice.VATAmount),
+		"vatRate":  strconv.FormatFloat(invoice.VATRate, 'f', -1, 64),
+		"total":    formatInvoiceAmount(invoice.TotalAmount),
+		"pdfURL":   pdfURL + "?lang=" + lang,
+	})
+}
+
+// Invoice as a PDF in lang; Nepali is drawn with the embedded Devanagari font
+func invoicePDF(invoice *Invoice, lang string) []byte {
+	t := invoiceLabels[lang]
+	planName := invoice.PlanName
+	if lang == "nepali" && invoice.PlanNameNepali != "" {
+		planName = invoice.PlanNameNepali
+	}
+	doc := &pdfDocument{}
+	left, right := 50.0, 545.0
+
+	doc.Text(left, 60, 20, true, strings.ToUpper(t["title"]))
+	doc.Text(left, 85, 11, true, invoice.SellerName)
+	doc.Text(left, 100, 9, false, invoice.SellerAddress)
+	if invoice.SellerPAN != "" {
+		doc.Text(left, 113, 9, false, t["pan"]+": "+invoice.SellerPAN)
+	}
+
+	doc.TextRight(right, 85, 10, true, t["number"]+" "+invoice.Number)
+	doc.TextRight(right, 100, 9, false, t["date"]+": "+invoice.IssuedAt.In(nepalTime).Format("2006-01-02"))
+	doc.Line(left, right, 130)
+
+	y := 150.0
+	doc.Text(left, y, 10, true, t["bill_to"])
+	for _, line := range []string{
+		invoice.BuyerName,
+		invoice.BuyerEmail,
+		invoice.BuyerAddress,
+	} {
+		if line != "" {
+			y += 14
+			doc.Text(left, y, 9, false, line)
+		}
+	}
+	if invoice.BuyerPAN != "" {
+		y += 14
+		doc.Text(left, y, 9, false, t["pan"]+": "+invoice.BuyerPAN)
+	}
+
+	y += 35
+	doc.Text(left, y, 9, true, t["description"])
+	doc.Text(300, y, 9, true, t["period"])
+	doc.TextRight(right, y, 9, true, t["amount"]+" ("+invoice.Currency+")")
+	doc.Line(left, right, y+6)
+
+	y += 22
+	doc.Text(left, y, 9, false, t["subscription"]+" - "+planName)
+	doc.Text(300, y, 9, false, fmt.Sprintf(t["period_range"], invoice.PeriodStart.In(nepalTime).Format("2006-01-02"), invoice.PeriodEnd.In(nepalTime).Format("2006-01-02")))
+	doc.TextRight(right, y, 9, false, formatInvoiceAmount(invoice.TaxableAmount))
+	doc.Line(left, right, y+10)
+
+	rate := strconv.FormatFloat(invoice.VATRate, 'f', -1, 64)
+	for _, row := range [][2]string{
+		{t["taxable"], formatInvoiceAmount(invoice.TaxableAmount)},
+		{t["vat"] + " (" + rate + "%)", formatInvoiceAmount(invoice.VATAmount)},
+		{t["total"], formatInvoiceAmount(invoice.TotalAmount)},
+	} {
+		y += 18
+		bold := row[0] == t["total"]
+		doc.TextRight(440, y, 9, bold, row[0])
+		doc.TextRight(right, y, 9, bold, row[1])
+	}
+
+	y += 35
+	doc.Text(left, y, 9, false, t["payment"]+": "+invoice.PaymentMethod)
+	doc.Text(left, y+14, 9, false, t["reference"]+": "+invoice.PaymentReference)
+	doc.Text(left, 800, 8, false, t["note"])
+
+	return doc.Bytes()
+}
+
+func sendInvoicePDF(c *gin.Context, invoice *Invoice) {
+	c.Header("Content-Disposition", "attachment; filename=\""+invoice.Number+".pdf\"")
+	c.Data(http.StatusOK, "application/pdf", invoicePDF(invoice, invoiceLanguage(c)))
+}
+
+// The signed-in user's invoices
+func invoicesHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var invoices []Invoice
+	db.Where("user_id = ?", userID).Order("issued_at DESC").Find(&invoices)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":    len(invoices),
+		"invoices": invoices,
+	})
+}
+
+// One invoice as HTML (?lang=english|nepali)
+func invoiceHandler(c *gin.Context) {
+	if invoice, ok := findInvoice(c, false); ok {
+		renderInvoice(c, invoice, "/dashboard/invoices/"+invoice.Number+"/pdf")
+	}
+}
+
+// One invoice as PDF
+func invoicePDFHandler(c *gin.Context) {
+	if invoice, ok := findInvoice(c, false); ok {
+		sendInvoicePDF(c, invoice)
+	}
+}
+
+// Buyer details printed on future invoices
+func billingDetailsHandler(c *gin.Context) {
+	var user User
+	db.First(&user, c.GetUint("userID"))
+
+	c.JSON(http.StatusOK, gin.H{
+		"name":    user.BillingName,
+		"pan":     user.BillingPAN,
+		"address": user.BillingAddress,
+	})
+}
+
+// Update billing details. Existing invoices keep the details they were issued with.
+func updateBillingDetailsHandler(c *gin.Context) {
+	var input struct {
+		Name    string `json:"name"`
+		PAN     string `json:"pan"`
+		Address string `json:"address"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	input.PAN = strings.TrimSpace(input.PAN)
+	if input.PAN != "" && !panPattern.MatchString(input.PAN) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "PAN must be 9 digits"})
+		return
+	}
+	if len(input.Name) > 200 || len(input.Address) > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name or address is too long"})
+		return
+	}
+
+	db.Model(&User{}).Where("id = ?", c.GetUint("userID")).Updates(map[string]interface{}{
+		"billing_name":    strings.TrimSpace(input.Name),
+		"billing_pan":     input.PAN,
+		"billing_address": strings.TrimSpace(input.Address),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Billing details updated"})
+}
+
+// Admin: invoices, optionally for one user
+func adminInvoicesHandler(c *gin.Context) {
+	query := db.Model(&Invoice{}).Order("issued_at DESC").Limit(500)
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	var invoices []Invoice
+	query.Find(&invoices)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":    len(invoices),
+		"invoices": invoices,
+	})
+}
+
+// Admin: any invoice as HTML
+func adminInvoiceHandler(c *gin.Context) {
+	if invoice, ok := findInvoice(c, true); ok {
+		renderInvoice(c, invoice, "/admin/invoices/"+invoice.Number+"/pdf")
+	}
+}
+
+// Admin: any invoice as PDF
+func adminInvoicePDFHandler(c *gin.Context) {
+	if invoice, ok := findInvoice(c, true); ok {
+		sendInvoicePDF(c, invoice)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestFiscalYear(t *testing.T) {
+	tests := []struct {
+		at   time.Time
+		want int
+	}{
+		{time.Date(2026, time.January, 1, 12, 0, 0, 0, nepalTime), 2082},
+		{time.Date(2026, time.July, 16, 23, 59, 0, 0, nepalTime), 2082}, // Last day of Ashadh 2083
+		{time.Date(2026, time.July, 17, 0, 0, 0, 0, nepalTime), 2083},   // 1 Shrawan 2083
+		{time.Date(2026, time.July, 16, 18, 30, 0, 0, time.UTC), 2083},  // Already 17 July in Nepal
+		{time.Date(2024, time.July, 16, 0, 0, 0, 0, nepalTime), 2081},
+		{time.Date(2024, time.July, 15, 0, 0, 0, 0, nepalTime), 2080},
+	}
+	for _, tt := range tests {
+		if got := fiscalYear(tt.at); got != tt.want {
+			t.Errorf("fiscalYear(%s) = %d, want %d", tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestInvoiceNumbersRestartEachFiscalYear(t *testing.T) {
+	setupTestDB(t)
+
+	next := func(year int) string {
+		var number string
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			number, err = nextInvoiceNumber(tx, year)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("next invoice number: %v", err)
+		}
+		return number
+	}
+
+	for _, want := range []struct {
+		year   int
+		number string
+	}{
+		{2082, "INV-2082-83-000001"},
+		{2082, "INV-2082-83-000002"},
+		{2083, "INV-2083-84-000001"},
+		{2082, "INV-2082-83-000003"},
+		{2099, "INV-2099-00-000001"},
+	} {
+		if got := next(want.year); got != want.number {
+			t.Fatalf("next number for %d = %s, want %s", want.year, got, want.number)
+		}
+	}
+}
+
+func TestInvoicePDFLanguages(t *testing.T) {
+	invoice := &Invoice{
+		Number:         "INV-2083-84-000001",
+		IssuedAt:       time.Date(2026, time.August, 1, 10, 0, 0, 0, nepalTime),
+		SellerName:     "IPO Pilot",
+		SellerAddress:  "Kathmandu, Nepal",
+		BuyerName:      "राम शर्मा",
+		BuyerEmail:     "ram@example.com",
+		PlanName:       "Premium",
+		PlanNameNepali: "प्रिमियम",
+		PeriodStart:    time.Date(2026, time.August, 1, 0, 0, 0, 0, nepalTime),
+		PeriodEnd:      time.Date(2026, time.September, 1, 0, 0, 0, 0, nepalTime),
+		TaxableAmount:  1769.03,
+		VATRate:        13,
+		VATAmount:      229.97,
+		TotalAmount:    1999,
+		Currency:       "NPR",
+	}
+
+	// Devanagari buyer details are drawn on English invoices too; without them
+	// an English invoice needs no embedded font
+	latin := *invoice
+	latin.BuyerName = "Ram Sharma"
+
+	for _, lang := range []string{"english", "nepali"} {
+		doc := invoicePDF(&latin, lang)
+
+		// The xref table must be where startxref says, or viewers rebuild or reject the file
+		match := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(doc)
+		if match == nil {
+			t.Fatalf("%s PDF has no startxref", lang)
+		}
+		offset, _ := strconv.Atoi(string(match[1]))
+		if !bytes.HasPrefix(doc[offset:], []byte("xref\n")) {
+			t.Fatalf("%s PDF: startxref %d doesn't point at the xref table", lang, offset)
+		}
+
+		embedded := bytes.Contains(doc, []byte("/FontFile2"))
+		if embedded != (lang == "nepali") {
+			t.Fatalf("%s PDF embeds the Devanagari font: %v", lang, embedded)
+		}
+	}
+
+	// All text is drawn with a font that has it, none falls back to "?"
+	unprintable := regexp.MustCompile(`\([^)]*\?[^)]*\) Tj`)
+	for _, lang := range []string{"english", "nepali"} {
+		doc := invoicePDF(invoice, lang)
+		if text := unprintable.Find(doc); text != nil {
+			t.Fatalf("%s PDF has text the fonts can't draw: %s", lang, text)
+		}
+		if !bytes.Contains(doc, []byte("(ram@example.com) Tj")) {
+			t.Fatalf("Latin text in the %s PDF isn't drawn with Helvetica", lang)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -276,8 +277,36 @@ func startMonitoringHandler(c *gin.Context) {
 		return
 	}
 
+	// Verify profile ownership
+	var profile Profile
+	if err := db.Where("id = ? AND user_id = ?", input.ProfileID, userID).First(&profile).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Profile not found"})
+		return
+	}
+
+	var running int64
+	db.Model(&MonitoringSession{}).Where("profile_id = ? AND is_active = ?", profile.ID, true).Count(&running)
+	if running > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "This profile is already being monitored"})
+		return
+	}
+
+	entitlements, err := loadEntitlements(userID)
+	if err != nil {
+		respondEntitlementError(c, err)
+		return
+	}
+
 	if input.Interval == 0 {
 		input.Interval = 300 // Default 5 minutes
+		if min := entitlements.Subscription.MinMonitorInterval; min > input.Interval {
+			input.Interval = min
+		}
+	}
+
+	if err := entitlements.CanStartMonitoring(input.Interval); err != nil {
+		respondEntitlementError(c, err)
+		return
 	}
 
 	session := MonitoringSession{
@@ -319,8 +348,9 @@ func stopMonitoringHandler(c *gin.Context) {
 	db.Model(&MonitoringSession{}).
 		Where("id = ? AND user_id = ?", input.SessionID, userID).
 		Updates(map[string]interface{}{
-			"is_active":  false,
-			"stopped_at": now,
+			"is_active":     false,
+			"stopped_at":    now,
+			"paused_reason": "", // Stopped by the user, don't auto-resume on renewal
 		})
 
 	c.JSON(http.StatusOK, gin.H{"message": "Monitoring stopped"})
@@ -359,17 +389,48 @@ func monitorIPOsForSession(session *MonitoringSession) {
 			continue
 		}
 
-		// Auto-apply to new IPOs
+		// Auto-apply to new IPOs, within the plan's application limit
 		var profile Profile
 		db.First(&profile, session.ProfileID)
 
+		entitlements, err := loadEntitlements(session.UserID)
+		if err != nil {
+			// Access ended; the lifecycle job pauses the session
+			<-ticker.C
+			continue
+		}
+
 		for _, ipo := range ipos {
+			notifyUser(session.UserID, NotifyNewIPO, NotifyNewIPO+":"+ipo.CompanyShareID, gin.H{
+				"Company":   ipo.CompanyName,
+				"Symbol":    ipo.StockSymbol,
+				"CloseDate": ipo.IssueCloseDate,
+				"Price":     ipo.StockPrice,
+				"ShareID":   ipo.CompanyShareID,
+			})
+
 			// Check if already applied
 			var existingApp IPOApplication
 			result := db.Where("user_id = ? AND profile_id = ? AND company_share_id = ?",
 				session.UserID, session.ProfileID, ipo.CompanyShareID).First(&existingApp)
 
 			if result.Error != nil { // Not applied yet
+				if err := entitlements.CanApply(); err != nil {
+					fmt.Printf("Session %d: skipping %s: %v\n", session.ID, ipo.CompanyName, err)
+					reason := err.Error()
+					var entErr *EntitlementError
+					if errors.As(err, &entErr) {
+						reason = entErr.Message
+					}
+					notifyUser(session.UserID, NotifyMonitoringSkipped,
+						fmt.Sprintf("%s:%s:%d", NotifyMonitoringSkipped, ipo.CompanyShareID, session.ProfileID), gin.H{
+							"Company": ipo.CompanyName,
+							"Profile": profile.Name,
+							"Reason":  reason,
+						})
+					continue
+				}
+
 				// Create application
 				app := IPOApplication{
 					UserID:         session.UserID,
@@ -383,6 +444,7 @@ func monitorIPOsForSession(session *MonitoringSession) {
 					AppliedAt:      time.Now(),
 				}
 				db.Create(&app)
+				entitlements.ApplicationsThisPeriod++
 
 				// Process application
 				go processIPOApplication(&app, &profile)
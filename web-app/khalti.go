@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Khalti ePayment (KPG-2). We initiate server-side and get a pidx plus a
+// payment_url to send the user to. Khalti redirects back to return_url, and
+// the payment is only completed after the lookup API confirms it.
+
+// Khalti API base URLs per KHALTI_ENV
+const (
+	khaltiSandboxURL = "https://dev.khalti.com/api/v2/"
+	khaltiLiveURL    = "https://khalti.com/api/v2/"
+	khaltiFakePath   = "/_fake/khalti" // Local stub, see khalti_fake.go
+)
+
+// Khalti payment statuses
+const (
+	khaltiStatusCompleted = "Completed"
+	khaltiStatusPending   = "Pending"
+	khaltiStatusInitiated = "Initiated"
+	khaltiStatusExpired   = "Expired"
+	khaltiStatusCanceled  = "User canceled"
+)
+
+var (
+	errKhaltiMismatch = errors.New("khalti: lookup does not match the transaction")
+	errKhaltiOpen     = errors.New("khalti: the earlier payment for this transaction is still open")
+)
+
+// A stored payment_url is not handed out this close to its expiry
+const khaltiLinkMargin = time.Minute
+
+// API base URL for KHALTI_ENV: "live", "fake", or anything else for the sandbox
+func khaltiBaseURL(env string) string {
+	switch env {
+	case "live":
+		return khaltiLiveURL
+	case "fake":
+		return getBaseURL() + khaltiFakePath + "/api/v2/"
+	}
+	return khaltiSandboxURL
+}
+
+// KhaltiInitiateResponse is returned by epayment/initiate
+type KhaltiInitiateResponse struct {
+	Pidx       string `json:"pidx"`
+	PaymentURL string `json:"payment_url"`
+	ExpiresAt  string `json:"expires_at"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+// KhaltiLookupResponse is returned by epayment/lookup
+type KhaltiLookupResponse struct {
+	Pidx          string `json:"pidx"`
+	TotalAmount   int64  `json:"total_amount"` // Paisa
+	Status        string `json:"status"`
+	TransactionID string `json:"transaction_id"`
+	Fee           int64  `json:"fee"`
+	Refunded      bool   `json:"refunded"`
+}
+
+// NPR to paisa, rounded
+func toPaisa(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// POST a JSON body to a Khalti endpoint and decode the response into out
+func khaltiRequest(config NepalPaymentConfig, endpoint string, body interface{}, out interface{}) ([]byte, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Key "+config.KhaltiSecretKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := paymentHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Error bodies look like {"detail": "...", "error_key": "..."} or per-field lists
+		return raw, fmt.Errorf("khalti %s: HTTP %d: %s", endpoint, resp.StatusCode, raw)
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return raw, fmt.Errorf("khalti %s: %w", endpoint, err)
+	}
+	return raw, nil
+}
+
+// Start a Khalti payment for a pending transaction and remember its pidx and
+// payment_url. While that link is valid it is handed out again, so a
+// transaction only ever has one payable pidx: a second tab, the back button or
+// a reload can't pay a pidx we no longer look up.
+func initiateKhaltiPayment(config NepalPaymentConfig, txn *PaymentTransaction, plan *Plan, user *User) (*KhaltiInitiateResponse, error) {
+	if txn.GatewayRef != "" {
+		if txn.GatewayURL != "" && txn.GatewayURLExpiresAt != nil && time.Until(*txn.GatewayURLExpiresAt) > khaltiLinkMargin {
+			return &KhaltiInitiateResponse{Pidx: txn.GatewayRef, PaymentURL: txn.GatewayURL, ExpiresAt: txn.GatewayURLExpiresAt.Format(time.RFC3339)}, nil
+		}
+		// Only replace a pidx that can no longer be paid
+		lookup, _, err := lookupKhaltiPayment(config, txn.GatewayRef)
+		if err != nil {
+			return nil, err
+		}
+		if lookup.Status != khaltiStatusExpired && lookup.Status != khaltiStatusCanceled {
+			return nil, errKhaltiOpen
+		}
+	}
+
+	body := gin.H{
+		"return_url":          getBaseURL() + "/payment/khalti/return",
+		"website_url":         getBaseURL(),
+		"amount":              toPaisa(txn.Amount),
+		"purchase_order_id":   txn.Reference,
+		"purchase_order_name": "IPO Pilot " + plan.Name,
+		"customer_info": gin.H{
+			"name":  user.Name,
+			"email": user.Email,
+		},
+	}
+
+	var resp KhaltiInitiateResponse
+	if _, err := khaltiRequest(config, config.KhaltiBaseURL+"epayment/initiate/", body, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Pidx == "" || resp.PaymentURL == "" {
+		return nil, errors.New("khalti initiate: missing pidx or payment_url")
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, resp.ExpiresAt)
+	if err != nil {
+		expiresAt = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+
+	// Conditional on the pidx we replaced, so two parallel checkouts can't both store one
+	result := db.Model(&PaymentTransaction{}).
+		Where("id = ? AND gateway_ref = ?", txn.ID, txn.GatewayRef).
+		Updates(map[string]interface{}{
+			"gateway_ref":            resp.Pidx,
+			"gateway_url":            resp.PaymentURL,
+			"gateway_url_expires_at": expiresAt,
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		current, err := getPaymentTransaction(txn.Reference)
+		if err != nil {
+			return nil, err
+		}
+		if current.GatewayURL == "" {
+			return nil, errKhaltiOpen
+		}
+		return &KhaltiInitiateResponse{Pidx: current.GatewayRef, PaymentURL: current.GatewayURL}, nil
+	}
+
+	txn.GatewayRef, txn.GatewayURL, txn.GatewayURLExpiresAt = resp.Pidx, resp.PaymentURL, &expiresAt
+	return &resp, nil
+}
+
+// Look up a payment by pidx
+func lookupKhaltiPayment(config NepalPaymentConfig, pidx string) (*KhaltiLookupResponse, []byte, error) {
+	var resp KhaltiLookupResponse
+	raw, err := khaltiRequest(config, config.KhaltiBaseURL+"epayment/lookup/", gin.H{"pidx": pidx}, &resp)
+	if err != nil {
+		return nil, raw, err
+	}
+	if resp.Pidx != pidx {
+		return nil, raw, errKhaltiMismatch
+	}
+	return &resp, raw, nil
+}
+
+// Confirm a transaction with the lookup API and complete or fail it in the ledger.
+// The paid amount must match the plan price recorded on the transaction.
+func verifyKhaltiPayment(config NepalPaymentConfig, txn *PaymentTransaction) (string, error) {
+	if txn.GatewayRef == "" {
+		return "", errKhaltiMismatch
+	}
+
+	lookup, raw, err := lookupKhaltiPayment(config, txn.GatewayRef)
+	if err != nil {
+		return "", err
+	}
+
+	switch lookup.Status {
+	case khaltiStatusCompleted:
+		if _, _, err = completePaymentTransaction(txn.Reference, txn.GatewayRef, float64(lookup.TotalAmount)/100, string(raw)); err != nil {
+			return "", err
+		}
+		return PaymentCompleted, nil
+	case khaltiStatusExpired, khaltiStatusCanceled:
+		failPaymentTransaction(txn.Reference, "khalti: "+lookup.Status, string(raw))
+		return PaymentFailed, nil
+	}
+	return PaymentPending, nil
+}
+
+// Full refund of a completed payment. The refund API lives outside /api/v2 and
+// wants Khalti's transaction_id, which only the lookup API gives us.
+func refundKhaltiPayment(config NepalPaymentConfig, txn *PaymentTransaction) error {
+	lookup, _, err := lookupKhaltiPayment(config, txn.GatewayRef)
+	if err != nil {
+		return err
+	}
+	if lookup.Status != khaltiStatusCompleted || lookup.TransactionID == "" {
+		return fmt.Errorf("khalti refund: payment is %s", lookup.Status)
+	}
+
+	endpoint := strings.TrimSuffix(config.KhaltiBaseURL, "v2/") + "merchant-transaction/" + url.PathEscape(lookup.TransactionID) + "/refund/"
+	var resp struct {
+		Detail string `json:"detail"`
+	}
+	_, err = khaltiRequest(config, endpoint, gin.H{}, &resp)
+	return err
+}
+
+// khaltiGateway is Khalti ePayment behind the PaymentGateway interface
+type khaltiGateway struct{}
+
+func (khaltiGateway) Name() string { return "khalti" }
+
+func (khaltiGateway) Enabled() bool { return getNepalPaymentConfig().KhaltiEnabled }
+
+// Khalti hands back a payment_url to redirect to. It is reused while valid, and
+// a new pidx is only issued once the previous one expired or was cancelled.
+func (khaltiGateway) Initiate(txn *PaymentTransaction, plan *Plan, user *User) (*PaymentInitiation, error) {
+	resp, err := initiateKhaltiPayment(getNepalPaymentConfig(), txn, plan, user)
+	if err != nil {
+		return nil, err
+	}
+	return &PaymentInitiation{Method: paymentMethodRedirect, URL: resp.PaymentURL}, nil
+}
+
+// return_url query parameters are unsigned; we only use them to find the
+// transaction, and the pidx must be the one we initiated
+func (khaltiGateway) HandleCallback(c *gin.Context) (*PaymentTransaction, error) {
+	txn, err := getPaymentTransaction(c.Query("purchase_order_id"))
+	if err != nil || txn.Gateway != "khalti" {
+		return nil, errPaymentNotFound
+	}
+	if txn.GatewayRef == "" || txn.GatewayRef != c.Query("pidx") {
+		return nil, errKhaltiMismatch
+	}
+	return txn, nil
+}
+
+// Khalti notifies with the fields of its return_url callback, as JSON or a form.
+// Nothing is signed, so like the callback the pidx must be the one stored for the order.
+func (khaltiGateway) ParseNotification(body []byte) (*PaymentNotification, error) {
+	var payload struct {
+		Pidx            string `json:"pidx"`
+		PurchaseOrderID string `json:"purchase_order_id"`
+		Status          string `json:"status"`
+	}
+	if json.Unmarshal(body, &payload) != nil {
+		form, _ := url.ParseQuery(string(body))
+		payload.Pidx, payload.PurchaseOrderID, payload.Status = form.Get("pidx"), form.Get("purchase_order_id"), form.Get("status")
+	}
+
+	txn, err := getPaymentTransaction(payload.PurchaseOrderID)
+	if err != nil || txn.Gateway != "khalti" {
+		return nil, errPaymentNotFound
+	}
+	if txn.GatewayRef == "" || txn.GatewayRef != payload.Pidx {
+		return nil, errKhaltiMismatch
+	}
+	return &PaymentNotification{
+		EventID:   payload.Pidx + ":" + payload.Status,
+		Type:      payload.Status,
+		Reference: txn.Reference,
+	}, nil
+}
+
+func (khaltiGateway) Verify(txn *PaymentTransaction) (string, error) {
+	return verifyKhaltiPayment(getNepalPaymentConfig(), txn)
+}
+
+// Only full refunds: partial ones need the payer's mobile number, which we don't keep
+func (khaltiGateway) Refund(txn *PaymentTransaction, amount float64, reason string) error {
+	if math.Abs(amount-txn.Amount) > 0.005 {
+		return errRefundUnsupported
+	}
+	return refundKhaltiPayment(getNepalPaymentConfig(), txn)
+}
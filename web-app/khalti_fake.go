@@ -0,0 +1,246 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Local stub of Khalti ePayment (KPG-2) for development and integration testing.
+// Enabled with KHALTI_ENV=fake, which also points the Khalti config at it.
+// It checks the secret key and amount like the sandbox does, shows a pay/cancel
+// page, and answers lookups - never enable it in production.
+
+const fakeKhaltiLinkTTL = 30 * time.Minute
+
+type fakeKhaltiPayment struct {
+	Amount        int64
+	ReturnURL     string
+	OrderID       string
+	OrderName     string
+	Status        string
+	TransactionID string
+	Refunded      bool
+	ExpiresAt     time.Time
+}
+
+type fakeKhalti struct {
+	mu       sync.Mutex
+	payments map[string]*fakeKhaltiPayment
+}
+
+// Mount the stub under khaltiFakePath
+func mountFakeKhalti(r *gin.Engine) *fakeKhalti {
+	fake := &fakeKhalti{payments: make(map[string]*fakeKhaltiPayment)}
+
+	group := r.Group(khaltiFakePath)
+	group.POST("/api/v2/epayment/initiate/", fake.initiateHandler)
+	group.POST("/api/v2/epayment/lookup/", fake.lookupHandler)
+	group.POST("/api/merchant-transaction/:id/refund/", fake.refundHandler)
+	group.GET("/pay/:pidx", fake.payPageHandler)
+	group.POST("/pay/:pidx", fake.payHandler)
+	return fake
+}
+
+func fakeKhaltiID(n int) string {
+	raw := make([]byte, n)
+	crand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// Reject requests without the merchant secret key
+func (f *fakeKhalti) authorized(c *gin.Context) bool {
+	if c.GetHeader("Authorization") != "Key "+getNepalPaymentConfig().KhaltiSecretKey {
+		c.JSON(http.StatusUnauthorized, gin.H{"detail": "Invalid token.", "status_code": 401})
+		return false
+	}
+	return true
+}
+
+func (f *fakeKhalti) initiateHandler(c *gin.Context) {
+	if !f.authorized(c) {
+		return
+	}
+
+	var input struct {
+		ReturnURL         string `json:"return_url"`
+		WebsiteURL        string `json:"website_url"`
+		Amount            int64  `json:"amount"`
+		PurchaseOrderID   string `json:"purchase_order_id"`
+		PurchaseOrderName string `json:"purchase_order_name"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "Invalid request body.", "error_key": "validation_error"})
+		return
+	}
+	if input.ReturnURL == "" || input.WebsiteURL == "" || input.PurchaseOrderID == "" || input.PurchaseOrderName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "Required fields are missing.", "error_key": "validation_error"})
+		return
+	}
+	if input.Amount < 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"amount":    []string{"Amount should be greater than Rs. 10, that is 1000 paisa."},
+			"error_key": "validation_error",
+		})
+		return
+	}
+
+	pidx := fakeKhaltiID(11)
+	expiresAt := time.Now().Add(fakeKhaltiLinkTTL)
+
+	f.mu.Lock()
+	f.payments[pidx] = &fakeKhaltiPayment{
+		Amount:    input.Amount,
+		ReturnURL: input.ReturnURL,
+		OrderID:   input.PurchaseOrderID,
+		OrderName: input.PurchaseOrderName,
+		Status:    khaltiStatusInitiated,
+		ExpiresAt: expiresAt,
+	}
+	f.mu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"pidx":        pidx,
+		"payment_url": getBaseURL() + khaltiFakePath + "/pay/" + pidx,
+		"expires_at":  expiresAt.Format(time.RFC3339),
+		"expires_in":  int(fakeKhaltiLinkTTL.Seconds()),
+	})
+}
+
+// Current state of a payment, expiring stale links
+func (f *fakeKhalti) get(pidx string) (fakeKhaltiPayment, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	payment, ok := f.payments[pidx]
+	if !ok {
+		return fakeKhaltiPayment{}, false
+	}
+	if payment.Status == khaltiStatusInitiated && time.Now().After(payment.ExpiresAt) {
+		payment.Status = khaltiStatusExpired
+	}
+	return *payment, true
+}
+
+func (f *fakeKhalti) lookupHandler(c *gin.Context) {
+	if !f.authorized(c) {
+		return
+	}
+
+	var input struct {
+		Pidx string `json:"pidx"`
+	}
+	c.ShouldBindJSON(&input)
+
+	payment, ok := f.get(input.Pidx)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "Not found.", "error_key": "validation_error"})
+		return
+	}
+
+	var transactionID interface{}
+	if payment.TransactionID != "" {
+		transactionID = payment.TransactionID
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"pidx":           input.Pidx,
+		"total_amount":   payment.Amount,
+		"status":         payment.Status,
+		"transaction_id": transactionID,
+		"fee":            0,
+		"refunded":       payment.Refunded,
+	})
+}
+
+func (f *fakeKhalti) payPageHandler(c *gin.Context) {
+	pidx := c.Param("pidx")
+	payment, ok := f.get(pidx)
+	if !ok || payment.Status != khaltiStatusInitiated {
+		c.String(http.StatusNotFound, "fake khalti: payment link is not valid")
+		return
+	}
+
+	page := `<!DOCTYPE html><html><body style="font-family:sans-serif;text-align:center;margin-top:80px">
+<h2>Fake Khalti</h2><p>Pay NPR %s for %s?</p>
+<form method="POST" action="%s/pay/%s">
+<button name="decision" value="pay">Pay</button> <button name="decision" value="cancel">Cancel</button>
+</form></body></html>`
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(fmt.Sprintf(page,
+		strconv.FormatFloat(float64(payment.Amount)/100, 'f', -1, 64), html.EscapeString(payment.OrderName),
+		khaltiFakePath, html.EscapeString(pidx))))
+}
+
+// Customer decision: redirect to return_url with Khalti's query parameters
+func (f *fakeKhalti) payHandler(c *gin.Context) {
+	pidx := c.Param("pidx")
+
+	f.mu.Lock()
+	stored, ok := f.payments[pidx]
+	var payment fakeKhaltiPayment
+	if ok {
+		if stored.Status == khaltiStatusInitiated && time.Now().Before(stored.ExpiresAt) {
+			if c.PostForm("decision") == "pay" {
+				stored.Status = khaltiStatusCompleted
+				stored.TransactionID = strings.ToUpper(fakeKhaltiID(8))
+			} else {
+				stored.Status = khaltiStatusCanceled
+			}
+		}
+		payment = *stored
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		c.String(http.StatusNotFound, "fake khalti: unknown payment")
+		return
+	}
+
+	query := url.Values{}
+	query.Set("pidx", pidx)
+	query.Set("status", payment.Status)
+	query.Set("purchase_order_id", payment.OrderID)
+	query.Set("purchase_order_name", payment.OrderName)
+	query.Set("amount", strconv.FormatInt(payment.Amount, 10))
+	query.Set("total_amount", strconv.FormatInt(payment.Amount, 10))
+	query.Set("mobile", "98XXXXX001")
+	if payment.TransactionID != "" {
+		query.Set("transaction_id", payment.TransactionID)
+		query.Set("txnId", payment.TransactionID)
+		query.Set("tidx", payment.TransactionID)
+	}
+	c.Redirect(http.StatusFound, payment.ReturnURL+"?"+query.Encode())
+}
+
+// Full refund of a completed payment, by Khalti transaction_id
+func (f *fakeKhalti) refundHandler(c *gin.Context) {
+	if !f.authorized(c) {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, payment := range f.payments {
+		if payment.TransactionID != c.Param("id") {
+			continue
+		}
+		if payment.Status != khaltiStatusCompleted || payment.Refunded {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "Transaction cannot be refunded.", "error_key": "validation_error"})
+			return
+		}
+		payment.Status = "Refunded"
+		payment.Refunded = true
+		c.JSON(http.StatusOK, gin.H{"detail": "Transaction refunded successfully."})
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"detail": "Not found.", "error_key": "validation_error"})
+}
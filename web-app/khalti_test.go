@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Khalti payment flow against the local stub (khalti_fake.go)
+
+type khaltiTest struct {
+	fake *fakeKhalti
+	user *User
+	plan *Plan
+}
+
+func setupKhaltiTest(t *testing.T) *khaltiTest {
+	t.Helper()
+
+	setupTestDB(t)
+	t.Setenv("KHALTI_ENV", "fake")
+	registerPaymentGateways()
+
+	r := gin.New()
+	fake := mountFakeKhalti(r)
+	r.GET("/payment/khalti/return", paymentCallbackHandler("khalti"))
+	startTestServer(t, r)
+
+	return &khaltiTest{
+		fake: fake,
+		user: createTestUser(t, "khalti@example.com"),
+		plan: getTestPlan(t, "premium"),
+	}
+}
+
+// Create a pending payment and initiate it at the stub
+func (k *khaltiTest) start(t *testing.T) (*PaymentTransaction, *KhaltiInitiateResponse) {
+	t.Helper()
+
+	txn, err := createPaymentTransaction(k.user.ID, k.plan, "khalti", nil, "")
+	if err != nil {
+		t.Fatalf("creating payment: %v", err)
+	}
+	resp, err := initiateKhaltiPayment(getNepalPaymentConfig(), txn, k.plan, k.user)
+	if err != nil {
+		t.Fatalf("initiating payment: %v", err)
+	}
+	return txn, resp
+}
+
+// Customer decision on the stub's payment page; returns the return_url it sends the browser to
+func (k *khaltiTest) decide(t *testing.T, paymentURL, decision string) string {
+	t.Helper()
+
+	resp, err := noRedirectClient.PostForm(paymentURL, url.Values{"decision": {decision}})
+	if err != nil {
+		t.Fatalf("paying: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("pay page answered %d, want a redirect", resp.StatusCode)
+	}
+	return resp.Header.Get("Location")
+}
+
+// Follow a return_url into our callback handler; returns where it redirects
+func (k *khaltiTest) returnTo(t *testing.T, returnURL string) string {
+	t.Helper()
+
+	resp, err := noRedirectClient.Get(returnURL)
+	if err != nil {
+		t.Fatalf("calling return URL: %v", err)
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Location")
+}
+
+func (k *khaltiTest) subscriptionCount(t *testing.T) int64 {
+	t.Helper()
+
+	var count int64
+	db.Model(&Subscription{}).Where("user_id = ?", k.user.ID).Count(&count)
+	return count
+}
+
+func TestKhaltiInitiateLookupComplete(t *testing.T) {
+	k := setupKhaltiTest(t)
+	txn, initiated := k.start(t)
+
+	// Reloading the checkout page hands out the same link, not a new pidx
+	again, err := initiateKhaltiPayment(getNepalPaymentConfig(), txn, k.plan, k.user)
+	if err != nil {
+		t.Fatalf("initiating again: %v", err)
+	}
+	if again.Pidx != initiated.Pidx || again.PaymentURL != initiated.PaymentURL {
+		t.Fatalf("second initiate issued pidx %s, want the stored %s", again.Pidx, initiated.Pidx)
+	}
+
+	lookup, _, err := lookupKhaltiPayment(getNepalPaymentConfig(), initiated.Pidx)
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	if lookup.Status != khaltiStatusInitiated {
+		t.Fatalf("status before paying = %q, want %q", lookup.Status, khaltiStatusInitiated)
+	}
+
+	returnURL := k.decide(t, initiated.PaymentURL, "pay")
+
+	lookup, _, err = lookupKhaltiPayment(getNepalPaymentConfig(), initiated.Pidx)
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	if lookup.Status != khaltiStatusCompleted || lookup.TotalAmount != toPaisa(txn.Amount) {
+		t.Fatalf("lookup after paying = %s / %d paisa, want Completed / %d", lookup.Status, lookup.TotalAmount, toPaisa(txn.Amount))
+	}
+
+	if location := k.returnTo(t, returnURL); !strings.HasPrefix(location, "/dashboard?payment=success") {
+		t.Fatalf("return handler redirected to %q, want the success page", location)
+	}
+
+	txn = reloadPayment(t, txn.Reference)
+	if txn.Status != PaymentCompleted || txn.SubscriptionID == nil {
+		t.Fatalf("payment is %s with subscription %v, want completed with a subscription", txn.Status, txn.SubscriptionID)
+	}
+	sub, err := getCurrentSubscription(k.user.ID)
+	if err != nil || sub.ID != *txn.SubscriptionID {
+		t.Fatalf("current subscription = %v (%v), want #%d", sub, err, *txn.SubscriptionID)
+	}
+}
+
+func TestKhaltiAmountMismatchFailsPayment(t *testing.T) {
+	k := setupKhaltiTest(t)
+	txn, initiated := k.start(t)
+	k.decide(t, initiated.PaymentURL, "pay")
+
+	// Khalti confirms a different amount than the ledger expects
+	db.Model(&PaymentTransaction{}).Where("id = ?", txn.ID).Update("amount", txn.Amount+100)
+
+	_, err := verifyKhaltiPayment(getNepalPaymentConfig(), reloadPayment(t, txn.Reference))
+	if !errors.Is(err, errPaymentAmountMismatch) {
+		t.Fatalf("verify error = %v, want %v", err, errPaymentAmountMismatch)
+	}
+	if txn = reloadPayment(t, txn.Reference); txn.Status != PaymentFailed {
+		t.Fatalf("payment is %s, want failed", txn.Status)
+	}
+	if n := k.subscriptionCount(t); n != 0 {
+		t.Fatalf("user has %d subscriptions, want none", n)
+	}
+}
+
+func TestKhaltiCancelledAndExpiredLookupsFailPayment(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		end    func(k *khaltiTest, t *testing.T, initiated *KhaltiInitiateResponse)
+	}{
+		{
+			name:   "cancelled",
+			status: khaltiStatusCanceled,
+			end: func(k *khaltiTest, t *testing.T, initiated *KhaltiInitiateResponse) {
+				k.decide(t, initiated.PaymentURL, "cancel")
+			},
+		},
+		{
+			name:   "expired",
+			status: khaltiStatusExpired,
+			end: func(k *khaltiTest, t *testing.T, initiated *KhaltiInitiateResponse) {
+				k.fake.mu.Lock()
+				k.fake.payments[initiated.Pidx].ExpiresAt = time.Now().Add(-time.Minute)
+				k.fake.mu.Unlock()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := setupKhaltiTest(t)
+			txn, initiated := k.start(t)
+			tt.end(k, t, initiated)
+
+			lookup, _, err := lookupKhaltiPayment(getNepalPaymentConfig(), initiated.Pidx)
+			if err != nil {
+				t.Fatalf("lookup: %v", err)
+			}
+			if lookup.Status != tt.status {
+				t.Fatalf("lookup status = %q, want %q", lookup.Status, tt.status)
+			}
+
+			status, err := verifyKhaltiPayment(getNepalPaymentConfig(), reloadPayment(t, txn.Reference))
+			if err != nil || status != PaymentFailed {
+				t.Fatalf("verify = %q, %v; want failed", status, err)
+			}
+			txn = reloadPayment(t, txn.Reference)
+			if txn.Status != PaymentFailed || txn.FailureReason != "khalti: "+tt.status {
+				t.Fatalf("payment is %s (%q), want failed with the Khalti status", txn.Status, txn.FailureReason)
+			}
+			if n := k.subscriptionCount(t); n != 0 {
+				t.Fatalf("user has %d subscriptions, want none", n)
+			}
+		})
+	}
+}
+
+func TestKhaltiExpiredLinkIsReplaced(t *testing.T) {
+	k := setupKhaltiTest(t)
+	txn, initiated := k.start(t)
+
+	// An open pidx is never replaced, even once our copy of the link looks stale
+	db.Model(&PaymentTransaction{}).Where("id = ?", txn.ID).Update("gateway_url_expires_at", time.Now().Add(-time.Minute))
+	if _, err := initiateKhaltiPayment(getNepalPaymentConfig(), reloadPayment(t, txn.Reference), k.plan, k.user); !errors.Is(err, errKhaltiOpen) {
+		t.Fatalf("initiate with an open pidx: error = %v, want %v", err, errKhaltiOpen)
+	}
+
+	k.fake.mu.Lock()
+	k.fake.payments[initiated.Pidx].ExpiresAt = time.Now().Add(-time.Minute)
+	k.fake.mu.Unlock()
+
+	replaced, err := initiateKhaltiPayment(getNepalPaymentConfig(), reloadPayment(t, txn.Reference), k.plan, k.user)
+	if err != nil {
+		t.Fatalf("initiate after expiry: %v", err)
+	}
+	if replaced.Pidx == initiated.Pidx {
+		t.Fatal("expired pidx was handed out again")
+	}
+	if txn = reloadPayment(t, txn.Reference); txn.GatewayRef != replaced.Pidx {
+		t.Fatalf("stored pidx = %s, want %s", txn.GatewayRef, replaced.Pidx)
+	}
+}
+
+func TestKhaltiDuplicateCallbackIsIdempotent(t *testing.T) {
+	k := setupKhaltiTest(t)
+	txn, initiated := k.start(t)
+	returnURL := k.decide(t, initiated.PaymentURL, "pay")
+
+	for i := 0; i < 2; i++ {
+		if location := k.returnTo(t, returnURL); !strings.HasPrefix(location, "/dashboard?payment=success") {
+			t.Fatalf("callback %d redirected to %q, want the success page", i+1, location)
+		}
+	}
+	first := reloadPayment(t, txn.Reference)
+
+	// A verification racing the callback still sees the payment as pending
+	status, err := verifyKhaltiPayment(getNepalPaymentConfig(), txn)
+	if err != nil || status != PaymentCompleted {
+		t.Fatalf("late verify = %q, %v; want completed", status, err)
+	}
+
+	if n := k.subscriptionCount(t); n != 1 {
+		t.Fatalf("user has %d subscriptions, want 1", n)
+	}
+	var invoices int64
+	db.Model(&Invoice{}).Where("payment_transaction_id = ?", txn.ID).Count(&invoices)
+	if invoices != 1 {
+		t.Fatalf("payment has %d invoices, want 1", invoices)
+	}
+	last := reloadPayment(t, txn.Reference)
+	if !last.PeriodEnd.Equal(*first.PeriodEnd) || !last.CompletedAt.Equal(*first.CompletedAt) {
+		t.Fatalf("duplicate callback changed the payment: period end %v -> %v", first.PeriodEnd, last.PeriodEnd)
+	}
+}
@@ -44,7 +44,7 @@ func setLanguage(w http.ResponseWriter, lang string) {
 	})
 }
 
-// Get environment type (for pricing roadmap)
+// Get environment type
 func getEnvironmentMode() string {
 	mode := os.Getenv("APP_MODE")
 	if mode == "" {
@@ -52,29 +52,3 @@ func getEnvironmentMode() string {
 	}
 	return mode
 }
-
-// Pricing tiers based on year and environment
-type PricingTier struct {
-	Name            string
-	NameNepali      string
-	PriceNPR        int
-	PriceUSD        int
-	Duration        string
-	DurationNepali  string
-	IsPopular       bool
-	Description     string
-	DescriptionNepali string
-	Features        []string
-	FeaturesNepali  []string
-}
-
-// Get pricing based on year - PREMIUM ONLY
-func getPricingForYear(year int) (premiumPrice int) {
-	// 2026 LAUNCH: PREMIUM-ONLY - 50% Discount!
-	return 1999  // Single tier: ₹1,999 (was ₹3,999)
-}
-
-// Get pricing message for current year
-func getPricingMessage(year int) string {
-	return "🎉 2026 LAUNCH YEAR SPECIAL! One Premium Plan - ₹1,999 for 3 months!"
-}
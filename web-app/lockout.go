@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Progressive account lockout after repeated failed sign-ins
+
+const (
+	lockoutThreshold = 5              // Failures before the first lock
+	lockoutBase      = time.Minute    // First lock duration, doubled for each further failure
+	lockoutMax       = 24 * time.Hour // Longest lock
+)
+
+// Lock duration for a given consecutive failure count (0 = not locked)
+func lockoutDuration(failures int) time.Duration {
+	if failures < lockoutThreshold {
+		return 0
+	}
+	d := lockoutBase << uint(failures-lockoutThreshold)
+	if d > lockoutMax || d <= 0 {
+		return lockoutMax
+	}
+	return d
+}
+
+// Is the account currently locked?
+func isAccountLocked(user *User) bool {
+	return user.LockedUntil != nil && time.Now().Before(*user.LockedUntil)
+}
+
+func recordLoginAttempt(c *gin.Context, email string, user *User, success bool, reason string) {
+	attempt := LoginAttempt{
+		Email:     strings.ToLower(email),
+		IPAddress: c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		Success:   success,
+		Reason:    reason,
+	}
+	if user != nil {
+		attempt.UserID = &user.ID
+	}
+	db.Create(&attempt)
+}
+
+// Count a failed sign-in and lock the account once past the threshold. The
+// counter is incremented in the database so parallel failures all count.
+func registerLoginFailure(c *gin.Context, user *User, reason string) {
+	db.Model(&User{}).Where("id = ?", user.ID).UpdateColumn("failed_logins", gorm.Expr("failed_logins + 1"))
+	db.Model(&User{}).Select("failed_logins").Where("id = ?", user.ID).Row().Scan(&user.FailedLogins)
+
+	if d := lockoutDuration(user.FailedLogins); d > 0 {
+		until := time.Now().Add(d)
+		user.LockedUntil = &until
+		// Never shorten a longer lock set by a parallel failure
+		db.Model(&User{}).Where("id = ? AND (locked_until IS NULL OR locked_until < ?)", user.ID, until).UpdateColumn("locked_until", until)
+	}
+
+	recordLoginAttempt(c, user.Email, user, false, reason)
+}
+
+// Reset the failure counter after a successful sign-in
+func registerLoginSuccess(c *gin.Context, user *User) {
+	if user.FailedLogins > 0 || user.LockedUntil != nil {
+		db.Model(&User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+			"failed_logins": 0,
+			"locked_until":  nil,
+		})
+		user.FailedLogins = 0
+		user.LockedUntil = nil
+	}
+	recordLoginAttempt(c, user.Email, user, true, "")
+}
+
+// Respond for a locked account
+func respondAccountLocked(c *gin.Context, user *User) {
+	retryAfter := int(time.Until(*user.LockedUntil).Seconds()) + 1
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":        "Too many failed attempts. Account is temporarily locked.",
+		"locked_until": user.LockedUntil.Format(time.RFC3339),
+	})
+}
+
+// Admin: unlock an account and clear its failure counter
+func unlockUserHandler(c *gin.Context) {
+	userID, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+
+	result := db.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"failed_logins": 0,
+		"locked_until":  nil,
+	})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock user"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User unlocked"})
+}
+
+// Admin: recent login attempts, optionally filtered by user_id, email or ip
+func loginAttemptsHandler(c *gin.Context) {
+	query := db.Model(&LoginAttempt{}).Order("created_at DESC").Limit(200)
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	if email := c.Query("email"); email != "" {
+		query = query.Where("email = ?", strings.ToLower(email))
+	}
+	if ip := c.Query("ip"); ip != "" {
+		query = query.Where("ip_address = ?", ip)
+	}
+
+	var attempts []LoginAttempt
+	query.Find(&attempts)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":    len(attempts),
+		"attempts": attempts,
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Email outbox. Notification emails are stored before they are sent, so a mail
+// server outage delays them instead of losing them. A background worker sends
+// new rows as they arrive and retries failures with backoff.
+
+// Outbox statuses
+const (
+	OutboxPending = "pending"
+	OutboxSending = "sending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed" // Gave up after outboxMaxAttempts
+)
+
+const (
+	outboxMaxAttempts  = 6
+	outboxPollInterval = 30 * time.Second
+	outboxStuckAfter   = 10 * time.Minute // A worker died mid-send
+)
+
+// IDs of newly queued emails, for the worker
+var outboxQueue = make(chan uint, 256)
+
+// Store an email and hand it to the worker
+func queueEmail(email *EmailOutbox) error {
+	email.Status = OutboxPending
+	email.NextAttemptAt = time.Now()
+	if err := db.Create(email).Error; err != nil {
+		return err
+	}
+	enqueueOutboxEmail(email.ID)
+	return nil
+}
+
+// Hand an email to the worker without blocking; the poller picks up overflow
+func enqueueOutboxEmail(id uint) {
+	select {
+	case outboxQueue <- id:
+	default:
+	}
+}
+
+// Delay before retry n (1-based): 1, 4, 9, 16... minutes
+func outboxRetryDelay(attempt int) time.Duration {
+	return time.Duration(attempt*attempt) * time.Minute
+}
+
+// Send one queued email if it's due. The status update claims the row, so
+// several workers never send the same email.
+func sendOutboxEmail(id uint, now time.Time) {
+	result := db.Model(&EmailOutbox{}).
+		Where("id = ? AND status = ? AND next_attempt_at <= ?", id, OutboxPending, now).
+		Updates(map[string]interface{}{"status": OutboxSending, "attempts": gorm.Expr("attempts + 1")})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return
+	}
+
+	var email EmailOutbox
+	if err := db.First(&email, id).Error; err != nil {
+		return
+	}
+
+	msg := MailMessage{To: email.To, Subject: email.Subject, TextBody: email.TextBody}
+	if email.UnsubscribeURL != "" {
+		msg.Headers = map[string]string{
+			"List-Unsubscribe":      "<" + email.UnsubscribeURL + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		}
+	}
+
+	err := mailer.Send(msg)
+	updates := map[string]interface{}{"last_error": ""}
+	switch {
+	case err == nil:
+		updates["status"] = OutboxSent
+		updates["sent_at"] = time.Now()
+	case email.Attempts >= outboxMaxAttempts:
+		updates["status"] = OutboxFailed
+		updates["last_error"] = err.Error()
+		log.Printf("Email %d (%s to user %d) failed: %v\n", email.ID, email.Type, email.UserID, err)
+	default:
+		updates["status"] = OutboxPending
+		updates["last_error"] = err.Error()
+		updates["next_attempt_at"] = time.Now().Add(outboxRetryDelay(email.Attempts))
+	}
+	db.Model(&EmailOutbox{}).Where("id = ?", email.ID).Updates(updates)
+}
+
+// Due retries, plus emails whose worker died while sending them
+func runDueOutboxEmails(now time.Time) {
+	db.Model(&EmailOutbox{}).
+		Where("status = ? AND updated_at < ?", OutboxSending, now.Add(-outboxStuckAfter)).
+		Update("status", OutboxPending)
+
+	var ids []uint
+	db.Model(&EmailOutbox{}).
+		Where("status = ? AND next_attempt_at <= ?", OutboxPending, now).
+		Order("next_attempt_at").Limit(100).
+		Pluck("id", &ids)
+	for _, id := range ids {
+		sendOutboxEmail(id, now)
+	}
+}
+
+// Background worker: new emails as they are queued, retries on a timer
+func startMailOutboxWorker() {
+	go func() {
+		runDueOutboxEmails(time.Now())
+
+		ticker := time.NewTicker(outboxPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case id := <-outboxQueue:
+				sendOutboxEmail(id, time.Now())
+			case <-ticker.C:
+				runDueOutboxEmails(time.Now())
+			}
+		}
+	}()
+}
+
+// Admin: outbox, optionally filtered by status, type or user_id
+func adminEmailOutboxHandler(c *gin.Context) {
+	query := db.Model(&EmailOutbox{}).Order("created_at DESC").Limit(500)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if kind := c.Query("type"); kind != "" {
+		query = query.Where("type = ?", kind)
+	}
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	var emails []EmailOutbox
+	query.Find(&emails)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":  len(emails),
+		"emails": emails,
+	})
+}
+
+// Admin: send a failed email again
+func retryOutboxEmailHandler(c *gin.Context) {
+	var email EmailOutbox
+	if err := db.First(&email, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+		return
+	}
+	if email.Status != OutboxFailed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only failed emails can be retried"})
+		return
+	}
+
+	db.Model(&email).Updates(map[string]interface{}{
+		"status":          OutboxPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now(),
+	})
+	enqueueOutboxEmail(email.ID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email queued for sending"})
+}
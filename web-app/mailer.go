@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Outgoing mail. SMTP in production, .eml files on disk for development.
+
+// MailMessage is a single outgoing email
+type MailMessage struct {
+	To       string
+	Subject  string
+	TextBody string
+	HTMLBody string            // Optional
+	Headers  map[string]string // Extra headers, e.g. List-Unsubscribe
+}
+
+// Mailer sends email
+type Mailer interface {
+	Send(msg MailMessage) error
+}
+
+var mailer Mailer
+
+// SMTPMailer delivers mail through an SMTP server (STARTTLS when offered)
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// FileMailer writes each message to a directory and logs it - for local development
+type FileMailer struct {
+	Dir string
+}
+
+// Pick a mailer from environment: MAIL_DRIVER=smtp uses SMTP_*, anything else writes to MAIL_DIR
+func newMailerFromEnv() Mailer {
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "noreply@ipopilot.com"
+	}
+
+	if os.Getenv("MAIL_DRIVER") == "smtp" {
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("SMTP_USER"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+	}
+
+	dir := os.Getenv("MAIL_DIR")
+	if dir == "" {
+		dir = "tmp/mail"
+	}
+	return &FileMailer{Dir: dir}
+}
+
+// Send an email over SMTP
+func (m *SMTPMailer) Send(msg MailMessage) error {
+	if m.Host == "" {
+		return fmt.Errorf("SMTP_HOST is not configured")
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{msg.To}, buildMIMEMessage(m.From, msg))
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9@._-]`)
+
+// Write the email as an .eml file instead of sending it
+func (m *FileMailer) Send(msg MailMessage) error {
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000"), unsafeFileChars.ReplaceAllString(msg.To, "_"))
+	path := filepath.Join(m.Dir, name)
+	if err := os.WriteFile(path, buildMIMEMessage("dev@localhost", msg), 0o600); err != nil {
+		return err
+	}
+
+	log.Printf("📧 Mail to %s (%s) written to %s\n", msg.To, msg.Subject, path)
+	return nil
+}
+
+// Build an RFC 5322 message, multipart/alternative when an HTML body is set
+func buildMIMEMessage(from string, msg MailMessage) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	names := make([]string, 0, len(msg.Headers))
+	for name := range msg.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s: %s\r\n", name, msg.Headers[name])
+	}
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	if msg.HTMLBody == "" {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		buf.WriteString(strings.ReplaceAll(msg.TextBody, "\n", "\r\n"))
+		return buf.Bytes()
+	}
+
+	raw := make([]byte, 12)
+	crand.Read(raw)
+	boundary := "ipopilot-" + hex.EncodeToString(raw)
+
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+	fmt.Fprintf(&buf, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n", boundary)
+	buf.WriteString(strings.ReplaceAll(msg.TextBody, "\n", "\r\n"))
+	fmt.Fprintf(&buf, "\r\n--%s\r\nContent-Type: text/html; charset=utf-8\r\n\r\n", boundary)
+	buf.WriteString(msg.HTMLBody)
+	fmt.Fprintf(&buf, "\r\n--%s--\r\n", boundary)
+
+	return buf.Bytes()
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/driver/sqlite"
@@ -18,7 +19,16 @@ var embedFS embed.FS
 
 var db *gorm.DB
 
+// Auto-migrate database schema
+func migrateDatabase() error {
+	return db.AutoMigrate(&User{}, &UserRole{}, &RecoveryCode{}, &APIToken{}, &LoginAttempt{}, &RateLimitBucket{}, &Plan{}, &Subscription{}, &PaymentTransaction{}, &BankTransferClaim{}, &BankTransferComment{}, &WebhookEvent{}, &Invoice{}, &InvoiceSequence{}, &Refund{}, &Coupon{}, &CouponRedemption{}, &Referral{}, &EmailOutbox{}, &PhoneVerification{}, &SMSLog{}, &TelegramLinkCode{}, &TelegramLog{}, &Notification{}, &Broadcast{}, &NotificationPreference{}, &PendingNotification{}, &Profile{}, &IPOApplication{}, &IPOSource{}, &MonitoringSession{})
+}
+
 func main() {
+	if err := loadTOTPEncryptionKey(); err != nil {
+		log.Fatal(err)
+	}
+
 	// Initialize database
 	var err error
 	db, err = gorm.Open(sqlite.Open("ipo_pilot.db"), &gorm.Config{})
@@ -27,14 +37,64 @@ func main() {
 	}
 
 	// Auto-migrate database schema
-	db.AutoMigrate(&User{}, &Subscription{}, &Profile{}, &IPOApplication{}, &IPOSource{})
+	if err := migrateDatabase(); err != nil {
+		log.Fatal("Failed to migrate database:", err)
+	}
+
+	backfillCanonicalEmails()
+	migrateTOTPSecrets()
+	migrateSubscriptionStatuses()
+	consolidateSubscriptions()
+
+	// Plan catalog
+	seedPlans()
+	migrateSubscriptionPlans()
+	backfillPaymentListPrices()
 
 	// Initialize default admin user
 	initializeAdmin()
+	migrateAdminRoles()
+	backfillReferralCodes()
+	migrateEmailOptOuts()
+	migrateTelegramLinks()
+
+	// Outgoing mail (SMTP or local files, see mailer.go)
+	mailer = newMailerFromEnv()
+	startMailOutboxWorker()
+
+	// Outgoing SMS (Sparrow, Aakash or local files, see sms.go)
+	smsSender = newSMSSenderFromEnv()
+
+	// Telegram bot, when TELEGRAM_BOT_TOKEN is set (see telegram.go)
+	telegramBot = newTelegramBotFromEnv()
+	startTelegramBot()
+
+	// Notifications held for quiet hours and daily digests (see notification_preferences.go)
+	startNotificationScheduler()
+
+	// Rate limit buckets (in memory, or shared via RATE_LIMIT_BACKEND=db)
+	rateLimiter = newRateLimitStoreFromEnv()
+
+	// Online payment gateways (see payment_gateways.go)
+	registerPaymentGateways()
+	logDisabledPaymentGateways()
+	startWebhookWorker()
+
+	// Invoices for payments completed before invoicing existed
+	backfillInvoices()
+
+	// Subscription expiry, grace periods and reminders
+	onSubscriptionEvent(notifySubscriptionChange)
+	startSubscriptionLifecycleJob()
 
 	// Setup router
 	r := gin.Default()
 
+	// c.ClientIP() (rate limits, login attempts) only honours X-Forwarded-For from these
+	if err := r.SetTrustedProxies(trustedProxiesFromEnv()); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
 	// Load templates from embedded FS (reliable in Docker)
 	r.SetHTMLTemplate(template.Must(template.ParseFS(embedFS, "templates/*.html")))
 	
@@ -44,12 +104,20 @@ func main() {
 	// Public routes
 	r.GET("/", homeHandler)
 	r.GET("/login", loginPageHandler)
-	r.POST("/login", loginHandler)
+	r.POST("/login", rateLimitMiddleware("login", loginIPLimit), loginHandler)
+	r.POST("/login/2fa", rateLimitMiddleware("login", loginIPLimit), loginTwoFactorHandler)
 	r.GET("/register", registerPageHandler)
-	r.POST("/register", registerHandler)
+	r.POST("/register", rateLimitMiddleware("register", registerIPLimit), registerHandler)
+	r.GET("/verify-email", verifyEmailHandler)
+	r.GET("/forgot-password", forgotPasswordPageHandler)
+	r.POST("/forgot-password", rateLimitMiddleware("password-mail", passwordMailLimit), forgotPasswordHandler)
+	r.GET("/reset-password", resetPasswordPageHandler)
+	r.POST("/reset-password", resetPasswordHandler)
 	r.GET("/pricing", pricingHandler)
 	r.GET("/terms", termsHandler)
 	r.GET("/privacy", privacyHandler)
+	r.GET("/unsubscribe", unsubscribePageHandler)
+	r.POST("/unsubscribe", unsubscribeHandler)
 
 	// Language toggle
 	r.GET("/set-language/:lang", func(c *gin.Context) {
@@ -58,6 +126,9 @@ func main() {
 			lang = "english"
 		}
 		setLanguage(c.Writer, lang)
+		if token := requestToken(c); token != "" && authenticateSession(c, token) {
+			db.Model(&User{}).Where("id = ?", c.GetUint("userID")).Update("language", lang) // For emails
+		}
 		c.Redirect(http.StatusFound, c.GetHeader("Referer"))
 	})
 
@@ -67,55 +138,157 @@ func main() {
 	{
 		user.GET("", dashboardHandler)
 		user.GET("/profiles", profilesHandler)
-		user.POST("/profiles", createProfileHandler)
-		user.PUT("/profiles/:id", updateProfileHandler)
-		user.DELETE("/profiles/:id", deleteProfileHandler)
+		user.POST("/profiles", requireEntitlement(entitlementAddProfile), createProfileHandler)
+		user.PUT("/profiles/:id", requireRecentTwoFactor(), updateProfileHandler)
+		user.DELETE("/profiles/:id", requireRecentTwoFactor(), deleteProfileHandler)
+		user.GET("/profiles/:id/secrets", requireRecentConfirmation(), profileSecretsHandler)
 		user.GET("/ipos", iposHandler)
 		user.POST("/apply/:ipo_id", applyIPOHandler)
 		user.GET("/applications", applicationsHandler)
+		user.GET("/entitlements", entitlementsHandler)
+		user.GET("/subscriptions", subscriptionHistoryHandler)
+		user.GET("/subscription/cancel", cancellationQuoteHandler)
+		user.POST("/subscription/cancel", requireRecentTwoFactor(), cancelSubscriptionHandler)
+		user.GET("/refunds", refundsHandler)
+		user.GET("/payments", paymentHistoryHandler)
+		user.GET("/bank-transfers", bankTransfersHandler)
+		user.POST("/bank-transfers", submitBankTransferHandler)
+		user.GET("/bank-transfers/:id/receipt", bankTransferReceiptHandler)
+		user.GET("/referrals", referralsHandler)
+		user.GET("/invoices", invoicesHandler)
+		user.GET("/invoices/:number", invoiceHandler)
+		user.GET("/invoices/:number/pdf", invoicePDFHandler)
+		user.GET("/billing", billingDetailsHandler)
+		user.PUT("/billing", updateBillingDetailsHandler)
 		user.GET("/settings", settingsHandler)
 		user.POST("/settings", updateSettingsHandler)
+		user.GET("/settings/notifications", notificationPreferencesHandler)
+		user.GET("/phone", phoneHandler)
+		user.POST("/phone", startPhoneVerificationHandler)
+		user.POST("/phone/verify", verifyPhoneHandler)
+		user.DELETE("/phone", removePhoneHandler)
+		user.GET("/telegram", telegramHandler)
+		user.POST("/telegram/link", createTelegramLinkCodeHandler)
+		user.DELETE("/telegram", unlinkTelegramHandler)
+		user.POST("/verify-email/resend", rateLimitMiddleware("password-mail", passwordMailLimit), resendVerificationHandler)
+
+		// Two-factor authentication
+		user.GET("/2fa", twoFactorStatusHandler)
+		user.POST("/2fa/setup", twoFactorSetupHandler)
+		user.POST("/2fa/enable", twoFactorEnableHandler)
+		user.POST("/2fa/disable", twoFactorDisableHandler)
+		user.POST("/2fa/confirm", twoFactorConfirmHandler)
+		user.POST("/confirm-password", rateLimitMiddleware("login", loginIPLimit), confirmPasswordHandler)
+		user.POST("/2fa/recovery-codes", requireRecentTwoFactor(), regenerateRecoveryCodesHandler)
+
+		// Personal API tokens
+		user.GET("/api-tokens", listAPITokensHandler)
+		user.POST("/api-tokens", requireRecentTwoFactor(), createAPITokenHandler)
+		user.DELETE("/api-tokens/:id", revokeAPITokenHandler)
 	}
 
-	// Admin routes
+	// Admin routes - any staff role gets in, each route checks its permission
 	admin := r.Group("/admin")
 	admin.Use(authMiddleware(), adminMiddleware())
 	{
 		admin.GET("", adminDashboardHandler)
-		admin.GET("/users", adminUsersHandler)
-		admin.GET("/subscriptions", adminSubscriptionsHandler)
-		admin.POST("/subscriptions/:id/activate", activateSubscriptionHandler)
-		admin.POST("/subscriptions/:id/deactivate", deactivateSubscriptionHandler)
-		admin.GET("/ipo-sources", ipoSourcesHandler)
-		admin.POST("/ipo-sources", addIPOSourceHandler)
-		admin.DELETE("/ipo-sources/:id", deleteIPOSourceHandler)
-		admin.GET("/analytics", analyticsHandler)
+		admin.GET("/users", requirePermission(permUsersRead), adminUsersHandler)
+		admin.POST("/users/:id/unlock", requirePermission(permUsersWrite), unlockUserHandler)
+		admin.GET("/users/:id/roles", requirePermission(permUsersRead), getUserRolesHandler)
+		admin.PUT("/users/:id/roles", requirePermission(permRolesManage), setUserRolesHandler)
+		admin.GET("/roles", requirePermission(permRolesManage), listRolesHandler)
+		admin.GET("/login-attempts", requirePermission(permUsersRead), loginAttemptsHandler)
+		admin.GET("/email-outbox", requirePermission(permUsersRead), adminEmailOutboxHandler)
+		admin.POST("/email-outbox/:id/retry", requirePermission(permUsersWrite), retryOutboxEmailHandler)
+		admin.GET("/sms-log", requirePermission(permUsersRead), adminSMSLogHandler)
+		admin.GET("/telegram-log", requirePermission(permUsersRead), adminTelegramLogHandler)
+		admin.GET("/broadcasts", requirePermission(permUsersRead), adminBroadcastsHandler)
+		admin.POST("/broadcasts", requirePermission(permUsersWrite), createBroadcastHandler)
+		admin.GET("/subscriptions", requirePermission(permSubscriptionsRead), adminSubscriptionsHandler)
+		admin.POST("/subscriptions/:id/activate", requirePermission(permSubscriptionsWrite), activateSubscriptionHandler)
+		admin.POST("/subscriptions/:id/deactivate", requirePermission(permSubscriptionsWrite), deactivateSubscriptionHandler)
+		admin.GET("/payments", requirePermission(permRevenueRead), adminPaymentsHandler)
+		admin.GET("/invoices", requirePermission(permRevenueRead), adminInvoicesHandler)
+		admin.GET("/invoices/:number", requirePermission(permRevenueRead), adminInvoiceHandler)
+		admin.GET("/invoices/:number/pdf", requirePermission(permRevenueRead), adminInvoicePDFHandler)
+		admin.GET("/refunds", requirePermission(permPaymentsReview), adminRefundsHandler)
+		admin.POST("/refunds/:id/complete", requirePermission(permPaymentsReview), completeRefundHandler)
+		admin.GET("/webhook-events", requirePermission(permPaymentsReview), adminWebhookEventsHandler)
+		admin.POST("/webhook-events/:id/retry", requirePermission(permPaymentsReview), retryWebhookEventHandler)
+		admin.GET("/bank-transfers", requirePermission(permPaymentsReview), adminBankTransfersHandler)
+		admin.GET("/bank-transfers/:id/receipt", requirePermission(permPaymentsReview), adminBankTransferReceiptHandler)
+		admin.POST("/bank-transfers/:id/approve", requirePermission(permPaymentsReview), approveBankTransferHandler)
+		admin.POST("/bank-transfers/:id/reject", requirePermission(permPaymentsReview), rejectBankTransferHandler)
+		admin.POST("/bank-transfers/:id/comments", requirePermission(permPaymentsReview), commentBankTransferHandler)
+		admin.GET("/referrals", requirePermission(permSubscriptionsRead), adminReferralsHandler)
+		admin.POST("/referrals/:id/approve", requirePermission(permSubscriptionsWrite), approveReferralHandler)
+		admin.POST("/referrals/:id/reject", requirePermission(permSubscriptionsWrite), rejectReferralHandler)
+		admin.GET("/coupons", requirePermission(permPlansManage), adminCouponsHandler)
+		admin.POST("/coupons", requirePermission(permPlansManage), createCouponHandler)
+		admin.PUT("/coupons/:id", requirePermission(permPlansManage), updateCouponHandler)
+		admin.DELETE("/coupons/:id", requirePermission(permPlansManage), deleteCouponHandler)
+		admin.GET("/coupons/report", requirePermission(permRevenueRead), couponReportHandler)
+		admin.GET("/coupons/:id/redemptions", requirePermission(permRevenueRead), couponRedemptionsHandler)
+		admin.GET("/plans", requirePermission(permPlansManage), adminPlansHandler)
+		admin.POST("/plans", requirePermission(permPlansManage), createPlanHandler)
+		admin.PUT("/plans/:id", requirePermission(permPlansManage), updatePlanHandler)
+		admin.POST("/plans/:id/archive", requirePermission(permPlansManage), archivePlanHandler)
+		admin.GET("/ipo-sources", requirePermission(permIPOSourcesManage), ipoSourcesHandler)
+		admin.POST("/ipo-sources", requirePermission(permIPOSourcesManage), addIPOSourceHandler)
+		admin.DELETE("/ipo-sources/:id", requirePermission(permIPOSourcesManage), deleteIPOSourceHandler)
+		admin.POST("/ipo-results", requirePermission(permIPOSourcesManage), publishAllotmentResultsHandler)
+		admin.GET("/analytics", requirePermission(permRevenueRead), analyticsHandler)
 	}
 
-	// API routes for AJAX requests
+	// API routes (session JWT or personal API token with the right scope)
 	api := r.Group("/api")
-	api.Use(authMiddleware())
+	api.Use(apiAuthMiddleware())
 	{
-		api.GET("/ipos/live", getLiveIPOsHandler)
-		api.GET("/ipos/upcoming", getUpcomingIPOsHandler)
-		api.POST("/monitor/start", startMonitoringHandler)
-		api.POST("/monitor/stop", stopMonitoringHandler)
-		api.GET("/monitor/status", monitorStatusHandler)
+		api.GET("/ipos/live", requireScope(scopeReadIPOs), getLiveIPOsHandler)
+		api.GET("/ipos/upcoming", requireScope(scopeReadIPOs), getUpcomingIPOsHandler)
+		api.POST("/monitor/start", requireScope(scopeWriteMonitor), startMonitoringHandler)
+		api.POST("/monitor/stop", requireScope(scopeWriteMonitor), stopMonitoringHandler)
+		api.GET("/monitor/status", requireScope(scopeWriteMonitor), monitorStatusHandler)
+		api.POST("/apply/:ipo_id", requireScope(scopeWriteApply), applyIPOHandler)
+		api.GET("/notifications", requireScope(scopeReadNotifications), notificationsHandler)
+		api.POST("/notifications/read", requireScope(scopeWriteNotifications), markNotificationsReadHandler)
 	}
 
-	// Payment webhook
-	r.POST("/webhook/payment", paymentWebhookHandler)
+	// Gateway notifications, and our own HMAC-signed relay (see webhooks.go)
+	r.POST("/webhook/payment/:gateway", paymentWebhookHandler)
+	r.POST("/webhook/relay", relayWebhookHandler)
+
+	// Telegram bot updates in webhook mode (TELEGRAM_WEBHOOK_SECRET)
+	r.POST("/webhook/telegram", telegramWebhookHandler)
 
 	// Nepal Payment Gateways
 	payment := r.Group("/payment")
+	payment.Use(rateLimitMiddleware("payment", paymentIPLimit))
 	{
-		payment.POST("/nepal", nepaliPaymentHandler)
-		payment.GET("/esewa/success", esewaSuccessHandler)
-		payment.GET("/esewa/failure", func(c *gin.Context) {
-			c.JSON(http.StatusBadRequest, gin.H{"message": "Payment failed"})
-		})
-		payment.POST("/khalti/success", khaltiSuccessHandler)
-		payment.GET("/connectips", connectIPSHandler)
+		payment.GET("/methods", paymentMethodsHandler)
+		payment.POST("/nepal", authMiddleware(), startPaymentHandler)
+		payment.POST("/quote", authMiddleware(), paymentQuoteHandler)
+		payment.POST("/coupon", authMiddleware(), checkCouponHandler)
+		payment.GET("/checkout/:reference", authMiddleware(), paymentCheckoutHandler)
+		payment.GET("/esewa/success", paymentCallbackHandler("esewa"))
+		payment.GET("/esewa/failure", paymentCallbackHandler("esewa"))
+		payment.GET("/khalti/return", paymentCallbackHandler("khalti"))
+		payment.GET("/connectips/success", paymentCallbackHandler("connectips"))
+		payment.GET("/connectips/failure", paymentCallbackHandler("connectips"))
+	}
+
+	// Local fakes for development (ESEWA_ENV, KHALTI_ENV, CONNECTIPS_ENV, TELEGRAM_ENV=fake)
+	if os.Getenv("ESEWA_ENV") == "fake" {
+		mountFakeEsewa(r)
+	}
+	if os.Getenv("KHALTI_ENV") == "fake" {
+		mountFakeKhalti(r)
+	}
+	if os.Getenv("CONNECTIPS_ENV") == "fake" {
+		mountFakeConnectIPS(r)
+	}
+	if os.Getenv("TELEGRAM_ENV") == "fake" {
+		mountFakeTelegram(r)
 	}
 
 	// API documentation
@@ -138,12 +311,16 @@ func initializeAdmin() {
 	result := db.Where("email = ?", "admin@ipopilot.com").First(&admin)
 	if result.Error == gorm.ErrRecordNotFound {
 		hashedPassword, _ := hashPassword("admin123")
+		now := time.Now()
 		admin = User{
-			Email:    "admin@ipopilot.com",
-			Password: hashedPassword,
-			Name:     "Administrator",
-			IsAdmin:  true,
-			IsActive: true,
+			Email:           "admin@ipopilot.com",
+			EmailCanonical:  canonicalEmail("admin@ipopilot.com"),
+			EmailVerified:   true,
+			EmailVerifiedAt: &now,
+			Password:        hashedPassword,
+			Name:            "Administrator",
+			IsAdmin:         true,
+			IsActive:        true,
 		}
 		db.Create(&admin)
 		log.Println("✓ Default admin user created")
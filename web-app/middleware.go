@@ -3,52 +3,112 @@ package main
 import (
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// Read the bearer token from the Authorization header or auth cookie
+func requestToken(c *gin.Context) string {
+	token := c.GetHeader("Authorization")
+	if token == "" {
+		cookie, err := c.Cookie("auth_token")
+		if err == nil {
+			token = cookie
+		}
+	}
+
+	// Remove "Bearer " prefix if present
+	return strings.TrimPrefix(token, "Bearer ")
+}
+
+// Validate a session JWT and set user info in context. Sessions issued
+// before the user's last password reset are rejected.
+func authenticateSession(c *gin.Context, token string) bool {
+	claims, err := validateJWT(token)
+	if err != nil {
+		return false
+	}
+
+	var user User
+	if err := db.Select("id", "token_version").First(&user, claims.UserID).Error; err != nil || user.TokenVersion != claims.TokenVersion {
+		return false
+	}
+
+	c.Set("userID", claims.UserID)
+	c.Set("isAdmin", claims.IsAdmin)
+	c.Set("twoFactorAt", claims.TwoFactorAt)
+	c.Set("passwordAt", claims.PasswordAt)
+	return true
+}
+
 // Authentication middleware
 func authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Get token from header or cookie
-		token := c.GetHeader("Authorization")
-		if token == "" {
-			cookie, err := c.Cookie("auth_token")
-			if err == nil {
-				token = cookie
-			}
+		token := requestToken(c)
+
+		if token == "" || !authenticateSession(c, token) {
+			c.Redirect(http.StatusFound, "/login")
+			c.Abort()
+			return
 		}
 
-		// Remove "Bearer " prefix if present
-		token = strings.TrimPrefix(token, "Bearer ")
+		c.Next()
+	}
+}
+
+// API authentication middleware - accepts a session JWT or a personal API
+// token, and answers with JSON errors instead of redirecting to /login
+func apiAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := requestToken(c)
 
 		if token == "" {
-			c.Redirect(http.StatusFound, "/login")
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
 			c.Abort()
 			return
 		}
 
-		// Validate token
-		claims, err := validateJWT(token)
-		if err != nil {
-			c.Redirect(http.StatusFound, "/login")
-			c.Abort()
+		if strings.HasPrefix(token, apiTokenPrefix) {
+			apiToken, err := authenticateAPIToken(token, c.ClientIP())
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired API token"})
+				c.Abort()
+				return
+			}
+
+			var user User
+			if err := db.Select("id", "is_active").First(&user, apiToken.UserID).Error; err != nil || !user.IsActive {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Account is not active"})
+				c.Abort()
+				return
+			}
+
+			// API tokens never carry admin rights
+			c.Set("userID", apiToken.UserID)
+			c.Set("isAdmin", false)
+			c.Set("apiToken", apiToken)
+			c.Next()
 			return
 		}
 
-		// Set user info in context
-		c.Set("userID", claims.UserID)
-		c.Set("isAdmin", claims.IsAdmin)
+		if !authenticateSession(c, token) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+			c.Abort()
+			return
+		}
 
 		c.Next()
 	}
 }
 
-// Admin middleware - requires user to be admin
+// Admin middleware - requires at least one staff role. Roles are read from the
+// database on every request, not from the token's is_admin claim, so granted
+// roles work and revoked ones stop working without signing in again.
 func adminMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		isAdmin, exists := c.Get("isAdmin")
-		if !exists || !isAdmin.(bool) {
+		_, viaAPIToken := c.Get("apiToken")
+		if viaAPIToken || len(getUserRoles(c.GetUint("userID"))) == 0 {
 			c.JSON(http.StatusForbidden, gin.H{
 				"error": "Admin access required",
 			})
@@ -56,6 +116,73 @@ func adminMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		// 2FA is mandatory for admins: the session itself must have passed it
+		if c.GetInt64("twoFactorAt") == 0 {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":                "Two-factor authentication required for admin access",
+				"two_factor_setup_url": "/dashboard/settings",
+				"two_factor_required":  true,
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// Sensitive-action middleware - users with 2FA must have confirmed it recently
+func requireRecentTwoFactor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var user User
+		if err := db.Select("id", "two_factor_enabled").First(&user, c.GetUint("userID")).Error; err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+			c.Abort()
+			return
+		}
+
+		if user.TwoFactorEnabled {
+			confirmedAt := time.Unix(c.GetInt64("twoFactorAt"), 0)
+			if c.GetInt64("twoFactorAt") == 0 || time.Since(confirmedAt) > twoFactorConfirmTTL {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error":                       "Please confirm your two-factor code to continue",
+					"two_factor_confirm_required": true,
+				})
+				c.Abort()
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// Stricter than requireRecentTwoFactor, for reading secrets back: users with 2FA
+// must have confirmed it recently, everyone else must have re-entered their password
+func requireRecentConfirmation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var user User
+		if err := db.Select("id", "two_factor_enabled").First(&user, c.GetUint("userID")).Error; err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+			c.Abort()
+			return
+		}
+
+		if user.TwoFactorEnabled {
+			requireRecentTwoFactor()(c)
+			return
+		}
+
+		confirmedAt := c.GetInt64("passwordAt")
+		if confirmedAt == 0 || time.Since(time.Unix(confirmedAt, 0)) > twoFactorConfirmTTL {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":                     "Please confirm your password to continue",
+				"password_confirm_required": true,
+			})
+			c.Abort()
+			return
+		}
+
 		c.Next()
 	}
 }
@@ -76,12 +203,3 @@ func corsMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
-
-// Rate limiting middleware
-func rateLimitMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// TODO: Implement rate limiting
-		// Using redis or in-memory cache
-		c.Next()
-	}
-}
@@ -10,22 +10,121 @@ import (
 type User struct {
 	gorm.Model
 	Email           string         `gorm:"uniqueIndex;not null"`
+	EmailCanonical  string         `gorm:"index" json:"-"` // Alias-stripped email, used for trial abuse checks
+	EmailVerified   bool           `gorm:"default:false"`
+	EmailVerifiedAt *time.Time
 	Password        string         `gorm:"not null"`
 	Name            string         `gorm:"not null"`
 	IsAdmin         bool           `gorm:"default:false"`
 	IsActive        bool           `gorm:"default:true"`
+	TwoFactorEnabled bool          `gorm:"default:false"`
+	TOTPSecretEnc   string         `json:"-"` // Encrypted base32 TOTP secret
+	TOTPKeyVersion  int            `gorm:"default:0" json:"-"` // 1 = encrypted under TOTP_ENCRYPTION_KEY, 0 = legacy key from the user ID
+	TOTPLastStep    int64          `json:"-"` // Last accepted time step, blocks code replay
+	FailedLogins    int            `gorm:"default:0"` // Consecutive failures, reset on success
+	LockedUntil     *time.Time
+	TokenVersion    int            `gorm:"default:0" json:"-"` // Bumped on password reset; sessions of older versions are rejected
+	BillingName     string // Name or business name on invoices
+	BillingPAN      string // Buyer PAN/VAT number on invoices
+	BillingAddress  string
+	ReferralCode    string         `gorm:"index;size:16" json:"-"` // Shared in referral links, unique
+	ReferredByID    *uint          `gorm:"index" json:"-"`
+	SignupIP        string         `json:"-"`
+	ReferralCreditDays int         `gorm:"default:0" json:"-"` // Earned free days not yet added to a paid subscription
+	Language        string         `gorm:"default:english"` // english or nepali, for emails
+	EmailOptOuts    string         `json:"-"` // Legacy unsubscribes, moved to NotificationPreference by migrateEmailOptOuts
+	Phone           string         `json:"phone"` // Verified 10-digit mobile number for SMS alerts
+	PhoneVerifiedAt *time.Time     `json:"phone_verified_at"`
+	TelegramChatID  int64          `gorm:"index" json:"-"` // Linked Telegram chat, 0 = not linked
+	TelegramUserID  int64          `gorm:"index" json:"-"` // Telegram account that linked the chat, the only one it answers
+	TelegramUsername string        `json:"telegram_username"`
+	TelegramLinkedAt *time.Time    `json:"telegram_linked_at"`
+	Roles           []UserRole     `gorm:"foreignKey:UserID"`
 	Subscriptions   []Subscription `gorm:"foreignKey:UserID"`
 	Profiles        []Profile      `gorm:"foreignKey:UserID"`
 	IPOApplications []IPOApplication `gorm:"foreignKey:UserID"`
 }
 
+// UserRole assigns a staff role (see rbac.go) to a user
+type UserRole struct {
+	gorm.Model
+	UserID       uint   `gorm:"uniqueIndex:idx_user_role;not null"`
+	Role         string `gorm:"uniqueIndex:idx_user_role;not null"` // support, finance, source-manager, super-admin
+	AssignedByID uint
+}
+
+// APIToken is a personal access token for /api (only the hash is stored)
+type APIToken struct {
+	gorm.Model
+	UserID     uint       `gorm:"index;not null" json:"-"`
+	Name       string     `gorm:"not null" json:"name"`
+	TokenHash  string     `gorm:"uniqueIndex;not null" json:"-"`
+	Prefix     string     `json:"prefix"` // First characters, to help users tell tokens apart
+	Scopes     string     `gorm:"not null" json:"scopes"` // Comma-separated, see apiTokenScopes
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIP string     `json:"last_used_ip"`
+	RevokedAt  *time.Time `json:"-"`
+}
+
+// RecoveryCode is a single-use 2FA backup code (stored hashed)
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"index;not null"`
+	CodeHash string `gorm:"not null"`
+	UsedAt   *time.Time
+}
+
+// LoginAttempt records every sign-in attempt for auditing
+type LoginAttempt struct {
+	gorm.Model
+	UserID    *uint  `gorm:"index"`
+	Email     string `gorm:"index;not null"`
+	IPAddress string `gorm:"index"`
+	UserAgent string
+	Success   bool
+	Reason    string // bad_password, bad_2fa_code, locked, inactive, unknown_user
+}
+
+// RateLimitBucket persists a token bucket for the shared backend
+type RateLimitBucket struct {
+	BucketKey string `gorm:"primaryKey"`
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+// Plan is a purchasable subscription plan from the catalog (see plans.go)
+type Plan struct {
+	gorm.Model
+	Code               string  `gorm:"uniqueIndex;size:50;not null" json:"code"` // trial, premium, ...
+	Name               string  `gorm:"not null" json:"name"`
+	NameNepali         string  `json:"name_nepali"`
+	Description        string  `json:"description"`
+	DescriptionNepali  string  `json:"description_nepali"`
+	Features           string  `gorm:"type:text" json:"features"`        // One per line
+	FeaturesNepali     string  `gorm:"type:text" json:"features_nepali"` // One per line
+	Price              float64 `gorm:"not null" json:"price"`            // NPR
+	DurationMonths     int     `json:"duration_months"`
+	DurationDays       int     `json:"duration_days"` // Added to DurationMonths
+	MaxProfiles        int     `json:"max_profiles"`     // -1 = unlimited
+	MaxApplications    int     `json:"max_applications"` // Per period, -1 = unlimited
+	MinMonitorInterval int     `json:"min_monitor_interval"` // Seconds
+	IsTrial            bool    `gorm:"default:false" json:"is_trial"` // Granted on email verification, never sold
+	IsPopular          bool    `gorm:"default:false" json:"is_popular"`
+	SortOrder          int     `gorm:"default:0" json:"sort_order"`
+	IsActive           bool    `json:"is_active"`   // Shown on the pricing page and purchasable
+	IsArchived         bool    `json:"is_archived"` // Retired; kept for existing subscriptions
+}
+
 // Subscription represents a user's subscription plan
 type Subscription struct {
 	gorm.Model
 	UserID          uint      `gorm:"not null"`
 	User            User      `gorm:"foreignKey:UserID"`
-	PlanType        string    `gorm:"not null"` // trial, premium
-	Status          string    `gorm:"not null"` // active, expired, cancelled
+	PlanID          *uint     `gorm:"index"`
+	Plan            *Plan     `gorm:"foreignKey:PlanID"`
+	PlanType        string    `gorm:"not null"` // Plan code at purchase time: trial, premium, ...
+	Status          string    `gorm:"not null"` // trial, active, grace, expired, cancelled, superseded (see subscription_lifecycle.go)
 	IsTrial         bool      `gorm:"default:false"` // True for 7-day free trial
 	TrialEndDate    *time.Time `gorm:""`          // For trial subscriptions
 	StartDate       time.Time `gorm:"not null"`
@@ -33,8 +132,296 @@ type Subscription struct {
 	Price           float64   `gorm:"not null"`
 	PaymentMethod   string    `gorm:"not null"`
 	TransactionID   string    
-	MaxProfiles     int       `gorm:"default:1"`
-	MaxApplications int       `gorm:"default:100"`
+	MaxProfiles     int       `gorm:"default:1"`   // Limits are copied from the plan at purchase; -1 = unlimited
+	MaxApplications int       `gorm:"default:100"` // Per subscription period, -1 = unlimited
+	MinMonitorInterval int    `gorm:"default:300"` // Shortest allowed monitoring interval, seconds
+	GraceEndDate     *time.Time // Set when a paid plan enters its grace period
+	LastReminderDays int        `gorm:"default:0"` // Smallest expiry reminder sent (7/3/1), 0 = none
+	CancelledAt      *time.Time
+	SupersededByID   *uint      // Subscription that replaced this one
+}
+
+// PaymentTransaction is one payment attempt in the ledger (see payments.go)
+type PaymentTransaction struct {
+	gorm.Model
+	UserID         uint       `gorm:"index;not null" json:"user_id"`
+	PlanID         uint       `gorm:"not null" json:"plan_id"`
+	SubscriptionID *uint      `gorm:"index" json:"subscription_id"` // Subscription extended, or created on completion
+	Gateway        string     `gorm:"not null" json:"gateway"`       // esewa, khalti, connectips, bank_transfer
+	Reference      string     `gorm:"uniqueIndex;not null" json:"reference"` // Our ID, sent to the gateway
+	GatewayRef     string     `gorm:"index" json:"gateway_ref"`              // The gateway's ID for the payment
+	GatewayURL     string     `json:"-"` // Payment page the gateway issued for GatewayRef, reused until it expires
+	GatewayURLExpiresAt *time.Time `json:"-"`
+	Amount         float64    `gorm:"not null" json:"amount"` // Charged: ListPrice - DiscountAmount
+	ListPrice      float64    `json:"list_price"`             // Plan price at purchase time
+	DiscountAmount float64    `json:"discount_amount"`
+	CouponID       *uint      `gorm:"index" json:"coupon_id"`
+	CouponCode     string     `json:"coupon_code,omitempty"`
+	Kind           string     `json:"kind"`             // new, renewal, upgrade
+	ProrationCredit float64   `json:"proration_credit"` // Unused value of the plan being upgraded from
+	ReplacesSubscriptionID *uint `json:"replaces_subscription_id,omitempty"`
+	Currency       string     `gorm:"not null;default:NPR" json:"currency"`
+	Status         string     `gorm:"index;not null" json:"status"` // pending, completed, failed, refunded (in full)
+	RefundedAmount float64    `gorm:"default:0" json:"refunded_amount"`
+	FailureReason  string     `json:"failure_reason,omitempty"`
+	RawPayload     string     `gorm:"type:text" json:"-"` // Last callback/verification payload
+	CompletedAt    *time.Time `json:"completed_at"`
+	PeriodStart    *time.Time `json:"period_start"` // Subscription time this payment bought
+	PeriodEnd      *time.Time `json:"period_end"`
+}
+
+// BankTransferClaim is a user's claim that they paid for a plan by bank transfer.
+// It holds a pending PaymentTransaction that an admin completes or fails.
+type BankTransferClaim struct {
+	gorm.Model
+	UserID               uint       `gorm:"index;not null" json:"user_id"`
+	PlanID               uint       `gorm:"not null" json:"plan_id"`
+	PaymentTransactionID uint       `gorm:"not null" json:"payment_transaction_id"`
+	BankReference        string     `gorm:"index;not null" json:"bank_reference"` // Voucher/transaction number from the bank
+	Amount               float64    `gorm:"not null" json:"amount"`
+	TransferDate         time.Time  `json:"transfer_date"`
+	ReceiptPath          string     `json:"-"` // Relative to the upload directory
+	ReceiptName          string     `json:"receipt_name"`
+	ReceiptType          string     `json:"receipt_type"`
+	Status               string     `gorm:"index;not null" json:"status"` // pending, approved, rejected
+	ReviewedBy           *uint      `json:"reviewed_by"`
+	ReviewedAt           *time.Time `json:"reviewed_at"`
+	Comments             []BankTransferComment `gorm:"foreignKey:ClaimID" json:"comments,omitempty"`
+}
+
+// BankTransferComment is a reviewer note on a claim, visible to the user
+type BankTransferComment struct {
+	gorm.Model
+	ClaimID  uint   `gorm:"index;not null" json:"claim_id"`
+	AuthorID uint   `gorm:"not null" json:"author_id"`
+	Body     string `gorm:"type:text;not null" json:"body"`
+}
+
+// WebhookEvent is a verified gateway webhook, kept for audit and processed
+// asynchronously (see webhooks.go)
+type WebhookEvent struct {
+	gorm.Model
+	Gateway       string     `gorm:"uniqueIndex:idx_webhook_gateway_event;not null" json:"gateway"`
+	EventID       string     `gorm:"uniqueIndex:idx_webhook_gateway_event;not null" json:"event_id"` // Deduplicates redeliveries
+	Type          string     `json:"type"`
+	Reference     string     `gorm:"index" json:"reference"` // PaymentTransaction.Reference
+	Payload       string     `gorm:"type:text" json:"payload"` // Raw body as received
+	Signature     string     `json:"signature"`
+	SentAt        time.Time  `json:"sent_at"` // X-Webhook-Timestamp from the relay, else when received
+	RemoteIP      string     `json:"remote_ip"`
+	Status        string     `gorm:"index;not null" json:"status"` // pending, processing, processed, failed
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `gorm:"index" json:"next_attempt_at"`
+	LastError     string     `json:"last_error,omitempty"`
+	ProcessedAt   *time.Time `json:"processed_at"`
+}
+
+// EmailOutbox is a notification email waiting to be sent, or already sent
+// (see mail_outbox.go)
+type EmailOutbox struct {
+	gorm.Model
+	UserID         uint       `gorm:"index;not null" json:"user_id"`
+	Type           string     `gorm:"index;not null" json:"type"` // Notification type, see notifications.go
+	DedupeKey      string     `gorm:"index" json:"dedupe_key,omitempty"` // Same key for the same user is only queued once
+	To             string     `gorm:"not null" json:"to"`
+	Subject        string     `json:"subject"`
+	TextBody       string     `gorm:"type:text" json:"text_body"`
+	UnsubscribeURL string     `json:"-"`
+	Status         string     `gorm:"index;not null" json:"status"` // pending, sending, sent, failed
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  time.Time  `gorm:"index" json:"next_attempt_at"`
+	LastError      string     `json:"last_error,omitempty"`
+	SentAt         *time.Time `json:"sent_at"`
+}
+
+// PhoneVerification is a pending one-time code sent to a new phone number
+type PhoneVerification struct {
+	gorm.Model
+	UserID    uint      `gorm:"uniqueIndex;not null"` // One pending number per user
+	Phone     string    `gorm:"not null"`
+	CodeHash  string    `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	Attempts  int       `gorm:"default:0"`
+}
+
+// SMSLog records every SMS sent or attempted; alerts count against the daily quota
+type SMSLog struct {
+	gorm.Model
+	UserID    uint   `gorm:"index;not null" json:"user_id"`
+	Type      string `gorm:"index;not null" json:"type"` // Notification type, or otp
+	DedupeKey string `gorm:"index" json:"dedupe_key,omitempty"`
+	To        string `gorm:"not null" json:"to"`
+	Text      string `json:"text"`
+	Provider  string `json:"provider"`
+	Status    string `gorm:"index;not null" json:"status"` // pending, sent, failed
+	Error     string `json:"error,omitempty"`
+}
+
+// TelegramLinkCode is a one-time code that links a Telegram chat to a user
+type TelegramLinkCode struct {
+	gorm.Model
+	UserID    uint      `gorm:"uniqueIndex;not null"` // One open code per user
+	CodeHash  string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+// TelegramLog records every alert sent to a linked Telegram chat
+type TelegramLog struct {
+	gorm.Model
+	UserID    uint   `gorm:"index;not null" json:"user_id"`
+	ChatID    int64  `json:"chat_id"`
+	Type      string `gorm:"index;not null" json:"type"` // Notification type
+	DedupeKey string `gorm:"index" json:"dedupe_key,omitempty"`
+	Text      string `json:"text"`
+	MessageID int64  `json:"message_id"` // Telegram's ID, once sent
+	Status    string `gorm:"index;not null" json:"status"` // pending, sent, failed
+	Error     string `json:"error,omitempty"`
+}
+
+// Notification is an entry in the dashboard's notification center (see notification_center.go)
+type Notification struct {
+	gorm.Model
+	UserID      uint       `gorm:"index;not null" json:"user_id"`
+	Type        string     `gorm:"index;not null" json:"type"` // Notification type, or announcement
+	DedupeKey   string     `gorm:"index" json:"-"`
+	Title       string     `gorm:"not null" json:"title"`
+	Body        string     `gorm:"type:text" json:"body"`
+	Link        string     `json:"link,omitempty"` // Page to open, relative to the site
+	BroadcastID *uint      `gorm:"index" json:"broadcast_id,omitempty"`
+	ReadAt      *time.Time `gorm:"index" json:"read_at"`
+}
+
+// NotificationPreference is how a user wants to be notified (see notification_preferences.go).
+// Users without one get every channel, instantly.
+type NotificationPreference struct {
+	gorm.Model
+	UserID          uint   `gorm:"uniqueIndex;not null" json:"-"`
+	Channels        string `gorm:"type:text" json:"-"` // JSON: notification type -> enabled channels; missing types use the defaults
+	QuietHoursStart string `json:"quiet_hours_start"`  // HH:MM Nepal time, empty = no quiet hours
+	QuietHoursEnd   string `json:"quiet_hours_end"`
+	Delivery        string `gorm:"default:instant" json:"delivery"` // instant or digest
+	DigestHour      int    `gorm:"default:8" json:"digest_hour"`    // Nepal time hour the daily digest goes out
+}
+
+// PendingNotification is a notification held back by quiet hours or for the
+// daily digest, delivered later by the notification scheduler. Delivered rows
+// are soft-deleted and kept for deduplication.
+type PendingNotification struct {
+	gorm.Model
+	UserID       uint      `gorm:"index;not null"`
+	Type         string    `gorm:"not null"`
+	DedupeKey    string    `gorm:"index"`
+	Data         string    `gorm:"type:text"` // JSON template data
+	Channels     string    `gorm:"not null"`  // Comma-separated
+	Digest       bool      `gorm:"index"`
+	DeliverAfter time.Time `gorm:"index;not null"`
+}
+
+// Broadcast is an announcement an admin sent to many users' notification centers
+type Broadcast struct {
+	gorm.Model
+	Title      string `gorm:"not null" json:"title"`
+	Body       string `gorm:"type:text" json:"body"`
+	Link       string `json:"link,omitempty"`
+	Audience   string `gorm:"not null" json:"audience"` // all or subscribers
+	SentBy     uint   `json:"sent_by"`
+	Recipients int    `json:"recipients"`
+}
+
+// Invoice is a VAT invoice for a completed payment. Seller, buyer and plan
+// details are copied at issue time so the invoice never changes afterwards.
+type Invoice struct {
+	gorm.Model
+	Number               string    `gorm:"uniqueIndex;not null" json:"number"` // INV-2083-84-000001
+	UserID               uint      `gorm:"index;not null" json:"user_id"`
+	SubscriptionID       uint      `gorm:"index" json:"subscription_id"`
+	PaymentTransactionID uint      `gorm:"uniqueIndex;not null" json:"payment_transaction_id"`
+	IssuedAt             time.Time `json:"issued_at"`
+	SellerName           string    `json:"seller_name"`
+	SellerPAN            string    `json:"seller_pan"`
+	SellerAddress        string    `json:"seller_address"`
+	BuyerName            string    `json:"buyer_name"`
+	BuyerEmail           string    `json:"buyer_email"`
+	BuyerPAN             string    `json:"buyer_pan"`
+	BuyerAddress         string    `json:"buyer_address"`
+	PlanName             string    `json:"plan_name"`
+	PlanNameNepali       string    `json:"plan_name_nepali"`
+	PeriodStart          time.Time `json:"period_start"`
+	PeriodEnd            time.Time `json:"period_end"`
+	PaymentMethod        string    `json:"payment_method"`
+	PaymentReference     string    `json:"payment_reference"`
+	TaxableAmount        float64   `json:"taxable_amount"`
+	VATRate              float64   `json:"vat_rate"` // Percent
+	VATAmount            float64   `json:"vat_amount"`
+	TotalAmount          float64   `json:"total_amount"`
+	Currency             string    `json:"currency"`
+}
+
+// InvoiceSequence hands out gapless invoice numbers per Nepali fiscal year
+type InvoiceSequence struct {
+	Year       int `gorm:"primaryKey;autoIncrement:false"` // BS year the fiscal year starts in
+	LastNumber int `gorm:"not null"`
+}
+
+// Refund returns (part of) a completed payment, through its gateway or by hand
+type Refund struct {
+	gorm.Model
+	PaymentTransactionID uint       `gorm:"index;not null" json:"payment_transaction_id"`
+	SubscriptionID       *uint      `gorm:"index" json:"subscription_id"`
+	UserID               uint       `gorm:"index;not null" json:"user_id"`
+	Amount               float64    `gorm:"not null" json:"amount"`
+	Reason               string     `json:"reason"`
+	Method               string     `gorm:"not null" json:"method"` // gateway or manual
+	Status               string     `gorm:"index;not null" json:"status"` // pending, completed
+	FailureReason        string     `json:"failure_reason,omitempty"` // Why the gateway couldn't do it
+	GatewayAttemptedAt   *time.Time `json:"gateway_attempted_at,omitempty"` // Set before asking the gateway, so it's asked once
+	GatewayRefundedAt    *time.Time `json:"gateway_refunded_at,omitempty"`  // The gateway confirmed it returned the money
+	ManualReference      string     `json:"manual_reference,omitempty"` // Bank/wallet reference of a manual refund
+	RequestedByID        uint       `json:"requested_by_id"`
+	ProcessedByID        *uint      `json:"processed_by_id,omitempty"`
+	ProcessedAt          *time.Time `json:"processed_at"`
+}
+
+// Coupon is a discount code applied when a payment starts
+type Coupon struct {
+	gorm.Model
+	Code           string     `gorm:"uniqueIndex;size:50;not null" json:"code"` // Upper case
+	Description    string     `json:"description"`
+	DiscountType   string     `gorm:"not null" json:"discount_type"` // percent or fixed
+	DiscountValue  float64    `gorm:"not null" json:"discount_value"` // Percent, or NPR off
+	PlanCodes      string     `json:"plan_codes"`                     // Comma-separated; empty = every plan
+	StartsAt       *time.Time `json:"starts_at"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	MaxRedemptions int        `json:"max_redemptions"` // 0 = unlimited
+	PerUserLimit   int        `json:"per_user_limit"`  // 0 = unlimited
+	IsActive       bool       `json:"is_active"`
+}
+
+// CouponRedemption records a completed payment that used a coupon
+type CouponRedemption struct {
+	gorm.Model
+	CouponID             uint    `gorm:"index;not null" json:"coupon_id"`
+	UserID               uint    `gorm:"index;not null" json:"user_id"`
+	PaymentTransactionID uint    `gorm:"uniqueIndex;not null" json:"payment_transaction_id"`
+	PlanID               uint    `json:"plan_id"`
+	DiscountAmount       float64 `json:"discount_amount"`
+	AmountPaid           float64 `json:"amount_paid"`
+}
+
+// Referral links a new user to the user who referred them. It qualifies when
+// the referred user's first payment completes.
+type Referral struct {
+	gorm.Model
+	ReferrerID           uint       `gorm:"index;not null" json:"referrer_id"`
+	ReferredID           uint       `gorm:"uniqueIndex;not null" json:"referred_id"`
+	Status               string     `gorm:"index;not null" json:"status"` // pending, flagged, rewarded, capped, rejected, revoked
+	FlagReason           string     `json:"flag_reason,omitempty"`        // Why an admin needs to look at it
+	PaymentTransactionID *uint      `json:"payment_transaction_id"`       // The qualifying payment
+	RewardDays           int        `json:"reward_days"`
+	QualifiedAt          *time.Time `json:"qualified_at"`
+	RewardedAt           *time.Time `json:"rewarded_at"`
+	RevokedAt            *time.Time `json:"revoked_at,omitempty"`
+	ReviewedByID         *uint      `json:"reviewed_by_id,omitempty"`
 }
 
 // Profile represents a MeroShare account profile
@@ -71,6 +458,9 @@ type IPOApplication struct {
 	Status         string    `gorm:"not null"` // pending, success, failed
 	AppliedAt      time.Time `gorm:"not null"`
 	ResponseMsg    string
+	AllotmentStatus string    // Empty until results are published: allotted, not_allotted
+	AllottedKittas  int
+	ResultAt        *time.Time
 }
 
 // IPOSource represents an IPO data source
@@ -97,6 +487,7 @@ type MonitoringSession struct {
 	StartedAt time.Time `gorm:"not null"`
 	StoppedAt *time.Time
 	Interval  int       `gorm:"default:300"` // seconds
+	PausedReason string // Set when stopped by the system rather than the user, e.g. subscription_ended
 }
 
 // IPOData represents IPO information from various sources
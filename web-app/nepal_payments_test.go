@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+// The base64 JSON "data" eSewa sends back
+func encodeEsewaData(t *testing.T, fields map[string]string) string {
+	t.Helper()
+
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatalf("encoding eSewa data: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func TestLiveGatewaysNeedTheirSecrets(t *testing.T) {
+	t.Setenv("ESEWA_ENV", "live")
+	t.Setenv("ESEWA_MERCHANT_CODE", "NP-ES-IPOPILOT")
+	t.Setenv("ESEWA_SECRET", "")
+	t.Setenv("KHALTI_ENV", "live")
+	t.Setenv("KHALTI_SECRET_KEY", "")
+
+	config := getNepalPaymentConfig()
+	if config.EsewaEnabled || config.EsewaSecret != "" {
+		t.Fatalf("live eSewa without ESEWA_SECRET: enabled %v, secret %q", config.EsewaEnabled, config.EsewaSecret)
+	}
+	if config.KhaltiEnabled || config.KhaltiSecretKey != "" {
+		t.Fatalf("live Khalti without KHALTI_SECRET_KEY: enabled %v, key %q", config.KhaltiEnabled, config.KhaltiSecretKey)
+	}
+
+	// A payload signed with the public UAT key must not pass
+	fields := map[string]string{"transaction_uuid": "IPO-1", "total_amount": "1999", "status": "COMPLETE", "product_code": "NP-ES-IPOPILOT", "signed_field_names": "transaction_uuid,total_amount,status,product_code,signed_field_names"}
+	fields["signature"] = esewaSignature(esewaUATSecret, fields, fields["signed_field_names"])
+	if _, err := decodeEsewaCallback(config, encodeEsewaData(t, fields)); err == nil {
+		t.Fatal("live eSewa accepted a callback signed with the UAT key")
+	}
+
+	t.Setenv("ESEWA_SECRET", "live-secret")
+	t.Setenv("KHALTI_SECRET_KEY", "live_secret_key")
+	if config := getNepalPaymentConfig(); !config.EsewaEnabled || !config.KhaltiEnabled {
+		t.Fatal("live gateways with their secrets set are disabled")
+	}
+
+	// Sandboxes keep working out of the box
+	t.Setenv("ESEWA_ENV", "")
+	t.Setenv("ESEWA_SECRET", "")
+	t.Setenv("KHALTI_ENV", "")
+	t.Setenv("KHALTI_SECRET_KEY", "")
+	if config := getNepalPaymentConfig(); config.EsewaSecret != esewaUATSecret || config.KhaltiSecretKey != khaltiTestSecretKey {
+		t.Fatal("sandbox credentials aren't used outside live mode")
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// In-app notification center: the bell in the dashboard navbar. notifyUser
+// stores an entry for every type in inAppTemplates, so application results,
+// monitoring problems and subscription changes show up even when email, SMS
+// and Telegram are off. Admin broadcasts are written straight to it.
+
+const (
+	notificationPageSize    = 20
+	notificationMaxPageSize = 100
+	broadcastBatchSize      = 500
+)
+
+// Broadcast audiences
+const (
+	AudienceAll         = "all"
+	AudienceSubscribers = "subscribers" // Users whose subscription grants access
+)
+
+// InAppTemplate is the title and short body of a notification center entry
+type InAppTemplate struct {
+	Title string
+	Body  string
+}
+
+// Notification center text per type and language; types without one aren't stored
+var inAppTemplates = map[string]map[string]InAppTemplate{
+	NotifyNewIPO: {
+		"english": {Title: "New IPO: {{.Company}}", Body: "Open for applications{{if .CloseDate}} until {{.CloseDate}}{{end}}.{{if .Price}} Price per unit: {{.Price}}.{{end}}"},
+		"nepali":  {Title: "नयाँ IPO: {{.Company}}", Body: "आवेदन खुला छ{{if .CloseDate}}, {{.CloseDate}} सम्म{{end}}।{{if .Price}} प्रति कित्ता मूल्य: {{.Price}}।{{end}}"},
+	},
+	NotifyApplicationSubmitted: {
+		"english": {Title: "Applied: {{.Company}}", Body: "{{.Kittas}} kitta for {{.Profile}}."},
+		"nepali":  {Title: "आवेदन पेश भयो: {{.Company}}", Body: "{{.Profile}} का लागि {{.Kittas}} कित्ता।"},
+	},
+	NotifyApplicationFailed: {
+		"english": {Title: "Application failed: {{.Company}}", Body: "{{.Profile}}{{if .Message}}: {{.Message}}{{end}}"},
+		"nepali":  {Title: "आवेदन असफल: {{.Company}}", Body: "{{.Profile}}{{if .Message}}: {{.Message}}{{end}}"},
+	},
+	NotifyAllotmentResult: {
+		"english": {Title: "{{if .Allotted}}Allotted: {{.Company}}{{else}}Not allotted: {{.Company}}{{end}}", Body: "{{if .Allotted}}{{.Profile}} was allotted {{.Kittas}} kitta.{{else}}{{.Profile}} was not allotted this time.{{end}}"},
+		"nepali":  {Title: "{{if .Allotted}}बाँडफाँड भयो: {{.Company}}{{else}}बाँडफाँड भएन: {{.Company}}{{end}}", Body: "{{if .Allotted}}{{.Profile}} लाई {{.Kittas}} कित्ता बाँडफाँड भयो।{{else}}यस पटक {{.Profile}} लाई बाँडफाँड भएन।{{end}}"},
+	},
+	NotifySubscriptionExpiring: {
+		"english": {Title: "{{if .IsTrial}}Free trial{{else}}Subscription{{end}} ends in {{.DaysLeft}} day(s)", Body: "Renew before {{.EndDate}} to keep automatic applications running."},
+		"nepali":  {Title: "{{if .IsTrial}}निःशुल्क परीक्षण{{else}}सदस्यता{{end}} {{.DaysLeft}} दिनमा सकिँदैछ", Body: "स्वचालित आवेदन जारी राख्न {{.EndDate}} अघि नवीकरण गर्नुहोस्।"},
+	},
+	NotifyPaymentReceived: {
+		"english": {Title: "Payment received: NPR {{.Amount}}", Body: "{{.Plan}}, reference {{.Reference}}."},
+		"nepali":  {Title: "भुक्तानी प्राप्त: रु. {{.Amount}}", Body: "{{.Plan}}, सन्दर्भ {{.Reference}}।"},
+	},
+	NotifySubscriptionChanged: {
+		"english": {
+			Title: "{{if eq .Status \"active\"}}Subscription active{{else if eq .Status \"grace\"}}Subscription ended{{else if eq .Status \"expired\"}}Access expired{{else}}Subscription cancelled{{end}}",
+			Body: "{{if eq .Status \"active\"}}Your {{.Plan}} plan is active until {{.EndDate}}.{{if .Resumed}} Monitoring resumed for {{.Resumed}} profile(s).{{end}}" +
+				"{{else if eq .Status \"grace\"}}Your {{.Plan}} plan ended. You keep access until {{.GraceEndDate}}; renew to keep applying." +
+				"{{else}}{{if eq .Status \"expired\"}}Your access has expired.{{else}}Your {{.Plan}} plan was cancelled.{{end}}" +
+				"{{if .Paused}} Monitoring is paused for {{.Paused}} profile(s) and resumes when you renew.{{end}}{{end}}",
+		},
+		"nepali": {
+			Title: "{{if eq .Status \"active\"}}सदस्यता सक्रिय{{else if eq .Status \"grace\"}}सदस्यता सकियो{{else if eq .Status \"expired\"}}पहुँच समाप्त{{else}}सदस्यता रद्द{{end}}",
+			Body: "{{if eq .Status \"active\"}}तपाईंको {{.Plan}} योजना {{.EndDate}} सम्म सक्रिय छ।{{if .Resumed}} {{.Resumed}} प्रोफाइलको अनुगमन फेरि सुरु भयो।{{end}}" +
+				"{{else if eq .Status \"grace\"}}तपाईंको {{.Plan}} योजना सकियो। {{.GraceEndDate}} सम्म पहुँच रहन्छ; आवेदन जारी राख्न नवीकरण गर्नुहोस्।" +
+				"{{else}}{{if eq .Status \"expired\"}}तपाईंको पहुँच समाप्त भयो।{{else}}तपाईंको {{.Plan}} योजना रद्द भयो।{{end}}" +
+				"{{if .Paused}} {{.Paused}} प्रोफाइलको अनुगमन रोकिएको छ, नवीकरणपछि फेरि सुरु हुन्छ।{{end}}{{end}}",
+		},
+	},
+	NotifyMonitoringSkipped: {
+		"english": {Title: "Not applied: {{.Company}}", Body: "Monitoring for {{.Profile}} skipped this IPO: {{.Reason}}"},
+		"nepali":  {Title: "आवेदन दिइएन: {{.Company}}", Body: "{{.Profile}} को अनुगमनले यो IPO छोड्यो: {{.Reason}}"},
+	},
+}
+
+// Page each notification type links to
+var inAppLinks = map[string]string{
+	NotifyNewIPO:               "/dashboard/ipos",
+	NotifyApplicationSubmitted: "/dashboard/applications",
+	NotifyApplicationFailed:    "/dashboard/applications",
+	NotifyAllotmentResult:      "/dashboard/applications",
+	NotifySubscriptionExpiring: "/pricing",
+	NotifyPaymentReceived:      "/dashboard/settings",
+	NotifySubscriptionChanged:  "/dashboard/settings",
+	NotifyMonitoringSkipped:    "/pricing",
+}
+
+// Store the notification center entry for a notification
+func inAppNotification(user *User, kind, dedupeKey string, data gin.H) {
+	templates, ok := inAppTemplates[kind]
+	if !ok {
+		return
+	}
+	if dedupeKey != "" {
+		var count int64
+		db.Model(&Notification{}).Where("user_id = ? AND dedupe_key = ?", user.ID, dedupeKey).Count(&count)
+		if count > 0 {
+			return
+		}
+	}
+
+	values := notificationValues(user, data)
+	tmpl := templates[userLanguage(user)]
+	title, err := renderMessage(kind, tmpl.Title, values)
+	if err != nil {
+		log.Printf("Rendering %s notification for user %d failed: %v\n", kind, user.ID, err)
+		return
+	}
+	body, err := renderMessage(kind, tmpl.Body, values)
+	if err != nil {
+		log.Printf("Rendering %s notification for user %d failed: %v\n", kind, user.ID, err)
+		return
+	}
+
+	if err := db.Create(&Notification{
+		UserID:    user.ID,
+		Type:      kind,
+		DedupeKey: dedupeKey,
+		Title:     title,
+		Body:      body,
+		Link:      inAppLinks[kind],
+	}).Error; err != nil {
+		log.Printf("Storing %s notification for user %d failed: %v\n", kind, user.ID, err)
+	}
+}
+
+// Lifecycle hook: remind the user before their subscription ends and tell
+// them when it changes state
+func notifySubscriptionChange(event SubscriptionEvent) {
+	sub := event.Subscription
+	if event.Type == "reminder" {
+		// LastReminderDays already keeps each reminder to one send
+		notifyUser(sub.UserID, NotifySubscriptionExpiring, "", gin.H{
+			"IsTrial":  sub.IsTrial,
+			"DaysLeft": event.DaysLeft,
+			"EndDate":  sub.EndDate.In(nepalTime).Format("2006-01-02"),
+		})
+		return
+	}
+	if event.Type != "transition" || event.To == SubscriptionSuperseded || event.To == SubscriptionTrial {
+		return
+	}
+
+	data := gin.H{
+		"Status":  event.To,
+		"Plan":    sub.PlanType,
+		"EndDate": sub.EndDate.In(nepalTime).Format("2006-01-02"),
+	}
+	if plan, err := getSubscriptionPlan(&sub); err == nil {
+		data["Plan"] = plan.Name
+	}
+	if sub.GraceEndDate != nil {
+		data["GraceEndDate"] = sub.GraceEndDate.In(nepalTime).Format("2006-01-02")
+	}
+
+	// Monitoring was paused or resumed before the hooks ran
+	var sessions int64
+	if subscriptionGrantsAccess(event.To) {
+		db.Model(&MonitoringSession{}).Where("user_id = ? AND is_active = ?", sub.UserID, true).Count(&sessions)
+		if !subscriptionGrantsAccess(event.From) {
+			data["Resumed"] = sessions
+		}
+	} else {
+		db.Model(&MonitoringSession{}).Where("user_id = ? AND paused_reason = ?", sub.UserID, monitoringPausedByExpiry).Count(&sessions)
+		data["Paused"] = sessions
+	}
+
+	// cancelSubscription publishes after its gateway refunds have run
+	if event.To == SubscriptionCancelled {
+		var refunds []Refund
+		db.Where("subscription_id = ?", sub.ID).Order("id").Find(&refunds)
+		lines := []gin.H{}
+		for _, refund := range refunds {
+			lines = append(lines, gin.H{
+				"Amount":    formatInvoiceAmount(refund.Amount),
+				"Completed": refund.Status == RefundCompleted,
+			})
+		}
+		data["Refunds"] = lines
+	}
+
+	notifyUser(sub.UserID, NotifySubscriptionChanged, "", data)
+}
+
+// GET /api/notifications: newest first. ?unread=true for unread only,
+// ?before=<id> for the next page, ?limit=N (default 20, max 100).
+func notificationsHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 {
+		limit = notificationPageSize
+	}
+	if limit > notificationMaxPageSize {
+		limit = notificationMaxPageSize
+	}
+
+	query := db.Where("user_id = ?", userID).Order("id DESC").Limit(limit + 1)
+	if c.Query("unread") == "true" {
+		query = query.Where("read_at IS NULL")
+	}
+	if before, err := strconv.ParseUint(c.Query("before"), 10, 64); err == nil && before > 0 {
+		query = query.Where("id < ?", before)
+	}
+
+	var notifications []Notification
+	query.Find(&notifications)
+	hasMore := len(notifications) > limit
+	if hasMore {
+		notifications = notifications[:limit]
+	}
+
+	var unread int64
+	db.Model(&Notification{}).Where("user_id = ? AND read_at IS NULL", userID).Count(&unread)
+
+	c.JSON(http.StatusOK, gin.H{
+		"notifications": notifications,
+		"unread_count":  unread,
+		"has_more":      hasMore,
+	})
+}
+
+// POST /api/notifications/read: mark the given IDs read, or all of them without ids
+func markNotificationsReadHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var input struct {
+		IDs []uint `json:"ids"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+	}
+
+	query := db.Model(&Notification{}).Where("user_id = ? AND read_at IS NULL", userID)
+	if len(input.IDs) > 0 {
+		query = query.Where("id IN ?", input.IDs)
+	}
+	result := query.Update("read_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notifications"})
+		return
+	}
+
+	var unread int64
+	db.Model(&Notification{}).Where("user_id = ? AND read_at IS NULL", userID).Count(&unread)
+
+	c.JSON(http.StatusOK, gin.H{
+		"marked":       result.RowsAffected,
+		"unread_count": unread,
+	})
+}
+
+// Admin: send an announcement to every active user, or only to subscribers
+func createBroadcastHandler(c *gin.Context) {
+	var input struct {
+		Title    string `json:"title" binding:"required,max=120"`
+		Body     string `json:"body" binding:"max=2000"`
+		Link     string `json:"link"`
+		Audience string `json:"audience"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "title is required (at most 120 characters), body at most 2000"})
+		return
+	}
+	if input.Audience == "" {
+		input.Audience = AudienceAll
+	}
+	if input.Audience != AudienceAll && input.Audience != AudienceSubscribers {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "audience must be all or subscribers"})
+		return
+	}
+	// Shown as a link in the dashboard, so only site paths and https URLs
+	if input.Link != "" && !(strings.HasPrefix(input.Link, "/") && !strings.HasPrefix(input.Link, "//")) && !strings.HasPrefix(input.Link, "https://") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "link must be a site path (/...) or an https:// URL"})
+		return
+	}
+
+	users := db.Model(&User{}).Where("is_active = ?", true)
+	if input.Audience == AudienceSubscribers {
+		now := time.Now()
+		users = users.Where("id IN (?)", db.Model(&Subscription{}).Select("user_id").
+			Where("(status IN ? AND end_date > ?) OR (status = ? AND grace_end_date > ?)",
+				[]string{SubscriptionTrial, SubscriptionActive}, now, SubscriptionGrace, now))
+	}
+	var userIDs []uint
+	users.Pluck("id", &userIDs)
+
+	broadcast := Broadcast{
+		Title:      input.Title,
+		Body:       input.Body,
+		Link:       input.Link,
+		Audience:   input.Audience,
+		SentBy:     c.GetUint("userID"),
+		Recipients: len(userIDs),
+	}
+	// All or nothing, so Recipients is never more than actually got it
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&broadcast).Error; err != nil {
+			return err
+		}
+
+		notifications := make([]Notification, len(userIDs))
+		for i, userID := range userIDs {
+			notifications[i] = Notification{
+				UserID:      userID,
+				Type:        NotifyAnnouncement,
+				Title:       broadcast.Title,
+				Body:        broadcast.Body,
+				Link:        broadcast.Link,
+				BroadcastID: &broadcast.ID,
+			}
+		}
+		if len(notifications) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(notifications, broadcastBatchSize).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send broadcast"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":   "Broadcast sent",
+		"broadcast": broadcast,
+	})
+}
+
+// Admin: sent broadcasts, with how many recipients have read each
+func adminBroadcastsHandler(c *gin.Context) {
+	var broadcasts []Broadcast
+	db.Order("created_at DESC").Limit(100).Find(&broadcasts)
+
+	type broadcastStats struct {
+		Broadcast
+		Read int64 `json:"read"`
+	}
+	results := make([]broadcastStats, len(broadcasts))
+	for i := range broadcasts {
+		results[i].Broadcast = broadcasts[i]
+		db.Model(&Notification{}).Where("broadcast_id = ? AND read_at IS NOT NULL", broadcasts[i].ID).Count(&results[i].Read)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":      len(results),
+		"broadcasts": results,
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func TestFailedBroadcastLeavesNoPartialRecord(t *testing.T) {
+	setupTestDB(t)
+	admin := createTestUser(t, "admin@example.com")
+	createTestUser(t, "reader@example.com")
+
+	// Writing the notifications fails, after the broadcast row went in
+	db.Callback().Create().Before("gorm:create").Register("test:fail_notifications", func(tx *gorm.DB) {
+		if tx.Statement.Table == "notifications" {
+			tx.AddError(errors.New("disk full"))
+		}
+	})
+
+	r := gin.New()
+	r.POST("/admin/broadcasts", func(c *gin.Context) { c.Set("userID", admin.ID) }, createBroadcastHandler)
+	req := httptest.NewRequest("POST", "/admin/broadcasts", strings.NewReader(`{"title": "Maintenance tonight"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("broadcast with failing notifications: %d, want 500", w.Code)
+	}
+
+	var broadcasts int64
+	db.Model(&Broadcast{}).Count(&broadcasts)
+	if broadcasts != 0 {
+		t.Fatalf("%d broadcasts recorded, want none", broadcasts)
+	}
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Notification preferences. Per notification type a user picks the channels it
+// goes to. Quiet hours (Nepal time) hold SMS and Telegram alerts back until
+// they end, and digest delivery replaces individual email and Telegram alerts
+// with one summary a day. notifyUser applies them; held and digested
+// notifications wait in PendingNotification for the scheduler below.
+
+// Notification channels
+const (
+	ChannelInApp    = "in_app"
+	ChannelEmail    = "email"
+	ChannelSMS      = "sms"
+	ChannelTelegram = "telegram"
+	ChannelWebPush  = "web_push"
+)
+
+// Delivery modes
+const (
+	DeliveryInstant = "instant"
+	DeliveryDigest  = "digest"
+)
+
+const (
+	notificationSchedulerInterval = time.Minute
+	defaultDigestHour             = 8
+	notifyDigest                  = "digest" // EmailOutbox and TelegramLog type of daily digests
+)
+
+// Channels in display order
+var notificationChannels = []string{ChannelInApp, ChannelEmail, ChannelSMS, ChannelTelegram, ChannelWebPush}
+
+var notificationChannelLabels = map[string]string{
+	ChannelInApp:    "In-app",
+	ChannelEmail:    "Email",
+	ChannelSMS:      "SMS",
+	ChannelTelegram: "Telegram",
+	ChannelWebPush:  "Web push",
+}
+
+// Types users can configure, in display order. Announcements always go to the notification center.
+var preferenceTypes = []string{
+	NotifyNewIPO,
+	NotifyApplicationSubmitted,
+	NotifyApplicationFailed,
+	NotifyAllotmentResult,
+	NotifyMonitoringSkipped,
+	NotifySubscriptionExpiring,
+	NotifySubscriptionChanged,
+	NotifyPaymentReceived,
+}
+
+// Channels that interrupt the user; quiet hours hold them back
+var interruptingChannels = map[string]bool{
+	ChannelSMS:      true,
+	ChannelTelegram: true,
+	ChannelWebPush:  true,
+}
+
+// Can channel deliver this type? Each channel sends only the types it has templates for.
+func channelSupports(channel, kind string) bool {
+	var ok bool
+	switch channel {
+	case ChannelInApp:
+		_, ok = inAppTemplates[kind]
+	case ChannelEmail:
+		_, ok = notificationTemplates[kind]
+	case ChannelSMS:
+		_, ok = smsTemplates[kind]
+	case ChannelTelegram:
+		_, ok = telegramTemplates[kind]
+	case ChannelWebPush:
+		// Choices are stored now; channelReady keeps it from sending until there is a push sender
+		ok = isPreferenceType(kind)
+	}
+	return ok
+}
+
+// Is the channel set up for the user? Alerts to a channel that isn't are skipped.
+func channelReady(user *User, channel string) bool {
+	switch channel {
+	case ChannelSMS:
+		return user.PhoneVerifiedAt != nil
+	case ChannelTelegram:
+		return telegramBot != nil && user.TelegramChatID != 0
+	case ChannelWebPush:
+		return false // No push sender yet
+	}
+	return true
+}
+
+func isPreferenceType(kind string) bool {
+	for _, t := range preferenceTypes {
+		if t == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// A user's preferences; the defaults if they never saved any
+func loadNotificationPreferences(userID uint) *NotificationPreference {
+	prefs := NotificationPreference{UserID: userID, Delivery: DeliveryInstant, DigestHour: defaultDigestHour}
+	db.Where("user_id = ?", userID).First(&prefs)
+	return &prefs
+}
+
+// Saved channels per type
+func (p *NotificationPreference) channelMap() map[string][]string {
+	channels := map[string][]string{}
+	if p.Channels != "" {
+		if err := json.Unmarshal([]byte(p.Channels), &channels); err != nil {
+			log.Printf("Notification preferences of user %d are unreadable: %v\n", p.UserID, err)
+		}
+	}
+	return channels
+}
+
+// Does the user want notifications of this type on channel? Types never
+// configured go to every channel that supports them.
+func (p *NotificationPreference) Enabled(kind, channel string) bool {
+	if !channelSupports(channel, kind) {
+		return false
+	}
+	chosen, ok := p.channelMap()[kind]
+	if !ok {
+		return true
+	}
+	for _, c := range chosen {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *NotificationPreference) setChannels(kind string, channels []string) {
+	all := p.channelMap()
+	all[kind] = channels
+	encoded, _ := json.Marshal(all)
+	p.Channels = string(encoded)
+}
+
+// Turn a channel off for one type, or for every type with "all"
+func (p *NotificationPreference) disableChannel(channel, kind string) {
+	kinds := []string{kind}
+	if kind == unsubscribeAll {
+		kinds = preferenceTypes
+	}
+	for _, k := range kinds {
+		keep := []string{}
+		for _, c := range notificationChannels {
+			if c != channel && p.Enabled(k, c) {
+				keep = append(keep, c)
+			}
+		}
+		p.setChannels(k, keep)
+	}
+}
+
+// Minutes after midnight of an HH:MM time
+func parseClock(value string) (int, bool) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
+
+// First time after now that the clock in Nepal shows minutes after midnight
+func nextNepalClock(now time.Time, minutes int) time.Time {
+	day := startOfNepalDay(now)
+	next := day.Add(time.Duration(minutes) * time.Minute)
+	if !next.After(now) {
+		next = day.AddDate(0, 0, 1).Add(time.Duration(minutes) * time.Minute)
+	}
+	return next
+}
+
+// Is now within the user's quiet hours? Overnight ranges like 22:00-07:00 work.
+func (p *NotificationPreference) inQuietHours(now time.Time) bool {
+	start, ok := parseClock(p.QuietHoursStart)
+	end, ok2 := parseClock(p.QuietHoursEnd)
+	if !ok || !ok2 || start == end {
+		return false
+	}
+
+	local := now.In(nepalTime)
+	minute := local.Hour()*60 + local.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// When the current quiet hours end
+func (p *NotificationPreference) quietHoursEnd(now time.Time) time.Time {
+	end, _ := parseClock(p.QuietHoursEnd)
+	return nextNepalClock(now, end)
+}
+
+// When the next digest goes out
+func (p *NotificationPreference) nextDigestAt(now time.Time) time.Time {
+	return nextNepalClock(now, p.DigestHour*60)
+}
+
+// NotificationPreferencesInput is the notifications section of POST /dashboard/settings
+type NotificationPreferencesInput struct {
+	Channels        map[string][]string `json:"channels"` // Type -> channels; types left out keep their setting
+	QuietHoursStart *string             `json:"quiet_hours_start"`
+	QuietHoursEnd   *string             `json:"quiet_hours_end"`
+	Delivery        *string             `json:"delivery"`
+	DigestHour      *int                `json:"digest_hour"`
+}
+
+// Validate input and apply it
+func (p *NotificationPreference) apply(input *NotificationPreferencesInput) error {
+	for kind, channels := range input.Channels {
+		if !isPreferenceType(kind) {
+			return fmt.Errorf("Unknown notification type: %s", kind)
+		}
+		chosen := []string{}
+		for _, channel := range channels {
+			if !channelSupports(channel, kind) {
+				return fmt.Errorf("Channel %q can't send %s", channel, notificationTypeLabels[kind])
+			}
+			chosen = append(chosen, channel)
+		}
+		p.setChannels(kind, chosen)
+	}
+
+	if input.QuietHoursStart != nil || input.QuietHoursEnd != nil {
+		start, end := p.QuietHoursStart, p.QuietHoursEnd
+		if input.QuietHoursStart != nil {
+			start = *input.QuietHoursStart
+		}
+		if input.QuietHoursEnd != nil {
+			end = *input.QuietHoursEnd
+		}
+		if (start == "") != (end == "") {
+			return fmt.Errorf("Set both the start and end of quiet hours, or neither")
+		}
+		if start != "" {
+			if _, ok := parseClock(start); !ok {
+				return fmt.Errorf("Quiet hours must be times like 22:00")
+			}
+			if _, ok := parseClock(end); !ok {
+				return fmt.Errorf("Quiet hours must be times like 22:00")
+			}
+		}
+		p.QuietHoursStart, p.QuietHoursEnd = start, end
+	}
+
+	if input.Delivery != nil {
+		if *input.Delivery != DeliveryInstant && *input.Delivery != DeliveryDigest {
+			return fmt.Errorf("Delivery must be instant or digest")
+		}
+		p.Delivery = *input.Delivery
+	}
+	if input.DigestHour != nil {
+		if *input.DigestHour < 0 || *input.DigestHour > 23 {
+			return fmt.Errorf("Digest hour must be between 0 and 23")
+		}
+		p.DigestHour = *input.DigestHour
+	}
+	return nil
+}
+
+// Move queued digest items to the current schedule; back to instant
+// delivery, they go out with the next scheduler run
+func rescheduleDigest(prefs *NotificationPreference, now time.Time) {
+	when := now
+	if prefs.Delivery == DeliveryDigest {
+		when = prefs.nextDigestAt(now)
+	}
+	db.Model(&PendingNotification{}).
+		Where("user_id = ? AND digest = ?", prefs.UserID, true).
+		Update("deliver_after", when)
+}
+
+// Send a notification on one channel now
+func sendNotification(user *User, channel, kind, dedupeKey string, data gin.H) {
+	switch channel {
+	case ChannelEmail:
+		emailNotification(user, kind, dedupeKey, data)
+	case ChannelSMS:
+		smsNotification(user, kind, dedupeKey, data)
+	case ChannelTelegram:
+		telegramNotification(user, kind, dedupeKey, data)
+	}
+}
+
+// Hold a notification for channels until deliverAfter
+func deferNotification(user *User, kind, dedupeKey string, data gin.H, channels []string, digest bool, deliverAfter time.Time) {
+	if len(channels) == 0 {
+		return
+	}
+	// Delivered rows are soft-deleted and still count, so an alert repeated on
+	// every monitoring tick isn't queued again for the next digest
+	if dedupeKey != "" {
+		var count int64
+		db.Unscoped().Model(&PendingNotification{}).Where("user_id = ? AND dedupe_key = ? AND digest = ?", user.ID, dedupeKey, digest).Count(&count)
+		if count > 0 {
+			return
+		}
+	}
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Holding %s notification for user %d failed: %v\n", kind, user.ID, err)
+		return
+	}
+	if err := db.Create(&PendingNotification{
+		UserID:       user.ID,
+		Type:         kind,
+		DedupeKey:    dedupeKey,
+		Data:         string(encoded),
+		Channels:     strings.Join(channels, ","),
+		Digest:       digest,
+		DeliverAfter: deliverAfter,
+	}).Error; err != nil {
+		log.Printf("Holding %s notification for user %d failed: %v\n", kind, user.ID, err)
+	}
+}
+
+// Start the scheduler for held notifications and digests
+func startNotificationScheduler() {
+	go func() {
+		ticker := time.NewTicker(notificationSchedulerInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			runPendingNotifications(time.Now())
+		}
+	}()
+}
+
+// Deliver notifications whose quiet hours are over, and digests that are due
+func runPendingNotifications(now time.Time) {
+	var due []PendingNotification
+	db.Where("deliver_after <= ?", now).Order("id").Limit(1000).Find(&due)
+
+	digests := map[uint][]PendingNotification{}
+	for _, pending := range due {
+		// Deleting claims the row, so two instances never deliver it twice. The
+		// delete is soft: the row stays behind as the record of its dedupe key.
+		result := db.Delete(&PendingNotification{}, pending.ID)
+		if result.Error != nil || result.RowsAffected == 0 {
+			continue
+		}
+		if pending.Digest {
+			digests[pending.UserID] = append(digests[pending.UserID], pending)
+			continue
+		}
+
+		var user User
+		if err := db.First(&user, pending.UserID).Error; err != nil || !user.IsActive {
+			continue
+		}
+		data := gin.H{}
+		json.Unmarshal([]byte(pending.Data), &data)
+		for _, channel := range strings.Split(pending.Channels, ",") {
+			sendNotification(&user, channel, pending.Type, pending.DedupeKey, data)
+		}
+	}
+
+	for userID, items := range digests {
+		sendDigest(userID, items)
+	}
+}
+
+// Digest message per language; Items is one line per notification
+var digestTemplates = map[string]NotificationTemplate{
+	"english": {
+		Subject: "Your IPO Pilot daily digest: {{.Count}} update(s)",
+		Body:    "Hi {{.Name}},\n\nHere is what happened since your last digest:\n\n{{.Items}}\n\nDashboard: {{.BaseURL}}/dashboard\n",
+	},
+	"nepali": {
+		Subject: "IPO Pilot दैनिक सारांश: {{.Count}} अपडेट",
+		Body:    "नमस्ते {{.Name}},\n\nपछिल्लो सारांशपछिका गतिविधि:\n\n{{.Items}}\n\nड्यासबोर्ड: {{.BaseURL}}/dashboard\n",
+	},
+}
+
+// Send one user's digest by email and Telegram, each listing the items meant for it
+func sendDigest(userID uint, items []PendingNotification) {
+	var user User
+	if err := db.First(&user, userID).Error; err != nil || !user.IsActive {
+		return
+	}
+	lang := userLanguage(&user)
+
+	lines := map[string][]string{}
+	for _, item := range items {
+		tmpl, ok := inAppTemplates[item.Type][lang]
+		if !ok {
+			continue
+		}
+		data := gin.H{}
+		json.Unmarshal([]byte(item.Data), &data)
+		values := notificationValues(&user, data)
+		title, err := renderMessage(item.Type, tmpl.Title, values)
+		if err != nil {
+			continue
+		}
+		line := "• " + title
+		if body, err := renderMessage(item.Type, tmpl.Body, values); err == nil && body != "" {
+			line += " - " + body
+		}
+		for _, channel := range strings.Split(item.Channels, ",") {
+			lines[channel] = append(lines[channel], line)
+		}
+	}
+
+	tmpl := digestTemplates[lang]
+	if emailLines := lines[ChannelEmail]; len(emailLines) > 0 {
+		link, err := unsubscribeLink(user.ID, unsubscribeAll)
+		if err != nil {
+			log.Printf("Unsubscribe link for user %d failed: %v\n", user.ID, err)
+			return
+		}
+		values := notificationValues(&user, gin.H{"Count": len(emailLines), "Items": strings.Join(emailLines, "\n"), "UnsubscribeURL": link})
+		subject, err := renderMessage(notifyDigest, tmpl.Subject, values)
+		if err == nil {
+			var body string
+			if body, err = renderMessage(notifyDigest, tmpl.Body+notificationFooters[lang], values); err == nil {
+				err = queueEmail(&EmailOutbox{
+					UserID:         user.ID,
+					Type:           notifyDigest,
+					To:             user.Email,
+					Subject:        subject,
+					TextBody:       body,
+					UnsubscribeURL: link,
+				})
+			}
+		}
+		if err != nil {
+			log.Printf("Digest email for user %d failed: %v\n", user.ID, err)
+		}
+	}
+
+	if telegramLines := lines[ChannelTelegram]; len(telegramLines) > 0 && telegramBot != nil && user.TelegramChatID != 0 {
+		values := notificationValues(&user, gin.H{"Count": len(telegramLines)})
+		if subject, err := renderMessage(notifyDigest, tmpl.Subject, values); err == nil {
+			queueTelegramText(&user, notifyDigest, "", "📋 "+subject+"\n\n"+strings.Join(telegramLines, "\n"), nil)
+		}
+	}
+}
+
+// Notification preferences and the options for the settings page
+func notificationPreferencesHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+	prefs := loadNotificationPreferences(userID)
+
+	channels := make([]gin.H, 0, len(notificationChannels))
+	for _, channel := range notificationChannels {
+		channels = append(channels, gin.H{
+			"id":    channel,
+			"label": notificationChannelLabels[channel],
+			"ready": channelReady(&user, channel),
+		})
+	}
+	types := make([]gin.H, 0, len(preferenceTypes))
+	for _, kind := range preferenceTypes {
+		supported, enabled := []string{}, []string{}
+		for _, channel := range notificationChannels {
+			if channelSupports(channel, kind) {
+				supported = append(supported, channel)
+				if prefs.Enabled(kind, channel) {
+					enabled = append(enabled, channel)
+				}
+			}
+		}
+		types = append(types, gin.H{
+			"type":      kind,
+			"label":     notificationTypeLabels[kind],
+			"supported": supported,
+			"enabled":   enabled,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"channels":          channels,
+		"types":             types,
+		"quiet_hours_start": prefs.QuietHoursStart,
+		"quiet_hours_end":   prefs.QuietHoursEnd,
+		"delivery":          prefs.Delivery,
+		"digest_hour":       prefs.DigestHour,
+	})
+}
+
+// Move unsubscribes recorded on User.EmailOptOuts into notification preferences
+func migrateEmailOptOuts() {
+	var users []User
+	db.Where("email_opt_outs <> ''").Find(&users)
+
+	for i := range users {
+		prefs := loadNotificationPreferences(users[i].ID)
+		for _, kind := range strings.Split(users[i].EmailOptOuts, ",") {
+			if kind != "" {
+				prefs.disableChannel(ChannelEmail, kind)
+			}
+		}
+		if err := db.Save(prefs).Error; err != nil {
+			log.Printf("Migrating email opt-outs of user %d failed: %v\n", users[i].ID, err)
+			continue
+		}
+		db.Model(&users[i]).Update("email_opt_outs", "")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestWebPushIsAStoredPreference(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "push@example.com")
+	prefs := loadNotificationPreferences(user.ID)
+
+	err := prefs.apply(&NotificationPreferencesInput{Channels: map[string][]string{
+		NotifyNewIPO: {ChannelEmail, ChannelWebPush},
+	}})
+	if err != nil {
+		t.Fatalf("choosing web push: %v", err)
+	}
+	if !prefs.Enabled(NotifyNewIPO, ChannelWebPush) || prefs.Enabled(NotifyNewIPO, ChannelSMS) {
+		t.Fatal("web push choice wasn't stored")
+	}
+	if channelReady(user, ChannelWebPush) {
+		t.Fatal("web push is ready without a push sender")
+	}
+
+	if err := prefs.apply(&NotificationPreferencesInput{Channels: map[string][]string{"unknown": {ChannelWebPush}}}); err == nil {
+		t.Fatal("web push accepted an unknown type")
+	}
+}
+
+func TestDigestDoesNotRepeatDeliveredAlerts(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "digest@example.com")
+	prefs := loadNotificationPreferences(user.ID)
+	prefs.Delivery = DeliveryDigest
+	if err := db.Save(prefs).Error; err != nil {
+		t.Fatalf("saving preferences: %v", err)
+	}
+
+	digestEmails := func() int64 {
+		var count int64
+		db.Model(&EmailOutbox{}).Where("user_id = ? AND type = ?", user.ID, notifyDigest).Count(&count)
+		return count
+	}
+	alert := gin.H{"Company": "Test Hydropower", "Symbol": "TEST", "ShareID": "42"}
+
+	// Monitoring reports the same open IPO on every tick, across two digests
+	for day := 1; day <= 2; day++ {
+		notifyUser(user.ID, NotifyNewIPO, NotifyNewIPO+":42", alert)
+		notifyUser(user.ID, NotifyNewIPO, NotifyNewIPO+":42", alert)
+		runPendingNotifications(time.Now().Add(time.Duration(day) * 24 * time.Hour))
+	}
+
+	if n := digestEmails(); n != 1 {
+		t.Fatalf("%d digests sent, want one listing the IPO once", n)
+	}
+}
+
+func TestInvalidNotificationSettingsLeaveNameUnchanged(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "settings@example.com")
+
+	r := gin.New()
+	r.POST("/dashboard/settings", func(c *gin.Context) { c.Set("userID", user.ID) }, updateSettingsHandler)
+
+	body := `{"name": "New Name", "notifications": {"delivery": "hourly"}}`
+	req := httptest.NewRequest("POST", "/dashboard/settings", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid delivery mode: %d, want 400", w.Code)
+	}
+
+	var saved User
+	db.First(&saved, user.ID)
+	if saved.Name != user.Name {
+		t.Fatalf("name changed to %q by a rejected request", saved.Name)
+	}
+}
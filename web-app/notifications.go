@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// User notifications. notifyUser renders a message from the templates below in
+// the user's language and queues it in the email outbox (mail_outbox.go).
+// Every email carries an unsubscribe link for its type; account emails
+// (verification, password reset) are sent directly and can't be unsubscribed.
+
+// Notification types
+const (
+	NotifyNewIPO               = "new_ipo"
+	NotifyApplicationSubmitted = "application_submitted"
+	NotifyApplicationFailed    = "application_failed"
+	NotifyAllotmentResult      = "allotment_result"
+	NotifySubscriptionExpiring = "subscription_expiring"
+	NotifyPaymentReceived      = "payment_received"
+	NotifySubscriptionChanged  = "subscription_changed"
+	NotifyMonitoringSkipped    = "monitoring_skipped"
+	NotifyAnnouncement         = "announcement" // Admin broadcasts, notification center only
+)
+
+const (
+	purposeUnsubscribe = "unsubscribe"
+	unsubscribeTTL     = 365 * 24 * time.Hour
+	unsubscribeAll     = "all"
+)
+
+var errUnknownNotification = errors.New("unknown notification type")
+
+// NotificationTemplate is the subject and plain text body of one message
+type NotificationTemplate struct {
+	Subject string
+	Body    string
+}
+
+// Message templates per type and language. Templates get the data passed to
+// notifyUser plus Name, BaseURL and UnsubscribeURL.
+var notificationTemplates = map[string]map[string]NotificationTemplate{
+	NotifyNewIPO: {
+		"english": {
+			Subject: "New IPO open: {{.Company}}",
+			Body: "Hi {{.Name}},\n\n{{.Company}}{{if .Symbol}} ({{.Symbol}}){{end}} is open for applications" +
+				"{{if .CloseDate}} until {{.CloseDate}}{{end}}.\n{{if .Price}}Price per unit: {{.Price}}\n{{end}}" +
+				"\nSee open IPOs: {{.BaseURL}}/dashboard/ipos\n",
+		},
+		"nepali": {
+			Subject: "नयाँ IPO खुल्यो: {{.Company}}",
+			Body: "नमस्ते {{.Name}},\n\n{{.Company}}{{if .Symbol}} ({{.Symbol}}){{end}} को IPO आवेदनका लागि खुला छ" +
+				"{{if .CloseDate}}, {{.CloseDate}} सम्म{{end}}।\n{{if .Price}}प्रति कित्ता मूल्य: {{.Price}}\n{{end}}" +
+				"\nखुला IPO हेर्नुहोस्: {{.BaseURL}}/dashboard/ipos\n",
+		},
+	},
+	NotifyApplicationSubmitted: {
+		"english": {
+			Subject: "IPO application submitted: {{.Company}}",
+			Body: "Hi {{.Name}},\n\nWe applied for {{.Kittas}} kitta of {{.Company}} for {{.Profile}}.\n" +
+				"{{if .Message}}MeroShare said: {{.Message}}\n{{end}}" +
+				"\nYour applications: {{.BaseURL}}/dashboard/applications\n",
+		},
+		"nepali": {
+			Subject: "IPO आवेदन पेश भयो: {{.Company}}",
+			Body: "नमस्ते {{.Name}},\n\n{{.Profile}} का लागि {{.Company}} को {{.Kittas}} कित्ता आवेदन दिइयो।\n" +
+				"{{if .Message}}MeroShare: {{.Message}}\n{{end}}" +
+				"\nतपाईंका आवेदनहरू: {{.BaseURL}}/dashboard/applications\n",
+		},
+	},
+	NotifyApplicationFailed: {
+		"english": {
+			Subject: "IPO application failed: {{.Company}}",
+			Body: "Hi {{.Name}},\n\nYour application for {{.Kittas}} kitta of {{.Company}} for {{.Profile}} failed" +
+				"{{if .Message}}: {{.Message}}{{end}}.\n\nCheck the profile's MeroShare details and apply again while the issue is open:\n" +
+				"{{.BaseURL}}/dashboard/applications\n",
+		},
+		"nepali": {
+			Subject: "IPO आवेदन असफल: {{.Company}}",
+			Body: "नमस्ते {{.Name}},\n\n{{.Profile}} का लागि {{.Company}} को {{.Kittas}} कित्ता आवेदन असफल भयो" +
+				"{{if .Message}}: {{.Message}}{{end}}।\n\nप्रोफाइलको MeroShare विवरण जाँचेर IPO खुला रहेसम्म फेरि आवेदन दिनुहोस्:\n" +
+				"{{.BaseURL}}/dashboard/applications\n",
+		},
+	},
+	NotifyAllotmentResult: {
+		"english": {
+			Subject: "{{if .Allotted}}Allotted: {{.Kittas}} kitta of {{.Company}}{{else}}Not allotted: {{.Company}}{{end}}",
+			Body: "Hi {{.Name}},\n\n{{if .Allotted}}Congratulations! {{.Profile}} was allotted {{.Kittas}} kitta of {{.Company}}." +
+				"{{else}}{{.Profile}} was not allotted shares of {{.Company}} this time. The blocked amount will be released by your bank.{{end}}\n" +
+				"\nYour applications: {{.BaseURL}}/dashboard/applications\n",
+		},
+		"nepali": {
+			Subject: "{{if .Allotted}}बाँडफाँड भयो: {{.Company}} को {{.Kittas}} कित्ता{{else}}बाँडफाँड भएन: {{.Company}}{{end}}",
+			Body: "नमस्ते {{.Name}},\n\n{{if .Allotted}}बधाई छ! {{.Profile}} लाई {{.Company}} को {{.Kittas}} कित्ता बाँडफाँड भयो।" +
+				"{{else}}यस पटक {{.Profile}} लाई {{.Company}} को सेयर बाँडफाँड भएन। रोक्का रकम बैंकले फुकुवा गर्नेछ।{{end}}\n" +
+				"\nतपाईंका आवेदनहरू: {{.BaseURL}}/dashboard/applications\n",
+		},
+	},
+	NotifySubscriptionExpiring: {
+		"english": {
+			Subject: "Your IPO Pilot {{if .IsTrial}}free trial{{else}}subscription{{end}} ends in {{.DaysLeft}} day(s)",
+			Body: "Hi {{.Name}},\n\nYour IPO Pilot {{if .IsTrial}}free trial{{else}}subscription{{end}} ends on {{.EndDate}}. " +
+				"Renew to keep automatic IPO applications running:\n\n{{.BaseURL}}/pricing\n",
+		},
+		"nepali": {
+			Subject: "तपाईंको IPO Pilot {{if .IsTrial}}निःशुल्क परीक्षण{{else}}सदस्यता{{end}} {{.DaysLeft}} दिनमा सकिँदैछ",
+			Body: "नमस्ते {{.Name}},\n\nतपाईंको IPO Pilot {{if .IsTrial}}निःशुल्क परीक्षण{{else}}सदस्यता{{end}} {{.EndDate}} मा सकिन्छ। " +
+				"स्वचालित IPO आवेदन जारी राख्न नवीकरण गर्नुहोस्:\n\n{{.BaseURL}}/pricing\n",
+		},
+	},
+	NotifyPaymentReceived: {
+		"english": {
+			Subject: "Payment received: NPR {{.Amount}}",
+			Body: "Hi {{.Name}},\n\nThanks! We received NPR {{.Amount}} for {{.Plan}} (reference {{.Reference}}). " +
+				"Your subscription runs until {{.EndDate}}.\n" +
+				"{{if .Invoice}}\nInvoice {{.Invoice}}: {{.BaseURL}}/dashboard/invoices/{{.Invoice}}\n{{end}}",
+		},
+		"nepali": {
+			Subject: "भुक्तानी प्राप्त भयो: रु. {{.Amount}}",
+			Body: "नमस्ते {{.Name}},\n\nधन्यवाद! {{.Plan}} का लागि रु. {{.Amount}} प्राप्त भयो (सन्दर्भ {{.Reference}})। " +
+				"तपाईंको सदस्यता {{.EndDate}} सम्म चल्छ।\n" +
+				"{{if .Invoice}}\nबीजक {{.Invoice}}: {{.BaseURL}}/dashboard/invoices/{{.Invoice}}?lang=nepali\n{{end}}",
+		},
+	},
+	NotifySubscriptionChanged: {
+		"english": {
+			Subject: "{{if eq .Status \"active\"}}Your IPO Pilot subscription is active{{else if eq .Status \"grace\"}}Your IPO Pilot subscription has ended - grace period started" +
+				"{{else if eq .Status \"expired\"}}Your IPO Pilot access has expired{{else}}Your IPO Pilot subscription has been cancelled{{end}}",
+			Body: "Hi {{.Name}},\n\n{{if eq .Status \"active\"}}Your {{.Plan}} plan is active until {{.EndDate}}." +
+				"{{if .Resumed}} IPO monitoring has resumed for {{.Resumed}} profile(s).{{end}}\n" +
+				"{{else if eq .Status \"grace\"}}Your {{.Plan}} plan ended. You keep access until {{.GraceEndDate}}. Renew here:\n\n{{.BaseURL}}/pricing\n" +
+				"{{else if eq .Status \"expired\"}}Your access has expired and IPO monitoring is paused. " +
+				"It resumes automatically when you renew:\n\n{{.BaseURL}}/pricing\n" +
+				"{{else}}Your IPO Pilot subscription has been cancelled and IPO monitoring is paused.\n\n" +
+				"{{range .Refunds}}- NPR {{.Amount}} {{if .Completed}}has been refunded to your original payment method." +
+				"{{else}}will be refunded by our team, usually within 5 working days.{{end}}\n" +
+				"{{else}}No refund is due under our refund policy.\n{{end}}" +
+				"\nYou can subscribe again at any time:\n\n{{.BaseURL}}/pricing\n{{end}}",
+		},
+		"nepali": {
+			Subject: "{{if eq .Status \"active\"}}तपाईंको IPO Pilot सदस्यता सक्रिय छ{{else if eq .Status \"grace\"}}तपाईंको IPO Pilot सदस्यता सकियो - अनुग्रह अवधि सुरु भयो" +
+				"{{else if eq .Status \"expired\"}}तपाईंको IPO Pilot पहुँच समाप्त भयो{{else}}तपाईंको IPO Pilot सदस्यता रद्द गरियो{{end}}",
+			Body: "नमस्ते {{.Name}},\n\n{{if eq .Status \"active\"}}तपाईंको {{.Plan}} योजना {{.EndDate}} सम्म सक्रिय छ।" +
+				"{{if .Resumed}} {{.Resumed}} प्रोफाइलको IPO अनुगमन फेरि सुरु भयो।{{end}}\n" +
+				"{{else if eq .Status \"grace\"}}तपाईंको {{.Plan}} योजना सकियो। {{.GraceEndDate}} सम्म पहुँच रहन्छ। यहाँ नवीकरण गर्नुहोस्:\n\n{{.BaseURL}}/pricing\n" +
+				"{{else if eq .Status \"expired\"}}तपाईंको पहुँच समाप्त भयो र IPO अनुगमन रोकिएको छ। " +
+				"नवीकरण गरेपछि यो आफैं फेरि सुरु हुन्छ:\n\n{{.BaseURL}}/pricing\n" +
+				"{{else}}तपाईंको IPO Pilot सदस्यता रद्द गरियो र IPO अनुगमन रोकिएको छ।\n\n" +
+				"{{range .Refunds}}- रु. {{.Amount}} {{if .Completed}}तपाईंको मूल भुक्तानी माध्यममा फिर्ता गरियो।" +
+				"{{else}}हाम्रो टोलीले फिर्ता गर्नेछ, सामान्यतया ५ कार्य दिनभित्र।{{end}}\n" +
+				"{{else}}हाम्रो फिर्ता नीतिअनुसार कुनै रकम फिर्ता हुँदैन।\n{{end}}" +
+				"\nतपाईं जुनसुकै बेला फेरि सदस्यता लिन सक्नुहुन्छ:\n\n{{.BaseURL}}/pricing\n{{end}}",
+		},
+	},
+}
+
+// Footer with the unsubscribe link, per language
+var notificationFooters = map[string]string{
+	"english": "\n--\nYou get this email because of your IPO Pilot notification settings.\nUnsubscribe: {{.UnsubscribeURL}}\n",
+	"nepali":  "\n--\nतपाईंको IPO Pilot सूचना सेटिङअनुसार यो इमेल पठाइएको हो।\nइमेल बन्द गर्न: {{.UnsubscribeURL}}\n",
+}
+
+// Type names shown on the unsubscribe and settings pages
+var notificationTypeLabels = map[string]string{
+	NotifyNewIPO:               "new IPO alerts",
+	NotifyApplicationSubmitted: "application confirmations",
+	NotifyApplicationFailed:    "failed application alerts",
+	NotifyAllotmentResult:      "allotment results",
+	NotifySubscriptionExpiring: "subscription reminders",
+	NotifyPaymentReceived:      "payment receipts",
+	NotifySubscriptionChanged:  "subscription changes",
+	NotifyMonitoringSkipped:    "skipped IPO alerts",
+	unsubscribeAll:             "all IPO Pilot notification emails",
+}
+
+// Language for a user's messages
+func userLanguage(user *User) string {
+	if user.Language == "nepali" {
+		return "nepali"
+	}
+	return "english"
+}
+
+// Template values for a notification to user: data plus Name and BaseURL
+func notificationValues(user *User, data gin.H) gin.H {
+	values := gin.H{}
+	for k, v := range data {
+		values[k] = v
+	}
+	values["Name"] = user.Name
+	values["BaseURL"] = getBaseURL()
+	return values
+}
+
+// Execute a message template
+func renderMessage(name, text string, values gin.H) (string, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, values); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Render a notification email for user. data may be nil.
+func renderNotification(user *User, kind string, data gin.H, unsubscribeURL string) (subject, body string, err error) {
+	templates, ok := notificationTemplates[kind]
+	if !ok {
+		return "", "", errUnknownNotification
+	}
+	lang := userLanguage(user)
+
+	values := notificationValues(user, data)
+	values["UnsubscribeURL"] = unsubscribeURL
+
+	if subject, err = renderMessage(kind, templates[lang].Subject, values); err != nil {
+		return "", "", err
+	}
+	if body, err = renderMessage(kind, templates[lang].Body+notificationFooters[lang], values); err != nil {
+		return "", "", err
+	}
+	return subject, body, nil
+}
+
+// Link that unsubscribes user from kind ("all" for everything)
+func unsubscribeLink(userID uint, kind string) (string, error) {
+	token, err := generateActionToken(userID, purposeUnsubscribe, kind, unsubscribeTTL)
+	if err != nil {
+		return "", err
+	}
+	return getBaseURL() + "/unsubscribe?token=" + url.QueryEscape(token), nil
+}
+
+// Notify a user in the notification center and by email, SMS and Telegram,
+// each channel for the types it has templates for and the user left enabled
+// (notification_preferences.go). During quiet hours interrupting channels are
+// held until they end; with digest delivery email and Telegram wait for the
+// daily digest. dedupeKey, if set, makes repeat calls for the same event a
+// no-op (e.g. the same IPO seen by several monitoring sessions). Failures are
+// logged, never returned: a notification must not break the action that
+// triggered it.
+func notifyUser(userID uint, kind, dedupeKey string, data gin.H) {
+	var user User
+	if err := db.First(&user, userID).Error; err != nil || !user.IsActive {
+		return
+	}
+	prefs := loadNotificationPreferences(userID)
+	if kind == NotifyAnnouncement || prefs.Enabled(kind, ChannelInApp) {
+		inAppNotification(&user, kind, dedupeKey, data)
+	}
+
+	now := time.Now()
+	quiet := prefs.inQuietHours(now)
+	var held, digest []string
+	for _, channel := range []string{ChannelEmail, ChannelSMS, ChannelTelegram} {
+		switch {
+		case !prefs.Enabled(kind, channel):
+		case prefs.Delivery == DeliveryDigest && channel != ChannelSMS:
+			digest = append(digest, channel)
+		case quiet && interruptingChannels[channel]:
+			held = append(held, channel)
+		default:
+			sendNotification(&user, channel, kind, dedupeKey, data)
+		}
+	}
+	if len(held) > 0 {
+		deferNotification(&user, kind, dedupeKey, data, held, false, prefs.quietHoursEnd(now))
+	}
+	if len(digest) > 0 {
+		deferNotification(&user, kind, dedupeKey, data, digest, true, prefs.nextDigestAt(now))
+	}
+}
+
+// Queue the email for a notification
+func emailNotification(user *User, kind, dedupeKey string, data gin.H) {
+	if _, ok := notificationTemplates[kind]; !ok {
+		return
+	}
+	if dedupeKey != "" {
+		var count int64
+		db.Model(&EmailOutbox{}).Where("user_id = ? AND dedupe_key = ?", user.ID, dedupeKey).Count(&count)
+		if count > 0 {
+			return
+		}
+	}
+
+	link, err := unsubscribeLink(user.ID, kind)
+	if err != nil {
+		log.Printf("Unsubscribe link for user %d failed: %v\n", user.ID, err)
+		return
+	}
+	subject, body, err := renderNotification(user, kind, data, link)
+	if err != nil {
+		log.Printf("Rendering %s email for user %d failed: %v\n", kind, user.ID, err)
+		return
+	}
+
+	if err := queueEmail(&EmailOutbox{
+		UserID:         user.ID,
+		Type:           kind,
+		DedupeKey:      dedupeKey,
+		To:             user.Email,
+		Subject:        subject,
+		TextBody:       body,
+		UnsubscribeURL: link,
+	}); err != nil {
+		log.Printf("Queueing %s email for user %d failed: %v\n", kind, user.ID, err)
+	}
+}
+
+// Name of a profile for messages
+func profileLabel(profileID uint) string {
+	var profile Profile
+	if err := db.Unscoped().First(&profile, profileID).Error; err != nil {
+		return fmt.Sprintf("profile #%d", profileID)
+	}
+	return profile.Name
+}
+
+// Company an application is for; applications made through the API only know the share ID
+func applicationCompany(app *IPOApplication) string {
+	if app.CompanyName != "" {
+		return app.CompanyName
+	}
+	return app.CompanyShareID
+}
+
+// Email the user about an application that has been processed
+func notifyApplicationProcessed(app *IPOApplication) {
+	kind := NotifyApplicationSubmitted
+	if app.Status == "failed" {
+		kind = NotifyApplicationFailed
+	}
+	notifyUser(app.UserID, kind, fmt.Sprintf("%s:%d", kind, app.ID), gin.H{
+		"Company": applicationCompany(app),
+		"Profile": profileLabel(app.ProfileID),
+		"Kittas":  app.KittasApplied,
+		"Message": app.ResponseMsg,
+	})
+}
+
+// Email a receipt for a completed payment
+func notifyPaymentReceived(txn *PaymentTransaction, invoice *Invoice) {
+	plan := fmt.Sprintf("plan #%d", txn.PlanID)
+	var p Plan
+	if err := db.Unscoped().First(&p, txn.PlanID).Error; err == nil {
+		plan = p.Name
+	}
+	data := gin.H{
+		"Amount":    formatNPR(txn.Amount),
+		"Plan":      plan,
+		"Reference": txn.Reference,
+	}
+	if txn.PeriodEnd != nil {
+		data["EndDate"] = txn.PeriodEnd.In(nepalTime).Format("2006-01-02")
+	}
+	if invoice != nil {
+		data["Invoice"] = invoice.Number
+	}
+	notifyUser(txn.UserID, NotifyPaymentReceived, NotifyPaymentReceived+":"+txn.Reference, data)
+}
+
+// Unsubscribe page: confirms before unsubscribing, since mail scanners follow links
+func unsubscribePageHandler(c *gin.Context) {
+	claims, err := validateActionToken(c.Query("token"), purposeUnsubscribe)
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "unsubscribe.html", gin.H{"invalid": true})
+		return
+	}
+	c.HTML(http.StatusOK, "unsubscribe.html", gin.H{
+		"token": c.Query("token"),
+		"type":  claims.Binding,
+		"label": notificationTypeLabels[claims.Binding],
+	})
+}
+
+// Unsubscribe from the link's type, or from everything with scope=all. Also the
+// RFC 8058 one-click target of the List-Unsubscribe header.
+func unsubscribeHandler(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		token = c.PostForm("token")
+	}
+	claims, err := validateActionToken(token, purposeUnsubscribe)
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "unsubscribe.html", gin.H{"invalid": true})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, claims.UserID).Error; err != nil {
+		c.HTML(http.StatusBadRequest, "unsubscribe.html", gin.H{"invalid": true})
+		return
+	}
+
+	kind := claims.Binding
+	if c.PostForm("scope") == unsubscribeAll {
+		kind = unsubscribeAll
+	}
+	prefs := loadNotificationPreferences(user.ID)
+	prefs.disableChannel(ChannelEmail, kind)
+	if err := db.Save(prefs).Error; err != nil {
+		c.HTML(http.StatusInternalServerError, "unsubscribe.html", gin.H{"invalid": true})
+		return
+	}
+
+	c.HTML(http.StatusOK, "unsubscribe.html", gin.H{
+		"done":  true,
+		"label": notificationTypeLabels[kind],
+	})
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Payment gateways. Each online gateway implements PaymentGateway and is
+// registered by name; the payment routes only talk to the interface, so a new
+// gateway (IME Pay, Fonepay, ...) is one file plus a registerPaymentGateway call.
+
+// How the browser is sent to the gateway
+const (
+	paymentMethodForm     = "form"     // Auto-submitted POST form
+	paymentMethodRedirect = "redirect" // Plain redirect to URL
+)
+
+var errRefundUnsupported = errors.New("gateway does not support refunds through its API; refund from the merchant portal")
+
+// PaymentInitiation tells the client how to continue a payment at the gateway
+type PaymentInitiation struct {
+	Method string            // paymentMethodForm or paymentMethodRedirect
+	URL    string            // Form action or redirect target
+	Fields map[string]string // Form fields, signed where the gateway requires it
+}
+
+// PaymentGateway is an online payment provider.
+//
+// Initiate starts a payment for a pending ledger transaction. HandleCallback
+// authenticates the gateway's return request and resolves the transaction it is
+// about, without trusting its outcome. Verify asks the gateway server-side and
+// completes or fails the ledger entry, returning the resulting ledger status.
+// Refund returns money for a completed transaction, or errRefundUnsupported.
+type PaymentGateway interface {
+	Name() string
+	Enabled() bool
+	Initiate(txn *PaymentTransaction, plan *Plan, user *User) (*PaymentInitiation, error)
+	HandleCallback(c *gin.Context) (*PaymentTransaction, error)
+	Verify(txn *PaymentTransaction) (string, error)
+	Refund(txn *PaymentTransaction, amount float64, reason string) error
+}
+
+// PaymentNotification is what a gateway notification says, once authenticated
+type PaymentNotification struct {
+	EventID   string // Deduplicates redeliveries
+	Type      string
+	Reference string // PaymentTransaction.Reference
+	Signature string // The gateway's own signature, if it signs notifications
+}
+
+// PaymentNotifier is implemented by gateways that send server-to-server
+// notifications (see webhooks.go). ParseNotification authenticates one the
+// gateway's own way and resolves the payment it is about; as with callbacks, the
+// outcome still comes from Verify.
+type PaymentNotifier interface {
+	ParseNotification(body []byte) (*PaymentNotification, error)
+}
+
+var (
+	paymentGateways     = make(map[string]PaymentGateway)
+	paymentGatewayOrder []string
+)
+
+func registerPaymentGateway(gateway PaymentGateway) {
+	if _, exists := paymentGateways[gateway.Name()]; !exists {
+		paymentGatewayOrder = append(paymentGatewayOrder, gateway.Name())
+	}
+	paymentGateways[gateway.Name()] = gateway
+}
+
+// Built-in gateways
+func registerPaymentGateways() {
+	registerPaymentGateway(esewaGateway{})
+	registerPaymentGateway(khaltiGateway{})
+	registerPaymentGateway(connectIPSGateway{})
+}
+
+// An enabled gateway by name
+func getPaymentGateway(name string) (PaymentGateway, bool) {
+	gateway, ok := paymentGateways[name]
+	if !ok || !gateway.Enabled() {
+		return nil, false
+	}
+	return gateway, true
+}
+
+// Payment methods the pricing page can offer
+func paymentMethodsHandler(c *gin.Context) {
+	methods := []string{}
+	for _, name := range paymentGatewayOrder {
+		if paymentGateways[name].Enabled() {
+			methods = append(methods, name)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"methods": methods})
+}
+
+// Start a payment for a plan, or to renew one of the user's own subscriptions.
+// The amount always comes from the plan catalog, never from the client.
+func startPaymentHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var input struct {
+		PlanID         uint   `json:"plan_id"`
+		SubscriptionID uint   `json:"subscription_id"` // Optional: renew this subscription
+		PaymentMethod  string `json:"payment_method" binding:"required"`
+		CouponCode     string `json:"coupon_code"` // Optional
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	gateway, ok := getPaymentGateway(input.PaymentMethod)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported payment method"})
+		return
+	}
+
+	planID := input.PlanID
+	var renew *Subscription
+	if input.SubscriptionID != 0 {
+		var sub Subscription
+		if err := db.Where("id = ? AND user_id = ?", input.SubscriptionID, userID).First(&sub).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+			return
+		}
+		if sub.IsTrial || sub.PlanID == nil || (planID != 0 && planID != *sub.PlanID) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "This subscription can't be renewed with that plan"})
+			return
+		}
+		planID = *sub.PlanID
+		renew = &sub
+	}
+	if planID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "plan_id is required"})
+		return
+	}
+
+	plan, err := getPurchasablePlan(planID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Plan is not available"})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	// Record the payment before handing off to the gateway
+	txn, err := createPaymentTransaction(userID, plan, gateway.Name(), renew, input.CouponCode)
+	if msg, ok := paymentInputError(err); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start payment"})
+		return
+	}
+
+	initiation, err := gateway.Initiate(txn, plan, &user)
+	if err != nil {
+		log.Printf("Starting %s payment %s failed: %v\n", gateway.Name(), txn.Reference, err)
+		failPaymentTransaction(txn.Reference, err.Error(), "")
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Could not reach the payment gateway, please try again"})
+		return
+	}
+
+	response := gin.H{
+		"success":      true,
+		"method":       initiation.Method,
+		"url":          initiation.URL,
+		"checkout_url": "/payment/checkout/" + txn.Reference,
+		"reference":    txn.Reference,
+		"amount":       txn.Amount,
+		"discount":     txn.DiscountAmount,
+		"credit":       txn.ProrationCredit,
+		"kind":         txn.Kind,
+	}
+	if initiation.Fields != nil {
+		response["fields"] = initiation.Fields
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// Checkout page - sends the browser on to the gateway for a pending payment
+func paymentCheckoutHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	txn, err := getPaymentTransaction(c.Param("reference"))
+	if err != nil || txn.UserID != userID || txn.Status != PaymentPending {
+		c.Redirect(http.StatusFound, "/pricing?payment=failed")
+		return
+	}
+
+	gateway, ok := getPaymentGateway(txn.Gateway)
+	if !ok {
+		c.Redirect(http.StatusFound, "/pricing?payment=failed")
+		return
+	}
+
+	var plan Plan
+	var user User
+	if db.Unscoped().First(&plan, txn.PlanID).Error != nil || db.First(&user, userID).Error != nil {
+		c.Redirect(http.StatusFound, "/pricing?payment=failed")
+		return
+	}
+
+	initiation, err := gateway.Initiate(txn, &plan, &user)
+	if err != nil {
+		log.Printf("Checkout for %s payment %s failed: %v\n", gateway.Name(), txn.Reference, err)
+		c.Redirect(http.StatusFound, "/pricing?payment=failed")
+		return
+	}
+
+	if initiation.Method == paymentMethodRedirect {
+		c.Redirect(http.StatusFound, initiation.URL)
+		return
+	}
+	c.HTML(http.StatusOK, "payment_redirect.html", gin.H{
+		"gateway": txn.Gateway,
+		"action":  initiation.URL,
+		"fields":  initiation.Fields,
+	})
+}
+
+// Gateway return URL. The callback only identifies the transaction; the outcome
+// always comes from the gateway's verification API.
+func paymentCallbackHandler(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		gateway, ok := getPaymentGateway(name)
+		if !ok {
+			c.Redirect(http.StatusFound, "/pricing?payment=failed")
+			return
+		}
+
+		txn, err := gateway.HandleCallback(c)
+		if err != nil {
+			log.Printf("%s callback rejected: %v\n", name, err)
+			c.Redirect(http.StatusFound, "/pricing?payment=failed")
+			return
+		}
+
+		status := txn.Status
+		if status == PaymentPending {
+			if status, err = gateway.Verify(txn); err != nil {
+				log.Printf("%s payment %s not completed: %v\n", name, txn.Reference, err)
+				status = PaymentFailed
+			} else if status == PaymentCompleted {
+				log.Printf("%s payment %s completed\n", name, txn.Reference)
+			}
+		}
+
+		reference := url.QueryEscape(txn.Reference)
+		switch status {
+		case PaymentCompleted:
+			c.Redirect(http.StatusFound, "/dashboard?payment=success&reference="+reference)
+		case PaymentPending:
+			c.Redirect(http.StatusFound, "/dashboard?payment=pending&reference="+reference)
+		default:
+			c.Redirect(http.StatusFound, "/pricing?payment=failed&reference="+reference)
+		}
+	}
+}
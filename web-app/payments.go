@@ -0,0 +1,308 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Payment ledger. Every payment starts as a pending PaymentTransaction; a
+// verified gateway callback completes it and activates or extends the user's
+// subscription in the same database transaction.
+
+// Payment statuses
+const (
+	PaymentPending   = "pending"
+	PaymentCompleted = "completed"
+	PaymentFailed    = "failed"
+	PaymentRefunded  = "refunded" // In full, see refunds.go
+)
+
+// Client for gateway API calls
+var paymentHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+var (
+	errPaymentNotFound       = errors.New("payment transaction not found")
+	errPaymentNotPending     = errors.New("payment transaction is not pending")
+	errPaymentAmountMismatch = errors.New("paid amount does not match the transaction")
+)
+
+// Random merchant reference sent to the gateway, e.g. IPP-9F2C41D07A3B8E65
+func generatePaymentReference() (string, error) {
+	raw := make([]byte, 8)
+	if _, err := crand.Read(raw); err != nil {
+		return "", err
+	}
+	return "IPP-" + strings.ToUpper(hex.EncodeToString(raw)), nil
+}
+
+// Start a payment for a plan, priced by quotePayment: renewing the current
+// subscription (renew, or the plan the user is already on), upgrading from it,
+// or a new subscription. couponCode is optional. Errors the user can fix are
+// recognised by paymentInputError.
+func createPaymentTransaction(userID uint, plan *Plan, gateway string, renew *Subscription, couponCode string) (*PaymentTransaction, error) {
+	if renew != nil && renew.UserID != userID {
+		return nil, errPaymentNotFound
+	}
+	quote, err := quotePayment(userID, plan, renew, couponCode)
+	if err != nil {
+		return nil, err
+	}
+
+	reference, err := generatePaymentReference()
+	if err != nil {
+		return nil, err
+	}
+
+	txn := PaymentTransaction{
+		UserID:                 userID,
+		PlanID:                 plan.ID,
+		SubscriptionID:         quote.SubscriptionID,
+		Gateway:                gateway,
+		Reference:              reference,
+		Amount:                 quote.Amount,
+		ListPrice:              quote.ListPrice,
+		DiscountAmount:         quote.Discount,
+		Kind:                   quote.Kind,
+		ProrationCredit:        quote.Credit,
+		ReplacesSubscriptionID: quote.ReplacesID,
+		Currency:               "NPR",
+		Status:                 PaymentPending,
+	}
+	if quote.Coupon != nil {
+		txn.CouponID = &quote.Coupon.ID
+		txn.CouponCode = quote.Coupon.Code
+	}
+
+	if err := db.Create(&txn).Error; err != nil {
+		return nil, err
+	}
+	return &txn, nil
+}
+
+// Payments recorded before coupons existed were charged the list price
+func backfillPaymentListPrices() {
+	db.Model(&PaymentTransaction{}).Where("list_price = 0 OR list_price IS NULL").Update("list_price", gorm.Expr("amount"))
+}
+
+// Look up a transaction by our reference
+func getPaymentTransaction(reference string) (*PaymentTransaction, error) {
+	var txn PaymentTransaction
+	if err := db.Where("reference = ?", reference).First(&txn).Error; err != nil {
+		return nil, errPaymentNotFound
+	}
+	return &txn, nil
+}
+
+// Complete a verified payment and apply it to the subscription. amount is what
+// the gateway confirmed. Duplicate callbacks are harmless: only the first call
+// applies the payment, later ones return applied=false.
+func completePaymentTransaction(reference, gatewayRef string, amount float64, payload string) (txn *PaymentTransaction, applied bool, err error) {
+	var events []*SubscriptionEvent
+	txn = &PaymentTransaction{}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("reference = ?", reference).First(txn).Error; err != nil {
+			return errPaymentNotFound
+		}
+		if txn.Status == PaymentCompleted {
+			return nil
+		}
+		if txn.Status != PaymentPending {
+			return errPaymentNotPending
+		}
+		if math.Abs(amount-txn.Amount) > 0.005 {
+			return errPaymentAmountMismatch
+		}
+
+		// Claim the row; a concurrent duplicate callback stops here
+		now := time.Now()
+		result := tx.Model(&PaymentTransaction{}).
+			Where("id = ? AND status = ?", txn.ID, PaymentPending).
+			Updates(map[string]interface{}{
+				"status":       PaymentCompleted,
+				"gateway_ref":  gatewayRef,
+				"raw_payload":  payload,
+				"completed_at": now,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		txn.Status = PaymentCompleted
+		txn.GatewayRef = gatewayRef
+		txn.RawPayload = payload
+		txn.CompletedAt = &now
+
+		sub, subEvents, err := applyPaymentToSubscription(tx, txn, now)
+		if err != nil {
+			return err
+		}
+		txn.SubscriptionID = &sub.ID
+		if err := recordCouponRedemption(tx, txn); err != nil {
+			return err
+		}
+		if err := tx.Model(&PaymentTransaction{}).Where("id = ?", txn.ID).Updates(map[string]interface{}{
+			"subscription_id": sub.ID,
+			"period_start":    txn.PeriodStart,
+			"period_end":      txn.PeriodEnd,
+		}).Error; err != nil {
+			return err
+		}
+
+		events = subEvents
+		applied = true
+		return nil
+	})
+
+	if errors.Is(err, errPaymentAmountMismatch) {
+		failPaymentTransaction(reference, err.Error(), payload)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if applied {
+		for _, event := range events {
+			publishSubscriptionEvent(event)
+		}
+
+		// Issued outside the payment transaction so a hiccup here never blocks
+		// activation; backfillInvoices catches anything missed
+		invoice, err := issueInvoice(txn.ID)
+		if err != nil {
+			log.Printf("Issuing invoice for payment %s failed: %v\n", txn.Reference, err)
+		}
+		notifyPaymentReceived(txn, invoice)
+		if err := qualifyReferral(txn); err != nil {
+			log.Printf("Referral reward for payment %s failed: %v\n", txn.Reference, err)
+		}
+	}
+	return txn, applied, nil
+}
+
+// Activate or extend the subscription a completed payment pays for, recording
+// the period it bought on txn. Any other effective subscription of the user is
+// superseded, so exactly one is left.
+func applyPaymentToSubscription(tx *gorm.DB, txn *PaymentTransaction, now time.Time) (*Subscription, []*SubscriptionEvent, error) {
+	var plan Plan
+	if err := tx.Unscoped().First(&plan, txn.PlanID).Error; err != nil {
+		return nil, nil, err
+	}
+
+	// Renewal: extend from the current end date, or from now if it already lapsed.
+	// A subscription superseded since the payment started gets a new one instead.
+	var sub Subscription
+	if txn.SubscriptionID != nil {
+		if err := tx.First(&sub, *txn.SubscriptionID).Error; err != nil {
+			return nil, nil, err
+		}
+	}
+	if txn.SubscriptionID != nil && sub.Status != SubscriptionSuperseded {
+		start := sub.EndDate
+		if start.Before(now) {
+			start = now
+			sub.StartDate = now
+		}
+		sub.EndDate = plan.PeriodEnd(start)
+		end := sub.EndDate
+		txn.PeriodStart, txn.PeriodEnd = &start, &end
+		if err := applyReferralCredit(tx, &sub); err != nil {
+			return nil, nil, err
+		}
+		sub.Price = txn.Amount
+		sub.PaymentMethod = txn.Gateway
+		sub.TransactionID = txn.Reference
+		plan.ApplyTo(&sub)
+
+		event, err := transitionSubscription(tx, &sub, SubscriptionActive)
+		if err != nil {
+			return nil, nil, err
+		}
+		events, err := supersedeOtherSubscriptions(tx, &sub)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &sub, append(events, event), nil
+	}
+
+	sub = Subscription{
+		UserID:        txn.UserID,
+		Status:        SubscriptionActive,
+		StartDate:     now,
+		EndDate:       plan.PeriodEnd(now),
+		Price:         txn.Amount,
+		PaymentMethod: txn.Gateway,
+		TransactionID: txn.Reference,
+	}
+	plan.ApplyTo(&sub)
+	start, end := sub.StartDate, sub.EndDate
+	txn.PeriodStart, txn.PeriodEnd = &start, &end
+	if err := applyReferralCredit(tx, &sub); err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Create(&sub).Error; err != nil {
+		return nil, nil, err
+	}
+	events, err := supersedeOtherSubscriptions(tx, &sub)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &sub, append(events, &SubscriptionEvent{Type: "transition", Subscription: sub, To: SubscriptionActive}), nil
+}
+
+// Mark a pending transaction failed
+func failPaymentTransaction(reference, reason, payload string) {
+	db.Model(&PaymentTransaction{}).
+		Where("reference = ? AND status = ?", reference, PaymentPending).
+		Updates(map[string]interface{}{
+			"status":         PaymentFailed,
+			"failure_reason": reason,
+			"raw_payload":    payload,
+		})
+}
+
+// The signed-in user's payments
+func paymentHistoryHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var payments []PaymentTransaction
+	db.Where("user_id = ?", userID).Order("created_at DESC").Find(&payments)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":    len(payments),
+		"payments": payments,
+	})
+}
+
+// Admin: payment ledger, optionally filtered by status, gateway or user_id
+func adminPaymentsHandler(c *gin.Context) {
+	query := db.Model(&PaymentTransaction{}).Order("created_at DESC").Limit(500)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if gateway := c.Query("gateway"); gateway != "" {
+		query = query.Where("gateway = ?", gateway)
+	}
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	var payments []PaymentTransaction
+	query.Find(&payments)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":    len(payments),
+		"payments": payments,
+	})
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	_ "embed"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/go-text/typesetting/di"
+	"github.com/go-text/typesetting/font"
+	ot "github.com/go-text/typesetting/font/opentype"
+	"github.com/go-text/typesetting/font/opentype/tables"
+	"github.com/go-text/typesetting/language"
+	"github.com/go-text/typesetting/shaping"
+	"golang.org/x/image/math/fixed"
+)
+
+// Minimal single-page PDF writer, enough for invoices. Latin text uses the
+// standard Helvetica fonts, so it is limited to WinAnsi characters; anything else
+// is replaced with "?". Devanagari is shaped with HarfBuzz and drawn with the
+// embedded Noto Sans Devanagari (fonts/OFL.txt), which is only added to
+// documents that use it.
+
+const (
+	pdfPageWidth  = 595.0 // A4 in points
+	pdfPageHeight = 842.0
+)
+
+//go:embed fonts/NotoSansDevanagari-Regular.ttf
+var devanagariFontData []byte
+
+// Parsed once; the shaper keeps a cache and isn't safe for concurrent use
+var devanagariFont struct {
+	once   sync.Once
+	face   *font.Face
+	bbox   [4]int16
+	err    error
+	mu     sync.Mutex
+	shaper shaping.HarfbuzzShaper
+}
+
+func loadDevanagariFont() (*font.Face, error) {
+	devanagariFont.once.Do(func() {
+		face, err := font.ParseTTF(bytes.NewReader(devanagariFontData))
+		if err != nil {
+			devanagariFont.err = err
+			return
+		}
+		loader, err := ot.NewLoader(bytes.NewReader(devanagariFontData))
+		if err != nil {
+			devanagariFont.err = err
+			return
+		}
+		raw, err := loader.RawTable(ot.MustNewTag("head"))
+		if err != nil {
+			devanagariFont.err = err
+			return
+		}
+		head, _, err := tables.ParseHead(raw)
+		if err != nil {
+			devanagariFont.err = err
+			return
+		}
+		devanagariFont.face = face
+		devanagariFont.bbox = [4]int16{head.XMin, head.YMin, head.XMax, head.YMax}
+	})
+	return devanagariFont.face, devanagariFont.err
+}
+
+// Shape Devanagari text at size points
+func shapeDevanagari(face *font.Face, text string, size float64) shaping.Output {
+	runes := []rune(text)
+	devanagariFont.mu.Lock()
+	defer devanagariFont.mu.Unlock()
+	return devanagariFont.shaper.Shape(shaping.Input{
+		Text:      runes,
+		RunStart:  0,
+		RunEnd:    len(runes),
+		Direction: di.DirectionLTR,
+		Face:      face,
+		Size:      fixed.Int26_6(size * 64),
+		Script:    language.Devanagari,
+		Language:  language.NewLanguage("ne"),
+	})
+}
+
+func isDevanagari(r rune) bool {
+	return unicode.Is(unicode.Devanagari, r) || r == '\u200c' || r == '\u200d'
+}
+
+// A stretch of text drawn with one font
+type pdfRun struct {
+	text       string
+	devanagari bool
+}
+
+// Split text into Latin and Devanagari runs. Spaces, digits and punctuation stay
+// with the run they're in, so words and phrases are shaped together.
+func splitPDFRuns(face *font.Face, text string) []pdfRun {
+	var runs []pdfRun
+	var current strings.Builder
+	devanagari := false
+	for _, r := range text {
+		script := isDevanagari(r)
+		if !script && !unicode.IsLetter(r) && current.Len() > 0 {
+			script = devanagari
+			if _, ok := face.NominalGlyph(r); devanagari && !ok {
+				script = false
+			}
+		}
+		if script != devanagari && current.Len() > 0 {
+			runs = append(runs, pdfRun{current.String(), devanagari})
+			current.Reset()
+		}
+		devanagari = script
+		current.WriteRune(r)
+	}
+	if current.Len() > 0 {
+		runs = append(runs, pdfRun{current.String(), devanagari})
+	}
+	return runs
+}
+
+type pdfDocument struct {
+	content bytes.Buffer
+	glyphs  map[font.GID]bool // Devanagari glyphs used, for the font's width table
+}
+
+// Escape text for a PDF string literal
+func pdfText(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 32 && r < 127:
+			b.WriteRune(r)
+		case r >= 0xA0 && r <= 0xFF:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// Approximate Helvetica width, good enough to right-align amounts
+func pdfTextWidth(text string, size float64) float64 {
+	units := 0
+	for _, r := range text {
+		switch {
+		case r == ' ' || r == ',' || r == '.' || r == ':' || r == '/' || r == 'i' || r == 'l':
+			units += 278
+		case r >= 'A' && r <= 'Z':
+			units += 667
+		default:
+			units += 556
+		}
+	}
+	return float64(units) * size / 1000
+}
+
+// The embedded font, if text has any Devanagari to draw with it
+func (d *pdfDocument) devanagariFace(text string) *font.Face {
+	if strings.IndexFunc(text, isDevanagari) < 0 {
+		return nil
+	}
+	face, err := loadDevanagariFont()
+	if err != nil {
+		log.Printf("Loading the Devanagari PDF font failed: %v\n", err)
+		return nil
+	}
+	return face
+}
+
+// Width of text as Text draws it
+func (d *pdfDocument) textWidth(text string, size float64) float64 {
+	face := d.devanagariFace(text)
+	if face == nil {
+		return pdfTextWidth(text, size)
+	}
+
+	width := 0.0
+	for _, run := range splitPDFRuns(face, text) {
+		if run.devanagari {
+			width += float64(shapeDevanagari(face, run.text, size).Advance) / 64
+		} else {
+			width += pdfTextWidth(run.text, size)
+		}
+	}
+	return width
+}
+
+// Text at x, y (from the top-left corner)
+func (d *pdfDocument) Text(x, y, size float64, bold bool, text string) {
+	face := d.devanagariFace(text)
+	if face == nil {
+		d.latinText(x, y, size, bold, text)
+		return
+	}
+
+	for _, run := range splitPDFRuns(face, text) {
+		if run.devanagari {
+			x += d.devanagariText(face, x, y, size, bold, run.text)
+		} else {
+			d.latinText(x, y, size, bold, run.text)
+			x += pdfTextWidth(run.text, size)
+		}
+	}
+}
+
+func (d *pdfDocument) latinText(x, y, size float64, bold bool, text string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&d.content, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, pdfPageHeight-y, pdfText(text))
+}
+
+// Draw shaped Devanagari glyph by glyph; returns the advance. There is no bold
+// cut, so bold is drawn with a thin outline.
+func (d *pdfDocument) devanagariText(face *font.Face, x, y, size float64, bold bool, text string) float64 {
+	output := shapeDevanagari(face, text, size)
+	if d.glyphs == nil {
+		d.glyphs = make(map[font.GID]bool)
+	}
+
+	if bold {
+		fmt.Fprintf(&d.content, "q %.2f w BT 2 Tr /F3 %.1f Tf\n", size*0.03, size)
+	} else {
+		fmt.Fprintf(&d.content, "BT /F3 %.1f Tf\n", size)
+	}
+	dot := x
+	for _, glyph := range output.Glyphs {
+		d.glyphs[glyph.GlyphID] = true
+		gx := dot + float64(glyph.XOffset)/64
+		gy := pdfPageHeight - y + float64(glyph.YOffset)/64
+		fmt.Fprintf(&d.content, "1 0 0 1 %.2f %.2f Tm <%04X> Tj\n", gx, gy, uint16(glyph.GlyphID))
+		dot += float64(glyph.XAdvance) / 64
+	}
+	if bold {
+		d.content.WriteString("ET Q\n")
+	} else {
+		d.content.WriteString("ET\n")
+	}
+	return dot - x
+}
+
+// Text ending at x
+func (d *pdfDocument) TextRight(x, y, size float64, bold bool, text string) {
+	d.Text(x-d.textWidth(text, size), y, size, bold, text)
+}
+
+// Horizontal rule
+func (d *pdfDocument) Line(x1, x2, y float64) {
+	fmt.Fprintf(&d.content, "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, pdfPageHeight-y, x2, pdfPageHeight-y)
+}
+
+// PDF objects for the embedded Devanagari font, numbered from first: a Type0
+// font with Identity-H encoding, so content streams address glyphs by ID
+func (d *pdfDocument) devanagariFontObjects(first int) []string {
+	face := devanagariFont.face
+	scale := 1000 / float64(face.Upem())
+
+	ids := make([]int, 0, len(d.glyphs))
+	for gid := range d.glyphs {
+		ids = append(ids, int(gid))
+	}
+	sort.Ints(ids)
+	var widths strings.Builder
+	for _, gid := range ids {
+		fmt.Fprintf(&widths, "%d [%.0f] ", gid, float64(face.HorizontalAdvance(font.GID(gid)))*scale)
+	}
+
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	w.Write(devanagariFontData)
+	w.Close()
+
+	ascent, descent := 1000.0, -300.0
+	if extents, ok := face.FontHExtents(); ok {
+		ascent, descent = float64(extents.Ascender)*scale, float64(extents.Descender)*scale
+	}
+	bbox := devanagariFont.bbox
+	name := "/NotoSansDevanagari-Regular"
+
+	return []string{
+		fmt.Sprintf("<< /Type /Font /Subtype /Type0 /BaseFont %s /Encoding /Identity-H /DescendantFonts [%d 0 R] >>", name, first+1),
+		fmt.Sprintf("<< /Type /Font /Subtype /CIDFontType2 /BaseFont %s /CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> /FontDescriptor %d 0 R /CIDToGIDMap /Identity /DW 1000 /W [%s] >>", name, first+2, widths.String()),
+		fmt.Sprintf("<< /Type /FontDescriptor /FontName %s /Flags 32 /FontBBox [%.0f %.0f %.0f %.0f] /ItalicAngle 0 /Ascent %.0f /Descent %.0f /CapHeight %.0f /StemV 80 /FontFile2 %d 0 R >>",
+			name, float64(bbox[0])*scale, float64(bbox[1])*scale, float64(bbox[2])*scale, float64(bbox[3])*scale, ascent, descent, ascent, first+3),
+		fmt.Sprintf("<< /Length %d /Length1 %d /Filter /FlateDecode >>\nstream\n%s\nendstream", compressed.Len(), len(devanagariFontData), compressed.String()),
+	}
+}
+
+// Assemble the file
+func (d *pdfDocument) Bytes() []byte {
+	fonts := "/F1 5 0 R /F2 6 0 R"
+	if len(d.glyphs) > 0 {
+		fonts += " /F3 7 0 R"
+	}
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << %s >> >> /Contents 4 0 R >>", pdfPageWidth, pdfPageHeight, fonts),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", d.content.Len(), d.content.String()),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+	}
+	if len(d.glyphs) > 0 {
+		objects = append(objects, d.devanagariFontObjects(len(objects)+1)...)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Phone numbers for SMS alerts. A number is only used once the user confirms
+// the one-time code sent to it.
+
+const (
+	phoneOTPTTL         = 10 * time.Minute
+	phoneOTPMaxAttempts = 5
+)
+
+// Codes sent per user
+var phoneOTPLimit = RateLimit{Burst: 3, Per: time.Hour}
+
+// Random 6-digit code
+func generatePhoneOTP() (string, error) {
+	n, err := crand.Int(crand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// Hash of a code, bound to the number it was sent to
+func hashPhoneOTP(phone, code string) string {
+	sum := sha256.Sum256([]byte(phone + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// The signed-in user's phone number and SMS usage
+func phoneHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	response := gin.H{
+		"phone":       user.Phone,
+		"verified_at": user.PhoneVerifiedAt,
+		"sms_today":   smsAlertsToday(userID, time.Now()),
+		"daily_limit": smsDailyLimit(),
+	}
+	var pending PhoneVerification
+	if err := db.Where("user_id = ? AND expires_at > ?", userID, time.Now()).First(&pending).Error; err == nil {
+		response["pending_phone"] = pending.Phone
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// Send a verification code to a new phone number
+func startPhoneVerificationHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var input struct {
+		Phone string `json:"phone" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "phone is required"})
+		return
+	}
+	phone, err := normalizeNepaliMobile(input.Phone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !allowRequest(c, fmt.Sprintf("phone-otp:user:%d", userID), phoneOTPLimit) {
+		return
+	}
+
+	code, err := generatePhoneOTP()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send code"})
+		return
+	}
+
+	// A new code replaces any earlier one
+	db.Unscoped().Where("user_id = ?", userID).Delete(&PhoneVerification{})
+	verification := PhoneVerification{
+		UserID:    userID,
+		Phone:     phone,
+		CodeHash:  hashPhoneOTP(phone, code),
+		ExpiresAt: time.Now().Add(phoneOTPTTL),
+	}
+	if err := db.Create(&verification).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send code"})
+		return
+	}
+
+	entry := SMSLog{
+		UserID:   userID,
+		Type:     smsTypeOTP,
+		To:       phone,
+		Text:     fmt.Sprintf("IPO Pilot verification code: %s. It expires in %d minutes.", code, int(phoneOTPTTL.Minutes())),
+		Provider: smsSender.Name(),
+		Status:   SMSPending,
+	}
+	if err := db.Create(&entry).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send code"})
+		return
+	}
+	if err := deliverSMS(&entry); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Could not send the code. Please try again later."})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Verification code sent",
+		"phone":      phone,
+		"expires_in": int(phoneOTPTTL.Seconds()),
+	})
+}
+
+// Confirm the code and save the phone number
+func verifyPhoneHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var input struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+		return
+	}
+
+	var verification PhoneVerification
+	if err := db.Where("user_id = ?", userID).First(&verification).Error; err != nil || time.Now().After(verification.ExpiresAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No pending code. Request a new one."})
+		return
+	}
+	if verification.Attempts >= phoneOTPMaxAttempts {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many attempts. Request a new code."})
+		return
+	}
+	db.Model(&verification).Update("attempts", verification.Attempts+1)
+
+	expected := hashPhoneOTP(verification.Phone, input.Code)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(verification.CodeHash)) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	now := time.Now()
+	if err := db.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"phone":             verification.Phone,
+		"phone_verified_at": now,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save phone number"})
+		return
+	}
+	db.Unscoped().Delete(&verification)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Phone number verified",
+		"phone":   verification.Phone,
+	})
+}
+
+// Remove the phone number, which stops SMS alerts
+func removePhoneHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	db.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"phone":             "",
+		"phone_verified_at": nil,
+	})
+	db.Unscoped().Where("user_id = ?", userID).Delete(&PhoneVerification{})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Phone number removed"})
+}
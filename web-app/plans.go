@@ -0,0 +1,394 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Plan catalog. Prices, durations and limits live in the plans table so they
+// can change without a deploy. Subscriptions copy a plan's limits when bought,
+// so editing a plan only affects new purchases.
+
+// Built-in plan codes
+const (
+	planCodeTrial   = "trial"
+	planCodePremium = "premium"
+)
+
+var errPlanUnavailable = errors.New("plan is not available")
+
+// Plans created on first start
+var defaultPlans = []Plan{
+	{
+		Code:               planCodeTrial,
+		Name:               "Free Trial",
+		NameNepali:         "नि:शुल्क परीक्षण",
+		Description:        "Try every feature free for 7 days",
+		DescriptionNepali:  "७ दिन सबै सुविधा नि:शुल्क प्रयोग गर्नुहोस्",
+		DurationDays:       trialDays,
+		MaxProfiles:        3,
+		MaxApplications:    unlimited,
+		MinMonitorInterval: 300,
+		IsTrial:            true,
+		IsActive:           true,
+	},
+	{
+		Code:              planCodePremium,
+		Name:              "Premium",
+		NameNepali:        "प्रिमियम",
+		Description:       "Everything you need for IPO automation",
+		DescriptionNepali: "IPO स्वचालन के लिए आपको सभी कुछ",
+		Features: strings.Join([]string{
+			"✓ Unlimited MeroShare Accounts",
+			"✓ Unlimited IPO Applications",
+			"✓ Real-time IPO Notifications",
+			"✓ 24/7 Priority Email & Chat Support",
+			"✓ 2-minute Smart Monitoring",
+			"✓ Multi-Source IPO Tracking (All Exchanges)",
+			"✓ SMS Alerts for New IPOs",
+			"✓ Secure Credential Encryption",
+			"✓ Mobile-Friendly Dashboard",
+		}, "\n"),
+		FeaturesNepali: strings.Join([]string{
+			"✓ असीमित MeroShare खाताहरू",
+			"✓ असीमित IPO आवेदनहरू",
+			"✓ रिअल-टाइम IPO सूचनाहरू",
+			"✓ 24/7 प्राथमिकता समर्थन",
+			"✓ 2-मिनेट स्मार्ट निगरानी",
+			"✓ बहु-स्रोत IPO ट्र्यैकिङ",
+			"✓ SMS अलर्ट",
+			"✓ सुरक्षित एन्क्रिप्शन",
+			"✓ मोबाइल-अनुकूल डैशबोर्ड",
+		}, "\n"),
+		Price:              1999,
+		DurationMonths:     3,
+		MaxProfiles:        unlimited,
+		MaxApplications:    unlimited,
+		MinMonitorInterval: 120,
+		IsPopular:          true,
+		IsActive:           true,
+	},
+}
+
+// Create the built-in plans if they don't exist yet
+func seedPlans() {
+	for _, plan := range defaultPlans {
+		var count int64
+		db.Unscoped().Model(&Plan{}).Where("code = ?", plan.Code).Count(&count)
+		if count == 0 {
+			plan := plan
+			db.Create(&plan)
+		}
+	}
+}
+
+// Link subscriptions created before the catalog to their plan by code
+func migrateSubscriptionPlans() {
+	var plans []Plan
+	db.Unscoped().Find(&plans)
+	for _, plan := range plans {
+		db.Model(&Subscription{}).
+			Where("plan_id IS NULL AND plan_type = ?", plan.Code).
+			Update("plan_id", plan.ID)
+	}
+}
+
+// Look up a plan by code, including inactive and archived plans
+func getPlanByCode(code string) (*Plan, error) {
+	var plan Plan
+	if err := db.Where("code = ?", code).First(&plan).Error; err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// Look up a plan that can be bought right now
+func getPurchasablePlan(id uint) (*Plan, error) {
+	var plan Plan
+	err := db.Where("id = ? AND is_active = ? AND is_archived = ? AND is_trial = ?", id, true, false, false).
+		First(&plan).Error
+	if err != nil {
+		return nil, errPlanUnavailable
+	}
+	return &plan, nil
+}
+
+// Plans shown on the pricing page
+func listPricingPlans() []Plan {
+	var plans []Plan
+	db.Where("is_active = ? AND is_archived = ? AND is_trial = ?", true, false, false).
+		Order("sort_order, price").
+		Find(&plans)
+	return plans
+}
+
+// The plan a subscription was bought on
+func getSubscriptionPlan(sub *Subscription) (*Plan, error) {
+	if sub.PlanID != nil {
+		var plan Plan
+		if err := db.Unscoped().First(&plan, *sub.PlanID).Error; err == nil {
+			return &plan, nil
+		}
+	}
+	return getPlanByCode(sub.PlanType)
+}
+
+// End of a billing period starting at start
+func (p *Plan) PeriodEnd(start time.Time) time.Time {
+	return start.AddDate(0, p.DurationMonths, p.DurationDays)
+}
+
+// Copy the plan's code and limits onto a subscription
+func (p *Plan) ApplyTo(sub *Subscription) {
+	sub.PlanID = &p.ID
+	sub.PlanType = p.Code
+	sub.MaxProfiles = p.MaxProfiles
+	sub.MaxApplications = p.MaxApplications
+	sub.MinMonitorInterval = p.MinMonitorInterval
+}
+
+// Name in the given language ("english" or "nepali")
+func (p *Plan) LocalizedName(lang string) string {
+	if lang == "nepali" && p.NameNepali != "" {
+		return p.NameNepali
+	}
+	return p.Name
+}
+
+func (p *Plan) LocalizedDescription(lang string) string {
+	if lang == "nepali" && p.DescriptionNepali != "" {
+		return p.DescriptionNepali
+	}
+	return p.Description
+}
+
+// Feature bullet points in the given language
+func (p *Plan) FeatureList(lang string) []string {
+	features := p.Features
+	if lang == "nepali" && p.FeaturesNepali != "" {
+		features = p.FeaturesNepali
+	}
+
+	var list []string
+	for _, line := range strings.Split(features, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			list = append(list, line)
+		}
+	}
+	return list
+}
+
+// Human-readable duration, e.g. "3 months" or "7 days"
+func (p *Plan) DurationLabel(lang string) string {
+	month, months, day, days := "month", "months", "day", "days"
+	if lang == "nepali" {
+		month, months, day, days = "महिना", "महिना", "दिन", "दिन"
+	}
+
+	var parts []string
+	if p.DurationMonths == 1 {
+		parts = append(parts, "1 "+month)
+	} else if p.DurationMonths > 1 {
+		parts = append(parts, fmt.Sprintf("%d %s", p.DurationMonths, months))
+	}
+	if p.DurationDays == 1 {
+		parts = append(parts, "1 "+day)
+	} else if p.DurationDays > 1 {
+		parts = append(parts, fmt.Sprintf("%d %s", p.DurationDays, days))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Format an NPR amount with thousands separators: 1999 -> "1,999"
+func formatNPR(amount float64) string {
+	whole := int64(amount)
+	paisa := int64((amount-float64(whole))*100 + 0.5)
+
+	digits := strconv.FormatInt(whole, 10)
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(d)
+	}
+	if paisa > 0 {
+		fmt.Fprintf(&b, ".%02d", paisa)
+	}
+	return b.String()
+}
+
+// PlanInput is the admin create/update payload
+type PlanInput struct {
+	Code               string   `json:"code"`
+	Name               string   `json:"name" binding:"required"`
+	NameNepali         string   `json:"name_nepali"`
+	Description        string   `json:"description"`
+	DescriptionNepali  string   `json:"description_nepali"`
+	Features           []string `json:"features"`
+	FeaturesNepali     []string `json:"features_nepali"`
+	Price              float64  `json:"price"`
+	DurationMonths     int      `json:"duration_months"`
+	DurationDays       int      `json:"duration_days"`
+	MaxProfiles        int      `json:"max_profiles"`
+	MaxApplications    int      `json:"max_applications"`
+	MinMonitorInterval int      `json:"min_monitor_interval"`
+	IsTrial            bool     `json:"is_trial"`
+	IsPopular          bool     `json:"is_popular"`
+	SortOrder          int      `json:"sort_order"`
+	IsActive           bool     `json:"is_active"`
+}
+
+func (in *PlanInput) validate() error {
+	switch {
+	case in.Price < 0:
+		return errors.New("price cannot be negative")
+	case in.DurationMonths < 0 || in.DurationDays < 0 || in.DurationMonths+in.DurationDays == 0:
+		return errors.New("duration_months or duration_days must be positive")
+	case in.MaxProfiles == 0 || in.MaxProfiles < unlimited:
+		return errors.New("max_profiles must be positive or -1 for unlimited")
+	case in.MaxApplications == 0 || in.MaxApplications < unlimited:
+		return errors.New("max_applications must be positive or -1 for unlimited")
+	case in.MinMonitorInterval < 30:
+		return errors.New("min_monitor_interval must be at least 30 seconds")
+	case !in.IsTrial && in.Price == 0:
+		return errors.New("paid plans need a price")
+	}
+	return nil
+}
+
+func (in *PlanInput) applyTo(plan *Plan) {
+	plan.Name = in.Name
+	plan.NameNepali = in.NameNepali
+	plan.Description = in.Description
+	plan.DescriptionNepali = in.DescriptionNepali
+	plan.Features = strings.Join(in.Features, "\n")
+	plan.FeaturesNepali = strings.Join(in.FeaturesNepali, "\n")
+	plan.Price = in.Price
+	plan.DurationMonths = in.DurationMonths
+	plan.DurationDays = in.DurationDays
+	plan.MaxProfiles = in.MaxProfiles
+	plan.MaxApplications = in.MaxApplications
+	plan.MinMonitorInterval = in.MinMonitorInterval
+	plan.IsTrial = in.IsTrial
+	plan.IsPopular = in.IsPopular
+	plan.SortOrder = in.SortOrder
+	plan.IsActive = in.IsActive
+}
+
+// Admin: list plans (archived ones with ?archived=1)
+func adminPlansHandler(c *gin.Context) {
+	query := db.Order("sort_order, price")
+	if c.Query("archived") != "1" {
+		query = query.Where("is_archived = ?", false)
+	}
+
+	var plans []Plan
+	query.Find(&plans)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count": len(plans),
+		"plans": plans,
+	})
+}
+
+// Admin: create a plan
+func createPlanHandler(c *gin.Context) {
+	var input PlanInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	input.Code = strings.ToLower(strings.TrimSpace(input.Code))
+	if input.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+		return
+	}
+	if err := input.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var count int64
+	db.Unscoped().Model(&Plan{}).Where("code = ?", input.Code).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A plan with this code already exists"})
+		return
+	}
+
+	plan := Plan{Code: input.Code}
+	input.applyTo(&plan)
+
+	if err := db.Create(&plan).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create plan"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Plan created",
+		"plan":    plan,
+	})
+}
+
+// Admin: update a plan. Existing subscriptions keep the limits they were bought with.
+func updatePlanHandler(c *gin.Context) {
+	planID, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+
+	var plan Plan
+	if err := db.First(&plan, planID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	}
+	if plan.IsArchived {
+		c.JSON(http.StatusConflict, gin.H{"error": "Archived plans cannot be changed"})
+		return
+	}
+
+	var input PlanInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if err := input.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	input.applyTo(&plan) // Code is immutable
+	if err := db.Save(&plan).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update plan"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Plan updated",
+		"plan":    plan,
+	})
+}
+
+// Admin: archive a plan. It disappears from sale; subscriptions on it are unaffected.
+func archivePlanHandler(c *gin.Context) {
+	planID, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+
+	result := db.Model(&Plan{}).Where("id = ?", planID).Updates(map[string]interface{}{
+		"is_archived": true,
+		"is_active":   false,
+	})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to archive plan"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Plan archived"})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestProfileSecretsNeedPasswordConfirmation(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "secrets@example.com")
+	hash, _ := hashPassword("correct horse")
+	db.Model(user).Update("password", hash)
+
+	key := generateEncryptionKey("Ram")
+	passwordEnc, _ := encryptAES(key, "meroshare-pass")
+	crnEnc, _ := encryptAES(key, "CRN123")
+	pinEnc, _ := encryptAES(key, "1234")
+	profile := Profile{UserID: user.ID, Name: "Ram", DPID: "13000", BOID: "1301000000000001", PasswordEnc: passwordEnc, CRNEnc: crnEnc, TransactionPINEnc: pinEnc}
+	if err := db.Create(&profile).Error; err != nil {
+		t.Fatalf("creating profile: %v", err)
+	}
+
+	r := gin.New()
+	dashboard := r.Group("/dashboard", authMiddleware())
+	dashboard.POST("/confirm-password", confirmPasswordHandler)
+	dashboard.GET("/profiles/:id/secrets", requireRecentConfirmation(), profileSecretsHandler)
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	secretsPath := "/dashboard/profiles/" + strconv.FormatUint(uint64(profile.ID), 10) + "/secrets"
+
+	// A session alone, as a stolen cookie would be, isn't enough without 2FA either
+	session, _ := generateJWT(user, time.Time{})
+	if w := do("GET", secretsPath, session, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("secrets without confirmation: %d, want 403", w.Code)
+	}
+	if w := do("POST", "/dashboard/confirm-password", session, `{"password":"wrong"}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: %d, want 401", w.Code)
+	}
+
+	w := do("POST", "/dashboard/confirm-password", session, `{"password":"correct horse"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("confirming password: %d %s", w.Code, w.Body)
+	}
+	var confirmed struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &confirmed)
+
+	w = do("GET", secretsPath, confirmed.Token, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("secrets after confirmation: %d %s", w.Code, w.Body)
+	}
+	var secrets map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &secrets)
+	if secrets["transaction_pin"] != "1234" || secrets["crn"] != "CRN123" {
+		t.Fatalf("secrets = %v", secrets)
+	}
+
+	// Undecryptable credentials are an error, not empty strings
+	db.Model(&profile).Update("transaction_pin_enc", "not-base64!")
+	if w := do("GET", secretsPath, confirmed.Token, ""); w.Code != http.StatusInternalServerError {
+		t.Fatalf("secrets that don't decrypt: %d, want 500", w.Code)
+	}
+}
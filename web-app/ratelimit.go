@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Token bucket rate limiting. Buckets live in memory by default; set
+// RATE_LIMIT_BACKEND=db to share them through the database across instances.
+
+// RateLimit describes a bucket: Burst tokens, refilled at Burst per Per
+type RateLimit struct {
+	Burst int
+	Per   time.Duration
+}
+
+// Default policies
+var (
+	loginIPLimit      = RateLimit{Burst: 20, Per: 15 * time.Minute}
+	loginAccountLimit = RateLimit{Burst: 10, Per: 15 * time.Minute}
+	registerIPLimit   = RateLimit{Burst: 5, Per: time.Hour}
+	passwordMailLimit = RateLimit{Burst: 5, Per: time.Hour}
+	paymentIPLimit    = RateLimit{Burst: 30, Per: 10 * time.Minute}
+)
+
+// RateLimitStore takes one token from the bucket at key
+type RateLimitStore interface {
+	Take(key string, limit RateLimit) (allowed bool, retryAfter time.Duration)
+}
+
+var rateLimiter RateLimitStore
+
+func newRateLimitStoreFromEnv() RateLimitStore {
+	if os.Getenv("RATE_LIMIT_BACKEND") == "db" {
+		return &dbRateLimitStore{}
+	}
+	return newMemoryRateLimitStore()
+}
+
+// Proxies allowed to set X-Forwarded-For, from TRUSTED_PROXIES (comma-separated
+// IPs or CIDRs). None by default, so clients can't pick the IP they're limited by.
+func trustedProxiesFromEnv() []string {
+	var proxies []string
+	for _, p := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			proxies = append(proxies, p)
+		}
+	}
+	return proxies
+}
+
+// Refill a bucket for elapsed time and try to take a token
+func takeToken(tokens float64, last time.Time, now time.Time, limit RateLimit) (float64, bool, time.Duration) {
+	rate := float64(limit.Burst) / limit.Per.Seconds() // tokens per second
+	tokens = math.Min(float64(limit.Burst), tokens+now.Sub(last).Seconds()*rate)
+
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	wait := time.Duration((1 - tokens) / rate * float64(time.Second))
+	return tokens, false, wait
+}
+
+// In-memory store
+
+type memoryBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	store := &memoryRateLimitStore{buckets: make(map[string]*memoryBucket)}
+	go store.cleanup()
+	return store
+}
+
+func (s *memoryRateLimitStore) Take(key string, limit RateLimit) (bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: float64(limit.Burst), last: now}
+		s.buckets[key] = bucket
+	}
+
+	tokens, allowed, wait := takeToken(bucket.tokens, bucket.last, now, limit)
+	bucket.tokens = tokens
+	bucket.last = now
+	return allowed, wait
+}
+
+// Drop buckets idle long enough to have fully refilled
+func (s *memoryRateLimitStore) cleanup() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mu.Lock()
+		for key, bucket := range s.buckets {
+			if time.Since(bucket.last) > 24*time.Hour {
+				delete(s.buckets, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Shared store backed by the database
+
+type dbRateLimitStore struct{}
+
+func (s *dbRateLimitStore) Take(key string, limit RateLimit) (bool, time.Duration) {
+	allowed, wait := true, time.Duration(0)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		bucket := RateLimitBucket{BucketKey: key, Tokens: float64(limit.Burst), UpdatedAt: now}
+
+		// Create on first use, then lock the row for the read-modify-write
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&bucket).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&bucket, "bucket_key = ?", key).Error; err != nil {
+			return err
+		}
+
+		var tokens float64
+		tokens, allowed, wait = takeToken(bucket.Tokens, bucket.UpdatedAt, now, limit)
+		return tx.Model(&RateLimitBucket{}).Where("bucket_key = ?", key).
+			Updates(map[string]interface{}{"tokens": tokens, "updated_at": now}).Error
+	})
+
+	// Fail open: a broken limiter must not take the login page down
+	if err != nil {
+		return true, 0
+	}
+	return allowed, wait
+}
+
+// Take a token and write a 429 if the bucket is empty. Returns false when the request was rejected.
+func allowRequest(c *gin.Context, key string, limit RateLimit) bool {
+	allowed, wait := rateLimiter.Take(key, limit)
+	if allowed {
+		return true
+	}
+
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", fmt.Sprintf("%d", seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       "Too many requests. Please try again later.",
+		"retry_after": seconds,
+	})
+	c.Abort()
+	return false
+}
+
+// Rate limiting middleware - one bucket per client IP and scope
+func rateLimitMiddleware(scope string, limit RateLimit) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !allowRequest(c, scope+":ip:"+c.ClientIP(), limit) {
+			return
+		}
+		c.Next()
+	}
+}
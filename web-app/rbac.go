@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Role-based access control for /admin.
+// Roles and their permissions are defined here; assignments live in user_roles.
+// User.IsAdmin is kept in sync as "has at least one staff role".
+
+// Permissions
+const (
+	permUsersRead          = "users:read"
+	permUsersWrite         = "users:write"
+	permSubscriptionsRead  = "subscriptions:read"
+	permSubscriptionsWrite = "subscriptions:write"
+	permRevenueRead        = "revenue:read"
+	permPlansManage        = "plans:manage"
+	permPaymentsReview     = "payments:review"
+	permIPOSourcesManage   = "ipo_sources:manage"
+	permRolesManage        = "roles:manage"
+)
+
+// Roles
+const (
+	roleSupport       = "support"
+	roleFinance       = "finance"
+	roleSourceManager = "source-manager"
+	roleSuperAdmin    = "super-admin"
+)
+
+var errLastSuperAdmin = errors.New("cannot remove the last super-admin")
+
+// RoleDefinition describes a built-in role
+type RoleDefinition struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+var roleDefinitions = map[string]RoleDefinition{
+	roleSupport: {
+		Name:        roleSupport,
+		Description: "Read users and subscriptions",
+		Permissions: []string{permUsersRead, permSubscriptionsRead},
+	},
+	roleFinance: {
+		Name:        roleFinance,
+		Description: "Activate subscriptions, review bank transfers, manage plans and view revenue",
+		Permissions: []string{permSubscriptionsRead, permSubscriptionsWrite, permRevenueRead, permPlansManage, permPaymentsReview},
+	},
+	roleSourceManager: {
+		Name:        roleSourceManager,
+		Description: "Manage IPO data sources",
+		Permissions: []string{permIPOSourcesManage},
+	},
+	roleSuperAdmin: {
+		Name:        roleSuperAdmin,
+		Description: "Full access, including role assignment",
+		Permissions: []string{
+			permUsersRead, permUsersWrite,
+			permSubscriptionsRead, permSubscriptionsWrite,
+			permRevenueRead, permPlansManage, permPaymentsReview, permIPOSourcesManage, permRolesManage,
+		},
+	},
+}
+
+// Role names assigned to a user
+func getUserRoles(userID uint) []string {
+	var roles []string
+	db.Model(&UserRole{}).Where("user_id = ?", userID).Order("role").Pluck("role", &roles)
+	return roles
+}
+
+// Effective permission set for a user (union of their roles)
+func getUserPermissions(userID uint) map[string]bool {
+	permissions := make(map[string]bool)
+	for _, role := range getUserRoles(userID) {
+		for _, perm := range roleDefinitions[role].Permissions {
+			permissions[perm] = true
+		}
+	}
+	return permissions
+}
+
+// Check a permission for the signed-in user (loaded once per request)
+func hasPermission(c *gin.Context, permission string) bool {
+	permissions, ok := c.Get("permissions")
+	if !ok {
+		permissions = getUserPermissions(c.GetUint("userID"))
+		c.Set("permissions", permissions)
+	}
+	return permissions.(map[string]bool)[permission]
+}
+
+// Permission middleware - use after authMiddleware and adminMiddleware.
+// Roles are read from the database, so revocations apply immediately.
+func requirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasPermission(c, permission) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":      "You do not have permission to perform this action",
+				"permission": permission,
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// Give existing IsAdmin accounts without roles the super-admin role
+func migrateAdminRoles() {
+	var admins []User
+	db.Where("is_admin = ?", true).Find(&admins)
+	for _, admin := range admins {
+		var count int64
+		db.Model(&UserRole{}).Where("user_id = ?", admin.ID).Count(&count)
+		if count == 0 {
+			db.Create(&UserRole{UserID: admin.ID, Role: roleSuperAdmin})
+		}
+	}
+}
+
+// List the role catalog
+func listRolesHandler(c *gin.Context) {
+	names := make([]string, 0, len(roleDefinitions))
+	for name := range roleDefinitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	roles := make([]RoleDefinition, 0, len(names))
+	for _, name := range names {
+		roles = append(roles, roleDefinitions[name])
+	}
+
+	c.JSON(http.StatusOK, gin.H{"roles": roles})
+}
+
+// Get a user's roles
+func getUserRolesHandler(c *gin.Context) {
+	userID, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id": user.ID,
+		"roles":   getUserRoles(user.ID),
+	})
+}
+
+// Replace a user's roles
+func setUserRolesHandler(c *gin.Context) {
+	userID, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+	adminID := c.GetUint("userID")
+
+	var input struct {
+		Roles []string `json:"roles"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	roles := make(map[string]bool)
+	for _, role := range input.Roles {
+		if _, ok := roleDefinitions[role]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role: " + role})
+			return
+		}
+		roles[role] = true
+	}
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Never leave the system without a super-admin
+		if !roles[roleSuperAdmin] {
+			var others int64
+			tx.Model(&UserRole{}).Where("role = ? AND user_id <> ?", roleSuperAdmin, user.ID).Count(&others)
+			var current int64
+			tx.Model(&UserRole{}).Where("role = ? AND user_id = ?", roleSuperAdmin, user.ID).Count(&current)
+			if current > 0 && others == 0 {
+				return errLastSuperAdmin
+			}
+		}
+
+		if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&UserRole{}).Error; err != nil {
+			return err
+		}
+		for role := range roles {
+			if err := tx.Create(&UserRole{UserID: user.ID, Role: role, AssignedByID: adminID}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&user).Update("is_admin", len(roles) > 0).Error
+	})
+
+	if err == errLastSuperAdmin {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cannot remove the last super-admin"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update roles"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Roles updated",
+		"user_id": user.ID,
+		"roles":   getUserRoles(user.ID),
+	})
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Referral program. Every user has a referral code; signing up with it links
+// the new user to the referrer. When the new user's first payment completes the
+// referrer earns free days: added to their paid subscription right away, or
+// banked on the account until their next payment. Suspicious referrals are held
+// for an admin, and rewards are capped per referrer. A full refund of the
+// qualifying payment takes the reward back.
+
+// Referral statuses
+const (
+	ReferralPending  = "pending"  // Signed up, no payment yet
+	ReferralFlagged  = "flagged"  // Qualified, held for admin review
+	ReferralRewarded = "rewarded" // Referrer credited
+	ReferralCapped   = "capped"   // Qualified after the referrer hit a cap
+	ReferralRejected = "rejected" // Refused by an admin
+	ReferralRevoked  = "revoked"  // Qualifying payment fully refunded
+)
+
+const referralCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" // No 0/O or 1/I
+
+var errReferralNotReviewable = errors.New("referral is not awaiting review")
+
+// Reward and caps, from the environment
+func referralRewardDays() int  { return getEnvInt("REFERRAL_REWARD_DAYS", 30) }
+func referralMonthlyCap() int  { return getEnvInt("REFERRAL_MONTHLY_CAP", 5) }
+func referralLifetimeCap() int { return getEnvInt("REFERRAL_LIFETIME_CAP", 50) } // 0 = unlimited
+
+// Random code, e.g. K7MZQ4TX
+func generateReferralCode() (string, error) {
+	code := make([]byte, 8)
+	max := big.NewInt(int64(len(referralCodeAlphabet)))
+	for i := range code {
+		n, err := crand.Int(crand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = referralCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// A code no other user has
+func newReferralCode() (string, error) {
+	for i := 0; i < 5; i++ {
+		code, err := generateReferralCode()
+		if err != nil {
+			return "", err
+		}
+		var count int64
+		db.Unscoped().Model(&User{}).Where("referral_code = ?", code).Count(&count)
+		if count == 0 {
+			return code, nil
+		}
+	}
+	return "", errors.New("could not generate a unique referral code")
+}
+
+// Give users created before the referral program a code
+func backfillReferralCodes() {
+	var users []User
+	db.Where("referral_code IS NULL OR referral_code = ''").Find(&users)
+	for _, u := range users {
+		code, err := newReferralCode()
+		if err != nil {
+			log.Printf("Referral code for user %d: %v\n", u.ID, err)
+			continue
+		}
+		db.Model(&u).Update("referral_code", code)
+	}
+}
+
+// Link a newly registered user to the owner of code. Unknown codes are ignored
+// so a stale link never blocks sign-up; the same mailbox under an alias can't
+// refer itself.
+func recordReferral(user *User, code string) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return
+	}
+
+	var referrer User
+	if err := db.Where("referral_code = ?", code).First(&referrer).Error; err != nil || referrer.ID == user.ID {
+		return
+	}
+	if referrer.EmailCanonical == user.EmailCanonical {
+		log.Printf("Ignored self-referral of user %d by user %d\n", user.ID, referrer.ID)
+		return
+	}
+
+	referral := Referral{
+		ReferrerID: referrer.ID,
+		ReferredID: user.ID,
+		Status:     ReferralPending,
+	}
+	if referrer.SignupIP != "" && referrer.SignupIP == user.SignupIP {
+		referral.FlagReason = "same signup IP as referrer"
+	}
+	if err := db.Create(&referral).Error; err != nil {
+		log.Printf("Recording referral of user %d failed: %v\n", user.ID, err)
+		return
+	}
+	db.Model(user).Update("referred_by_id", referrer.ID)
+}
+
+// Why a qualifying referral needs review, or "" if it looks fine
+func referralAbuseReason(tx *gorm.DB, referral *Referral) string {
+	if referral.FlagReason != "" {
+		return referral.FlagReason
+	}
+
+	var referrer, referred User
+	if tx.First(&referrer, referral.ReferrerID).Error != nil || tx.First(&referred, referral.ReferredID).Error != nil {
+		return "referrer or referred account missing"
+	}
+	if !referrer.IsActive {
+		return "referrer account is disabled"
+	}
+	if referrer.BillingPAN != "" && referrer.BillingPAN == referred.BillingPAN {
+		return "same billing PAN as referrer"
+	}
+	return ""
+}
+
+// Has the referrer reached a reward cap?
+func referralCapReached(tx *gorm.DB, referrerID uint) bool {
+	rewarded := func(since time.Time) int64 {
+		var count int64
+		tx.Model(&Referral{}).
+			Where("referrer_id = ? AND status = ? AND rewarded_at > ?", referrerID, ReferralRewarded, since).
+			Count(&count)
+		return count
+	}
+	if cap := referralMonthlyCap(); cap > 0 && rewarded(time.Now().AddDate(0, 0, -30)) >= int64(cap) {
+		return true
+	}
+	if cap := referralLifetimeCap(); cap > 0 && rewarded(time.Time{}) >= int64(cap) {
+		return true
+	}
+	return false
+}
+
+// Credit free days: onto the referrer's active paid subscription, otherwise
+// banked until their next payment (see applyReferralCredit)
+func grantReferralDays(tx *gorm.DB, userID uint, days int) error {
+	var sub Subscription
+	err := tx.Where("user_id = ? AND status = ? AND is_trial = ? AND end_date > ?", userID, SubscriptionActive, false, time.Now()).
+		Order("end_date DESC").
+		First(&sub).Error
+	if err == nil {
+		return tx.Model(&sub).Updates(map[string]interface{}{
+			"end_date":           sub.EndDate.AddDate(0, 0, days),
+			"last_reminder_days": 0,
+		}).Error
+	}
+	return tx.Model(&User{}).Where("id = ?", userID).
+		Update("referral_credit_days", gorm.Expr("referral_credit_days + ?", days)).Error
+}
+
+// Take back free days: from the bank first, then off the referrer's paid
+// subscription, never ending it before now
+func deductReferralDays(tx *gorm.DB, userID uint, days int) error {
+	var user User
+	if err := tx.First(&user, userID).Error; err != nil {
+		return err
+	}
+	banked := user.ReferralCreditDays
+	if banked > days {
+		banked = days
+	}
+	if banked > 0 {
+		if err := tx.Model(&User{}).Where("id = ?", userID).
+			Update("referral_credit_days", gorm.Expr("referral_credit_days - ?", banked)).Error; err != nil {
+			return err
+		}
+	}
+	if days -= banked; days == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	var sub Subscription
+	if err := tx.Where("user_id = ? AND status = ? AND is_trial = ? AND end_date > ?", userID, SubscriptionActive, false, now).
+		Order("end_date DESC").
+		First(&sub).Error; err != nil {
+		return nil // Already used up
+	}
+	end := sub.EndDate.AddDate(0, 0, -days)
+	if end.Before(now) {
+		end = now
+	}
+	return tx.Model(&sub).Update("end_date", end).Error
+}
+
+// The qualifying payment was fully refunded: revoke the referral so it never
+// pays out, taking back the reward if it was granted. Runs in the refund's
+// transaction.
+func revokeReferralReward(tx *gorm.DB, paymentID uint) error {
+	var referral Referral
+	if err := tx.Where("payment_transaction_id = ? AND status IN ?", paymentID,
+		[]string{ReferralFlagged, ReferralCapped, ReferralRewarded}).First(&referral).Error; err != nil {
+		return nil
+	}
+
+	result := tx.Model(&Referral{}).Where("id = ? AND status = ?", referral.ID, referral.Status).Updates(map[string]interface{}{
+		"status":      ReferralRevoked,
+		"reward_days": 0,
+		"revoked_at":  time.Now(),
+	})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+	if referral.Status != ReferralRewarded || referral.RewardDays == 0 {
+		return nil
+	}
+	log.Printf("Revoked %d referral days from user %d: payment %d was refunded\n", referral.RewardDays, referral.ReferrerID, paymentID)
+	return deductReferralDays(tx, referral.ReferrerID, referral.RewardDays)
+}
+
+// Add a user's banked referral days to the subscription a payment is applied to
+func applyReferralCredit(tx *gorm.DB, sub *Subscription) error {
+	var user User
+	if err := tx.First(&user, sub.UserID).Error; err != nil || user.ReferralCreditDays <= 0 {
+		return err
+	}
+	sub.EndDate = sub.EndDate.AddDate(0, 0, user.ReferralCreditDays)
+	return tx.Model(&User{}).Where("id = ?", user.ID).Update("referral_credit_days", 0).Error
+}
+
+// Reward the referrer when a referred user's first payment completes. Later
+// payments find no pending referral and do nothing.
+func qualifyReferral(txn *PaymentTransaction) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var referral Referral
+		if err := tx.Where("referred_id = ? AND status = ?", txn.UserID, ReferralPending).First(&referral).Error; err != nil {
+			return nil
+		}
+
+		now := time.Now()
+		updates := map[string]interface{}{
+			"payment_transaction_id": txn.ID,
+			"qualified_at":           now,
+		}
+		if reason := referralAbuseReason(tx, &referral); reason != "" {
+			updates["status"] = ReferralFlagged
+			updates["flag_reason"] = reason
+		} else if referralCapReached(tx, referral.ReferrerID) {
+			updates["status"] = ReferralCapped
+		} else {
+			updates["status"] = ReferralRewarded
+			updates["reward_days"] = referralRewardDays()
+			updates["rewarded_at"] = now
+		}
+
+		// Claim the referral; a concurrent completion stops here
+		result := tx.Model(&Referral{}).Where("id = ? AND status = ?", referral.ID, ReferralPending).Updates(updates)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		if updates["status"] != ReferralRewarded {
+			return nil
+		}
+		return grantReferralDays(tx, referral.ReferrerID, referralRewardDays())
+	})
+}
+
+// The signed-in user's referral code, link and results
+func referralsHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+	if user.ReferralCode == "" {
+		if code, err := newReferralCode(); err == nil {
+			db.Model(&user).Update("referral_code", code)
+		}
+	}
+
+	var referrals []Referral
+	db.Where("referrer_id = ?", userID).Order("created_at DESC").Find(&referrals)
+
+	counts := map[string]int{}
+	daysEarned := 0
+	for _, referral := range referrals {
+		counts[referral.Status]++
+		daysEarned += referral.RewardDays
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":         user.ReferralCode,
+		"link":         getBaseURL() + "/register?ref=" + url.QueryEscape(user.ReferralCode),
+		"reward_days":  referralRewardDays(),
+		"signed_up":    len(referrals),
+		"pending":      counts[ReferralPending],
+		"in_review":    counts[ReferralFlagged],
+		"rewarded":     counts[ReferralRewarded],
+		"days_earned":  daysEarned,
+		"banked_days":  user.ReferralCreditDays,
+		"monthly_cap":  referralMonthlyCap(),
+		"lifetime_cap": referralLifetimeCap(),
+	})
+}
+
+// Admin: referrals, optionally filtered by status or referrer_id
+func adminReferralsHandler(c *gin.Context) {
+	query := db.Model(&Referral{}).Order("created_at DESC").Limit(500)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if referrerID := c.Query("referrer_id"); referrerID != "" {
+		query = query.Where("referrer_id = ?", referrerID)
+	}
+
+	var referrals []Referral
+	query.Find(&referrals)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":     len(referrals),
+		"referrals": referrals,
+	})
+}
+
+// Admin: look up a referral for review
+func reviewReferral(c *gin.Context, fn func(tx *gorm.DB, referral *Referral) error) {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var referral Referral
+		if err := tx.First(&referral, c.Param("id")).Error; err != nil {
+			return gorm.ErrRecordNotFound
+		}
+		return fn(tx, &referral)
+	})
+
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Referral not found"})
+	case errors.Is(err, errReferralNotReviewable):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update referral"})
+	default:
+		c.JSON(http.StatusOK, gin.H{"message": "Referral updated"})
+	}
+}
+
+// Admin: reward a flagged or capped referral anyway
+func approveReferralHandler(c *gin.Context) {
+	adminID := c.GetUint("userID")
+	reviewReferral(c, func(tx *gorm.DB, referral *Referral) error {
+		if referral.Status != ReferralFlagged && referral.Status != ReferralCapped {
+			return errReferralNotReviewable
+		}
+		days := referralRewardDays()
+		result := tx.Model(&Referral{}).Where("id = ? AND status = ?", referral.ID, referral.Status).Updates(map[string]interface{}{
+			"status":         ReferralRewarded,
+			"reward_days":    days,
+			"rewarded_at":    time.Now(),
+			"reviewed_by_id": adminID,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errReferralNotReviewable
+		}
+		return grantReferralDays(tx, referral.ReferrerID, days)
+	})
+}
+
+// Admin: refuse a referral so it never pays out
+func rejectReferralHandler(c *gin.Context) {
+	adminID := c.GetUint("userID")
+	reviewReferral(c, func(tx *gorm.DB, referral *Referral) error {
+		if referral.Status == ReferralRewarded || referral.Status == ReferralRejected || referral.Status == ReferralRevoked {
+			return errReferralNotReviewable
+		}
+		return tx.Model(&Referral{}).Where("id = ?", referral.ID).Updates(map[string]interface{}{
+			"status":         ReferralRejected,
+			"reviewed_by_id": adminID,
+		}).Error
+	})
+}
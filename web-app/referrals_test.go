@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+)
+
+// Cancel within the cooling-off window and pay the full refund out by hand
+func refundInFull(t *testing.T, txn *PaymentTransaction) {
+	t.Helper()
+
+	_, refunds, err := cancelSubscription(*txn.SubscriptionID, txn.UserID, "changed my mind", nil)
+	if err != nil {
+		t.Fatalf("cancelling: %v", err)
+	}
+	if len(refunds) != 1 || refunds[0].Amount != txn.Amount {
+		t.Fatalf("refunds = %+v, want one full refund of %.2f", refunds, txn.Amount)
+	}
+	if err := completeRefund(&refunds[0], "BANK-1", nil); err != nil {
+		t.Fatalf("completing refund: %v", err)
+	}
+}
+
+func linkReferral(t *testing.T, referrer, referred *User) {
+	t.Helper()
+
+	if err := db.Create(&Referral{ReferrerID: referrer.ID, ReferredID: referred.ID, Status: ReferralPending}).Error; err != nil {
+		t.Fatalf("linking referral: %v", err)
+	}
+}
+
+func loadReferral(t *testing.T, referredID uint) Referral {
+	t.Helper()
+
+	var referral Referral
+	if err := db.Where("referred_id = ?", referredID).First(&referral).Error; err != nil {
+		t.Fatalf("loading referral: %v", err)
+	}
+	return referral
+}
+
+func TestFullRefundRevokesReferralDays(t *testing.T) {
+	setupTestDB(t)
+	plan := getTestPlan(t, "premium")
+	referrer := createTestUser(t, "referrer@example.com")
+	referred := createTestUser(t, "referred@example.com")
+
+	payForPlan(t, referrer, plan, nil)
+	before, _ := getCurrentSubscription(referrer.ID)
+	linkReferral(t, referrer, referred)
+
+	txn := payForPlan(t, referred, plan, nil)
+	if referral := loadReferral(t, referred.ID); referral.Status != ReferralRewarded {
+		t.Fatalf("referral is %s after the first payment, want rewarded", referral.Status)
+	}
+	rewarded, _ := getCurrentSubscription(referrer.ID)
+	if days := rewarded.EndDate.Sub(before.EndDate).Hours() / 24; int(days) != referralRewardDays() {
+		t.Fatalf("referrer got %.0f days, want %d", days, referralRewardDays())
+	}
+
+	refundInFull(t, txn)
+
+	referral := loadReferral(t, referred.ID)
+	if referral.Status != ReferralRevoked || referral.RewardDays != 0 || referral.RevokedAt == nil {
+		t.Fatalf("referral after the refund = %s / %d days, want revoked", referral.Status, referral.RewardDays)
+	}
+	after, _ := getCurrentSubscription(referrer.ID)
+	if !after.EndDate.Equal(before.EndDate) {
+		t.Fatalf("referrer's subscription ends %v, want %v as before the reward", after.EndDate, before.EndDate)
+	}
+}
+
+func TestFullRefundRevokesBankedReferralDays(t *testing.T) {
+	setupTestDB(t)
+	plan := getTestPlan(t, "premium")
+	referrer := createTestUser(t, "referrer@example.com")
+	referred := createTestUser(t, "referred@example.com")
+	linkReferral(t, referrer, referred)
+
+	// Without a paid subscription the reward is banked, and taken back from the bank
+	refundInFull(t, payForPlan(t, referred, plan, nil))
+
+	var user User
+	db.First(&user, referrer.ID)
+	if user.ReferralCreditDays != 0 {
+		t.Fatalf("referrer has %d banked days, want 0", user.ReferralCreditDays)
+	}
+	if referral := loadReferral(t, referred.ID); referral.Status != ReferralRevoked {
+		t.Fatalf("referral is %s, want revoked", referral.Status)
+	}
+}
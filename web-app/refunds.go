@@ -0,0 +1,411 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Cancellation and refunds. Cancelling a subscription ends access at once and
+// refunds its payments by policy: in full within the cooling-off window after
+// a payment, otherwise the unused part of the period it bought. Refunds go
+// through the payment's gateway where it supports them; the rest (bank
+// transfers, eSewa, ConnectIPS, partial Khalti refunds) become manual refunds
+// that finance pays out and then marks completed.
+
+// Refund methods and statuses
+const (
+	RefundGateway   = "gateway"
+	RefundManual    = "manual"
+	RefundPending   = "pending"
+	RefundCompleted = "completed"
+)
+
+// Gateway refunds still pending this long are picked up by retryGatewayRefunds
+const gatewayRefundStaleAfter = 5 * time.Minute
+
+var (
+	errSubscriptionNotCancellable = errors.New("subscription is not active")
+	errRefundTooLarge             = errors.New("refund exceeds what was paid for this subscription")
+	errRefundNotPending           = errors.New("refund is not pending")
+)
+
+// Days after a payment during which it is refunded in full (REFUND_FULL_DAYS, default 7)
+func refundFullWindow() time.Duration {
+	return time.Duration(getEnvInt("REFUND_FULL_DAYS", 7)) * 24 * time.Hour
+}
+
+// refundAllocation is the part of one payment to give back
+type refundAllocation struct {
+	Payment PaymentTransaction
+	Amount  float64
+}
+
+// Completed payments behind a subscription that still have money to refund, newest first
+func refundablePayments(tx *gorm.DB, subID uint) []PaymentTransaction {
+	var payments []PaymentTransaction
+	tx.Where("subscription_id = ? AND status = ? AND amount > refunded_amount", subID, PaymentCompleted).
+		Order("completed_at DESC").Find(&payments)
+	return payments
+}
+
+// What the refund policy gives back for each payment if cancelled at now
+func policyRefunds(tx *gorm.DB, sub *Subscription, now time.Time) []refundAllocation {
+	allocations := []refundAllocation{}
+	for _, p := range refundablePayments(tx, sub.ID) {
+		left := p.Amount - p.RefundedAmount
+
+		amount := left
+		if p.CompletedAt == nil || now.Sub(*p.CompletedAt) > refundFullWindow() {
+			start, end := sub.StartDate, sub.EndDate
+			if p.PeriodStart != nil && p.PeriodEnd != nil {
+				start, end = *p.PeriodStart, *p.PeriodEnd
+			}
+			amount = math.Min(math.Floor(proRataRemaining(p.Amount, start, end, now)), left)
+		}
+		if amount > 0 {
+			allocations = append(allocations, refundAllocation{Payment: p, Amount: amount})
+		}
+	}
+	return allocations
+}
+
+// Spread an admin-chosen refund over the payments, newest first
+func fixedRefunds(tx *gorm.DB, sub *Subscription, amount float64) ([]refundAllocation, error) {
+	allocations := []refundAllocation{}
+	for _, p := range refundablePayments(tx, sub.ID) {
+		if amount <= 0.005 {
+			break
+		}
+		part := math.Min(amount, p.Amount-p.RefundedAmount)
+		allocations = append(allocations, refundAllocation{Payment: p, Amount: part})
+		amount -= part
+	}
+	if amount > 0.005 {
+		return nil, errRefundTooLarge
+	}
+	return allocations, nil
+}
+
+func refundTotal(allocations []refundAllocation) float64 {
+	total := 0.0
+	for _, a := range allocations {
+		total += a.Amount
+	}
+	return total
+}
+
+// Cancel a subscription and refund it: by policy, or exactly refundAmount when
+// an admin sets one. Gateway refunds run after the cancellation is committed;
+// the user is notified of the outcome.
+func cancelSubscription(subID, requestedBy uint, reason string, refundAmount *float64) (*Subscription, []Refund, error) {
+	var sub Subscription
+	var event *SubscriptionEvent
+	refunds := []Refund{}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&sub, subID).Error; err != nil {
+			return gorm.ErrRecordNotFound
+		}
+		if !subscriptionGrantsAccess(sub.Status) {
+			return errSubscriptionNotCancellable
+		}
+
+		allocations := policyRefunds(tx, &sub, time.Now())
+		if refundAmount != nil {
+			var err error
+			if allocations, err = fixedRefunds(tx, &sub, *refundAmount); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		if event, err = transitionSubscription(tx, &sub, SubscriptionCancelled); err != nil {
+			return err
+		}
+
+		for _, a := range allocations {
+			method := RefundManual
+			if _, ok := getPaymentGateway(a.Payment.Gateway); ok {
+				method = RefundGateway
+			}
+			refund := Refund{
+				PaymentTransactionID: a.Payment.ID,
+				SubscriptionID:       &sub.ID,
+				UserID:               sub.UserID,
+				Amount:               a.Amount,
+				Reason:               reason,
+				Method:               method,
+				Status:               RefundPending,
+				RequestedByID:        requestedBy,
+			}
+			if err := tx.Create(&refund).Error; err != nil {
+				return err
+			}
+			refunds = append(refunds, refund)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range refunds {
+		if refunds[i].Method == RefundGateway {
+			processGatewayRefund(&refunds[i])
+		}
+	}
+	// After the gateway refunds, so the user is told how each one went
+	publishSubscriptionEvent(event)
+	return &sub, refunds, nil
+}
+
+// Ask the gateway to return the money; if it can't, the refund becomes manual
+func processGatewayRefund(refund *Refund) {
+	var txn PaymentTransaction
+	if err := db.First(&txn, refund.PaymentTransactionID).Error; err != nil {
+		return
+	}
+
+	// Claim the refund first: a gateway must never be asked twice for the same money
+	now := time.Now()
+	claim := db.Model(&Refund{}).Where("id = ? AND gateway_attempted_at IS NULL", refund.ID).Update("gateway_attempted_at", now)
+	if claim.Error != nil || claim.RowsAffected == 0 {
+		return
+	}
+	refund.GatewayAttemptedAt = &now
+
+	err := errRefundUnsupported
+	if gateway, ok := getPaymentGateway(txn.Gateway); ok {
+		err = gateway.Refund(&txn, refund.Amount, refund.Reason)
+	}
+	if err != nil {
+		log.Printf("Refund %d of payment %s left for manual processing: %v\n", refund.ID, txn.Reference, err)
+		makeRefundManual(refund, err.Error())
+		return
+	}
+
+	refundedAt := time.Now()
+	refund.GatewayRefundedAt = &refundedAt
+	db.Model(refund).Update("gateway_refunded_at", refundedAt)
+	if err := completeRefund(refund, "", nil); err != nil {
+		log.Printf("Recording refund %d failed, will retry: %v\n", refund.ID, err)
+	}
+}
+
+// Hand a gateway refund to finance
+func makeRefundManual(refund *Refund, reason string) {
+	refund.Method = RefundManual
+	refund.FailureReason = reason
+	db.Model(refund).Updates(map[string]interface{}{"method": RefundManual, "failure_reason": reason})
+}
+
+// Finish gateway refunds interrupted by a crash or a failed write. Refunds the
+// gateway confirmed are recorded; ones never sent are sent now; ones whose
+// gateway call has no recorded result go to finance, who check the gateway
+// before paying out, rather than risk refunding twice.
+func retryGatewayRefunds(now time.Time) {
+	var refunds []Refund
+	db.Where("method = ? AND status = ? AND created_at <= ?", RefundGateway, RefundPending, now.Add(-gatewayRefundStaleAfter)).Find(&refunds)
+
+	for i := range refunds {
+		refund := &refunds[i]
+		switch {
+		case refund.GatewayRefundedAt != nil:
+			if err := completeRefund(refund, "", nil); err != nil {
+				log.Printf("Recording refund %d failed: %v\n", refund.ID, err)
+			}
+		case refund.GatewayAttemptedAt == nil:
+			processGatewayRefund(refund)
+		case refund.GatewayAttemptedAt.Before(now.Add(-gatewayRefundStaleAfter)):
+			log.Printf("Refund %d has no recorded gateway result, left for manual processing\n", refund.ID)
+			makeRefundManual(refund, "The gateway's answer was not recorded; check the gateway before paying out")
+		}
+	}
+}
+
+// Mark a refund paid out and update the payment's ledger entry
+func completeRefund(refund *Refund, reference string, processedBy *uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&Refund{}).Where("id = ? AND status = ?", refund.ID, RefundPending).Updates(map[string]interface{}{
+			"status":           RefundCompleted,
+			"manual_reference": reference,
+			"processed_by_id":  processedBy,
+			"processed_at":     now,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRefundNotPending
+		}
+
+		var txn PaymentTransaction
+		if err := tx.First(&txn, refund.PaymentTransactionID).Error; err != nil {
+			return err
+		}
+		updates := map[string]interface{}{"refunded_amount": txn.RefundedAmount + refund.Amount}
+		fullyRefunded := txn.RefundedAmount+refund.Amount >= txn.Amount-0.005
+		if fullyRefunded {
+			updates["status"] = PaymentRefunded
+		}
+		if err := tx.Model(&txn).Updates(updates).Error; err != nil {
+			return err
+		}
+		// A referral can't be earned with money that was given back
+		if fullyRefunded {
+			if err := revokeReferralReward(tx, txn.ID); err != nil {
+				return err
+			}
+		}
+
+		refund.Status = RefundCompleted
+		refund.ManualReference = reference
+		refund.ProcessedByID = processedBy
+		refund.ProcessedAt = &now
+		return nil
+	})
+}
+
+// Map a cancellation error to a response
+func respondCancellationError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+	case errors.Is(err, errSubscriptionNotCancellable), errors.Is(err, errInvalidSubscriptionTransition):
+		c.JSON(http.StatusConflict, gin.H{"error": errSubscriptionNotCancellable.Error()})
+	case errors.Is(err, errRefundTooLarge):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel subscription"})
+	}
+}
+
+// What cancelling the current subscription now would refund
+func cancellationQuoteHandler(c *gin.Context) {
+	sub, err := getCurrentSubscription(c.GetUint("userID"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No active subscription"})
+		return
+	}
+
+	allocations := policyRefunds(db, sub, time.Now())
+	breakdown := []gin.H{}
+	for _, a := range allocations {
+		breakdown = append(breakdown, gin.H{
+			"payment_reference": a.Payment.Reference,
+			"paid":              a.Payment.Amount,
+			"refund":            a.Amount,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"subscription_id":  sub.ID,
+		"refund":           refundTotal(allocations),
+		"payments":         breakdown,
+		"full_refund_days": int(refundFullWindow().Hours() / 24),
+	})
+}
+
+// Cancel the signed-in user's current subscription
+func cancelSubscriptionHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var input struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	current, err := getCurrentSubscription(userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No active subscription"})
+		return
+	}
+
+	sub, refunds, err := cancelSubscription(current.ID, userID, strings.TrimSpace(input.Reason), nil)
+	if err != nil {
+		respondCancellationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Subscription cancelled",
+		"subscription": sub,
+		"refunds":      refunds,
+	})
+}
+
+// The signed-in user's refunds
+func refundsHandler(c *gin.Context) {
+	var refunds []Refund
+	db.Where("user_id = ?", c.GetUint("userID")).Order("created_at DESC").Find(&refunds)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":   len(refunds),
+		"refunds": refunds,
+	})
+}
+
+// Admin: refunds, optionally filtered by status or method (?status=pending&method=manual is the payout queue)
+func adminRefundsHandler(c *gin.Context) {
+	query := db.Model(&Refund{}).Order("created_at DESC").Limit(500)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if method := c.Query("method"); method != "" {
+		query = query.Where("method = ?", method)
+	}
+
+	var refunds []Refund
+	query.Find(&refunds)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":   len(refunds),
+		"refunds": refunds,
+	})
+}
+
+// Admin: record that a manual refund has been paid out
+func completeRefundHandler(c *gin.Context) {
+	adminID := c.GetUint("userID")
+
+	var input struct {
+		Reference string `json:"reference" binding:"required"` // Bank/wallet transaction number
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reference is required"})
+		return
+	}
+
+	var refund Refund
+	if err := db.First(&refund, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Refund not found"})
+		return
+	}
+	if refund.Method != RefundManual {
+		c.JSON(http.StatusConflict, gin.H{"error": "Gateway refunds complete automatically"})
+		return
+	}
+
+	if err := completeRefund(&refund, strings.TrimSpace(input.Reference), &adminID); errors.Is(err, errRefundNotPending) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete refund"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Refund completed",
+		"refund":  refund,
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryGatewayRefunds(t *testing.T) {
+	setupTestDB(t)
+	gateway := registerStubGateway(t, "stub")
+	plan := getTestPlan(t, "premium")
+
+	// A pending gateway refund of a fresh payment, created stale minutes ago
+	pendingRefund := func(email string, updates map[string]interface{}) *Refund {
+		user := createTestUser(t, email)
+		txn := payForPlan(t, user, plan, nil)
+		db.Model(txn).Update("gateway", "stub")
+
+		refund := Refund{PaymentTransactionID: txn.ID, UserID: user.ID, Amount: txn.Amount, Method: RefundGateway, Status: RefundPending}
+		if err := db.Create(&refund).Error; err != nil {
+			t.Fatalf("creating refund: %v", err)
+		}
+		updates["created_at"] = time.Now().Add(-2 * gatewayRefundStaleAfter)
+		db.Model(&refund).Updates(updates)
+		return &refund
+	}
+	stale := time.Now().Add(-2 * gatewayRefundStaleAfter)
+
+	neverSent := pendingRefund("never-sent@example.com", map[string]interface{}{})
+	confirmed := pendingRefund("confirmed@example.com", map[string]interface{}{"gateway_attempted_at": stale, "gateway_refunded_at": stale})
+	unknown := pendingRefund("unknown@example.com", map[string]interface{}{"gateway_attempted_at": stale})
+
+	retryGatewayRefunds(time.Now())
+
+	if gateway.refunded != 1 {
+		t.Fatalf("gateway asked %d times, want once for the refund never sent", gateway.refunded)
+	}
+	for _, refund := range []*Refund{neverSent, confirmed} {
+		db.First(refund, refund.ID)
+		if refund.Status != RefundCompleted {
+			t.Fatalf("refund %d is %s, want completed", refund.ID, refund.Status)
+		}
+	}
+	db.First(unknown, unknown.ID)
+	if unknown.Status != RefundPending || unknown.Method != RefundManual || unknown.FailureReason == "" {
+		t.Fatalf("refund with no gateway result = %s/%s, want pending manual", unknown.Status, unknown.Method)
+	}
+
+	// Nothing is sent twice on the next run
+	retryGatewayRefunds(time.Now())
+	if gateway.refunded != 1 {
+		t.Fatalf("gateway asked %d times after a second run, want 1", gateway.refunded)
+	}
+}
+
+func TestFailedGatewayRefundBecomesManual(t *testing.T) {
+	setupTestDB(t)
+	gateway := registerStubGateway(t, "stub")
+	gateway.refundErr = errors.New("gateway down")
+	user := createTestUser(t, "refund@example.com")
+	txn := payForPlan(t, user, getTestPlan(t, "premium"), nil)
+	db.Model(txn).Update("gateway", "stub")
+
+	refund := Refund{PaymentTransactionID: txn.ID, UserID: user.ID, Amount: txn.Amount, Method: RefundGateway, Status: RefundPending}
+	db.Create(&refund)
+	processGatewayRefund(&refund)
+
+	db.First(&refund, refund.ID)
+	if refund.Method != RefundManual || refund.Status != RefundPending {
+		t.Fatalf("refund after a gateway error = %s/%s, want pending manual", refund.Status, refund.Method)
+	}
+}
+
+func TestCancellationNotifiesThroughOutbox(t *testing.T) {
+	setupTestDB(t)
+	registerStubGateway(t, "stub")
+	user := createTestUser(t, "cancel@example.com")
+	db.Model(user).Update("language", "nepali")
+	txn := payForPlan(t, user, getTestPlan(t, "premium"), nil)
+	db.Model(txn).Update("gateway", "stub")
+
+	hooks := subscriptionHooks
+	t.Cleanup(func() { subscriptionHooks = hooks })
+	onSubscriptionEvent(notifySubscriptionChange)
+
+	if _, _, err := cancelSubscription(*txn.SubscriptionID, user.ID, "test", nil); err != nil {
+		t.Fatalf("cancelling: %v", err)
+	}
+
+	var email EmailOutbox
+	if err := db.Where("user_id = ? AND type = ?", user.ID, NotifySubscriptionChanged).First(&email).Error; err != nil {
+		t.Fatalf("no cancellation email queued: %v", err)
+	}
+	if email.UnsubscribeURL == "" || !strings.Contains(email.Subject, "रद्द") {
+		t.Fatalf("cancellation email = %q (unsubscribe %q), want Nepali with an unsubscribe link", email.Subject, email.UnsubscribeURL)
+	}
+	// The gateway refund ran before the hooks, so the email reports it done
+	if !strings.Contains(email.TextBody, "फिर्ता गरियो") {
+		t.Fatalf("cancellation email doesn't report the completed refund:\n%s", email.TextBody)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Outgoing SMS. Sparrow SMS or Aakash SMS in production, files on disk for
+// development. SMS_API_URL overrides a provider's endpoint, e.g. to point it at
+// a local fake.
+
+// SMSMessage is a single outgoing text message
+type SMSMessage struct {
+	To   string // 10-digit Nepali mobile number, see normalizeNepaliMobile
+	Text string
+}
+
+// SMSSender sends text messages
+type SMSSender interface {
+	Send(msg SMSMessage) error
+	Name() string
+}
+
+var smsSender SMSSender
+
+// Client for SMS provider calls
+var smsHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+var errInvalidMobile = errors.New("Enter a 10-digit Nepali mobile number, e.g. 98XXXXXXXX")
+
+// SparrowSMS sends through Sparrow SMS (api.sparrowsms.com)
+type SparrowSMS struct {
+	APIURL string
+	Token  string
+	From   string // Sender identity assigned by Sparrow
+}
+
+// AakashSMS sends through Aakash SMS (sms.aakashsms.com)
+type AakashSMS struct {
+	APIURL string
+	Token  string
+}
+
+// FileSMS writes each message to a directory and logs it - for local development
+type FileSMS struct {
+	Dir string
+}
+
+// Pick an SMS sender from environment: SMS_DRIVER=sparrow or aakash, anything else writes to SMS_DIR
+func newSMSSenderFromEnv() SMSSender {
+	switch os.Getenv("SMS_DRIVER") {
+	case "sparrow":
+		return &SparrowSMS{
+			APIURL: getEnvDefault("SMS_API_URL", "https://api.sparrowsms.com/v2/sms/"),
+			Token:  os.Getenv("SPARROW_SMS_TOKEN"),
+			From:   getEnvDefault("SPARROW_SMS_FROM", "InfoSMS"),
+		}
+	case "aakash":
+		return &AakashSMS{
+			APIURL: getEnvDefault("SMS_API_URL", "https://sms.aakashsms.com/sms/v3/send"),
+			Token:  os.Getenv("AAKASH_SMS_TOKEN"),
+		}
+	}
+	return &FileSMS{Dir: getEnvDefault("SMS_DIR", "tmp/sms")}
+}
+
+// Normalize a Nepali mobile number to its 10 digits (98XXXXXXXX), dropping
+// spaces, dashes and the +977 prefix
+func normalizeNepaliMobile(phone string) (string, error) {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		if r == ' ' || r == '-' || r == '+' || r == '(' || r == ')' {
+			return -1
+		}
+		return 'x'
+	}, phone)
+	if strings.Contains(digits, "x") {
+		return "", errInvalidMobile
+	}
+	if len(digits) == 13 && strings.HasPrefix(digits, "977") {
+		digits = digits[3:]
+	}
+	if len(digits) != 10 || digits[0] != '9' || !strings.ContainsRune("678", rune(digits[1])) {
+		return "", errInvalidMobile
+	}
+	return digits, nil
+}
+
+// POST a form to an SMS provider and return the body of a 2xx response
+func postSMSForm(endpoint string, form url.Values) ([]byte, error) {
+	resp, err := smsHTTPClient.PostForm(endpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("SMS provider returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// Send an SMS through Sparrow SMS
+func (s *SparrowSMS) Send(msg SMSMessage) error {
+	if s.Token == "" {
+		return fmt.Errorf("SPARROW_SMS_TOKEN is not configured")
+	}
+	body, err := postSMSForm(s.APIURL, url.Values{
+		"token": {s.Token},
+		"from":  {s.From},
+		"to":    {msg.To},
+		"text":  {msg.Text},
+	})
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		ResponseCode int    `json:"response_code"`
+		Response     string `json:"response"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("unexpected Sparrow SMS response: %s", body)
+	}
+	if result.ResponseCode != 200 {
+		return fmt.Errorf("Sparrow SMS error %d: %s", result.ResponseCode, result.Response)
+	}
+	return nil
+}
+
+func (s *SparrowSMS) Name() string { return "sparrow" }
+
+// Send an SMS through Aakash SMS
+func (s *AakashSMS) Send(msg SMSMessage) error {
+	if s.Token == "" {
+		return fmt.Errorf("AAKASH_SMS_TOKEN is not configured")
+	}
+	body, err := postSMSForm(s.APIURL, url.Values{
+		"auth_token": {s.Token},
+		"to":         {msg.To},
+		"text":       {msg.Text},
+	})
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("unexpected Aakash SMS response: %s", body)
+	}
+	if result.Error {
+		return fmt.Errorf("Aakash SMS error: %s", result.Message)
+	}
+	return nil
+}
+
+func (s *AakashSMS) Name() string { return "aakash" }
+
+// Write the message to a file instead of sending it
+func (s *FileSMS) Send(msg SMSMessage) error {
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.txt", time.Now().Format("20060102-150405.000"), msg.To)
+	path := filepath.Join(s.Dir, name)
+	if err := os.WriteFile(path, []byte("To: "+msg.To+"\n\n"+msg.Text+"\n"), 0o600); err != nil {
+		return err
+	}
+
+	log.Printf("📱 SMS to %s written to %s\n", msg.To, path)
+	return nil
+}
+
+func (s *FileSMS) Name() string { return "file" }
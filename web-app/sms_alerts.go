@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SMS alerts. New IPOs and allotment results also go out by SMS to users with
+// a verified phone number (see phone.go) and a subscription that grants access,
+// up to SMS_DAILY_LIMIT alerts per user per Nepal day. Messages are sent in
+// the background and every one is recorded in SMSLog.
+
+// SMS statuses
+const (
+	SMSPending = "pending"
+	SMSSent    = "sent"
+	SMSFailed  = "failed"
+)
+
+const smsTypeOTP = "otp" // SMSLog.Type of verification codes; they don't count against the quota
+
+// Alerts per user per day, from the environment
+func smsDailyLimit() int { return getEnvInt("SMS_DAILY_LIMIT", 5) }
+
+// SMS text per notification type and language; types without one get no SMS.
+// Kept short: Nepali text is sent as Unicode, 70 characters per part.
+var smsTemplates = map[string]map[string]string{
+	NotifyNewIPO: {
+		"english": "IPO Pilot: {{.Company}} IPO is open{{if .CloseDate}} until {{.CloseDate}}{{end}}. {{.BaseURL}}/dashboard/ipos",
+		"nepali":  "IPO Pilot: {{.Company}} को IPO खुला छ{{if .CloseDate}}, {{.CloseDate}} सम्म{{end}}। {{.BaseURL}}/dashboard/ipos",
+	},
+	NotifyAllotmentResult: {
+		"english": "IPO Pilot: {{if .Allotted}}{{.Profile}} was allotted {{.Kittas}} kitta of {{.Company}}.{{else}}{{.Profile}} was not allotted {{.Company}}.{{end}}",
+		"nepali":  "IPO Pilot: {{if .Allotted}}{{.Profile}} लाई {{.Company}} को {{.Kittas}} कित्ता बाँडफाँड भयो।{{else}}{{.Profile}} लाई {{.Company}} बाँडफाँड भएन।{{end}}",
+	},
+}
+
+// Midnight at the start of now's day in Nepal
+func startOfNepalDay(now time.Time) time.Time {
+	y, m, d := now.In(nepalTime).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, nepalTime)
+}
+
+// Alerts sent (or being sent) to the user since midnight Nepal time
+func smsAlertsToday(userID uint, now time.Time) int64 {
+	var count int64
+	db.Model(&SMSLog{}).
+		Where("user_id = ? AND type <> ? AND status <> ? AND created_at >= ?", userID, smsTypeOTP, SMSFailed, startOfNepalDay(now)).
+		Count(&count)
+	return count
+}
+
+// Send the SMS for a notification, if the type has one and the user qualifies
+func smsNotification(user *User, kind, dedupeKey string, data gin.H) {
+	templates, ok := smsTemplates[kind]
+	if !ok || user.Phone == "" || user.PhoneVerifiedAt == nil {
+		return
+	}
+	if _, err := getCurrentSubscription(user.ID); err != nil {
+		return
+	}
+	if dedupeKey != "" {
+		var count int64
+		db.Model(&SMSLog{}).Where("user_id = ? AND dedupe_key = ?", user.ID, dedupeKey).Count(&count)
+		if count > 0 {
+			return
+		}
+	}
+	if smsAlertsToday(user.ID, time.Now()) >= int64(smsDailyLimit()) {
+		log.Printf("SMS %s for user %d skipped: daily limit reached\n", kind, user.ID)
+		return
+	}
+
+	text, err := renderMessage(kind, templates[userLanguage(user)], notificationValues(user, data))
+	if err != nil {
+		log.Printf("Rendering %s SMS for user %d failed: %v\n", kind, user.ID, err)
+		return
+	}
+
+	entry := SMSLog{
+		UserID:    user.ID,
+		Type:      kind,
+		DedupeKey: dedupeKey,
+		To:        user.Phone,
+		Text:      text,
+		Provider:  smsSender.Name(),
+		Status:    SMSPending,
+	}
+	if err := db.Create(&entry).Error; err != nil {
+		log.Printf("Recording %s SMS for user %d failed: %v\n", kind, user.ID, err)
+		return
+	}
+	go deliverSMS(&entry)
+}
+
+// Send a recorded SMS and store the outcome
+func deliverSMS(entry *SMSLog) error {
+	err := smsSender.Send(SMSMessage{To: entry.To, Text: entry.Text})
+	updates := map[string]interface{}{"status": SMSSent}
+	if err != nil {
+		updates["status"] = SMSFailed
+		updates["error"] = err.Error()
+		log.Printf("SMS %d to user %d failed: %v\n", entry.ID, entry.UserID, err)
+	}
+	db.Model(&SMSLog{}).Where("id = ?", entry.ID).Updates(updates)
+	return err
+}
+
+// Admin: SMS log, optionally filtered by status, type or user_id
+func adminSMSLogHandler(c *gin.Context) {
+	query := db.Model(&SMSLog{}).Order("created_at DESC").Limit(500)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if kind := c.Query("type"); kind != "" {
+		query = query.Where("type = ?", kind)
+	}
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	var messages []SMSLog
+	query.Find(&messages)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":    len(messages),
+		"messages": messages,
+	})
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Renewals, upgrades and the one-subscription rule. A user has at most one
+// effective subscription (trial, active or grace). Paying for the current plan
+// extends it from its end date; paying for a pricier plan starts the new plan
+// now, with the unused part of the current one credited against the price, and
+// marks the old subscription superseded. Old rows are kept as history.
+
+// Payment kinds
+const (
+	PaymentKindNew     = "new"
+	PaymentKindRenewal = "renewal"
+	PaymentKindUpgrade = "upgrade"
+)
+
+var (
+	errSubscriptionNotCurrent = errors.New("Only your current subscription can be renewed")
+	errDowngradeMidTerm       = errors.New("You can switch to this plan once your current plan ends")
+)
+
+// PaymentQuote is the server-side price of a purchase
+type PaymentQuote struct {
+	Kind           string  `json:"kind"`
+	ListPrice      float64 `json:"list_price"`
+	Discount       float64 `json:"discount"`                  // Coupon
+	Credit         float64 `json:"proration_credit"`          // Unused value of the plan upgraded from
+	Amount         float64 `json:"amount"`                    // To pay
+	SubscriptionID *uint   `json:"subscription_id,omitempty"` // Renewed
+	ReplacesID     *uint   `json:"replaces_subscription_id,omitempty"`
+	Coupon         *Coupon `json:"-"`
+}
+
+// Value of the time left on a subscription: each payment's period is worth
+// what was paid for it, pro rata. Older rows without recorded periods fall
+// back to the subscription's own price and dates.
+func unusedSubscriptionValue(sub *Subscription, now time.Time) float64 {
+	var payments []PaymentTransaction
+	db.Where("subscription_id = ? AND status = ? AND period_start IS NOT NULL AND period_end IS NOT NULL",
+		sub.ID, PaymentCompleted).Find(&payments)
+
+	value := 0.0
+	for _, p := range payments {
+		value += proRataRemaining(p.Amount, *p.PeriodStart, *p.PeriodEnd, now)
+	}
+	if len(payments) == 0 {
+		value = proRataRemaining(sub.Price, sub.StartDate, sub.EndDate, now)
+	}
+	return math.Floor(value)
+}
+
+// Share of amount, paid for start..end, that covers the time after now
+func proRataRemaining(amount float64, start, end, now time.Time) float64 {
+	total := end.Sub(start)
+	if total <= 0 || !end.After(now) {
+		return 0
+	}
+	if start.Before(now) {
+		start = now
+	}
+	return amount * float64(end.Sub(start)) / float64(total)
+}
+
+// Work out what buying plan costs the user right now. renew, if set, is the
+// subscription the user asked to renew.
+func quotePayment(userID uint, plan *Plan, renew *Subscription, couponCode string) (*PaymentQuote, error) {
+	quote := &PaymentQuote{Kind: PaymentKindNew, ListPrice: plan.Price}
+	current, _ := getCurrentSubscription(userID)
+
+	switch {
+	case renew != nil:
+		if current != nil && current.ID != renew.ID {
+			return nil, errSubscriptionNotCurrent
+		}
+		quote.Kind = PaymentKindRenewal
+		quote.SubscriptionID = &renew.ID
+	case current == nil:
+	case current.IsTrial || current.Status == SubscriptionGrace:
+		// Nothing left to credit; the new plan replaces it
+		quote.ReplacesID = &current.ID
+	case current.PlanID != nil && *current.PlanID == plan.ID:
+		quote.Kind = PaymentKindRenewal
+		quote.SubscriptionID = &current.ID
+	default:
+		currentPrice := current.Price
+		if currentPlan, err := getSubscriptionPlan(current); err == nil {
+			currentPrice = currentPlan.Price
+		}
+		if plan.Price <= currentPrice {
+			return nil, errDowngradeMidTerm
+		}
+		quote.Kind = PaymentKindUpgrade
+		quote.ReplacesID = &current.ID
+		quote.Credit = unusedSubscriptionValue(current, time.Now())
+	}
+
+	if couponCode != "" {
+		coupon, discount, err := validateCoupon(couponCode, plan, userID)
+		if err != nil {
+			return nil, err
+		}
+		quote.Coupon = coupon
+		quote.Discount = discount
+	}
+
+	// Never below what the gateways accept; the credit gives way first
+	quote.Amount = quote.ListPrice - quote.Discount - quote.Credit
+	if quote.Amount < minPayableAmount {
+		quote.Credit = math.Max(quote.Credit-(minPayableAmount-quote.Amount), 0)
+		quote.Amount = quote.ListPrice - quote.Discount - quote.Credit
+	}
+	return quote, nil
+}
+
+// User-facing message for a payment that can't be started as requested
+func paymentInputError(err error) (string, bool) {
+	var couponErr couponError
+	switch {
+	case errors.As(err, &couponErr):
+		return couponErr.Error(), true
+	case errors.Is(err, errSubscriptionNotCurrent), errors.Is(err, errDowngradeMidTerm):
+		return err.Error(), true
+	}
+	return "", false
+}
+
+// Supersede the user's other effective subscriptions once replacement is in
+// place (inside the payment transaction)
+func supersedeOtherSubscriptions(tx *gorm.DB, replacement *Subscription) ([]*SubscriptionEvent, error) {
+	var others []Subscription
+	tx.Where("user_id = ? AND id <> ? AND status IN ?", replacement.UserID, replacement.ID,
+		[]string{SubscriptionTrial, SubscriptionActive, SubscriptionGrace}).Find(&others)
+
+	events := []*SubscriptionEvent{}
+	for i := range others {
+		others[i].SupersededByID = &replacement.ID
+		event, err := transitionSubscription(tx, &others[i], SubscriptionSuperseded)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// Restore the one-subscription rule for users who ended up with several
+// effective rows before it existed: the one running longest wins
+func consolidateSubscriptions() {
+	var userIDs []uint
+	db.Model(&Subscription{}).
+		Where("status IN ?", []string{SubscriptionTrial, SubscriptionActive, SubscriptionGrace}).
+		Group("user_id").Having("COUNT(*) > 1").
+		Pluck("user_id", &userIDs)
+
+	for _, userID := range userIDs {
+		var keep Subscription
+		if err := db.Where("user_id = ? AND status IN ?", userID, []string{SubscriptionTrial, SubscriptionActive, SubscriptionGrace}).
+			Order("is_trial, end_date DESC").First(&keep).Error; err != nil {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			_, err := supersedeOtherSubscriptions(tx, &keep)
+			return err
+		})
+		if err != nil {
+			log.Printf("Consolidating subscriptions of user %d failed: %v\n", userID, err)
+		}
+	}
+}
+
+// Price of a plan for the signed-in user: renewal, upgrade credit and coupon
+func paymentQuoteHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var input struct {
+		PlanID         uint   `json:"plan_id" binding:"required"`
+		SubscriptionID uint   `json:"subscription_id"`
+		CouponCode     string `json:"coupon_code"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "plan_id is required"})
+		return
+	}
+
+	plan, err := getPurchasablePlan(input.PlanID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Plan is not available"})
+		return
+	}
+
+	var renew *Subscription
+	if input.SubscriptionID != 0 {
+		var sub Subscription
+		if err := db.Where("id = ? AND user_id = ?", input.SubscriptionID, userID).First(&sub).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+			return
+		}
+		renew = &sub
+	}
+
+	quote, err := quotePayment(userID, plan, renew, input.CouponCode)
+	if msg, ok := paymentInputError(err); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to price plan"})
+		return
+	}
+
+	c.JSON(http.StatusOK, quote)
+}
+
+// The signed-in user's subscriptions, newest first, with the payments behind them
+func subscriptionHistoryHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var subscriptions []Subscription
+	db.Where("user_id = ?", userID).Order("created_at DESC").Find(&subscriptions)
+
+	var payments []PaymentTransaction
+	db.Where("user_id = ? AND status = ?", userID, PaymentCompleted).Order("completed_at").Find(&payments)
+	bySubscription := map[uint][]PaymentTransaction{}
+	for _, p := range payments {
+		if p.SubscriptionID != nil {
+			bySubscription[*p.SubscriptionID] = append(bySubscription[*p.SubscriptionID], p)
+		}
+	}
+
+	current, _ := getCurrentSubscription(userID)
+	history := []gin.H{}
+	for _, sub := range subscriptions {
+		subPayments := bySubscription[sub.ID]
+		if subPayments == nil {
+			subPayments = []PaymentTransaction{}
+		}
+		history = append(history, gin.H{
+			"id":            sub.ID,
+			"plan":          sub.PlanType,
+			"status":        sub.Status,
+			"current":       current != nil && current.ID == sub.ID,
+			"start_date":    sub.StartDate,
+			"end_date":      sub.EndDate,
+			"superseded_by": sub.SupersededByID,
+			"cancelled_at":  sub.CancelledAt,
+			"payments":      subPayments,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":         len(history),
+		"subscriptions": history,
+	})
+}
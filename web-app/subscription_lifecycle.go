@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Subscription lifecycle: trial/active -> grace -> expired, plus cancellation
+// and replacement by a new plan (superseded, see subscription_changes.go).
+// A periodic job moves subscriptions between states, sends expiry reminders
+// and pauses monitoring when a user loses access.
+
+// Subscription states
+const (
+	SubscriptionTrial      = "trial"
+	SubscriptionActive     = "active"
+	SubscriptionGrace      = "grace"
+	SubscriptionExpired    = "expired"
+	SubscriptionCancelled  = "cancelled"
+	SubscriptionSuperseded = "superseded" // Replaced by an upgrade or a paid plan; final
+)
+
+const (
+	subscriptionGracePeriod  = 3 * 24 * time.Hour // Paid plans only; trials expire immediately
+	lifecycleJobInterval     = time.Hour
+	monitoringPausedByExpiry = "subscription_ended"
+)
+
+var errInvalidSubscriptionTransition = errors.New("invalid subscription transition")
+
+// Days-before-expiry reminder thresholds, largest first
+var subscriptionReminderDays = []int{7, 3, 1}
+
+// Allowed state transitions
+var subscriptionTransitions = map[string][]string{
+	SubscriptionTrial:     {SubscriptionActive, SubscriptionExpired, SubscriptionCancelled, SubscriptionSuperseded},
+	SubscriptionActive:    {SubscriptionGrace, SubscriptionExpired, SubscriptionCancelled, SubscriptionSuperseded},
+	SubscriptionGrace:     {SubscriptionActive, SubscriptionExpired, SubscriptionCancelled, SubscriptionSuperseded},
+	SubscriptionExpired:   {SubscriptionActive},
+	SubscriptionCancelled: {SubscriptionActive},
+}
+
+// SubscriptionEvent is passed to lifecycle hooks
+type SubscriptionEvent struct {
+	Type         string // "transition" or "reminder"
+	Subscription Subscription
+	From         string // transition only
+	To           string // transition only
+	DaysLeft     int    // reminder only
+}
+
+// SubscriptionHook reacts to lifecycle events (emails, notifications, ...)
+type SubscriptionHook func(event SubscriptionEvent)
+
+var (
+	subscriptionHooksMu sync.RWMutex
+	subscriptionHooks   []SubscriptionHook
+)
+
+// Register a lifecycle hook
+func onSubscriptionEvent(hook SubscriptionHook) {
+	subscriptionHooksMu.Lock()
+	defer subscriptionHooksMu.Unlock()
+	subscriptionHooks = append(subscriptionHooks, hook)
+}
+
+func fireSubscriptionEvent(event SubscriptionEvent) {
+	subscriptionHooksMu.RLock()
+	hooks := append([]SubscriptionHook(nil), subscriptionHooks...)
+	subscriptionHooksMu.RUnlock()
+
+	for _, hook := range hooks {
+		hook(event)
+	}
+}
+
+// Does this status give the user access to paid features?
+func subscriptionGrantsAccess(status string) bool {
+	return status == SubscriptionTrial || status == SubscriptionActive || status == SubscriptionGrace
+}
+
+// The subscription currently giving the user access. Dates are checked as well
+// as status, so access ends on time even between lifecycle job runs.
+func getCurrentSubscription(userID uint) (*Subscription, error) {
+	var subscription Subscription
+	now := time.Now()
+	err := db.Where("user_id = ? AND ((status IN ? AND end_date > ?) OR (status = ? AND grace_end_date > ?))",
+		userID, []string{SubscriptionTrial, SubscriptionActive}, now, SubscriptionGrace, now).
+		Order("end_date DESC").
+		First(&subscription).Error
+	if err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+func canTransition(from, to string) bool {
+	for _, allowed := range subscriptionTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Move a subscription to a new state and persist it with tx. Callers set any
+// date fields on sub first. The returned event must be handed to
+// publishSubscriptionEvent once tx has committed (nil when nothing changed).
+func transitionSubscription(tx *gorm.DB, sub *Subscription, to string) (*SubscriptionEvent, error) {
+	from := sub.Status
+	if from == to {
+		return nil, tx.Save(sub).Error
+	}
+	if !canTransition(from, to) {
+		return nil, fmt.Errorf("%w %s -> %s", errInvalidSubscriptionTransition, from, to)
+	}
+
+	sub.Status = to
+	switch to {
+	case SubscriptionActive:
+		sub.LastReminderDays = 0
+		sub.GraceEndDate = nil
+		sub.CancelledAt = nil
+	case SubscriptionGrace:
+		graceEnd := sub.EndDate.Add(subscriptionGracePeriod)
+		sub.GraceEndDate = &graceEnd
+	case SubscriptionCancelled:
+		now := time.Now()
+		sub.CancelledAt = &now
+	}
+
+	if err := tx.Save(sub).Error; err != nil {
+		return nil, err
+	}
+
+	if subscriptionGrantsAccess(from) && !subscriptionGrantsAccess(to) {
+		pauseMonitoringForUser(tx, sub.UserID)
+	}
+
+	return &SubscriptionEvent{Type: "transition", Subscription: *sub, From: from, To: to}, nil
+}
+
+// Run post-commit side effects of a transition: resume monitoring, fire hooks
+func publishSubscriptionEvent(event *SubscriptionEvent) {
+	if event == nil {
+		return
+	}
+	if event.Type == "transition" && !subscriptionGrantsAccess(event.From) && subscriptionGrantsAccess(event.To) {
+		resumeMonitoringForUser(event.Subscription.UserID)
+	}
+	fireSubscriptionEvent(*event)
+}
+
+// Transition outside a transaction and publish immediately
+func applySubscriptionTransition(sub *Subscription, to string) error {
+	event, err := transitionSubscription(db, sub, to)
+	if err != nil {
+		return err
+	}
+	publishSubscriptionEvent(event)
+	return nil
+}
+
+// Stop a user's monitoring sessions when access ends, marking them for resumption
+func pauseMonitoringForUser(tx *gorm.DB, userID uint) {
+	// Another subscription may still grant access
+	var others int64
+	now := time.Now()
+	tx.Model(&Subscription{}).
+		Where("user_id = ? AND ((status IN ? AND end_date > ?) OR (status = ? AND grace_end_date > ?))",
+			userID, []string{SubscriptionTrial, SubscriptionActive}, now, SubscriptionGrace, now).
+		Count(&others)
+	if others > 0 {
+		return
+	}
+
+	tx.Model(&MonitoringSession{}).
+		Where("user_id = ? AND is_active = ?", userID, true).
+		Updates(map[string]interface{}{
+			"is_active":     false,
+			"stopped_at":    now,
+			"paused_reason": monitoringPausedByExpiry,
+		})
+}
+
+// Restart sessions that were paused because access ended
+func resumeMonitoringForUser(userID uint) {
+	var sessions []MonitoringSession
+	db.Where("user_id = ? AND paused_reason = ?", userID, monitoringPausedByExpiry).Find(&sessions)
+
+	for i := range sessions {
+		session := sessions[i]
+		db.Model(&session).Updates(map[string]interface{}{
+			"is_active":     true,
+			"stopped_at":    nil,
+			"paused_reason": "",
+		})
+		session.IsActive = true
+		go monitorIPOsForSession(&session)
+	}
+}
+
+// Smallest reminder threshold that daysLeft has reached and that hasn't been sent yet (0 = none due)
+func dueReminder(daysLeft, lastSent int) int {
+	due := 0
+	for _, threshold := range subscriptionReminderDays {
+		if daysLeft <= threshold && (lastSent == 0 || threshold < lastSent) {
+			due = threshold
+		}
+	}
+	return due
+}
+
+// One pass of the lifecycle job
+func runSubscriptionLifecycle(now time.Time) {
+	// trial/active past their end date
+	var ended []Subscription
+	db.Where("status IN ? AND end_date <= ?", []string{SubscriptionTrial, SubscriptionActive}, now).Find(&ended)
+	for i := range ended {
+		sub := &ended[i]
+		to := SubscriptionGrace
+		if sub.Status == SubscriptionTrial {
+			to = SubscriptionExpired
+		}
+		if err := applySubscriptionTransition(sub, to); err != nil {
+			log.Printf("Subscription %d: %v\n", sub.ID, err)
+		}
+	}
+
+	// grace period over
+	var graceOver []Subscription
+	db.Where("status = ? AND grace_end_date <= ?", SubscriptionGrace, now).Find(&graceOver)
+	for i := range graceOver {
+		if err := applySubscriptionTransition(&graceOver[i], SubscriptionExpired); err != nil {
+			log.Printf("Subscription %d: %v\n", graceOver[i].ID, err)
+		}
+	}
+
+	// expiry reminders
+	horizon := now.AddDate(0, 0, subscriptionReminderDays[0])
+	var expiring []Subscription
+	db.Where("status IN ? AND end_date > ? AND end_date <= ?",
+		[]string{SubscriptionTrial, SubscriptionActive}, now, horizon).Find(&expiring)
+	for i := range expiring {
+		sub := &expiring[i]
+		daysLeft := int(sub.EndDate.Sub(now).Hours()/24) + 1
+		threshold := dueReminder(daysLeft, sub.LastReminderDays)
+		if threshold == 0 {
+			continue
+		}
+
+		// Conditional update so two instances never send the same reminder
+		result := db.Model(&Subscription{}).
+			Where("id = ? AND last_reminder_days = ?", sub.ID, sub.LastReminderDays).
+			Update("last_reminder_days", threshold)
+		if result.Error != nil || result.RowsAffected == 0 {
+			continue
+		}
+		sub.LastReminderDays = threshold
+		fireSubscriptionEvent(SubscriptionEvent{Type: "reminder", Subscription: *sub, DaysLeft: daysLeft})
+	}
+}
+
+// Start the periodic lifecycle job
+func startSubscriptionLifecycleJob() {
+	go func() {
+		runSubscriptionLifecycle(time.Now())
+
+		ticker := time.NewTicker(lifecycleJobInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			runSubscriptionLifecycle(time.Now())
+			// Invoices that failed to issue when their payment completed
+			backfillInvoices()
+			retryGatewayRefunds(time.Now())
+		}
+	}()
+}
+
+// Older rows used status "active" for trials too
+func migrateSubscriptionStatuses() {
+	db.Model(&Subscription{}).
+		Where("status = ? AND is_trial = ?", SubscriptionActive, true).
+		Update("status", SubscriptionTrial)
+}
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Telegram bot. Users link their account by sending the bot a one-time code
+// from Settings; the linked chat then gets IPO alerts (new IPOs with Apply/Skip
+// buttons, application and allotment results) and answers /ipos, /status and
+// /results. Updates arrive by webhook when TELEGRAM_WEBHOOK_SECRET is set,
+// otherwise by long polling. TELEGRAM_API_URL points the client at another Bot
+// API server; TELEGRAM_ENV=fake uses the local fake in telegram_fake.go.
+
+const (
+	telegramDefaultAPIURL = "https://api.telegram.org"
+	telegramFakePath      = "/_fake/telegram" // Local fake, see telegram_fake.go
+	telegramLinkCodeTTL   = 15 * time.Minute
+	telegramPollTimeout   = 30 // Seconds per getUpdates long poll
+	telegramMaxIPOs       = 10 // Listed by /ipos
+)
+
+// Telegram alert statuses
+const (
+	TelegramPending = "pending"
+	TelegramSent    = "sent"
+	TelegramFailed  = "failed"
+)
+
+const telegramHelpText = "IPO Pilot bot commands:\n" +
+	"/ipos - open IPOs, with apply buttons\n" +
+	"/status - your plan and usage\n" +
+	"/results - your recent applications and allotment results\n" +
+	"/unlink - stop alerts in this chat"
+
+const telegramNotLinkedText = "Link your IPO Pilot account first: open Settings on the website, " +
+	"get a code and send it here, e.g. /link K7MZQ4TX"
+
+var telegramBot *TelegramBot // nil when TELEGRAM_BOT_TOKEN is unset
+
+// TelegramBot is a Bot API client
+type TelegramBot struct {
+	APIURL        string
+	Token         string
+	WebhookSecret string // Webhook mode when set
+
+	mu       sync.RWMutex
+	username string // From TELEGRAM_BOT_USERNAME or getMe
+	client   *http.Client
+}
+
+// Bot API types, only the fields we use
+
+// TelegramUser is a Telegram account
+type TelegramUser struct {
+	ID        int64  `json:"id"`
+	Username  string `json:"username,omitempty"`
+	FirstName string `json:"first_name,omitempty"`
+}
+
+// TelegramChat is a conversation with the bot
+type TelegramChat struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"` // "private", "group", "supergroup" or "channel"
+}
+
+// TelegramMessage is a chat message
+type TelegramMessage struct {
+	MessageID   int64             `json:"message_id"`
+	Chat        TelegramChat      `json:"chat"`
+	From        *TelegramUser     `json:"from,omitempty"`
+	Text        string            `json:"text"`
+	ReplyMarkup *TelegramKeyboard `json:"reply_markup,omitempty"`
+}
+
+// TelegramCallbackQuery is a tap on an inline button
+type TelegramCallbackQuery struct {
+	ID      string           `json:"id"`
+	From    TelegramUser     `json:"from"`
+	Message *TelegramMessage `json:"message,omitempty"`
+	Data    string           `json:"data"`
+}
+
+// TelegramUpdate is one incoming event
+type TelegramUpdate struct {
+	UpdateID      int64                  `json:"update_id"`
+	Message       *TelegramMessage       `json:"message,omitempty"`
+	CallbackQuery *TelegramCallbackQuery `json:"callback_query,omitempty"`
+}
+
+// TelegramButton is an inline keyboard button
+type TelegramButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
+}
+
+// TelegramKeyboard is an inline keyboard, rows of buttons
+type TelegramKeyboard struct {
+	InlineKeyboard [][]TelegramButton `json:"inline_keyboard"`
+}
+
+// Configure the bot from environment; nil without TELEGRAM_BOT_TOKEN
+func newTelegramBotFromEnv() *TelegramBot {
+	token := os.Getenv("TELEGRAM_BOT_TOKEN")
+	if token == "" {
+		return nil
+	}
+
+	apiURL := getEnvDefault("TELEGRAM_API_URL", telegramDefaultAPIURL)
+	if os.Getenv("TELEGRAM_ENV") == "fake" {
+		apiURL = getBaseURL() + telegramFakePath
+	}
+	return &TelegramBot{
+		APIURL:        strings.TrimRight(apiURL, "/"),
+		Token:         token,
+		WebhookSecret: os.Getenv("TELEGRAM_WEBHOOK_SECRET"),
+		username:      os.Getenv("TELEGRAM_BOT_USERNAME"),
+		client:        &http.Client{Timeout: (telegramPollTimeout + 15) * time.Second},
+	}
+}
+
+// Call a Bot API method and decode its result into result (may be nil)
+func (b *TelegramBot) call(method string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	resp, err := b.client.Post(b.APIURL+"/bot"+b.Token+"/"+method, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The URL holds the bot token; keep it out of logs
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("telegram %s: %v", method, err)
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		OK          bool            `json:"ok"`
+		Result      json.RawMessage `json:"result"`
+		Description string          `json:"description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("telegram %s: unexpected response (HTTP %d)", method, resp.StatusCode)
+	}
+	if !envelope.OK {
+		return fmt.Errorf("telegram %s: %s", method, envelope.Description)
+	}
+	if result != nil {
+		return json.Unmarshal(envelope.Result, result)
+	}
+	return nil
+}
+
+// The bot's own account
+func (b *TelegramBot) GetMe() (*TelegramUser, error) {
+	var me TelegramUser
+	return &me, b.call("getMe", struct{}{}, &me)
+}
+
+// Long poll for updates from offset on
+func (b *TelegramBot) GetUpdates(offset int64) ([]TelegramUpdate, error) {
+	var updates []TelegramUpdate
+	err := b.call("getUpdates", gin.H{
+		"offset":          offset,
+		"timeout":         telegramPollTimeout,
+		"allowed_updates": []string{"message", "callback_query"},
+	}, &updates)
+	return updates, err
+}
+
+// Send a plain text message, with inline buttons if keyboard is set
+func (b *TelegramBot) SendMessage(chatID int64, text string, keyboard *TelegramKeyboard) (*TelegramMessage, error) {
+	params := gin.H{"chat_id": chatID, "text": text}
+	if keyboard != nil {
+		params["reply_markup"] = keyboard
+	}
+	var msg TelegramMessage
+	return &msg, b.call("sendMessage", params, &msg)
+}
+
+// Replace a message's text, dropping its buttons
+func (b *TelegramBot) EditMessageText(chatID, messageID int64, text string) error {
+	return b.call("editMessageText", gin.H{"chat_id": chatID, "message_id": messageID, "text": text}, nil)
+}
+
+// Acknowledge a button tap, optionally with a short toast
+func (b *TelegramBot) AnswerCallbackQuery(id, text string) error {
+	return b.call("answerCallbackQuery", gin.H{"callback_query_id": id, "text": text}, nil)
+}
+
+// Have Telegram deliver updates to webhookURL
+func (b *TelegramBot) SetWebhook(webhookURL, secret string) error {
+	return b.call("setWebhook", gin.H{
+		"url":             webhookURL,
+		"secret_token":    secret,
+		"allowed_updates": []string{"message", "callback_query"},
+	}, nil)
+}
+
+// Switch back to getUpdates
+func (b *TelegramBot) DeleteWebhook() error {
+	return b.call("deleteWebhook", struct{}{}, nil)
+}
+
+// Bot username for t.me links, "" until known
+func (b *TelegramBot) Username() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.username
+}
+
+// Connect the bot: register the webhook, or start long polling
+func startTelegramBot() {
+	if telegramBot == nil {
+		return
+	}
+
+	go func() {
+		// The API may be served by this process (TELEGRAM_ENV=fake), so let the
+		// router start, then retry until it answers
+		time.Sleep(time.Second)
+		for attempt := 1; ; attempt++ {
+			me, err := telegramBot.GetMe()
+			if err == nil {
+				telegramBot.mu.Lock()
+				if telegramBot.username == "" {
+					telegramBot.username = me.Username
+				}
+				telegramBot.mu.Unlock()
+				break
+			}
+			log.Printf("Telegram bot not reachable: %v\n", err)
+			time.Sleep(time.Duration(min(attempt, 12)) * 5 * time.Second)
+		}
+
+		if telegramBot.WebhookSecret != "" {
+			if err := telegramBot.SetWebhook(getBaseURL()+"/webhook/telegram", telegramBot.WebhookSecret); err != nil {
+				log.Printf("Registering Telegram webhook failed: %v\n", err)
+			}
+			return
+		}
+
+		// getUpdates is refused while a webhook is registered
+		if err := telegramBot.DeleteWebhook(); err != nil {
+			log.Printf("Removing Telegram webhook failed: %v\n", err)
+		}
+		pollTelegramUpdates()
+	}()
+}
+
+// Long polling loop
+func pollTelegramUpdates() {
+	var offset int64
+	for {
+		updates, err := telegramBot.GetUpdates(offset)
+		if err != nil {
+			log.Printf("Telegram getUpdates failed: %v\n", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for i := range updates {
+			offset = updates[i].UpdateID + 1
+			handleTelegramUpdate(&updates[i])
+		}
+	}
+}
+
+// Updates pushed by Telegram in webhook mode
+func telegramWebhookHandler(c *gin.Context) {
+	if telegramBot == nil || telegramBot.WebhookSecret == "" ||
+		subtle.ConstantTimeCompare([]byte(c.GetHeader("X-Telegram-Bot-Api-Secret-Token")), []byte(telegramBot.WebhookSecret)) != 1 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+
+	var update TelegramUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid update"})
+		return
+	}
+	handleTelegramUpdate(&update)
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// Dispatch one update
+func handleTelegramUpdate(update *TelegramUpdate) {
+	switch {
+	case update.CallbackQuery != nil:
+		handleTelegramCallback(update.CallbackQuery)
+	case update.Message != nil && strings.HasPrefix(update.Message.Text, "/"):
+		handleTelegramCommand(update.Message)
+	case update.Message != nil:
+		telegramReply(update.Message.Chat.ID, telegramHelpText, nil)
+	}
+}
+
+// Send a reply, logging failures
+func telegramReply(chatID int64, text string, keyboard *TelegramKeyboard) {
+	if _, err := telegramBot.SendMessage(chatID, text, keyboard); err != nil {
+		log.Printf("Telegram reply to chat %d failed: %v\n", chatID, err)
+	}
+}
+
+// The active user linked to a chat, if fromID is the Telegram account that linked it
+func telegramChatUser(chatID, fromID int64) (*User, bool) {
+	if fromID == 0 {
+		return nil, false
+	}
+	var user User
+	if err := db.Where("telegram_chat_id = ? AND telegram_user_id = ? AND is_active = ?", chatID, fromID, true).First(&user).Error; err != nil {
+		return nil, false
+	}
+	return &user, true
+}
+
+func handleTelegramCommand(msg *TelegramMessage) {
+	fields := strings.Fields(msg.Text)
+	command := strings.ToLower(strings.SplitN(fields[0], "@", 2)[0]) // "/ipos@IPOPilotBot" in groups
+	chatID := msg.Chat.ID
+
+	// /start CODE comes from the t.me deep link, /link CODE from typing it
+	if (command == "/start" || command == "/link") && len(fields) > 1 {
+		telegramReply(chatID, linkTelegramChat(msg.Chat, msg.From, fields[1]), nil)
+		return
+	}
+
+	var fromID int64
+	if msg.From != nil {
+		fromID = msg.From.ID
+	}
+	user, ok := telegramChatUser(chatID, fromID)
+	if !ok {
+		telegramReply(chatID, telegramNotLinkedText, nil)
+		return
+	}
+
+	switch command {
+	case "/ipos":
+		text, keyboard := telegramOpenIPOs()
+		telegramReply(chatID, text, keyboard)
+	case "/status":
+		telegramReply(chatID, telegramStatusText(user), nil)
+	case "/results":
+		telegramReply(chatID, telegramResultsText(user), nil)
+	case "/unlink":
+		unlinkTelegram(user.ID)
+		telegramReply(chatID, "Unlinked. This chat won't get IPO Pilot alerts anymore.", nil)
+	default:
+		telegramReply(chatID, telegramHelpText, nil)
+	}
+}
+
+// Hash of a link code as stored
+func hashTelegramLinkCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToUpper(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+// Link a private chat to the owner of code and return the reply. A chat belongs to one account,
+// and only the Telegram account that linked it can use it.
+func linkTelegramChat(chat TelegramChat, from *TelegramUser, code string) string {
+	const invalid = "That code is invalid or has expired. Get a new one from Settings."
+
+	// Anyone in a group could tap the apply buttons, so alerts only go to private chats
+	if chat.Type != "private" || from == nil {
+		return "Link your account in a private chat with the bot, not in a group."
+	}
+
+	var linkCode TelegramLinkCode
+	if err := db.Where("code_hash = ? AND expires_at > ?", hashTelegramLinkCode(code), time.Now()).First(&linkCode).Error; err != nil {
+		return invalid
+	}
+	var user User
+	if err := db.First(&user, linkCode.UserID).Error; err != nil || !user.IsActive {
+		return invalid
+	}
+
+	db.Model(&User{}).Where("telegram_chat_id = ? AND id <> ?", chat.ID, user.ID).Updates(map[string]interface{}{
+		"telegram_chat_id":   0,
+		"telegram_user_id":   0,
+		"telegram_username":  "",
+		"telegram_linked_at": nil,
+	})
+	if err := db.Model(&user).Updates(map[string]interface{}{
+		"telegram_chat_id":   chat.ID,
+		"telegram_user_id":   from.ID,
+		"telegram_username":  from.Username,
+		"telegram_linked_at": time.Now(),
+	}).Error; err != nil {
+		return "Linking failed, please try again."
+	}
+	db.Unscoped().Delete(&linkCode)
+
+	return fmt.Sprintf("Linked to %s. New IPO alerts will arrive here.\n\n%s", user.Email, telegramHelpText)
+}
+
+// Links made before the linking account was recorded: a private chat's ID is its
+// user's ID, so keep those, and drop group links, which anyone in the group could use
+func migrateTelegramLinks() {
+	db.Model(&User{}).Where("telegram_chat_id > 0 AND telegram_user_id = 0").
+		Update("telegram_user_id", gorm.Expr("telegram_chat_id"))
+	db.Model(&User{}).Where("telegram_chat_id < 0").Updates(map[string]interface{}{
+		"telegram_chat_id":   0,
+		"telegram_user_id":   0,
+		"telegram_username":  "",
+		"telegram_linked_at": nil,
+	})
+}
+
+// Stop alerts for a user
+func unlinkTelegram(userID uint) {
+	db.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"telegram_chat_id":   0,
+		"telegram_user_id":   0,
+		"telegram_username":  "",
+		"telegram_linked_at": nil,
+	})
+}
+
+// Callback data of the apply and skip buttons
+func telegramApplyData(shareID string) string { return "apply:" + shareID }
+func telegramSkipData(shareID string) string  { return "skip:" + shareID }
+
+// An IPO that is open right now, by company share ID
+func findOpenIPO(shareID string) (*IPOData, bool) {
+	ipos, _ := getOpenIPOsFromAllSources()
+	for i := range ipos {
+		if ipos[i].CompanyShareID == shareID {
+			return &ipos[i], true
+		}
+	}
+	return nil, false
+}
+
+// /ipos: open IPOs, one apply button each
+func telegramOpenIPOs() (string, *TelegramKeyboard) {
+	ipos, _ := getOpenIPOsFromAllSources()
+	if len(ipos) == 0 {
+		return "No IPOs are open right now.", nil
+	}
+
+	var b strings.Builder
+	keyboard := &TelegramKeyboard{}
+	b.WriteString("Open IPOs:\n")
+	for i, ipo := range ipos {
+		if i == telegramMaxIPOs {
+			break
+		}
+		label := ipo.CompanyName
+		if ipo.StockSymbol != "" {
+			label = ipo.StockSymbol
+		}
+		fmt.Fprintf(&b, "\n• %s", ipo.CompanyName)
+		if ipo.IssueCloseDate != "" {
+			fmt.Fprintf(&b, " - closes %s", ipo.IssueCloseDate)
+		}
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, []TelegramButton{
+			{Text: "Apply all profiles: " + label, CallbackData: telegramApplyData(ipo.CompanyShareID)},
+		})
+	}
+	return b.String(), keyboard
+}
+
+// /status: plan, limits and usage
+func telegramStatusText(user *User) string {
+	e, err := loadEntitlements(user.ID)
+	if err != nil {
+		return "No active subscription. Subscribe to keep applying automatically: " + getBaseURL() + "/pricing"
+	}
+
+	sub := e.Subscription
+	planName := sub.PlanType
+	if plan, err := getSubscriptionPlan(sub); err == nil {
+		planName = plan.Name
+	}
+	applications := fmt.Sprintf("%d", e.ApplicationsThisPeriod)
+	if sub.MaxApplications != unlimited {
+		applications += fmt.Sprintf(" of %d", sub.MaxApplications)
+	}
+	return fmt.Sprintf("Plan: %s (%s) until %s\nProfiles: %d\nApplications this period: %s\nMonitoring sessions running: %d",
+		planName, sub.Status, sub.EndDate.In(nepalTime).Format("2006-01-02"), e.Profiles, applications, e.ActiveMonitors)
+}
+
+// /results: the latest applications and their outcome
+func telegramResultsText(user *User) string {
+	var applications []IPOApplication
+	db.Preload("Profile").Where("user_id = ?", user.ID).Order("applied_at DESC").Limit(10).Find(&applications)
+	if len(applications) == 0 {
+		return "No applications yet."
+	}
+
+	var b strings.Builder
+	b.WriteString("Recent applications:\n")
+	for i := range applications {
+		app := &applications[i]
+		var result string
+		switch {
+		case app.AllotmentStatus == AllotmentAllotted:
+			result = fmt.Sprintf("allotted %d kitta", app.AllottedKittas)
+		case app.AllotmentStatus == AllotmentNotAllotted:
+			result = "not allotted"
+		case app.Status == "success":
+			result = fmt.Sprintf("applied for %d kitta, result pending", app.KittasApplied)
+		case app.Status == "failed":
+			result = "failed: " + app.ResponseMsg
+		default:
+			result = "processing"
+		}
+		fmt.Fprintf(&b, "\n• %s (%s): %s", applicationCompany(app), app.Profile.Name, result)
+	}
+	return b.String()
+}
+
+func handleTelegramCallback(query *TelegramCallbackQuery) {
+	if query.Message == nil {
+		telegramBot.AnswerCallbackQuery(query.ID, "")
+		return
+	}
+	chatID := query.Message.Chat.ID
+	user, ok := telegramChatUser(chatID, query.From.ID)
+	if !ok {
+		telegramBot.AnswerCallbackQuery(query.ID, "Link your IPO Pilot account first")
+		return
+	}
+
+	action, shareID, _ := strings.Cut(query.Data, ":")
+	switch action {
+	case "apply":
+		telegramBot.AnswerCallbackQuery(query.ID, "Applying...")
+		telegramReply(chatID, telegramApplyAll(user, shareID), nil)
+	case "skip":
+		telegramBot.AnswerCallbackQuery(query.ID, "Skipped")
+		if err := telegramBot.EditMessageText(chatID, query.Message.MessageID, query.Message.Text+"\n\nSkipped."); err != nil {
+			log.Printf("Telegram edit in chat %d failed: %v\n", chatID, err)
+		}
+	default:
+		telegramBot.AnswerCallbackQuery(query.ID, "")
+	}
+}
+
+// Apply to an open IPO with every active profile of the user, through the
+// same path as applyIPOHandler. Returns the reply.
+func telegramApplyAll(user *User, shareID string) string {
+	ipo, ok := findOpenIPO(shareID)
+	if !ok {
+		return "This IPO is no longer open."
+	}
+
+	var profiles []Profile
+	db.Where("user_id = ? AND is_active = ?", user.ID, true).Find(&profiles)
+	if len(profiles) == 0 {
+		return "Add a MeroShare profile on the website first: " + getBaseURL() + "/dashboard/profiles"
+	}
+
+	submitted := 0
+	lines := make([]string, 0, len(profiles))
+	for i := range profiles {
+		profile := &profiles[i]
+		kittas := profile.DefaultKittas
+		if kittas < 10 {
+			kittas = 10 // MeroShare minimum
+		}
+
+		_, err := submitIPOApplication(user.ID, profile, ipo.CompanyShareID, ipo.CompanyName, kittas)
+		var entErr *EntitlementError
+		switch {
+		case err == nil:
+			submitted++
+			lines = append(lines, fmt.Sprintf("• %s: applying for %d kitta", profile.Name, kittas))
+		case errors.Is(err, errAlreadyApplied):
+			lines = append(lines, fmt.Sprintf("• %s: already applied", profile.Name))
+		case errors.As(err, &entErr):
+			lines = append(lines, fmt.Sprintf("• %s: %s", profile.Name, entErr.Message))
+		default:
+			log.Printf("Telegram apply for user %d failed: %v\n", user.ID, err)
+			lines = append(lines, fmt.Sprintf("• %s: failed, please try again", profile.Name))
+		}
+	}
+
+	return fmt.Sprintf("%s: submitted %d of %d profile(s).\n%s", ipo.CompanyName, submitted, len(profiles), strings.Join(lines, "\n"))
+}
+
+// Telegram alert text per notification type and language; other types aren't sent
+var telegramTemplates = map[string]map[string]string{
+	NotifyNewIPO: {
+		"english": "📢 New IPO: {{.Company}}{{if .Symbol}} ({{.Symbol}}){{end}}{{if .CloseDate}}\nCloses: {{.CloseDate}}{{end}}{{if .Price}}\nPrice per unit: {{.Price}}{{end}}",
+		"nepali":  "📢 नयाँ IPO: {{.Company}}{{if .Symbol}} ({{.Symbol}}){{end}}{{if .CloseDate}}\nबन्द हुने मिति: {{.CloseDate}}{{end}}{{if .Price}}\nप्रति कित्ता मूल्य: {{.Price}}{{end}}",
+	},
+	NotifyApplicationSubmitted: {
+		"english": "✅ Applied for {{.Kittas}} kitta of {{.Company}} for {{.Profile}}.",
+		"nepali":  "✅ {{.Profile}} का लागि {{.Company}} को {{.Kittas}} कित्ता आवेदन दिइयो।",
+	},
+	NotifyApplicationFailed: {
+		"english": "❌ Application for {{.Company}} ({{.Profile}}) failed{{if .Message}}: {{.Message}}{{end}}.",
+		"nepali":  "❌ {{.Profile}} का लागि {{.Company}} को आवेदन असफल भयो{{if .Message}}: {{.Message}}{{end}}।",
+	},
+	NotifyAllotmentResult: {
+		"english": "{{if .Allotted}}🎉 {{.Profile}} was allotted {{.Kittas}} kitta of {{.Company}}.{{else}}{{.Profile}} was not allotted {{.Company}}.{{end}}",
+		"nepali":  "{{if .Allotted}}🎉 {{.Profile}} लाई {{.Company}} को {{.Kittas}} कित्ता बाँडफाँड भयो।{{else}}{{.Profile}} लाई {{.Company}} बाँडफाँड भएन।{{end}}",
+	},
+}
+
+// Labels of the new-IPO alert buttons per language
+var telegramAlertButtons = map[string][2]string{
+	"english": {"Apply all profiles", "Skip"},
+	"nepali":  {"सबै प्रोफाइलबाट आवेदन", "छोड्नुहोस्"},
+}
+
+// Send the Telegram alert for a notification to a linked chat
+func telegramNotification(user *User, kind, dedupeKey string, data gin.H) {
+	templates, ok := telegramTemplates[kind]
+	if !ok || telegramBot == nil || user.TelegramChatID == 0 {
+		return
+	}
+	if dedupeKey != "" {
+		var count int64
+		db.Model(&TelegramLog{}).Where("user_id = ? AND dedupe_key = ?", user.ID, dedupeKey).Count(&count)
+		if count > 0 {
+			return
+		}
+	}
+
+	lang := userLanguage(user)
+	text, err := renderMessage(kind, templates[lang], notificationValues(user, data))
+	if err != nil {
+		log.Printf("Rendering %s Telegram alert for user %d failed: %v\n", kind, user.ID, err)
+		return
+	}
+
+	var keyboard *TelegramKeyboard
+	if shareID, _ := data["ShareID"].(string); kind == NotifyNewIPO && shareID != "" {
+		labels := telegramAlertButtons[lang]
+		keyboard = &TelegramKeyboard{InlineKeyboard: [][]TelegramButton{{
+			{Text: labels[0], CallbackData: telegramApplyData(shareID)},
+			{Text: labels[1], CallbackData: telegramSkipData(shareID)},
+		}}}
+	}
+
+	queueTelegramText(user, kind, dedupeKey, text, keyboard)
+}
+
+// Record a message to a linked chat and send it in the background
+func queueTelegramText(user *User, kind, dedupeKey, text string, keyboard *TelegramKeyboard) {
+	entry := TelegramLog{
+		UserID:    user.ID,
+		ChatID:    user.TelegramChatID,
+		Type:      kind,
+		DedupeKey: dedupeKey,
+		Text:      text,
+		Status:    TelegramPending,
+	}
+	if err := db.Create(&entry).Error; err != nil {
+		log.Printf("Recording %s Telegram alert for user %d failed: %v\n", kind, user.ID, err)
+		return
+	}
+	go deliverTelegram(&entry, keyboard)
+}
+
+// Send a recorded alert and store the outcome
+func deliverTelegram(entry *TelegramLog, keyboard *TelegramKeyboard) {
+	msg, err := telegramBot.SendMessage(entry.ChatID, entry.Text, keyboard)
+	updates := map[string]interface{}{"status": TelegramSent}
+	if err != nil {
+		updates["status"] = TelegramFailed
+		updates["error"] = err.Error()
+		log.Printf("Telegram alert %d to user %d failed: %v\n", entry.ID, entry.UserID, err)
+	} else {
+		updates["message_id"] = msg.MessageID
+	}
+	db.Model(&TelegramLog{}).Where("id = ?", entry.ID).Updates(updates)
+}
+
+// The signed-in user's Telegram link
+func telegramHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	response := gin.H{
+		"enabled":   telegramBot != nil,
+		"linked":    user.TelegramChatID != 0,
+		"username":  user.TelegramUsername,
+		"linked_at": user.TelegramLinkedAt,
+	}
+	if telegramBot != nil {
+		response["bot_username"] = telegramBot.Username()
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// Create a one-time code to send to the bot
+func createTelegramLinkCodeHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+	if telegramBot == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Telegram alerts are not available"})
+		return
+	}
+
+	code, err := generateReferralCode() // Same short, unambiguous alphabet
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create code"})
+		return
+	}
+
+	// A new code replaces any earlier one
+	db.Unscoped().Where("user_id = ?", userID).Delete(&TelegramLinkCode{})
+	if err := db.Create(&TelegramLinkCode{
+		UserID:    userID,
+		CodeHash:  hashTelegramLinkCode(code),
+		ExpiresAt: time.Now().Add(telegramLinkCodeTTL),
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create code"})
+		return
+	}
+
+	response := gin.H{
+		"code":       code,
+		"command":    "/link " + code,
+		"expires_in": int(telegramLinkCodeTTL.Seconds()),
+	}
+	if username := telegramBot.Username(); username != "" {
+		response["link"] = "https://t.me/" + username + "?start=" + code
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// Unlink Telegram from the website
+func unlinkTelegramHandler(c *gin.Context) {
+	unlinkTelegram(c.GetUint("userID"))
+	c.JSON(http.StatusOK, gin.H{"message": "Telegram unlinked"})
+}
+
+// Admin: Telegram alerts, optionally filtered by status, type or user_id
+func adminTelegramLogHandler(c *gin.Context) {
+	query := db.Model(&TelegramLog{}).Order("created_at DESC").Limit(500)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if kind := c.Query("type"); kind != "" {
+		query = query.Where("type = ?", kind)
+	}
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	var messages []TelegramLog
+	query.Find(&messages)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":    len(messages),
+		"messages": messages,
+	})
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Local stub of the Telegram Bot API for development and integration testing.
+// Enabled with TELEGRAM_ENV=fake, which also points the bot at it. It checks
+// the bot token, queues updates for getUpdates (or POSTs them to a registered
+// webhook) and records what the bot sends. Play the user with:
+//
+//	POST /_fake/telegram/chats/:chat/send {"text": "/link CODE"}
+//	POST /_fake/telegram/chats/:chat/tap  {"message_id": 3, "data": "apply:123"}
+//	GET  /_fake/telegram/chats/:chat/messages
+//
+// A positive :chat is a private chat with the user of that ID, a negative one a
+// group; add "from" to send or tap as another user.
+//
+// Never enable it in production.
+
+const fakeTelegramBotUsername = "ipopilot_fake_bot"
+
+type fakeTelegram struct {
+	mu            sync.Mutex
+	nextUpdateID  int64
+	nextMessageID int64
+	updates       []TelegramUpdate
+	waiting       chan struct{} // Closed when an update is queued
+	messages      map[int64][]*TelegramMessage
+	callbacks     map[string]string // Callback query ID -> answer text
+	webhookURL    string
+	webhookSecret string
+}
+
+// Mount the stub under telegramFakePath
+func mountFakeTelegram(r *gin.Engine) {
+	fake := &fakeTelegram{
+		waiting:   make(chan struct{}),
+		messages:  make(map[int64][]*TelegramMessage),
+		callbacks: make(map[string]string),
+	}
+
+	group := r.Group(telegramFakePath)
+	group.POST("/:bot/:method", fake.apiHandler)
+	group.POST("/chats/:chat/send", fake.sendHandler)
+	group.POST("/chats/:chat/tap", fake.tapHandler)
+	group.GET("/chats/:chat/messages", fake.messagesHandler)
+}
+
+// Bot API reply envelope
+func fakeTelegramOK(c *gin.Context, result interface{}) {
+	c.JSON(http.StatusOK, gin.H{"ok": true, "result": result})
+}
+
+func fakeTelegramError(c *gin.Context, status int, description string) {
+	c.JSON(status, gin.H{"ok": false, "error_code": status, "description": description})
+}
+
+func (f *fakeTelegram) apiHandler(c *gin.Context) {
+	if telegramBot == nil || c.Param("bot") != "bot"+telegramBot.Token {
+		fakeTelegramError(c, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var params struct {
+		Offset          int64             `json:"offset"`
+		Timeout         int               `json:"timeout"`
+		ChatID          int64             `json:"chat_id"`
+		MessageID       int64             `json:"message_id"`
+		Text            string            `json:"text"`
+		ReplyMarkup     *TelegramKeyboard `json:"reply_markup"`
+		CallbackQueryID string            `json:"callback_query_id"`
+		URL             string            `json:"url"`
+		SecretToken     string            `json:"secret_token"`
+	}
+	c.ShouldBindJSON(&params)
+
+	switch c.Param("method") {
+	case "getMe":
+		fakeTelegramOK(c, TelegramUser{ID: 1, Username: fakeTelegramBotUsername, FirstName: "IPO Pilot"})
+	case "getUpdates":
+		f.getUpdates(c, params.Offset, params.Timeout)
+	case "setWebhook":
+		f.mu.Lock()
+		f.webhookURL, f.webhookSecret = params.URL, params.SecretToken
+		f.mu.Unlock()
+		fakeTelegramOK(c, true)
+	case "deleteWebhook":
+		f.mu.Lock()
+		f.webhookURL, f.webhookSecret = "", ""
+		f.mu.Unlock()
+		fakeTelegramOK(c, true)
+	case "sendMessage":
+		if params.ChatID == 0 || params.Text == "" {
+			fakeTelegramError(c, http.StatusBadRequest, "Bad Request: chat_id and text are required")
+			return
+		}
+		f.mu.Lock()
+		f.nextMessageID++
+		msg := &TelegramMessage{MessageID: f.nextMessageID, Chat: fakeTelegramChatOf(params.ChatID), Text: params.Text, ReplyMarkup: params.ReplyMarkup}
+		f.messages[params.ChatID] = append(f.messages[params.ChatID], msg)
+		f.mu.Unlock()
+		fakeTelegramOK(c, msg)
+	case "editMessageText":
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for _, msg := range f.messages[params.ChatID] {
+			if msg.MessageID == params.MessageID {
+				msg.Text, msg.ReplyMarkup = params.Text, params.ReplyMarkup
+				fakeTelegramOK(c, msg)
+				return
+			}
+		}
+		fakeTelegramError(c, http.StatusBadRequest, "Bad Request: message to edit not found")
+	case "answerCallbackQuery":
+		f.mu.Lock()
+		f.callbacks[params.CallbackQueryID] = params.Text
+		f.mu.Unlock()
+		fakeTelegramOK(c, true)
+	default:
+		fakeTelegramError(c, http.StatusNotFound, "Not Found: method not found")
+	}
+}
+
+// Long poll: answer with queued updates from offset on, waiting up to timeout
+func (f *fakeTelegram) getUpdates(c *gin.Context, offset int64, timeout int) {
+	deadline := time.After(time.Duration(timeout) * time.Second)
+	for {
+		f.mu.Lock()
+		if f.webhookURL != "" {
+			f.mu.Unlock()
+			fakeTelegramError(c, http.StatusConflict, "Conflict: can't use getUpdates method while webhook is active")
+			return
+		}
+		// Updates before offset are confirmed
+		kept := f.updates[:0]
+		for _, update := range f.updates {
+			if update.UpdateID >= offset {
+				kept = append(kept, update)
+			}
+		}
+		f.updates = kept
+		pending := append([]TelegramUpdate{}, f.updates...)
+		waiting := f.waiting
+		f.mu.Unlock()
+
+		if len(pending) > 0 || timeout == 0 {
+			fakeTelegramOK(c, pending)
+			return
+		}
+		select {
+		case <-waiting:
+		case <-deadline:
+			fakeTelegramOK(c, []TelegramUpdate{})
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// Queue an update, or push it to the webhook
+func (f *fakeTelegram) deliver(update TelegramUpdate) {
+	f.mu.Lock()
+	f.nextUpdateID++
+	update.UpdateID = f.nextUpdateID
+	webhookURL, secret := f.webhookURL, f.webhookSecret
+	if webhookURL == "" {
+		f.updates = append(f.updates, update)
+		close(f.waiting)
+		f.waiting = make(chan struct{})
+	}
+	f.mu.Unlock()
+
+	if webhookURL != "" {
+		go func() {
+			body, _ := json.Marshal(update)
+			req, _ := http.NewRequest(http.MethodPost, webhookURL, bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+}
+
+func fakeTelegramChat(c *gin.Context) (int64, bool) {
+	chatID, err := strconv.ParseInt(c.Param("chat"), 10, 64)
+	if err != nil || chatID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return 0, false
+	}
+	return chatID, true
+}
+
+// Like Telegram, positive IDs are private chats with the user of that ID and negative ones groups
+func fakeTelegramChatOf(chatID int64) TelegramChat {
+	if chatID < 0 {
+		return TelegramChat{ID: chatID, Type: "group"}
+	}
+	return TelegramChat{ID: chatID, Type: "private"}
+}
+
+// Who sent an update: the given user, or the owner of a private chat
+func fakeTelegramSender(chatID, from int64) int64 {
+	if from == 0 && chatID > 0 {
+		return chatID
+	}
+	return from
+}
+
+func (f *fakeTelegram) sendHandler(c *gin.Context) {
+	chatID, ok := fakeTelegramChat(c)
+	if !ok {
+		return
+	}
+	var input struct {
+		Text     string `json:"text" binding:"required"`
+		Username string `json:"username"`
+		From     int64  `json:"from"` // Sender's user ID, defaults to the private chat's owner
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "text is required"})
+		return
+	}
+
+	f.mu.Lock()
+	f.nextMessageID++
+	msg := &TelegramMessage{
+		MessageID: f.nextMessageID,
+		Chat:      fakeTelegramChatOf(chatID),
+		From:      &TelegramUser{ID: fakeTelegramSender(chatID, input.From), Username: input.Username},
+		Text:      input.Text,
+	}
+	f.mu.Unlock()
+
+	f.deliver(TelegramUpdate{Message: msg})
+	c.JSON(http.StatusOK, gin.H{"message_id": msg.MessageID})
+}
+
+// The user taps an inline button on one of the bot's messages
+func (f *fakeTelegram) tapHandler(c *gin.Context) {
+	chatID, ok := fakeTelegramChat(c)
+	if !ok {
+		return
+	}
+	var input struct {
+		MessageID int64  `json:"message_id" binding:"required"`
+		Data      string `json:"data" binding:"required"`
+		From      int64  `json:"from"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "message_id and data are required"})
+		return
+	}
+
+	f.mu.Lock()
+	var tapped *TelegramMessage
+	for _, msg := range f.messages[chatID] {
+		if msg.MessageID == input.MessageID {
+			copied := *msg
+			tapped = &copied
+		}
+	}
+	f.nextUpdateID++ // Unique callback query ID
+	queryID := strconv.FormatInt(f.nextUpdateID, 10)
+	f.mu.Unlock()
+	if tapped == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	f.deliver(TelegramUpdate{CallbackQuery: &TelegramCallbackQuery{
+		ID:      queryID,
+		From:    TelegramUser{ID: fakeTelegramSender(chatID, input.From)},
+		Message: tapped,
+		Data:    input.Data,
+	}})
+	c.JSON(http.StatusOK, gin.H{"callback_query_id": queryID})
+}
+
+// Everything the bot sent to a chat, and its callback answers
+func (f *fakeTelegram) messagesHandler(c *gin.Context) {
+	chatID, ok := fakeTelegramChat(c)
+	if !ok {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	messages := f.messages[chatID]
+	if messages == nil {
+		messages = []*TelegramMessage{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"messages":  messages,
+		"callbacks": f.callbacks,
+	})
+}
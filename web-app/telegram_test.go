@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func createTelegramLinkCode(t *testing.T, user *User, code string) {
+	t.Helper()
+
+	if err := db.Create(&TelegramLinkCode{
+		UserID:    user.ID,
+		CodeHash:  hashTelegramLinkCode(code),
+		ExpiresAt: time.Now().Add(telegramLinkCodeTTL),
+	}).Error; err != nil {
+		t.Fatalf("creating link code: %v", err)
+	}
+}
+
+func TestTelegramLinksOnlyInPrivateChats(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "telegram@example.com")
+	createTelegramLinkCode(t, user, "GROUP1")
+
+	reply := linkTelegramChat(TelegramChat{ID: -100, Type: "group"}, &TelegramUser{ID: 42}, "GROUP1")
+	if !strings.Contains(reply, "private chat") {
+		t.Fatalf("linking in a group replied %q", reply)
+	}
+	if _, ok := telegramChatUser(-100, 42); ok {
+		t.Fatal("group chat got linked")
+	}
+}
+
+func TestTelegramChatAnswersOnlyTheLinkingAccount(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "telegram@example.com")
+	createTelegramLinkCode(t, user, "PRIVATE1")
+
+	reply := linkTelegramChat(TelegramChat{ID: 42, Type: "private"}, &TelegramUser{ID: 42, Username: "ram"}, "PRIVATE1")
+	if !strings.HasPrefix(reply, "Linked to") {
+		t.Fatalf("linking replied %q", reply)
+	}
+
+	if linked, ok := telegramChatUser(42, 42); !ok || linked.ID != user.ID {
+		t.Fatal("linking account can't use the chat")
+	}
+	if _, ok := telegramChatUser(42, 43); ok {
+		t.Fatal("another account can use the chat")
+	}
+	if _, ok := telegramChatUser(42, 0); ok {
+		t.Fatal("an update without a sender can use the chat")
+	}
+
+	unlinkTelegram(user.ID)
+	if _, ok := telegramChatUser(42, 42); ok {
+		t.Fatal("chat still answers after unlinking")
+	}
+}
+
+func TestMigrateTelegramLinks(t *testing.T) {
+	setupTestDB(t)
+	private := createTestUser(t, "private@example.com")
+	group := createTestUser(t, "group@example.com")
+	db.Model(private).Update("telegram_chat_id", 42)
+	db.Model(group).Update("telegram_chat_id", -100)
+
+	migrateTelegramLinks()
+
+	if _, ok := telegramChatUser(42, 42); !ok {
+		t.Fatal("private chat link was dropped")
+	}
+	var user User
+	db.First(&user, group.ID)
+	if user.TelegramChatID != 0 || user.TelegramUserID != 0 {
+		t.Fatalf("group link kept: chat %d, user %d", user.TelegramChatID, user.TelegramUserID)
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TOTP two-factor authentication (RFC 6238, SHA1, 6 digits, 30s steps)
+
+const (
+	totpIssuer          = "IPO Pilot"
+	totpPeriod          = 30
+	totpDigits          = 6
+	totpSkew            = 1 // Accept one step either side for clock drift
+	recoveryCodeCount   = 10
+	twoFactorChallenge  = "2fa_login"
+	twoFactorLoginTTL   = 5 * time.Minute
+	twoFactorConfirmTTL = 10 * time.Minute // Re-confirmation window for sensitive actions
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Server-side key TOTP secrets are encrypted under, from TOTP_ENCRYPTION_KEY
+var totpMasterKey []byte
+
+// Generate a random 160-bit TOTP secret
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := crand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// Compute the TOTP code for a given time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// Verify a TOTP code. Returns the matched step; steps at or before lastStep are rejected as replays.
+func verifyTOTP(secret, code string, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := time.Now().Unix() / totpPeriod
+	for i := -totpSkew; i <= totpSkew; i++ {
+		step := current + int64(i)
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Build the otpauth:// URI that authenticator apps scan as a QR code
+func totpProvisioningURI(email, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + email)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", totpDigits))
+	params.Set("period", fmt.Sprintf("%d", totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// Load TOTP_ENCRYPTION_KEY. Without a key kept outside the database, a dump
+// of it would be enough to read every TOTP secret.
+func loadTOTPEncryptionKey() error {
+	key := os.Getenv("TOTP_ENCRYPTION_KEY")
+	if len(key) < 16 {
+		return errors.New("TOTP_ENCRYPTION_KEY must be set to a random string of at least 16 characters")
+	}
+	totpMasterKey = []byte(key)
+	return nil
+}
+
+// TOTP secrets are encrypted per user, independent of editable fields like email
+func totpEncryptionKey(userID uint) string {
+	mac := hmac.New(sha256.New, totpMasterKey)
+	fmt.Fprintf(mac, "totp-%d", userID)
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// Re-encrypt secrets stored under the old key, which came from the user ID alone
+func migrateTOTPSecrets() {
+	var users []User
+	db.Where("totp_secret_enc <> '' AND totp_key_version = 0").Find(&users)
+
+	for i := range users {
+		secret, err := decryptAES(generateEncryptionKey(fmt.Sprintf("totp-%d", users[i].ID)), users[i].TOTPSecretEnc)
+		if err != nil {
+			log.Printf("Migrating TOTP secret of user %d failed: %v\n", users[i].ID, err)
+			continue
+		}
+		secretEnc, err := encryptAES(totpEncryptionKey(users[i].ID), secret)
+		if err != nil {
+			log.Printf("Migrating TOTP secret of user %d failed: %v\n", users[i].ID, err)
+			continue
+		}
+		db.Model(&users[i]).Updates(map[string]interface{}{
+			"totp_secret_enc":  secretEnc,
+			"totp_key_version": 1,
+		})
+	}
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// Replace a user's recovery codes with a fresh set and return the plaintext codes
+func generateRecoveryCodes(userID uint) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	records := make([]RecoveryCode, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := crand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(raw)
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		records = append(records, RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(code)})
+	}
+
+	if err := db.Unscoped().Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Create(&records).Error; err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Consume a recovery code. Each code works exactly once.
+func useRecoveryCode(userID uint, code string) bool {
+	now := time.Now()
+	result := db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashRecoveryCode(code)).
+		Update("used_at", now)
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// Verify a second factor (TOTP or recovery code) for a user with 2FA enabled
+func verifySecondFactor(user *User, code string) bool {
+	if !user.TwoFactorEnabled || user.TOTPSecretEnc == "" {
+		return false
+	}
+
+	secret, err := decryptAES(totpEncryptionKey(user.ID), user.TOTPSecretEnc)
+	if err != nil {
+		return false
+	}
+
+	if step, ok := verifyTOTP(secret, code, user.TOTPLastStep); ok {
+		// Conditional update so two concurrent requests can't both use the same code
+		result := db.Model(&User{}).
+			Where("id = ? AND totp_last_step < ?", user.ID, step).
+			Update("totp_last_step", step)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return false
+		}
+		user.TOTPLastStep = step
+		return true
+	}
+
+	if len(strings.TrimSpace(code)) > totpDigits {
+		return useRecoveryCode(user.ID, code)
+	}
+	return false
+}
+
+// Issue a session after 2FA and set it as the auth cookie
+func issueTwoFactorSession(c *gin.Context, user *User) (string, error) {
+	token, err := generateJWT(user, time.Now())
+	if err != nil {
+		return "", err
+	}
+	c.SetCookie("auth_token", token, 86400, "/", "", false, false)
+	return token, nil
+}
+
+// Second login step: exchange challenge token + code for a session
+func loginTwoFactorHandler(c *gin.Context) {
+	var input struct {
+		ChallengeToken string `json:"challenge_token" binding:"required"`
+		Code           string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	claims, err := validateActionToken(input.ChallengeToken, twoFactorChallenge)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login session expired. Please sign in again."})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, claims.UserID).Error; err != nil || !user.IsActive {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+
+	if isAccountLocked(&user) {
+		recordLoginAttempt(c, user.Email, &user, false, "locked")
+		respondAccountLocked(c, &user)
+		return
+	}
+
+	if !verifySecondFactor(&user, input.Code) {
+		registerLoginFailure(c, &user, "bad_2fa_code")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication code"})
+		return
+	}
+
+	registerLoginSuccess(c, &user)
+	respondWithSession(c, &user, time.Now())
+}
+
+// 2FA status for the settings page
+func twoFactorStatusHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	var remaining int64
+	db.Model(&RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&remaining)
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":                  user.TwoFactorEnabled,
+		"required":                 user.IsAdmin,
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// Start enrollment: generate a secret and return its provisioning URI
+func twoFactorSetupHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if user.TwoFactorEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+		return
+	}
+
+	secretEnc, err := encryptAES(totpEncryptionKey(user.ID), secret)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+		return
+	}
+
+	if err := db.Model(&user).Updates(map[string]interface{}{
+		"totp_secret_enc":  secretEnc,
+		"totp_key_version": 1,
+		"totp_last_step":   0,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save secret"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":           secret,
+		"provisioning_uri": totpProvisioningURI(user.Email, secret),
+	})
+}
+
+// Finish enrollment: verify the first code, enable 2FA and hand out recovery codes
+func twoFactorEnableHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var input struct {
+		Code string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if user.TwoFactorEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	if user.TOTPSecretEnc == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Start two-factor setup first"})
+		return
+	}
+
+	secret, err := decryptAES(totpEncryptionKey(user.ID), user.TOTPSecretEnc)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read secret"})
+		return
+	}
+
+	step, ok := verifyTOTP(secret, input.Code, user.TOTPLastStep)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication code"})
+		return
+	}
+
+	codes, err := generateRecoveryCodes(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+
+	if err := db.Model(&user).Updates(map[string]interface{}{
+		"two_factor_enabled": true,
+		"totp_last_step":     step,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+
+	// The current session has just proven possession of the second factor
+	token, err := issueTwoFactorSession(c, &user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+		"token":          token,
+	})
+}
+
+// Disable 2FA (admins cannot, it is mandatory for them)
+func twoFactorDisableHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var input struct {
+		Code string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if user.IsAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is required for admin accounts"})
+		return
+	}
+
+	if !verifySecondFactor(&user, input.Code) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication code"})
+		return
+	}
+
+	if err := db.Model(&user).Updates(map[string]interface{}{
+		"two_factor_enabled": false,
+		"totp_secret_enc":    "",
+		"totp_last_step":     0,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+	db.Unscoped().Where("user_id = ?", user.ID).Delete(&RecoveryCode{})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// Re-confirm 2FA before sensitive actions; refreshes the session's confirmation time
+func twoFactorConfirmHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var input struct {
+		Code string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if !verifySecondFactor(&user, input.Code) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication code"})
+		return
+	}
+
+	token, err := issueTwoFactorSession(c, &user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "Two-factor confirmed",
+		"token":     token,
+		"valid_for": int(twoFactorConfirmTTL.Seconds()),
+	})
+}
+
+// Regenerate recovery codes (route is behind requireRecentTwoFactor)
+func regenerateRecoveryCodesHandler(c *gin.Context) {
+	userID := c.GetUint("userID")
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil || !user.TwoFactorEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	codes, err := generateRecoveryCodes(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTOTPKeyNeedsServerSecret(t *testing.T) {
+	t.Setenv("TOTP_ENCRYPTION_KEY", "")
+	if err := loadTOTPEncryptionKey(); err == nil {
+		t.Fatal("loaded without TOTP_ENCRYPTION_KEY")
+	}
+
+	t.Setenv("TOTP_ENCRYPTION_KEY", "server-side-totp-key")
+	if err := loadTOTPEncryptionKey(); err != nil {
+		t.Fatalf("loading key: %v", err)
+	}
+	first := totpEncryptionKey(1)
+	if first == generateEncryptionKey("totp-1") {
+		t.Fatal("TOTP key is still derived from the user ID alone")
+	}
+
+	t.Setenv("TOTP_ENCRYPTION_KEY", "another-server-key")
+	loadTOTPEncryptionKey()
+	if totpEncryptionKey(1) == first {
+		t.Fatal("TOTP key doesn't depend on the server-side key")
+	}
+}
+
+func TestMigrateTOTPSecrets(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "totp@example.com")
+
+	secret, _ := generateTOTPSecret()
+	legacyEnc, _ := encryptAES(generateEncryptionKey(fmt.Sprintf("totp-%d", user.ID)), secret)
+	db.Model(user).Updates(map[string]interface{}{"two_factor_enabled": true, "totp_secret_enc": legacyEnc})
+
+	migrateTOTPSecrets()
+
+	var migrated User
+	db.First(&migrated, user.ID)
+	if migrated.TOTPKeyVersion != 1 || migrated.TOTPSecretEnc == legacyEnc {
+		t.Fatalf("secret not re-encrypted: version %d", migrated.TOTPKeyVersion)
+	}
+	code, _ := totpCode(secret, time.Now().Unix()/totpPeriod)
+	if !verifySecondFactor(&migrated, code) {
+		t.Fatal("migrated secret doesn't verify codes")
+	}
+}
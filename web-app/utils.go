@@ -5,10 +5,15 @@ import (
 	"crypto/cipher"
 	"crypto/md5"
 	crand "crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -19,22 +24,47 @@ var jwtSecret = []byte("your-secret-key-change-in-production")
 
 // JWT Claims
 type Claims struct {
-	UserID  uint `json:"user_id"`
-	IsAdmin bool `json:"is_admin"`
+	UserID       uint   `json:"user_id"`
+	IsAdmin      bool   `json:"is_admin"`
+	TwoFactorAt  int64  `json:"tfa_at,omitempty"`  // Unix time of last 2FA confirmation
+	PasswordAt   int64  `json:"pwd_at,omitempty"`  // Unix time the password was last re-entered
+	TokenVersion int    `json:"tv,omitempty"`      // User.TokenVersion when issued
+	Purpose      string `json:"purpose,omitempty"` // Set only on action tokens, never on sessions
 	jwt.RegisteredClaims
 }
 
-// Generate JWT token
-func generateJWT(userID uint, isAdmin bool) (string, error) {
+// Short-lived token claims for multi-step flows (2FA login challenge, email links)
+type ActionClaims struct {
+	UserID  uint   `json:"user_id"`
+	Purpose string `json:"purpose"`
+	Binding string `json:"bind,omitempty"` // Fingerprint of state the token must still match
+	jwt.RegisteredClaims
+}
+
+// Generate JWT token. A zero twoFactorAt means the session has not passed 2FA.
+func generateJWT(user *User, twoFactorAt time.Time) (string, error) {
+	return generateConfirmedJWT(user, twoFactorAt, time.Time{})
+}
+
+// Generate JWT token for a session that also re-entered its password at passwordAt
+func generateConfirmedJWT(user *User, twoFactorAt, passwordAt time.Time) (string, error) {
 	claims := &Claims{
-		UserID:  userID,
-		IsAdmin: isAdmin,
+		UserID:       user.ID,
+		IsAdmin:      user.IsAdmin,
+		TokenVersion: user.TokenVersion,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 
+	if !twoFactorAt.IsZero() {
+		claims.TwoFactorAt = twoFactorAt.Unix()
+	}
+	if !passwordAt.IsZero() {
+		claims.PasswordAt = passwordAt.Unix()
+	}
+
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(jwtSecret)
 }
@@ -51,13 +81,84 @@ func validateJWT(tokenString string) (*Claims, error) {
 		return nil, err
 	}
 
-	if !token.Valid {
+	// Action tokens share the signing key, so never accept one as a session
+	if !token.Valid || claims.Purpose != "" {
+		return nil, errors.New("invalid token")
+	}
+
+	return claims, nil
+}
+
+// Generate a signed token bound to a single purpose. If binding is set the token
+// stops working once the bound state changes (e.g. the password it was issued for).
+func generateActionToken(userID uint, purpose, binding string, ttl time.Duration) (string, error) {
+	claims := &ActionClaims{
+		UserID:  userID,
+		Purpose: purpose,
+		Binding: binding,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtSecret)
+}
+
+// Validate a purpose token and return its claims
+func validateActionToken(tokenString, purpose string) (*ActionClaims, error) {
+	claims := &ActionClaims{}
+
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid || claims.Purpose != purpose {
 		return nil, errors.New("invalid token")
 	}
 
 	return claims, nil
 }
 
+// Short fingerprint of a value for ActionClaims.Binding, without exposing it
+func tokenBinding(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Environment variable with a fallback
+func getEnvDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Integer environment variable with a fallback for unset or invalid values
+func getEnvInt(key string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// Public base URL for links in emails and payment redirects
+func getBaseURL() string {
+	if base := os.Getenv("APP_BASE_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	return "http://localhost:" + port
+}
+
 // Hash password using bcrypt
 func hashPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
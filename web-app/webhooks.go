@@ -0,0 +1,414 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Payment notifications. Nothing in a notification is trusted beyond which
+// payment it is about: verified events are stored and acknowledged at once, then
+// a background worker asks the gateway for the real outcome
+// (PaymentGateway.Verify) and retries with backoff until it settles.
+//
+// POST /webhook/payment/:gateway takes a gateway's own notification, for
+// gateways that send them (PaymentNotifier), authenticated the gateway's way:
+// eSewa signs its payload with the merchant secret, Khalti's pidx must be the one
+// we stored for the order. ConnectIPS doesn't notify; its callback and
+// reconcilePendingPayments cover it.
+//
+// POST /webhook/relay is for our own relay only (e.g. a forwarder for a gateway
+// that can't reach us directly), never a gateway. The relay signs
+// "<X-Webhook-Timestamp>.<raw body>" with HMAC-SHA256 using WEBHOOK_RELAY_SECRET
+// and sends the hex digest in X-Webhook-Signature (optionally prefixed
+// "sha256="). The body is JSON with event_id, gateway, type and our payment
+// reference. Unset disables the relay.
+//
+// The browser doesn't always come back from the gateway and not every gateway
+// notifies, so the worker also asks the gateway about online payments left
+// pending for a few minutes (reconcilePendingPayments).
+
+// Webhook event statuses
+const (
+	WebhookPending    = "pending"
+	WebhookProcessing = "processing"
+	WebhookProcessed  = "processed"
+	WebhookFailed     = "failed"
+)
+
+const (
+	webhookMaxBody       = 64 << 10
+	webhookTimestampSkew = 5 * time.Minute // Older or further in the future is a replay
+	webhookMaxAttempts   = 8
+	webhookPollInterval  = 30 * time.Second
+	webhookStuckAfter    = 10 * time.Minute // A worker died mid-event
+
+	paymentReconcileInterval = 5 * time.Minute
+	paymentReconcileAfter    = 5 * time.Minute // Time for the callback to arrive first
+	paymentReconcileMaxAge   = 72 * time.Hour  // Older payments are left to admins
+)
+
+var (
+	errWebhookSignature      = errors.New("invalid webhook signature")
+	errWebhookTimestamp      = errors.New("webhook timestamp outside the allowed window")
+	errWebhookPaymentPending = errors.New("payment still pending at the gateway")
+)
+
+// Event IDs of newly stored events, for the worker
+var webhookQueue = make(chan uint, 256)
+
+// Secret shared with our relay. Empty disables /webhook/relay.
+func webhookRelaySecret() string {
+	return os.Getenv("WEBHOOK_RELAY_SECRET")
+}
+
+// Relay signature: HMAC-SHA256 hex over "<timestamp>.<body>"
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check a relay request's timestamp window and signature
+func verifyWebhookSignature(secret, timestamp, signature string, body []byte, now time.Time) (time.Time, error) {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, errWebhookTimestamp
+	}
+	sentAt := time.Unix(unix, 0)
+	if sentAt.Before(now.Add(-webhookTimestampSkew)) || sentAt.After(now.Add(webhookTimestampSkew)) {
+		return time.Time{}, errWebhookTimestamp
+	}
+
+	expected := webhookSignature(secret, timestamp, body)
+	signature = strings.TrimPrefix(signature, "sha256=")
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return time.Time{}, errWebhookSignature
+	}
+	return sentAt, nil
+}
+
+// Read a webhook body, answering 413 if it's too large
+func readWebhookBody(c *gin.Context) ([]byte, bool) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, webhookMaxBody+1))
+	if err != nil || len(body) > webhookMaxBody {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Payload too large"})
+		return nil, false
+	}
+	return body, true
+}
+
+// Receive a gateway's own notification: authenticate it the gateway's way, store, acknowledge
+func paymentWebhookHandler(c *gin.Context) {
+	name := c.Param("gateway")
+	gateway, ok := getPaymentGateway(name)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown gateway"})
+		return
+	}
+	notifier, ok := gateway.(PaymentNotifier)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "This gateway does not send notifications"})
+		return
+	}
+
+	body, ok := readWebhookBody(c)
+	if !ok {
+		return
+	}
+
+	notification, err := notifier.ParseNotification(body)
+	if err != nil {
+		log.Printf("Rejected %s notification from %s: %v\n", name, c.ClientIP(), err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification"})
+		return
+	}
+	if notification.EventID == "" || len(notification.EventID) > 128 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification"})
+		return
+	}
+
+	storeWebhookEvent(c, WebhookEvent{
+		Gateway:   name,
+		EventID:   notification.EventID,
+		Type:      notification.Type,
+		Reference: notification.Reference,
+		Payload:   string(body),
+		Signature: notification.Signature,
+		SentAt:    time.Now(),
+	})
+}
+
+// Receive an event from our relay: verify its HMAC, store, acknowledge
+func relayWebhookHandler(c *gin.Context) {
+	secret := webhookRelaySecret()
+	if secret == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "The webhook relay is not enabled"})
+		return
+	}
+
+	body, ok := readWebhookBody(c)
+	if !ok {
+		return
+	}
+
+	signature := c.GetHeader("X-Webhook-Signature")
+	sentAt, err := verifyWebhookSignature(secret, c.GetHeader("X-Webhook-Timestamp"), signature, body, time.Now())
+	if err != nil {
+		log.Printf("Rejected relayed webhook from %s: %v\n", c.ClientIP(), err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	var payload struct {
+		EventID   string `json:"event_id"`
+		Gateway   string `json:"gateway"`
+		Type      string `json:"type"`
+		Reference string `json:"reference"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload"})
+		return
+	}
+	if _, ok := getPaymentGateway(payload.Gateway); !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown gateway"})
+		return
+	}
+	eventID := c.GetHeader("X-Webhook-Id")
+	if eventID == "" {
+		eventID = payload.EventID
+	}
+	if eventID == "" || len(eventID) > 128 || payload.Reference == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "event_id and reference are required"})
+		return
+	}
+
+	storeWebhookEvent(c, WebhookEvent{
+		Gateway:   payload.Gateway,
+		EventID:   eventID,
+		Type:      payload.Type,
+		Reference: payload.Reference,
+		Payload:   string(body),
+		Signature: signature,
+		SentAt:    sentAt,
+	})
+}
+
+// Store an authenticated event for the worker and acknowledge it. Redeliveries
+// of an event we already have are acknowledged without processing them again.
+func storeWebhookEvent(c *gin.Context, event WebhookEvent) {
+	var existing WebhookEvent
+	if db.Where("gateway = ? AND event_id = ?", event.Gateway, event.EventID).First(&existing).Error == nil {
+		c.JSON(http.StatusOK, gin.H{"received": true, "duplicate": true})
+		return
+	}
+
+	event.RemoteIP = c.ClientIP()
+	event.Status = WebhookPending
+	event.NextAttemptAt = time.Now()
+	if err := db.Create(&event).Error; err != nil {
+		// Lost a race with a concurrent delivery of the same event
+		if db.Where("gateway = ? AND event_id = ?", event.Gateway, event.EventID).First(&existing).Error == nil {
+			c.JSON(http.StatusOK, gin.H{"received": true, "duplicate": true})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store event"})
+		return
+	}
+
+	enqueueWebhookEvent(event.ID)
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
+
+// Hand an event to the worker without blocking; the poller picks up overflow
+func enqueueWebhookEvent(id uint) {
+	select {
+	case webhookQueue <- id:
+	default:
+	}
+}
+
+// Delay before retry n (1-based): 1, 4, 9, 16... minutes
+func webhookRetryDelay(attempt int) time.Duration {
+	return time.Duration(attempt*attempt) * time.Minute
+}
+
+// Process one stored event if it's due. Safe to call from several goroutines:
+// the status update claims the event.
+func processWebhookEvent(id uint, now time.Time) {
+	result := db.Model(&WebhookEvent{}).
+		Where("id = ? AND status = ? AND next_attempt_at <= ?", id, WebhookPending, now).
+		Updates(map[string]interface{}{"status": WebhookProcessing, "attempts": gorm.Expr("attempts + 1")})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return
+	}
+
+	var event WebhookEvent
+	if err := db.First(&event, id).Error; err != nil {
+		return
+	}
+
+	err := handleWebhookEvent(&event)
+	updates := map[string]interface{}{"last_error": ""}
+	switch {
+	case err == nil:
+		processedAt := time.Now()
+		updates["status"] = WebhookProcessed
+		updates["processed_at"] = processedAt
+	case errors.Is(err, errPaymentNotFound) || event.Attempts >= webhookMaxAttempts:
+		// Retrying can't help, or we've tried long enough
+		updates["status"] = WebhookFailed
+		updates["last_error"] = err.Error()
+		log.Printf("Webhook event %d (%s %s) failed: %v\n", event.ID, event.Gateway, event.EventID, err)
+	default:
+		updates["status"] = WebhookPending
+		updates["last_error"] = err.Error()
+		updates["next_attempt_at"] = time.Now().Add(webhookRetryDelay(event.Attempts))
+	}
+	db.Model(&WebhookEvent{}).Where("id = ?", event.ID).Updates(updates)
+}
+
+// Apply an event: the payload only says which payment to look at, the gateway's
+// verification API decides what happened to it
+func handleWebhookEvent(event *WebhookEvent) error {
+	gateway, ok := getPaymentGateway(event.Gateway)
+	if !ok {
+		return errPaymentNotFound
+	}
+
+	txn, err := getPaymentTransaction(event.Reference)
+	if err != nil || txn.Gateway != event.Gateway {
+		return errPaymentNotFound
+	}
+	if txn.Status != PaymentPending {
+		return nil
+	}
+
+	status, err := gateway.Verify(txn)
+	if err != nil {
+		return err
+	}
+	if status == PaymentPending {
+		return errWebhookPaymentPending
+	}
+	return nil
+}
+
+// Due retries, plus events whose worker died while processing them
+func runDueWebhookEvents(now time.Time) {
+	db.Model(&WebhookEvent{}).
+		Where("status = ? AND updated_at < ?", WebhookProcessing, now.Add(-webhookStuckAfter)).
+		Update("status", WebhookPending)
+
+	var ids []uint
+	db.Model(&WebhookEvent{}).
+		Where("status = ? AND next_attempt_at <= ?", WebhookPending, now).
+		Order("next_attempt_at").Limit(100).
+		Pluck("id", &ids)
+	for _, id := range ids {
+		processWebhookEvent(id, now)
+	}
+}
+
+// Ask the gateway about online payments still pending after the callback
+// should have arrived; Verify completes or fails them in the ledger
+func reconcilePendingPayments(now time.Time) {
+	var txns []PaymentTransaction
+	db.Where("status = ? AND created_at BETWEEN ? AND ?", PaymentPending, now.Add(-paymentReconcileMaxAge), now.Add(-paymentReconcileAfter)).
+		Order("created_at").Limit(100).Find(&txns)
+
+	for i := range txns {
+		gateway, ok := getPaymentGateway(txns[i].Gateway)
+		if !ok {
+			continue // Bank transfers, or a gateway since disabled
+		}
+		status, err := gateway.Verify(&txns[i])
+		if err != nil {
+			log.Printf("Reconciling %s payment %s failed: %v\n", txns[i].Gateway, txns[i].Reference, err)
+			continue
+		}
+		if status != PaymentPending {
+			log.Printf("Reconciled %s payment %s: %s\n", txns[i].Gateway, txns[i].Reference, status)
+		}
+	}
+}
+
+// Background worker: new events as they arrive, retries and reconciliation on timers
+func startWebhookWorker() {
+	go func() {
+		runDueWebhookEvents(time.Now())
+		reconcilePendingPayments(time.Now())
+
+		ticker := time.NewTicker(webhookPollInterval)
+		defer ticker.Stop()
+		reconcile := time.NewTicker(paymentReconcileInterval)
+		defer reconcile.Stop()
+		for {
+			select {
+			case id := <-webhookQueue:
+				processWebhookEvent(id, time.Now())
+			case <-ticker.C:
+				runDueWebhookEvents(time.Now())
+			case <-reconcile.C:
+				reconcilePendingPayments(time.Now())
+			}
+		}
+	}()
+}
+
+// Admin: stored webhook events, optionally filtered by status, gateway or reference
+func adminWebhookEventsHandler(c *gin.Context) {
+	query := db.Model(&WebhookEvent{}).Order("created_at DESC").Limit(500)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if gateway := c.Query("gateway"); gateway != "" {
+		query = query.Where("gateway = ?", gateway)
+	}
+	if reference := c.Query("reference"); reference != "" {
+		query = query.Where("reference = ?", reference)
+	}
+
+	var events []WebhookEvent
+	query.Find(&events)
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":  len(events),
+		"events": events,
+	})
+}
+
+// Admin: run a failed event again
+func retryWebhookEventHandler(c *gin.Context) {
+	var event WebhookEvent
+	if err := db.First(&event, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		return
+	}
+	if event.Status != WebhookFailed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only failed events can be retried"})
+		return
+	}
+
+	db.Model(&event).Updates(map[string]interface{}{
+		"status":          WebhookPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now(),
+	})
+	enqueueWebhookEvent(event.ID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Event queued for processing"})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func postWebhook(r *gin.Engine, path, body string, header map[string]string) int {
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func webhookEventCount() int64 {
+	var count int64
+	db.Model(&WebhookEvent{}).Count(&count)
+	return count
+}
+
+func TestKhaltiNotificationIsReconfirmed(t *testing.T) {
+	k := setupKhaltiTest(t)
+	txn, initiated := k.start(t)
+	k.decide(t, initiated.PaymentURL, "pay")
+
+	r := gin.New()
+	r.POST("/webhook/payment/:gateway", paymentWebhookHandler)
+
+	// A pidx we didn't issue for the order is refused before anything is stored
+	forged := `{"pidx":"forged","purchase_order_id":"` + txn.Reference + `","status":"Completed"}`
+	if code := postWebhook(r, "/webhook/payment/khalti", forged, nil); code != http.StatusBadRequest {
+		t.Fatalf("forged pidx answered %d, want 400", code)
+	}
+	if n := webhookEventCount(); n != 0 {
+		t.Fatalf("%d events stored for a forged notification", n)
+	}
+
+	body := `{"pidx":"` + initiated.Pidx + `","purchase_order_id":"` + txn.Reference + `","status":"Completed"}`
+	for i := 0; i < 2; i++ {
+		if code := postWebhook(r, "/webhook/payment/khalti", body, nil); code != http.StatusOK {
+			t.Fatalf("notification %d answered %d, want 200", i+1, code)
+		}
+	}
+	if n := webhookEventCount(); n != 1 {
+		t.Fatalf("%d events stored, want 1", n)
+	}
+
+	// The worker takes the outcome from Khalti's lookup, not the notification
+	var event WebhookEvent
+	db.First(&event)
+	processWebhookEvent(event.ID, time.Now())
+	if txn = reloadPayment(t, txn.Reference); txn.Status != PaymentCompleted {
+		t.Fatalf("payment is %s, want completed", txn.Status)
+	}
+}
+
+func TestRelayWebhookRequiresSignature(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("KHALTI_ENV", "fake")
+	registerPaymentGateways()
+
+	r := gin.New()
+	r.POST("/webhook/relay", relayWebhookHandler)
+	body := `{"event_id":"evt-1","gateway":"khalti","type":"payment","reference":"IPP-1"}`
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	if code := postWebhook(r, "/webhook/relay", body, nil); code != http.StatusNotFound {
+		t.Fatalf("relay without a secret answered %d, want 404", code)
+	}
+
+	t.Setenv("WEBHOOK_RELAY_SECRET", "relay-secret")
+	if code := postWebhook(r, "/webhook/relay", body, map[string]string{
+		"X-Webhook-Timestamp": timestamp,
+		"X-Webhook-Signature": webhookSignature("other-secret", timestamp, []byte(body)),
+	}); code != http.StatusUnauthorized {
+		t.Fatalf("wrongly signed relay answered %d, want 401", code)
+	}
+	if code := postWebhook(r, "/webhook/relay", body, map[string]string{
+		"X-Webhook-Timestamp": timestamp,
+		"X-Webhook-Signature": "sha256=" + webhookSignature("relay-secret", timestamp, []byte(body)),
+	}); code != http.StatusOK {
+		t.Fatalf("signed relay answered %d, want 200", code)
+	}
+	if n := webhookEventCount(); n != 1 {
+		t.Fatalf("%d events stored, want 1", n)
+	}
+}
+
+func TestReconcilePendingPayments(t *testing.T) {
+	setupTestDB(t)
+	gateway := registerStubGateway(t, "stub")
+	gateway.status = PaymentCompleted
+	user := createTestUser(t, "reconcile@example.com")
+	plan := getTestPlan(t, "premium")
+
+	pending := func(gatewayName string, age time.Duration) *PaymentTransaction {
+		txn, err := createPaymentTransaction(user.ID, plan, gatewayName, nil, "")
+		if err != nil {
+			t.Fatalf("creating payment: %v", err)
+		}
+		db.Model(txn).Update("created_at", time.Now().Add(-age))
+		return txn
+	}
+	abandoned := pending("stub", 20*time.Minute) // Paid, but the browser never came back
+	fresh := pending("stub", time.Minute)
+	transfer := pending("bank_transfer", time.Hour)
+
+	reconcilePendingPayments(time.Now())
+
+	if gateway.verified != 1 {
+		t.Fatalf("gateway asked about %d payments, want 1", gateway.verified)
+	}
+	if got := reloadPayment(t, abandoned.Reference); got.Status != PaymentCompleted {
+		t.Fatalf("payment left at the gateway is %s, want completed", got.Status)
+	}
+	for _, txn := range []*PaymentTransaction{fresh, transfer} {
+		if got := reloadPayment(t, txn.Reference); got.Status != PaymentPending {
+			t.Fatalf("%s payment is %s, want pending", txn.Gateway, got.Status)
+		}
+	}
+}